@@ -10,6 +10,44 @@ import clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 
 // Conditions and condition Reasons for the TalosControlPlane object
 
+// Reasons for failures to reach the Talos API, which might be set on any condition
+// instead of the condition specific reason.
+const (
+	// CertificateUnknownAuthorityReason (Severity=Warning) documents the Talos API certificate not being signed
+	// by the CA of the talosconfig, usually caused by a mismatching talosconfig.
+	CertificateUnknownAuthorityReason = "CertificateUnknownAuthority"
+
+	// ConnectionRefusedReason (Severity=Warning) documents the Talos API refusing connections,
+	// e.g. when the node is rebooting or the API is firewalled.
+	ConnectionRefusedReason = "ConnectionRefused"
+
+	// DeadlineExceededReason (Severity=Warning) documents the Talos API call timing out.
+	DeadlineExceededReason = "DeadlineExceeded"
+
+	// EtcdNotRunningReason (Severity=Warning) documents the etcd service not running on the node.
+	EtcdNotRunningReason = "EtcdNotRunning"
+)
+
+// Conditions set on the control plane Machines.
+const (
+	// MachineBootstrapDataAvailableCondition documents the bootstrap data secret of the control plane Machine exists.
+	MachineBootstrapDataAvailableCondition clusterv1.ConditionType = "BootstrapDataAvailable"
+
+	// BootstrapDataMissingReason (Severity=Error) documents the bootstrap data secret of the Machine being deleted,
+	// the Machine can't be re-provisioned until it's restored.
+	BootstrapDataMissingReason = "BootstrapDataMissing"
+)
+
+const (
+	// MachineEtcdMemberHealthyCondition documents the health of the etcd member of the control plane Machine:
+	// the etcd service is reachable over the Talos API, running and healthy, and the member sees the same members
+	// as the other nodes.
+	MachineEtcdMemberHealthyCondition clusterv1.ConditionType = "EtcdMemberHealthy"
+
+	// EtcdMemberUnhealthyReason (Severity=Warning) documents the etcd member of the Machine being unhealthy.
+	EtcdMemberUnhealthyReason = "EtcdMemberUnhealthy"
+)
+
 const (
 	// MachinesReadyCondition reports an aggregate of current status of the machines controlled by the TalosControlPlane.
 	MachinesReadyCondition clusterv1.ConditionType = "MachinesReady"
@@ -22,6 +60,10 @@ const (
 	// WaitingForMachinesReason (Severity=Info) documents a TalosControlPlane bootstrap is waiting
 	// for all control plane nodes to be created.
 	WaitingForMachinesReason = "WaitingForMachines"
+
+	// EndpointNotResolvedReason (Severity=Warning) documents a TalosControlPlane bootstrap is postponed
+	// until the control plane endpoint DNS name resolves.
+	EndpointNotResolvedReason = "EndpointNotResolved"
 )
 
 const (
@@ -47,6 +89,21 @@ const (
 
 	// ScalingDownReason (Severity=Info) documents a TalosControlPlane that is decreasing the number of replicas.
 	ScalingDownReason = "ScalingDown"
+
+	// RollingUpdateReason (Severity=Warning) documents a TalosControlPlane replacing the outdated machines.
+	RollingUpdateReason = "RollingUpdate"
+
+	// EtcdMaintenanceReason (Severity=Info) documents a TalosControlPlane postponing resizing
+	// until the etcd maintenance operation completes.
+	EtcdMaintenanceReason = "EtcdMaintenance"
+
+	// ScaleDownBlockedReason (Severity=Warning) documents a TalosControlPlane which can't scale down
+	// because all of the machines are excluded from scale down.
+	ScaleDownBlockedReason = "ScaleDownBlocked"
+
+	// ChangeApprovalRequiredReason (Severity=Info) documents a TalosControlPlane which doesn't replace
+	// the outdated machines until the change is approved.
+	ChangeApprovalRequiredReason = "ChangeApprovalRequired"
 )
 
 const (
@@ -60,14 +117,212 @@ const (
 
 	// ControlPlaneComponentsInspectionFailedReason documents a failure in inspecting the control plane component status.
 	ControlPlaneComponentsInspectionFailedReason = "ControlPlaneComponentsInspectionFailed"
+
+	// MachineNotReadyReason (Severity=Warning) documents a control plane node reporting not ready
+	// machine status via the Talos API.
+	MachineNotReadyReason = "MachineNotReady"
+
+	// EtcdDiskPressureReason (Severity=Warning) documents a control plane node running out of space
+	// on the filesystem holding etcd data.
+	EtcdDiskPressureReason = "EtcdDiskPressure"
+
+	// MemoryPressureReason (Severity=Warning) documents a control plane node running out of memory.
+	MemoryPressureReason = "MemoryPressure"
+)
+
+const (
+	// ClockSynchronizedCondition reports whether the clocks of the control plane nodes are in sync with their time servers.
+	// Time skew breaks etcd and certificate validation.
+	ClockSynchronizedCondition clusterv1.ConditionType = "ClockSynchronized"
+
+	// ClockDriftedReason (Severity=Warning) documents a control plane node clock drifting away from its time server.
+	ClockDriftedReason = "ClockDrifted"
+
+	// ClockInspectionFailedReason documents a failure in inspecting the control plane node clocks.
+	ClockInspectionFailedReason = "ClockInspectionFailed"
+)
+
+const (
+	// MachinesConfiguredCondition reports whether all control plane machines are running with the machine config applied.
+	MachinesConfiguredCondition clusterv1.ConditionType = "MachinesConfigured"
+
+	// MaintenanceModeReason (Severity=Error) documents a control plane machine running Talos in maintenance mode,
+	// waiting for the machine config to be applied.
+	MaintenanceModeReason = "MaintenanceMode"
+
+	// ConfigReapplyFailedReason (Severity=Error) documents a failure to apply the machine config to a control plane machine
+	// in maintenance mode.
+	ConfigReapplyFailedReason = "ConfigReapplyFailed"
+)
+
+const (
+	// APIServerCertificateValidCondition reports whether the API server certificate presented at the control plane endpoint
+	// is valid for the endpoint host.
+	APIServerCertificateValidCondition clusterv1.ConditionType = "APIServerCertificateValid"
+
+	// CertificateSANMismatchReason (Severity=Warning) documents the API server certificate not containing the control plane
+	// endpoint host in its SANs, usually caused by changing the endpoint after the cluster creation.
+	CertificateSANMismatchReason = "CertificateSANMismatch"
+
+	// APIServerCertificateInspectionFailedReason documents a failure in fetching the API server certificate.
+	APIServerCertificateInspectionFailedReason = "APIServerCertificateInspectionFailed"
+)
+
+const (
+	// OperatorDegradedCondition is set to true once the reconciles of the TalosControlPlane keep failing,
+	// the condition is removed after a successful reconcile.
+	// Unlike other conditions, the condition has negative polarity.
+	OperatorDegradedCondition clusterv1.ConditionType = "OperatorDegraded"
+
+	// ReconcileFailingReason (Severity=Error) documents the number of consecutive reconcile failures
+	// reaching the threshold.
+	ReconcileFailingReason = "ReconcileFailing"
+)
+
+const (
+	// OperationTimedOutCondition is set to true once a control plane change takes longer than the configured timeout,
+	// the message describes the step the change is blocked on. The condition is removed once the change completes.
+	// Unlike other conditions, the condition has negative polarity.
+	OperationTimedOutCondition clusterv1.ConditionType = "OperationTimedOut"
+
+	// RolloutTimedOutReason (Severity=Error) documents the outdated machines not being replaced within the rollout timeout.
+	RolloutTimedOutReason = "RolloutTimedOut"
+
+	// ScaleUpTimedOutReason (Severity=Error) documents the control plane not reaching the desired replicas within the scale up timeout.
+	ScaleUpTimedOutReason = "ScaleUpTimedOut"
 )
 
 const (
-	// EtcdClusterHealthyCondition documents the overall etcd cluster's health.
-	EtcdClusterHealthyCondition clusterv1.ConditionType = "EtcdClusterHealthyCondition"
+	// WorkloadAPIReachableCondition reports whether the workload cluster Kubernetes API is reachable
+	// via the control plane endpoint.
+	WorkloadAPIReachableCondition clusterv1.ConditionType = "WorkloadAPIReachable"
+
+	// ControlPlaneEndpointUnreachableReason (Severity=Warning) documents the Kubernetes API being unreachable while
+	// etcd and control plane components are healthy according to the Talos API, which points to a broken
+	// load balancer or network path to the control plane endpoint.
+	ControlPlaneEndpointUnreachableReason = "ControlPlaneEndpointUnreachable"
+
+	// ControlPlaneDownReason (Severity=Error) documents the Kubernetes API being unreachable with etcd or
+	// control plane components unhealthy according to the Talos API.
+	ControlPlaneDownReason = "ControlPlaneDown"
+
+	// APIServerCertificateUntrustedReason (Severity=Error) documents the workload cluster Kubernetes API server
+	// certificate not being trusted, either by the CA from the kubeconfig secret or by the pinned APIServerCASecretRef CA.
+	APIServerCertificateUntrustedReason = "APIServerCertificateUntrusted"
+)
+
+const (
+	// MembershipConsistentCondition reports whether the control plane Machines match the workload cluster control plane
+	// Nodes, the etcd members and the talosconfig endpoints. The membership is audited periodically.
+	MembershipConsistentCondition clusterv1.ConditionType = "MembershipConsistent"
+
+	// MembershipDriftReason (Severity=Warning) documents Nodes, etcd members or endpoints without a matching Machine,
+	// or Machines without a matching Node or etcd member.
+	MembershipDriftReason = "MembershipDrift"
+
+	// MembershipAuditFailedReason documents a failure in auditing the control plane membership.
+	MembershipAuditFailedReason = "MembershipAuditFailed"
+)
+
+const (
+	// SecretsAvailableCondition reports whether the secrets the TalosControlPlane depends on exist, the secrets
+	// might be missing when the management cluster is restored from a backup which doesn't include them.
+	SecretsAvailableCondition clusterv1.ConditionType = "SecretsAvailable"
+
+	// SecretsMissingReason (Severity=Error) documents referenced or generated secrets which don't exist.
+	// The kubeconfig and the talosconfig secrets are generated again, the other secrets have to be restored.
+	SecretsMissingReason = "SecretsMissing"
+
+	// SecretsInspectionFailedReason documents a failure in reading the secrets the TalosControlPlane depends on.
+	SecretsInspectionFailedReason = "SecretsInspectionFailed"
+)
+
+const (
+	// TalosIdentityMatchedCondition reports whether the Talos API certificates of the control plane machines
+	// are signed by the CA of the talosconfig used by the controller.
+	TalosIdentityMatchedCondition clusterv1.ConditionType = "TalosIdentityMatched"
+
+	// TalosIdentityMismatchReason (Severity=Error) documents machines presenting Talos API certificates signed by another CA,
+	// usually because the nodes were reinstalled out-of-band. The machines are re-adopted with the
+	// "controlplane.cluster.x-k8s.io/readopt-talosconfig" annotation.
+	TalosIdentityMismatchReason = "TalosIdentityMismatch"
+
+	// TalosIdentityReadoptFailedReason (Severity=Error) documents the talosconfig from the re-adopt annotation
+	// not being accepted, e.g. its CA doesn't match the machines either.
+	TalosIdentityReadoptFailedReason = "TalosIdentityReadoptFailed"
+)
+
+const (
+	// EtcdClusterHealthyCondition documents the overall etcd cluster's health, aggregated from the health
+	// of the etcd members reported with the EtcdMemberHealthy condition of the Machines.
+	EtcdClusterHealthyCondition clusterv1.ConditionType = "EtcdClusterHealthy"
 
 	// EtcdClusterUnhealthyReason (Severity=Error) is set when the etcd cluster is unhealthy.
 	EtcdClusterUnhealthyReason = "EtcdClusterUnhealthy"
+
+	// EtcdLearnerPromotingReason (Severity=Info) documents etcd learner members waiting for the promotion,
+	// learners don't count towards the quorum, so scaling and rollouts wait for the promotion.
+	EtcdLearnerPromotingReason = "EtcdLearnerPromoting"
+
+	// EtcdLearnerNotPromotedReason (Severity=Error) documents etcd learner members not promoted in time.
+	EtcdLearnerNotPromotedReason = "EtcdLearnerNotPromoted"
+)
+
+const (
+	// EtcdBackupFreshCondition reports whether the last successful etcd backup is younger than the configured MaxAge.
+	EtcdBackupFreshCondition clusterv1.ConditionType = "EtcdBackupFresh"
+
+	// EtcdBackupStaleReason (Severity=Warning) documents the last successful etcd backup being older than MaxAge,
+	// or no backup having ever succeeded.
+	EtcdBackupStaleReason = "EtcdBackupStale"
+
+	// DeletionBlockedReason (Severity=Error) documents the deletion of the TalosControlPlane held
+	// until a fresh etcd backup is uploaded, or the "controlplane.cluster.x-k8s.io/skip-stale-backup-check" annotation is set.
+	DeletionBlockedReason = "DeletionBlocked"
+)
+
+const (
+	// EtcdBackupRestorableCondition reports whether the last verified etcd backup was restored successfully.
+	// It is only set if the backup verification is configured.
+	EtcdBackupRestorableCondition clusterv1.ConditionType = "EtcdBackupRestorable"
+
+	// EtcdBackupNotVerifiedReason (Severity=Info) documents no etcd backup having been verified yet.
+	EtcdBackupNotVerifiedReason = "EtcdBackupNotVerified"
+
+	// EtcdBackupNotRestorableReason (Severity=Error) documents the last verified etcd backup failing to restore.
+	EtcdBackupNotRestorableReason = "EtcdBackupNotRestorable"
+
+	// EtcdBackupVerificationFailedReason (Severity=Warning) documents the verification failing before the backup
+	// was restored (e.g. the temporary machine was not provisioned in time), so the backup is not known to be restorable.
+	EtcdBackupVerificationFailedReason = "EtcdBackupVerificationFailed"
+)
+
+const (
+	// CARotatedCondition reports the progress of the certificate authority rotation requested with
+	// the "controlplane.cluster.x-k8s.io/rotate-ca" annotation, it is set to true once the rotation completes.
+	CARotatedCondition clusterv1.ConditionType = "CARotated"
+
+	// CARotationInProgressReason (Severity=Info) documents the new certificate authorities being rolled out
+	// to the control plane machines.
+	CARotationInProgressReason = "CARotationInProgress"
+
+	// WaitingForWorkerRolloutReason (Severity=Warning) documents the rotation waiting for the worker machines
+	// created with the secrets of the previous phase to be replaced.
+	WaitingForWorkerRolloutReason = "WaitingForWorkerRollout"
+
+	// CARotationFailedReason (Severity=Error) documents a failure to start or advance the rotation.
+	CARotationFailedReason = "CARotationFailed"
+)
+
+const (
+	// ImagesResolvedCondition reports whether the control plane nodes pull the images overridden in the TalosControlPlane.
+	ImagesResolvedCondition clusterv1.ConditionType = "ImagesResolved"
+
+	// ImagePullFailedReason (Severity=Error) documents a control plane node failing to pull an overridden image.
+	ImagePullFailedReason = "ImagePullFailed"
+
+	// ImagesInspectionFailedReason documents a failure in inspecting the images pulled by the control plane nodes.
+	ImagesInspectionFailedReason = "ImagesInspectionFailed"
 )
 
 const (
@@ -87,4 +342,8 @@ const (
 	// MachineGenerationFailedReason (Severity=Error) documents a TalosControlPlane failing to
 	// generate a machine object.
 	MachineGenerationFailedReason = "MachineGenerationFailed"
+
+	// UnsupportedVersionReason (Severity=Error) documents a TalosControlPlane requesting a Kubernetes version
+	// which is not supported by the provider.
+	UnsupportedVersionReason = "UnsupportedVersion"
 )
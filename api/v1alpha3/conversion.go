@@ -0,0 +1,13 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1alpha3
+
+// v1alpha3 is the storage version and the conversion hub, the controller works with v1alpha3 objects only.
+
+// Hub marks TalosControlPlane as a conversion hub.
+func (*TalosControlPlane) Hub() {}
+
+// Hub marks TalosControlPlaneList as a conversion hub.
+func (*TalosControlPlaneList) Hub() {}
@@ -8,17 +8,471 @@ import (
 	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
 const (
 	TalosControlPlaneFinalizer = "talos.controlplane.cluster.x-k8s.io"
+
+	// MachineEtcdFinalizer is set on the control plane Machines and is removed only after
+	// the machine's etcd member was removed from the etcd cluster.
+	MachineEtcdFinalizer = "etcd.controlplane.cluster.x-k8s.io"
+
+	// RenderConfigAnnotation requests rendering the bootstrap configuration and the machine configuration of
+	// a new control plane machine into the "<name>-rendered-config" ConfigMap without creating any machines.
+	// Secrets are redacted from the rendered machine configuration.
+	// The annotation is removed once the ConfigMap is written.
+	RenderConfigAnnotation = "controlplane.cluster.x-k8s.io/render-config"
+
+	// EtcdMaintenanceAnnotation marks an etcd maintenance operation (backup, defragmentation, recovery) in progress,
+	// the value is the name of the operation. Scaling of the control plane is postponed while the annotation is set.
+	// The annotation is managed by the provider for its own operations, external tools should set it
+	// for the duration of their operations and remove it once done.
+	EtcdMaintenanceAnnotation = "controlplane.cluster.x-k8s.io/etcd-maintenance"
+
+	// ConfigHashAnnotation is set on the control plane Machines to the hash of the machine configuration
+	// they were created with.
+	ConfigHashAnnotation = "controlplane.cluster.x-k8s.io/config-hash"
+
+	// ScaleDownDisabledAnnotation excludes the control plane Machine from being chosen for deletion on scale down,
+	// e.g. for the machine hosting services colocated with the control plane.
+	ScaleDownDisabledAnnotation = "controlplane.cluster.x-k8s.io/scale-down-disabled"
+
+	// ProfileReconcileAnnotation requests recording the duration of each phase of the next reconcile
+	// into the "<name>-reconcile-profile" ConfigMap and an event.
+	// The annotation is removed once the profile is written.
+	ProfileReconcileAnnotation = "controlplane.cluster.x-k8s.io/profile-reconcile"
+
+	// CertificatesExpiryAnnotation is set on the control plane Machines to the earliest expiry time (RFC 3339)
+	// of the Talos API and Kubernetes API server certificates, when RolloutBefore is configured.
+	CertificatesExpiryAnnotation = "controlplane.cluster.x-k8s.io/certificates-expiry"
+
+	// RemediateMachineAnnotation requests remediation of the control plane Machine, same as the OwnerRemediated
+	// condition set by the MachineHealthCheck: the Machine is deleted after its etcd member is removed and replaced.
+	RemediateMachineAnnotation = "cluster.x-k8s.io/remediate-machine"
+
+	// RemediationInProgressAnnotation is set on the TalosControlPlane while the remediated Machine is replaced,
+	// the value tracks the remediated Machine and the number of retries.
+	RemediationInProgressAnnotation = "controlplane.cluster.x-k8s.io/remediation-in-progress"
+
+	// RemediationForAnnotation is set on the Machine created as a replacement of the remediated Machine,
+	// the value is copied from the RemediationInProgressAnnotation.
+	RemediationForAnnotation = "controlplane.cluster.x-k8s.io/remediation-for"
+
+	// InstallHashAnnotation is set on the control plane Machines to the hash of the install configuration
+	// (kernel arguments and system extensions) applied to the machine.
+	InstallHashAnnotation = "controlplane.cluster.x-k8s.io/install-hash"
+
+	// InstallUpgradedAtAnnotation is set on the control plane Machine to the time (RFC 3339) it was upgraded
+	// in place to apply the install configuration, until the machine reboots.
+	InstallUpgradedAtAnnotation = "controlplane.cluster.x-k8s.io/install-upgraded-at"
+
+	// EtcdConfigHashAnnotation is set on the control plane Machines to the hash of the etcd configuration
+	// (tuning parameters and extra arguments) applied to the machine.
+	EtcdConfigHashAnnotation = "controlplane.cluster.x-k8s.io/etcd-config-hash"
+
+	// EtcdConfigAppliedAtAnnotation is set on the control plane Machine to the time (RFC 3339) the etcd configuration
+	// was applied in place, until the machine reboots.
+	EtcdConfigAppliedAtAnnotation = "controlplane.cluster.x-k8s.io/etcd-config-applied-at"
+
+	// StaticPodConfigHashAnnotation is set on the control plane Machines to the hash of the static pod configuration
+	// (API server, controller manager and scheduler) applied to the machine. ConfigHashAnnotation of the Machines
+	// with the annotation doesn't cover the static pod configuration, as its changes are applied in place.
+	StaticPodConfigHashAnnotation = "controlplane.cluster.x-k8s.io/static-pod-config-hash"
+
+	// StaticPodConfigAppliedAtAnnotation is set on the control plane Machine to the time (RFC 3339) the static pod
+	// configuration was applied in place, until the static pods are verified to run with it.
+	StaticPodConfigAppliedAtAnnotation = "controlplane.cluster.x-k8s.io/static-pod-config-applied-at"
+
+	// MaintenanceCertificateFingerprintAnnotation is set on the control plane Machine to the SPKI fingerprint
+	// of the certificate Talos presents in maintenance mode (printed on the node console), the machine config
+	// is re-applied with the ReapplyConfig maintenance mode policy only to the node presenting the certificate.
+	MaintenanceCertificateFingerprintAnnotation = "controlplane.cluster.x-k8s.io/maintenance-certificate-fingerprint"
+
+	// ApprovedChangesAnnotation approves the pending changes which require approval,
+	// the value is a comma-separated list of the pending change IDs published in the status.
+	ApprovedChangesAnnotation = "controlplane.cluster.x-k8s.io/approved-changes"
+
+	// ReadoptTalosconfigAnnotation requests re-adopting the control plane machines reinstalled out-of-band with a new Talos CA,
+	// the value is the name of a Secret in the TalosControlPlane namespace with the talosconfig for the new CA
+	// under the "talosconfig" key. Once the machines are verified to match the new CA, TalosConfigSecretRef
+	// in the status is set to the Secret and the annotation is removed.
+	ReadoptTalosconfigAnnotation = "controlplane.cluster.x-k8s.io/readopt-talosconfig"
+
+	// SkipStaleBackupCheckAnnotation lets the deletion of the TalosControlPlane proceed
+	// even though the etcd backups are stale and the StaleDeletionPolicy is Block.
+	SkipStaleBackupCheckAnnotation = "controlplane.cluster.x-k8s.io/skip-stale-backup-check"
+
+	// SkipVersionSkewCheckAnnotation lets the version changes which violate the Kubernetes version skew policy
+	// (downgrades, skipped minor versions) through the admission.
+	SkipVersionSkewCheckAnnotation = "controlplane.cluster.x-k8s.io/skip-version-skew-check"
+
+	// RotateCAAnnotation requests the rotation of the cluster certificate authorities, the value is a comma-separated
+	// list of the certificate authorities to rotate: "talos" (Talos API) and/or "kubernetes".
+	// The annotation is removed once the rotation completes, the progress is published in the status.
+	RotateCAAnnotation = "controlplane.cluster.x-k8s.io/rotate-ca"
+
+	// TalosEndpointsAnnotation lists the Talos API endpoints of the control plane Machine (comma-separated addresses)
+	// for the Annotation address source.
+	TalosEndpointsAnnotation = "controlplane.cluster.x-k8s.io/talos-endpoints"
+
+	// AdoptMachineAnnotation requests adopting the unmanaged Machine of the cluster into the control plane,
+	// the value is the name of the TalosControlPlane.
+	// The provider doesn't join the node to etcd: Talos joins the control plane nodes on boot, so the node should run
+	// a control plane machine configuration of the cluster. The adoption waits until the node is an etcd member,
+	// the annotation is removed afterwards.
+	AdoptMachineAnnotation = "controlplane.cluster.x-k8s.io/adopt"
+
+	// EjectMachineAnnotation requests ejecting the control plane Machine: its etcd member is removed and
+	// the Machine is released from the control plane without being deleted.
+	// The control plane scales back up to the desired replicas unless they are reduced along with the ejection.
+	EjectMachineAnnotation = "controlplane.cluster.x-k8s.io/eject"
+
+	// MigrateFromKCPAnnotation requests taking over the cluster from the KubeadmControlPlane, the value is its name.
+	// The migration is experimental and only performed if enabled in the controller, the progress is published in the status.
+	MigrateFromKCPAnnotation = "controlplane.cluster.x-k8s.io/migrate-from-kcp"
+
+	// TalosControlPlaneLabel is set on the secrets and config maps generated for the TalosControlPlane,
+	// the value is its name. Together with the owner reference it identifies the generated objects
+	// after a management cluster restore, when the owner UID changes.
+	TalosControlPlaneLabel = "controlplane.cluster.x-k8s.io/talos-control-plane"
+
+	// EtcdBackupVerificationLabel marks the temporary Machine the etcd backup is restored on,
+	// the value is the name of the TalosControlPlane.
+	EtcdBackupVerificationLabel = "controlplane.cluster.x-k8s.io/etcd-backup-verification"
+)
+
+// AddressSourceName names a source of the control plane machine addresses used as the Talos API endpoints.
+type AddressSourceName string
+
+const (
+	// MachineStatusAddressSource uses the external and internal addresses of the Machine.
+	MachineStatusAddressSource AddressSourceName = "MachineStatus"
+
+	// NodeStatusAddressSource uses the external and internal addresses of the workload cluster Node.
+	NodeStatusAddressSource AddressSourceName = "NodeStatus"
+
+	// InfrastructureMachineAddressSource uses the external and internal addresses of the infrastructure machine.
+	InfrastructureMachineAddressSource AddressSourceName = "InfrastructureMachine"
+
+	// DiscoveryAddressSource uses the addresses the node announced to the Talos cluster discovery,
+	// as seen by the other control plane nodes.
+	DiscoveryAddressSource AddressSourceName = "Discovery"
+
+	// AnnotationAddressSource uses the addresses from the TalosEndpointsAnnotation of the Machine.
+	AnnotationAddressSource AddressSourceName = "Annotation"
 )
 
 type ControlPlaneConfig struct {
 	// Deprecated: starting from cacppt v0.4.0 provider doesn't use init configs.
 	InitConfig         cabptv1.TalosConfigSpec `json:"init,omitempty"`
 	ControlPlaneConfig cabptv1.TalosConfigSpec `json:"controlplane"`
+
+	// TalosConfigSecretRef references a Secret in the TalosControlPlane namespace with the talosconfig
+	// under the "talosconfig" key, which is used by the controller to access Talos API of the control plane machines.
+	// Generated admin credentials are used if not set.
+	// +optional
+	TalosConfigSecretRef *corev1.LocalObjectReference `json:"talosConfigSecretRef,omitempty"`
+
+	// APIServerCASecretRef references a Secret in the TalosControlPlane namespace with the PEM-encoded CA bundle
+	// under the "ca.crt" key, which is trusted for the workload cluster Kubernetes API server instead of the CA
+	// from the kubeconfig secret. To rotate the CA, put both the old and the new CA into the bundle.
+	// +optional
+	APIServerCASecretRef *corev1.LocalObjectReference `json:"apiServerCASecretRef,omitempty"`
+
+	// ExtraManifests is the list of URLs of the manifests applied to the workload cluster on bootstrap
+	// (cluster.extraManifests in the Talos machine configuration).
+	// Manifests are applied again by the provider when the manifests change, removed manifests are not deleted.
+	// +optional
+	ExtraManifests []string `json:"extraManifests,omitempty"`
+
+	// InlineManifests is the list of manifests applied to the workload cluster on bootstrap
+	// (cluster.inlineManifests in the Talos machine configuration).
+	// Manifests are applied again by the provider when the manifests change, removed manifests are not deleted.
+	// +optional
+	InlineManifests []InlineManifest `json:"inlineManifests,omitempty"`
+}
+
+// InlineManifest is a manifest embedded into the control plane machine configuration.
+type InlineManifest struct {
+	// Name of the manifest.
+	Name string `json:"name"`
+
+	// Contents of the manifest, one or more YAML documents.
+	Contents string `json:"contents"`
+}
+
+// ImageOverrides allows overriding image references used by control plane machines,
+// e.g. to pull everything from a private registry in air-gapped environments.
+// Empty fields keep the default image selected by Talos.
+type ImageOverrides struct {
+	// Installer is the Talos installer image.
+	// +optional
+	Installer string `json:"installer,omitempty"`
+
+	// Kubelet is the kubelet image.
+	// +optional
+	Kubelet string `json:"kubelet,omitempty"`
+
+	// APIServer is the kube-apiserver image.
+	// +optional
+	APIServer string `json:"apiServer,omitempty"`
+
+	// ControllerManager is the kube-controller-manager image.
+	// +optional
+	ControllerManager string `json:"controllerManager,omitempty"`
+
+	// Scheduler is the kube-scheduler image.
+	// +optional
+	Scheduler string `json:"scheduler,omitempty"`
+
+	// Proxy is the kube-proxy image.
+	// +optional
+	Proxy string `json:"proxy,omitempty"`
+
+	// Etcd is the etcd image.
+	// +optional
+	Etcd string `json:"etcd,omitempty"`
+}
+
+// ComponentVersions pins control plane components to Kubernetes versions other than the TalosControlPlane version,
+// e.g. to hold the scheduler at N-1 during an upgrade of a cluster with a customized scheduler.
+// Pinned versions might be at most one minor version older than the TalosControlPlane version.
+// kube-proxy and CoreDNS are deployed by Talos only on bootstrap, so they are never upgraded
+// together with the control plane.
+type ComponentVersions struct {
+	// APIServer is the kube-apiserver version.
+	// +kubebuilder:validation:Pattern:=^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)([-0-9a-zA-Z_\.+]*)?$
+	// +optional
+	APIServer string `json:"apiServer,omitempty"`
+
+	// ControllerManager is the kube-controller-manager version.
+	// +kubebuilder:validation:Pattern:=^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)([-0-9a-zA-Z_\.+]*)?$
+	// +optional
+	ControllerManager string `json:"controllerManager,omitempty"`
+
+	// Scheduler is the kube-scheduler version.
+	// +kubebuilder:validation:Pattern:=^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)([-0-9a-zA-Z_\.+]*)?$
+	// +optional
+	Scheduler string `json:"scheduler,omitempty"`
+}
+
+// EtcdConfig defines etcd tuning parameters rendered into the machine configs.
+type EtcdConfig struct {
+	// QuotaBackendBytes is the etcd backend database size quota in bytes.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	QuotaBackendBytes *int64 `json:"quotaBackendBytes,omitempty"`
+
+	// HeartbeatIntervalMilliseconds is the time between etcd leader heartbeats.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	HeartbeatIntervalMilliseconds *int32 `json:"heartbeatIntervalMilliseconds,omitempty"`
+
+	// ElectionTimeoutMilliseconds is the time a follower waits without heartbeats before starting an election.
+	// etcd requires it to be at least five times the heartbeat interval.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ElectionTimeoutMilliseconds *int32 `json:"electionTimeoutMilliseconds,omitempty"`
+
+	// SnapshotCount is the number of committed transactions which trigger a snapshot to disk.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SnapshotCount *int64 `json:"snapshotCount,omitempty"`
+
+	// ExtraArgs are additional etcd command line arguments.
+	// Arguments set by the fields above take precedence.
+	// +optional
+	ExtraArgs map[string]string `json:"extraArgs,omitempty"`
+}
+
+// PreDrainHook configures coordination of the control plane machine removal with external controllers.
+//
+// On scale down the hook annotation "pre-drain.delete.hook.machine.cluster.x-k8s.io/<name>" is set
+// on the Machine before it is deleted, external controllers (e.g. load balancer deregistration)
+// acknowledge the removal by deleting the annotation. etcd member removal and node drain wait
+// for the acknowledgement or the timeout.
+type PreDrainHook struct {
+	// Name is the name of the pre-drain hook.
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Timeout is how long to wait for the acknowledgement before the hook is removed by the controller.
+	// Defaults to 5 minutes.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// AdmissionConfig defines kube-apiserver admission control settings.
+type AdmissionConfig struct {
+	// EnablePlugins is a list of admission plugins to enable in addition to the default ones.
+	// +optional
+	EnablePlugins []string `json:"enablePlugins,omitempty"`
+
+	// DisablePlugins is a list of admission plugins to disable.
+	// +optional
+	DisablePlugins []string `json:"disablePlugins,omitempty"`
+
+	// PodSecurity defines the cluster-wide Pod Security Admission defaults.
+	// Talos writes the admission configuration file only on boot, so changing the defaults replaces the machines.
+	// +optional
+	PodSecurity *PodSecurityDefaults `json:"podSecurity,omitempty"`
+}
+
+// PodSecurityDefaults defines Pod Security Standard levels applied to namespaces without pod security labels.
+type PodSecurityDefaults struct {
+	// Enforce is the level which rejects violating pods.
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	// +optional
+	Enforce string `json:"enforce,omitempty"`
+
+	// Audit is the level which adds audit annotations to violating pods.
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	// +optional
+	Audit string `json:"audit,omitempty"`
+
+	// Warn is the level which returns warnings to the user for violating pods.
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	// +optional
+	Warn string `json:"warn,omitempty"`
+
+	// ExemptNamespaces is a list of namespaces excluded from pod security checks.
+	// +optional
+	ExemptNamespaces []string `json:"exemptNamespaces,omitempty"`
+}
+
+// ResourcePressureThresholds defines the node resource usage which is reported as pressure
+// in the control plane health conditions.
+type ResourcePressureThresholds struct {
+	// EtcdDiskUsagePercent is the usage of the filesystem holding the etcd data directory
+	// above which the node is considered to be under disk pressure. Defaults to 85.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	EtcdDiskUsagePercent *int32 `json:"etcdDiskUsagePercent,omitempty"`
+
+	// MemoryUsagePercent is the memory usage above which the node is considered
+	// to be under memory pressure. Defaults to 90.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	MemoryUsagePercent *int32 `json:"memoryUsagePercent,omitempty"`
+}
+
+// MaintenanceModePolicy defines how machines which dropped into Talos maintenance mode are handled.
+// +kubebuilder:validation:Enum=Report;ReapplyConfig
+type MaintenanceModePolicy string
+
+const (
+	// MaintenanceModeReport only reports machines in maintenance mode.
+	MaintenanceModeReport MaintenanceModePolicy = "Report"
+
+	// MaintenanceModeReapplyConfig applies the machine bootstrap config to machines in maintenance mode.
+	// The node certificate is verified against MaintenanceCertificateFingerprintAnnotation of the Machine.
+	MaintenanceModeReapplyConfig MaintenanceModePolicy = "ReapplyConfig"
+)
+
+// GeneratedSecretsPolicy defines what happens to the secrets and config maps generated by the control plane
+// provider when the TalosControlPlane is deleted.
+// +kubebuilder:validation:Enum=Delete;Retain
+type GeneratedSecretsPolicy string
+
+const (
+	// GeneratedSecretsDelete deletes the generated objects together with the TalosControlPlane.
+	GeneratedSecretsDelete GeneratedSecretsPolicy = "Delete"
+
+	// GeneratedSecretsRetain keeps the generated objects, they are released from the TalosControlPlane ownership.
+	GeneratedSecretsRetain GeneratedSecretsPolicy = "Retain"
+)
+
+// ChangeOrdering defines how simultaneous version and replicas changes are sequenced.
+// +kubebuilder:validation:Enum=ScaleFirst;UpgradeFirst
+type ChangeOrdering string
+
+const (
+	// ScaleFirst creates the new machines with the version of the existing machines,
+	// the version change is applied once the desired number of replicas is reached.
+	ScaleFirst ChangeOrdering = "ScaleFirst"
+
+	// UpgradeFirst creates the new machines with the desired version right away.
+	UpgradeFirst ChangeOrdering = "UpgradeFirst"
+)
+
+// RolloutStrategyType defines the rollout strategies for the TalosControlPlane.
+// +kubebuilder:validation:Enum=RollingUpdate;OnDelete
+type RolloutStrategyType string
+
+const (
+	// RollingUpdateStrategyType replaces the outdated machines one by one.
+	RollingUpdateStrategyType RolloutStrategyType = "RollingUpdate"
+
+	// OnDeleteStrategyType replaces the outdated machines only when they are deleted manually.
+	// The replacements are always created with the desired version, ChangeOrdering doesn't apply.
+	OnDeleteStrategyType RolloutStrategyType = "OnDelete"
+)
+
+// ChangeStrategy describes how a spec change is applied to the control plane machines.
+// +kubebuilder:validation:Enum=InPlace;Reboot;Replacement
+type ChangeStrategy string
+
+const (
+	// InPlaceChangeStrategy applies the change without restarting the machines (e.g. manifests).
+	InPlaceChangeStrategy ChangeStrategy = "InPlace"
+
+	// RebootChangeStrategy applies the change by upgrading and rebooting the machines in place (e.g. kernel arguments).
+	RebootChangeStrategy ChangeStrategy = "Reboot"
+
+	// ReplacementChangeStrategy applies the change by replacing the machines (e.g. version, machine configuration).
+	ReplacementChangeStrategy ChangeStrategy = "Replacement"
+)
+
+// RolloutStrategy describes how to replace the outdated control plane machines.
+type RolloutStrategy struct {
+	// Type of rollout. Allowed values are "RollingUpdate" and "OnDelete".
+	// Default is RollingUpdate.
+	// +optional
+	Type RolloutStrategyType `json:"type,omitempty"`
+
+	// Rolling update config params. Present only if RolloutStrategyType = RollingUpdate.
+	// +optional
+	RollingUpdate *RollingUpdate `json:"rollingUpdate,omitempty"`
+}
+
+// RollingUpdate is used to control the desired behavior of rolling update.
+type RollingUpdate struct {
+	// The maximum number of control planes that can be scheduled above or under the
+	// desired number of control planes.
+	// Value can be an absolute number 1 or 0.
+	// Defaults to 1.
+	// Example: when this is set to 0, the old control plane machine is deleted
+	// before the new one is created, so the rollout doesn't need extra resources.
+	// A single replica control plane always surges, as it can't be scaled down to zero.
+	// +optional
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+}
+
+// TalosControlPlaneMachineTemplate defines the metadata of the control plane machines.
+type TalosControlPlaneMachineTemplate struct {
+	// Standard object's metadata.
+	// Labels and annotations are propagated to the control plane Machines and infrastructure machines,
+	// changes are applied to the existing machines without a rollout.
+	// +optional
+	ObjectMeta clusterv1.ObjectMeta `json:"metadata,omitempty"`
+
+	// FailureDomainMetadata defines additional labels and annotations per failure domain name.
+	// They are merged over ObjectMeta for the machines placed into that failure domain.
+	// +optional
+	FailureDomainMetadata map[string]clusterv1.ObjectMeta `json:"failureDomainMetadata,omitempty"`
+
+	// NodeDrainTimeout is the total amount of time that the controller will spend on draining a control plane node.
+	// The default value is 0, meaning that the node can be drained without any time limitations.
+	// NOTE: NodeDrainTimeout is different from `kubectl drain --timeout`.
+	// Changes are applied to the existing machines without a rollout.
+	// +optional
+	NodeDrainTimeout *metav1.Duration `json:"nodeDrainTimeout,omitempty"`
 }
 
 // TalosControlPlaneSpec defines the desired state of TalosControlPlane
@@ -41,6 +495,490 @@ type TalosControlPlaneSpec struct {
 	// ControlPlaneConfig is a two TalosConfigSpecs
 	// to use for initializing and joining machines to the control plane.
 	ControlPlaneConfig ControlPlaneConfig `json:"controlPlaneConfig"`
+
+	// MachineTemplate contains the metadata of the control plane machines.
+	// +optional
+	MachineTemplate TalosControlPlaneMachineTemplate `json:"machineTemplate,omitempty"`
+
+	// Images overrides image references rendered into the machine configs
+	// of the control plane machines.
+	// Images the control plane nodes fail to pull are reported with the ImagesResolved condition,
+	// the installer image is not checked as it is pulled only on install and upgrade.
+	// +optional
+	Images *ImageOverrides `json:"images,omitempty"`
+
+	// ComponentVersions pins control plane components to other Kubernetes versions.
+	// Image overrides take precedence over the pinned versions.
+	// +optional
+	ComponentVersions *ComponentVersions `json:"componentVersions,omitempty"`
+
+	// Etcd defines etcd tuning parameters for the control plane machines.
+	// Changes are applied by rebooting the machines one at a time, arguments removed from the spec
+	// are left on the machines until they are replaced.
+	// +optional
+	Etcd *EtcdConfig `json:"etcd,omitempty"`
+
+	// ResourcePressureThresholds configures when node resource usage is reported
+	// as unhealthy control plane components.
+	// +optional
+	ResourcePressureThresholds *ResourcePressureThresholds `json:"resourcePressureThresholds,omitempty"`
+
+	// Admission defines kube-apiserver admission plugins and Pod Security Admission defaults.
+	// Changes are only applied to machines created after the change.
+	// +optional
+	Admission *AdmissionConfig `json:"admission,omitempty"`
+
+	// ApproveKubeletServingCertificates enables automatic approval of pending kubelet serving
+	// certificate signing requests of the control plane nodes in the workload cluster.
+	// Requests are approved only if the requester and SANs match the control plane Machine.
+	// Useful when kubelet has rotate-server-certificates enabled.
+	// +optional
+	ApproveKubeletServingCertificates bool `json:"approveKubeletServingCertificates,omitempty"`
+
+	// MaintenanceModePolicy defines how control plane machines which dropped into Talos maintenance mode
+	// (e.g. machine config was lost after a disk replacement) are handled. Defaults to Report.
+	// +optional
+	MaintenanceModePolicy MaintenanceModePolicy `json:"maintenanceModePolicy,omitempty"`
+
+	// PreDrainHook makes scale down wait for external controllers before the machine is removed.
+	// +optional
+	PreDrainHook *PreDrainHook `json:"preDrainHook,omitempty"`
+
+	// GeneratedSecretsPolicy defines whether the secrets and config maps generated by the provider
+	// (e.g. kubeconfig) are deleted together with the TalosControlPlane. Defaults to Delete.
+	// +optional
+	GeneratedSecretsPolicy GeneratedSecretsPolicy `json:"generatedSecretsPolicy,omitempty"`
+
+	// ChangeOrdering defines how simultaneous changes of version and replicas are sequenced.
+	// Defaults to UpgradeFirst.
+	// +optional
+	ChangeOrdering ChangeOrdering `json:"changeOrdering,omitempty"`
+
+	// RolloutStrategy is the strategy to replace the outdated control plane machines.
+	// Defaults to RollingUpdate with maxSurge of 1.
+	// +optional
+	RolloutStrategy *RolloutStrategy `json:"rolloutStrategy,omitempty"`
+
+	// RolloutAfter is a field to indicate a rollout should be performed
+	// after the specified time even if no changes have been made to the
+	// TalosControlPlane.
+	// +optional
+	RolloutAfter *metav1.Time `json:"rolloutAfter,omitempty"`
+
+	// RolloutBefore is a field to indicate a rollout should be performed
+	// if the specified criteria is met.
+	// +optional
+	RolloutBefore *RolloutBefore `json:"rolloutBefore,omitempty"`
+
+	// RemediationStrategy bounds the remediation of the unhealthy control plane machines.
+	// +optional
+	RemediationStrategy *RemediationStrategy `json:"remediationStrategy,omitempty"`
+
+	// RemediationTemplate references a template of the external remediation requests (e.g. Metal3RemediationTemplate).
+	// When set, an external remediation request named after the unhealthy machine is created instead of deleting the machine,
+	// and it is deleted once the machine is healthy again.
+	// +optional
+	RemediationTemplate *corev1.ObjectReference `json:"remediationTemplate,omitempty"`
+
+	// Install defines kernel arguments and system extensions of the control plane machines.
+	// Changes are applied by upgrading the machines in place one at a time, without replacing them.
+	// +optional
+	Install *InstallConfig `json:"install,omitempty"`
+
+	// RequireApproval lists the change strategies which are not applied until approved.
+	// Pending changes are published in the status with their IDs, the change is approved
+	// by adding its ID to the "controlplane.cluster.x-k8s.io/approved-changes" annotation.
+	// +optional
+	RequireApproval []ChangeStrategy `json:"requireApproval,omitempty"`
+
+	// EtcdBackup configures the scheduled etcd backups uploaded to S3-compatible storage.
+	// +optional
+	EtcdBackup *EtcdBackup `json:"etcdBackup,omitempty"`
+
+	// AddressSources lists the sources of the Talos API endpoints of the control plane machines in the order they are tried,
+	// the first source which knows the addresses of a machine is used. Besides the built-in sources, the names of the sources
+	// registered with the controller can be used. Defaults to MachineStatus, InfrastructureMachine, with NodeStatus tried first for the control planes with the init config.
+	// +optional
+	AddressSources []AddressSourceName `json:"addressSources,omitempty"`
+
+	// OperationTimeouts defines the deadlines of the control plane changes, the OperationTimedOut condition
+	// is set once a change takes longer. The controller keeps working on the change after the deadline.
+	// +optional
+	OperationTimeouts *OperationTimeouts `json:"operationTimeouts,omitempty"`
+}
+
+// OperationTimeouts defines how long the control plane changes may take.
+type OperationTimeouts struct {
+	// Rollout is the deadline for replacing the outdated machines, counted from the time they were first detected to be outdated.
+	// +optional
+	Rollout *metav1.Duration `json:"rollout,omitempty"`
+
+	// ScaleUp is the deadline for creating the machines up to the desired number of replicas.
+	// +optional
+	ScaleUp *metav1.Duration `json:"scaleUp,omitempty"`
+}
+
+// EtcdBackup defines the scheduled etcd backups.
+type EtcdBackup struct {
+	// Interval between the backups, at least one minute.
+	Interval metav1.Duration `json:"interval"`
+
+	// S3 is the S3-compatible storage (AWS S3, MinIO, GCS with HMAC keys) the backups are uploaded to.
+	S3 EtcdBackupS3 `json:"s3"`
+
+	// MaxAge is the age of the last successful backup after which the backups are reported as stale,
+	// at least the interval. Backups are not checked for staleness if empty.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// StaleDeletionPolicy defines how the deletion of the TalosControlPlane is handled while the backups are stale.
+	// Defaults to Warn.
+	// +optional
+	StaleDeletionPolicy StaleBackupDeletionPolicy `json:"staleDeletionPolicy,omitempty"`
+
+	// Verification periodically restores the last backup on a temporary single-node machine
+	// to check that the backup is restorable. Backups are not verified if empty.
+	// +optional
+	Verification *EtcdBackupVerification `json:"verification,omitempty"`
+}
+
+// EtcdBackupVerification defines the restore verification of the etcd backups.
+//
+// The temporary machine is created with a standalone Talos configuration, so it doesn't join the cluster,
+// but the restored Kubernetes control plane runs on it until the verification completes:
+// the infrastructure template should place the machine into an isolated network.
+type EtcdBackupVerification struct {
+	// Interval between the verifications, at least one hour. A backup is verified only once.
+	Interval metav1.Duration `json:"interval"`
+
+	// InfrastructureTemplate is the template of the temporary machine the backup is restored on.
+	InfrastructureTemplate corev1.ObjectReference `json:"infrastructureTemplate"`
+
+	// Timeout of a single verification, including the provisioning of the machine. Defaults to 30 minutes.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// StaleBackupDeletionPolicy defines how the deletion of a TalosControlPlane with stale etcd backups is handled.
+// +kubebuilder:validation:Enum=Warn;Block
+type StaleBackupDeletionPolicy string
+
+const (
+	// StaleBackupDeletionWarn records a warning event and proceeds with the deletion.
+	StaleBackupDeletionWarn StaleBackupDeletionPolicy = "Warn"
+
+	// StaleBackupDeletionBlock attempts a final backup and holds the deletion until a backup succeeds,
+	// or the SkipStaleBackupCheckAnnotation is set.
+	StaleBackupDeletionBlock StaleBackupDeletionPolicy = "Block"
+)
+
+// EtcdBackupS3 defines the S3-compatible storage of the etcd backups.
+type EtcdBackupS3 struct {
+	// Endpoint is the URL of the storage, e.g. "https://s3.us-east-1.amazonaws.com" or "https://storage.googleapis.com".
+	// Objects are addressed path-style.
+	Endpoint string `json:"endpoint"`
+
+	// Bucket the backups are uploaded to.
+	Bucket string `json:"bucket"`
+
+	// Region of the bucket used to sign the requests. Defaults to "us-east-1".
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Prefix of the object keys, backups are uploaded as "<prefix><namespace>/<cluster>/etcd-<timestamp>.db.gz".
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// CredentialsSecretRef references the secret with the "accessKeyID" and "secretAccessKey" keys
+	// in the namespace of the TalosControlPlane.
+	CredentialsSecretRef corev1.LocalObjectReference `json:"credentialsSecretRef"`
+}
+
+// InstallConfig defines the Talos installation parameters which are applied by the in-place upgrade.
+type InstallConfig struct {
+	// ExtraKernelArgs is the list of extra kernel arguments (machine.install.extraKernelArgs).
+	// +optional
+	ExtraKernelArgs []string `json:"extraKernelArgs,omitempty"`
+
+	// Extensions is the list of Talos system extensions (machine.install.extensions).
+	// +optional
+	Extensions []InstallExtension `json:"extensions,omitempty"`
+
+	// ImageDigests pins the digests of the installer and system extension images by the image reference,
+	// e.g. "ghcr.io/siderolabs/installer:v1.0.0": "sha256:...". The nodes pull the pinned images by the digest
+	// ("image@digest"), so the image pushed again with the same tag is not installed; the registry credentials and
+	// mirrors configured in Talos are used. The installer image is pinned if it's set in spec.images.installer,
+	// or in the machine configuration of the node upgraded in place. Image signatures are not verified.
+	// +optional
+	ImageDigests map[string]string `json:"imageDigests,omitempty"`
+}
+
+// InstallExtension describes a Talos system extension.
+type InstallExtension struct {
+	// Image is the system extension container image reference.
+	Image string `json:"image"`
+}
+
+// RemediationStrategy controls how the unhealthy control plane machines are remediated.
+type RemediationStrategy struct {
+	// MaxRetry is the maximum number of times the replacement of a remediated machine is remediated again
+	// when it fails as well. Retries are not limited if not set.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxRetry *int32 `json:"maxRetry,omitempty"`
+
+	// RetryPeriodSeconds is the time to wait before remediating the replacement of a remediated machine.
+	// Defaults to 0, i.e. the replacement is remediated right away.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	RetryPeriodSeconds *int32 `json:"retryPeriodSeconds,omitempty"`
+
+	// MinHealthyPeriodSeconds is the time the replacement of a remediated machine should stay healthy
+	// for its failure to be considered unrelated to the previous remediation, which resets the retry count.
+	// Defaults to 3600.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinHealthyPeriodSeconds *int32 `json:"minHealthyPeriodSeconds,omitempty"`
+}
+
+// RolloutBefore describes when a rollout should be performed on the control plane machines.
+type RolloutBefore struct {
+	// CertificatesExpiryDays indicates a rollout needs to be performed if the
+	// Talos API or Kubernetes API server certificates of the machine will expire
+	// within the specified days.
+	// +kubebuilder:validation:Minimum=7
+	// +optional
+	CertificatesExpiryDays *int32 `json:"certificatesExpiryDays,omitempty"`
+}
+
+// ReconcileHint describes the next planned reconcile of the TalosControlPlane.
+type ReconcileHint struct {
+	// After is the time of the next planned reconcile, it is not set when the controller
+	// retries with backoff after a failure.
+	// +optional
+	After *metav1.Time `json:"after,omitempty"`
+
+	// Reason is the reason of the condition the controller is waiting for.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// RolloutStatus describes the control plane machines outdated by the spec changes.
+type RolloutStatus struct {
+	// Reason is a short summary of the changes (version, infrastructure template, config hash).
+	Reason string `json:"reason"`
+
+	// OutdatedReplicas is the number of machines which don't match the spec.
+	OutdatedReplicas int32 `json:"outdatedReplicas"`
+
+	// StartTime is the time the machines were first detected to be outdated.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+}
+
+// PendingChange describes a spec change which is not applied to the control plane machines yet.
+type PendingChange struct {
+	// ID identifies the desired state of the change, it is used to approve the change.
+	ID string `json:"id"`
+
+	// Strategy is how the change is applied.
+	Strategy ChangeStrategy `json:"strategy"`
+
+	// Reason is a short summary of the change.
+	Reason string `json:"reason"`
+
+	// Machines is the number of machines affected by the change.
+	// +optional
+	Machines int32 `json:"machines,omitempty"`
+
+	// Approved is set if the change requires approval and was approved.
+	// +optional
+	Approved bool `json:"approved,omitempty"`
+}
+
+// EtcdBackupStatus describes the scheduled etcd backups.
+type EtcdBackupStatus struct {
+	// LastAttemptTime is the time of the last backup attempt.
+	// +optional
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+
+	// LastSuccessTime is the time of the last successful backup.
+	// +optional
+	LastSuccessTime *metav1.Time `json:"lastSuccessTime,omitempty"`
+
+	// LastObject is the object key of the last successful backup.
+	// +optional
+	LastObject string `json:"lastObject,omitempty"`
+
+	// LastError is the error of the last backup attempt, empty if it succeeded.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// Verification describes the restore verification of the backups.
+	// +optional
+	Verification *EtcdBackupVerificationStatus `json:"verification,omitempty"`
+}
+
+// EtcdBackupVerificationStatus describes the restore verification of the etcd backups.
+type EtcdBackupVerificationStatus struct {
+	// Machine is the name of the temporary machine of the verification in progress.
+	// +optional
+	Machine string `json:"machine,omitempty"`
+
+	// Object is the object key of the backup being verified.
+	// +optional
+	Object string `json:"object,omitempty"`
+
+	// StartTime is the time the verification in progress was started at.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// Restored is set once the backup is uploaded to the machine and etcd is bootstrapped from it.
+	// +optional
+	Restored bool `json:"restored,omitempty"`
+
+	// LastCompletionTime is the time the last verification completed at.
+	// +optional
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+
+	// LastObject is the object key of the last verified backup.
+	// +optional
+	LastObject string `json:"lastObject,omitempty"`
+
+	// LastError is the error of the last verification, empty if the backup was restored.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+}
+
+// CertificateAuthority names a certificate authority of the cluster.
+type CertificateAuthority string
+
+const (
+	// TalosCertificateAuthority is the Talos API certificate authority (machine.ca).
+	TalosCertificateAuthority CertificateAuthority = "talos"
+
+	// KubernetesCertificateAuthority is the Kubernetes certificate authority (cluster.ca).
+	KubernetesCertificateAuthority CertificateAuthority = "kubernetes"
+)
+
+// CARotationPhase is a phase of the certificate authority rotation, each phase is applied to all control plane machines in turn.
+type CARotationPhase string
+
+const (
+	// CARotationTrustNew makes the machines trust both the old and the new certificate authorities,
+	// the certificates are still issued by the old one.
+	CARotationTrustNew CARotationPhase = "TrustNew"
+
+	// CARotationIssueNew makes the machines issue the certificates with the new certificate authority,
+	// the old one is still trusted.
+	CARotationIssueNew CARotationPhase = "IssueNew"
+
+	// CARotationDropOld makes the machines trust only the new certificate authority.
+	CARotationDropOld CARotationPhase = "DropOld"
+)
+
+// CARotationStatus describes the certificate authority rotation in progress.
+type CARotationStatus struct {
+	// Authorities are the certificate authorities being rotated.
+	Authorities []CertificateAuthority `json:"authorities"`
+
+	// Phase of the rotation.
+	Phase CARotationPhase `json:"phase"`
+
+	// StartTime is the time the rotation started at.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// UpdatedMachines are the control plane machines running with the configuration of the current phase.
+	// +optional
+	UpdatedMachines []string `json:"updatedMachines,omitempty"`
+
+	// PendingMachine is the control plane machine rebooting to apply the configuration of the current phase.
+	// +optional
+	PendingMachine string `json:"pendingMachine,omitempty"`
+
+	// AppliedTime is the time the configuration was applied to the pending machine.
+	// +optional
+	AppliedTime *metav1.Time `json:"appliedTime,omitempty"`
+
+	// PublishedTime is the time the secrets of the current phase were published for the new machines,
+	// once all control plane machines were updated. Worker machines created before are expected to be replaced
+	// before the next phase starts.
+	// +optional
+	PublishedTime *metav1.Time `json:"publishedTime,omitempty"`
+}
+
+// MachineStatus describes a control plane machine.
+type MachineStatus struct {
+	// Name of the Machine.
+	Name string `json:"name"`
+
+	// LastTalosAPIContactTime is the last time the Talos API of the machine responded, recorded with a minute precision.
+	// +optional
+	LastTalosAPIContactTime *metav1.Time `json:"lastTalosAPIContactTime,omitempty"`
+
+	// LastNodeContactTime is the last time the kubelet of the machine renewed its node lease, recorded with a minute precision.
+	// +optional
+	LastNodeContactTime *metav1.Time `json:"lastNodeContactTime,omitempty"`
+
+	// BootstrapConfig is the TalosConfig the machine was created with.
+	// +optional
+	BootstrapConfig *BootstrapConfigReference `json:"bootstrapConfig,omitempty"`
+
+	// TalosEndpoint is the address of the machine selected for the Talos API requests.
+	// +optional
+	TalosEndpoint string `json:"talosEndpoint,omitempty"`
+}
+
+// BootstrapConfigReference identifies the TalosConfig a machine was created with.
+type BootstrapConfigReference struct {
+	// Name of the TalosConfig.
+	Name string `json:"name"`
+
+	// UID of the TalosConfig.
+	UID types.UID `json:"uid"`
+
+	// Generation of the TalosConfig when it was first observed by the controller.
+	Generation int64 `json:"generation"`
+}
+
+// KubeadmMigrationPhase is a phase of the migration from the KubeadmControlPlane.
+type KubeadmMigrationPhase string
+
+const (
+	// KubeadmMigrationPending waits for the migration prerequisites, no machines are created.
+	KubeadmMigrationPending KubeadmMigrationPhase = "Pending"
+
+	// KubeadmMigrationInProgress adds the Talos machines one at a time and retires the kubeadm machines.
+	KubeadmMigrationInProgress KubeadmMigrationPhase = "InProgress"
+
+	// KubeadmMigrationCompleted is set once all kubeadm machines are retired.
+	KubeadmMigrationCompleted KubeadmMigrationPhase = "Completed"
+)
+
+// KubeadmMigrationStatus describes the migration from the KubeadmControlPlane.
+type KubeadmMigrationStatus struct {
+	// Source is the name of the KubeadmControlPlane the cluster is taken over from.
+	Source string `json:"source"`
+
+	// Phase of the migration.
+	Phase KubeadmMigrationPhase `json:"phase"`
+
+	// KubeadmReplicas is the number of the kubeadm control plane machines left.
+	// +optional
+	KubeadmReplicas int32 `json:"kubeadmReplicas"`
+
+	// Message describes what the migration waits for.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is the time the migration started at.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time the last kubeadm machine was retired at.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
 }
 
 // TalosControlPlaneStatus defines the observed state of TalosControlPlane
@@ -58,6 +996,11 @@ type TalosControlPlaneStatus struct {
 	// +optional
 	Replicas int32 `json:"replicas,omitempty"`
 
+	// Total number of non-terminated machines targeted by this control plane
+	// that match the desired spec.
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
 	// Total number of fully running and ready control plane machines.
 	// +optional
 	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
@@ -70,6 +1013,12 @@ type TalosControlPlaneStatus struct {
 	// +optional
 	UnavailableReplicas int32 `json:"unavailableReplicas,omitempty"`
 
+	// DisruptionAllowed is the number of control plane machines which can be disrupted
+	// right now (e.g. rebooted for host maintenance) without losing etcd quorum.
+	// It is zero whenever etcd or control plane components are not healthy.
+	// +optional
+	DisruptionAllowed int32 `json:"disruptionAllowed"`
+
 	// Initialized denotes whether or not the control plane has the
 	// uploaded talos-config configmap.
 	// +optional
@@ -100,6 +1049,70 @@ type TalosControlPlaneStatus struct {
 	// +optional
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 
+	// ConsecutiveFailures is the number of reconciles in a row which failed with an error.
+	// It is reset after a successful reconcile.
+	// +optional
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+
+	// NextReconcileHint is set while the controller waits for a long running operation
+	// (e.g. bootstrap, scaling) to tell when the control plane is checked again.
+	// +optional
+	NextReconcileHint *ReconcileHint `json:"nextReconcileHint,omitempty"`
+
+	// Rollout summarizes why the control plane machines don't match the spec anymore.
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
+	// ScaleUpStartTime is the time the control plane was first detected to have fewer machines than desired.
+	// +optional
+	ScaleUpStartTime *metav1.Time `json:"scaleUpStartTime,omitempty"`
+
+	// PendingVersion is the desired version postponed until scaling completes
+	// according to the change ordering.
+	// +optional
+	PendingVersion string `json:"pendingVersion,omitempty"`
+
+	// Version is the lowest Kubernetes version of the control plane machines,
+	// the version changes are checked against it for the Kubernetes version skew policy.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// ManifestsChecksum is the checksum of the extra and inline manifests last applied to the workload cluster.
+	// +optional
+	ManifestsChecksum string `json:"manifestsChecksum,omitempty"`
+
+	// PendingChanges classifies the spec changes not applied yet by how they are applied
+	// (in place, with a reboot or by replacing the machines), before acting on them.
+	// +optional
+	PendingChanges []PendingChange `json:"pendingChanges,omitempty"`
+
+	// EtcdBackup describes the scheduled etcd backups.
+	// +optional
+	EtcdBackup *EtcdBackupStatus `json:"etcdBackup,omitempty"`
+
+	// MachineStatuses describes each control plane machine.
+	// +optional
+	MachineStatuses []MachineStatus `json:"machineStatuses,omitempty"`
+
+	// KubeconfigExpiryTime is the expiry of the client certificate in the kubeconfig secret of the cluster,
+	// the kubeconfig is regenerated before it expires.
+	// +optional
+	KubeconfigExpiryTime *metav1.Time `json:"kubeconfigExpiryTime,omitempty"`
+
+	// CARotation describes the certificate authority rotation in progress.
+	// +optional
+	CARotation *CARotationStatus `json:"caRotation,omitempty"`
+
+	// KubeadmMigration describes the migration from the KubeadmControlPlane.
+	// +optional
+	KubeadmMigration *KubeadmMigrationStatus `json:"kubeadmMigration,omitempty"`
+
+	// TalosConfigSecretRef references the Secret with the talosconfig published by the controller
+	// (e.g. for the rotated Talos CA or the re-adopted machines). It takes precedence over the TalosConfigSecretRef of the spec
+	// to access Talos API of the control plane machines.
+	// +optional
+	TalosConfigSecretRef *corev1.LocalObjectReference `json:"talosConfigSecretRef,omitempty"`
+
 	// Conditions defines current service state of the KubeadmControlPlane.
 	// +optional
 	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
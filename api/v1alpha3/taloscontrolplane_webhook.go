@@ -1,11 +1,617 @@
 package v1alpha3
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	scaleValidationPath = "/validate-scale-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane"
+	warningPath         = "/warn-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane"
+)
+
+// apiRequests counts the TalosControlPlane create and update requests by the API version used by the client.
+var apiRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cacppt_api_requests_total",
+		Help: "Number of TalosControlPlane create and update requests by the API version used by the client.",
+	},
+	[]string{"version", "operation"},
 )
 
+func init() {
+	metrics.Registry.MustRegister(apiRequests)
+}
+
 func (r *TalosControlPlane) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(scaleValidationPath, &webhook.Admission{Handler: &scaleValidator{reader: mgr.GetAPIReader()}})
+	mgr.GetWebhookServer().Register(warningPath, &webhook.Admission{Handler: &admissionWarner{}})
+
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
 }
+
+// +kubebuilder:webhook:verbs=create;update,path=/mutate-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane,mutating=true,failurePolicy=fail,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanes,versions=v1alpha3,name=default.taloscontrolplane.controlplane.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Defaulter = &TalosControlPlane{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+//
+// Only the fields left empty are filled in, so that the defaults don't change the existing control planes.
+func (r *TalosControlPlane) Default() {
+	if r.Spec.Replicas == nil {
+		replicas := int32(1)
+		r.Spec.Replicas = &replicas
+	}
+
+	if r.Spec.Version != "" && !strings.HasPrefix(r.Spec.Version, "v") {
+		r.Spec.Version = "v" + r.Spec.Version
+	}
+
+	DefaultTemplateSpec(&r.Spec)
+
+	// the creation timestamp is set by the API server after the mutating webhooks on create
+	if r.CreationTimestamp.IsZero() {
+		DefaultRolloutStrategy(&r.Spec)
+	}
+}
+
+// DefaultTemplateSpec fills in the defaults of the fields which are not managed by the ClusterClass topology controller.
+//
+// The TalosControlPlaneTemplate is defaulted with it, so that the topology controller doesn't fight the defaulting
+// of the control planes created from the template.
+func DefaultTemplateSpec(spec *TalosControlPlaneSpec) {
+	defaultGenerateType(&spec.ControlPlaneConfig.ControlPlaneConfig, "controlplane")
+
+	if !reflect.ValueOf(spec.ControlPlaneConfig.InitConfig).IsZero() {
+		defaultGenerateType(&spec.ControlPlaneConfig.InitConfig, "init")
+	}
+}
+
+// DefaultRolloutStrategy fills in the RollingUpdate rollout strategy with the surge of one machine.
+//
+// It's applied only on create: the controller rolls out the objects without the rollout strategy the same way,
+// and setting it on update would change the spec of the existing objects on their next unrelated update.
+func DefaultRolloutStrategy(spec *TalosControlPlaneSpec) {
+	if spec.RolloutStrategy == nil {
+		spec.RolloutStrategy = &RolloutStrategy{}
+	}
+
+	if spec.RolloutStrategy.Type == "" {
+		spec.RolloutStrategy.Type = RollingUpdateStrategyType
+	}
+
+	if spec.RolloutStrategy.Type == RollingUpdateStrategyType {
+		if spec.RolloutStrategy.RollingUpdate == nil {
+			spec.RolloutStrategy.RollingUpdate = &RollingUpdate{}
+		}
+
+		if spec.RolloutStrategy.RollingUpdate.MaxSurge == nil {
+			maxSurge := intstr.FromInt(1)
+			spec.RolloutStrategy.RollingUpdate.MaxSurge = &maxSurge
+		}
+	}
+}
+
+// defaultGenerateType generates the machine config of the given type, unless the config is provided as is.
+func defaultGenerateType(spec *cabptv1.TalosConfigSpec, generateType string) {
+	if spec.GenerateType != "" {
+		return
+	}
+
+	if spec.Data != "" {
+		spec.GenerateType = "none"
+	} else {
+		spec.GenerateType = generateType
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane,mutating=false,failurePolicy=fail,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanes,versions=v1alpha3,name=vtaloscontrolplane.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+// +kubebuilder:webhook:verbs=create;update,path=/warn-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane,mutating=false,failurePolicy=ignore,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanes,versions=v1alpha3,name=wtaloscontrolplane.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+// +kubebuilder:webhook:verbs=update,path=/validate-scale-controlplane-cluster-x-k8s-io-v1alpha3-taloscontrolplane,mutating=false,failurePolicy=fail,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanes/scale,versions=v1alpha3,name=vtaloscontrolplanescale.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Validator = &TalosControlPlane{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
+func (r *TalosControlPlane) ValidateCreate() error {
+	return r.validate(nil)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+func (r *TalosControlPlane) ValidateUpdate(old runtime.Object) error {
+	oldTCP, ok := old.(*TalosControlPlane)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a TalosControlPlane but got a %T", old))
+	}
+
+	if err := r.validate(oldTCP); err != nil {
+		return err
+	}
+
+	allErrs := r.validateTransition(oldTCP)
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("TalosControlPlane").GroupKind(), r.Name, allErrs)
+}
+
+// validateTransition checks the changes which are not supported by the controller.
+func (r *TalosControlPlane) validateTransition(old *TalosControlPlane) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if err := validateReplicasTransition(old, r.Spec.Replicas); err != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "replicas"), err.Error()))
+	}
+
+	configPath := field.NewPath("spec", "controlPlaneConfig")
+
+	if _, skip := r.Annotations[SkipVersionSkewCheckAnnotation]; !skip && r.Spec.Version != old.Spec.Version {
+		// the machines might be still rolling out the previous change
+		current := old.Status.Version
+		if current == "" {
+			current = old.Spec.Version
+		}
+
+		if err := validateVersionSkew(current, r.Spec.Version); err != nil {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "version"),
+				fmt.Sprintf("%s; set the %q annotation to change the version anyway", err, SkipVersionSkewCheckAnnotation)))
+		}
+	}
+
+	if oldType, newType := old.Spec.ControlPlaneConfig.ControlPlaneConfig.GenerateType, r.Spec.ControlPlaneConfig.ControlPlaneConfig.GenerateType; oldType != newType {
+		allErrs = append(allErrs, field.Invalid(configPath.Child("controlplane", "generateType"), newType, fmt.Sprintf("is immutable, was %q", oldType)))
+	}
+
+	return allErrs
+}
+
+// validateReplicasTransition checks the replicas can be changed.
+func validateReplicasTransition(tcp *TalosControlPlane, replicas *int32) error {
+	if tcp.Spec.Replicas == nil || replicas == nil || *tcp.Spec.Replicas == *replicas {
+		return nil
+	}
+
+	if !tcp.DeletionTimestamp.IsZero() {
+		return fmt.Errorf("cannot be changed while the TalosControlPlane is being deleted")
+	}
+
+	return nil
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+func (r *TalosControlPlane) ValidateDelete() error {
+	return nil
+}
+
+// validate checks the spec, on update only the fields changed from the old object (nil on create) are checked,
+// so that the existing control planes can still be updated (e.g. by the controller itself).
+func (r *TalosControlPlane) validate(old *TalosControlPlane) error {
+	var (
+		allErrs field.ErrorList
+		oldSpec *TalosControlPlaneSpec
+	)
+
+	if old != nil {
+		oldSpec = &old.Spec
+	}
+
+	if r.Spec.Replicas != nil && (old == nil || old.Spec.Replicas == nil || *old.Spec.Replicas != *r.Spec.Replicas) {
+		if err := validateReplicas(*r.Spec.Replicas); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "replicas"), *r.Spec.Replicas, err.Error()))
+		}
+	}
+
+	if old == nil || old.Spec.Version != r.Spec.Version {
+		if err := validateVersion(r.Spec.Version); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "version"), r.Spec.Version, err.Error()))
+		}
+	}
+
+	if old == nil || old.Spec.InfrastructureTemplate != r.Spec.InfrastructureTemplate {
+		allErrs = append(allErrs, validateInfrastructureTemplate(field.NewPath("spec", "infrastructureTemplate"), r.Spec.InfrastructureTemplate, r.Namespace)...)
+	}
+
+	allErrs = append(allErrs, ValidateTemplateSpec(field.NewPath("spec"), &r.Spec, oldSpec, r.Namespace)...)
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("TalosControlPlane").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateTemplateSpec checks the fields of the spec which are not managed by the ClusterClass topology controller,
+// i.e. everything but the replicas, version and infrastructure template.
+//
+// The TalosControlPlaneTemplate is validated with it, so that the control planes created from a template pass the validation.
+// If the old spec is set, only the fields changed from it are checked.
+func ValidateTemplateSpec(specPath *field.Path, spec, old *TalosControlPlaneSpec, namespace string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	changed := func(get func(*TalosControlPlaneSpec) interface{}) bool {
+		return old == nil || !reflect.DeepEqual(get(spec), get(old))
+	}
+
+	if changed(func(s *TalosControlPlaneSpec) interface{} { return s.RolloutStrategy }) && spec.RolloutStrategy != nil && spec.RolloutStrategy.RollingUpdate != nil && spec.RolloutStrategy.RollingUpdate.MaxSurge != nil {
+		maxSurge := spec.RolloutStrategy.RollingUpdate.MaxSurge
+
+		if maxSurge.Type != intstr.Int || (maxSurge.IntVal != 0 && maxSurge.IntVal != 1) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("rolloutStrategy", "rollingUpdate", "maxSurge"), maxSurge.String(), "must be 0 or 1"))
+		}
+	}
+
+	configPath := specPath.Child("controlPlaneConfig")
+
+	if changed(func(s *TalosControlPlaneSpec) interface{} { return s.ControlPlaneConfig.ControlPlaneConfig }) {
+		allErrs = append(allErrs, validateTalosConfigSpec(configPath.Child("controlplane"), &spec.ControlPlaneConfig.ControlPlaneConfig, "controlplane")...)
+		allErrs = append(allErrs, validateConfigPatches(configPath.Child("controlplane", "configPatches"), spec.ControlPlaneConfig.ControlPlaneConfig.ConfigPatches)...)
+	}
+
+	if changed(func(s *TalosControlPlaneSpec) interface{} { return s.ControlPlaneConfig.InitConfig }) {
+		if !reflect.ValueOf(spec.ControlPlaneConfig.InitConfig).IsZero() {
+			allErrs = append(allErrs, validateTalosConfigSpec(configPath.Child("init"), &spec.ControlPlaneConfig.InitConfig, "init")...)
+		}
+
+		allErrs = append(allErrs, validateConfigPatches(configPath.Child("init", "configPatches"), spec.ControlPlaneConfig.InitConfig.ConfigPatches)...)
+	}
+
+	if etcd := spec.Etcd; etcd != nil && changed(func(s *TalosControlPlaneSpec) interface{} { return s.Etcd }) {
+		allErrs = append(allErrs, validateEtcdConfig(specPath.Child("etcd"), etcd)...)
+	}
+
+	if backup := spec.EtcdBackup; backup != nil && changed(func(s *TalosControlPlaneSpec) interface{} { return s.EtcdBackup }) {
+		backupPath := specPath.Child("etcdBackup")
+
+		if backup.Interval.Duration < time.Minute {
+			allErrs = append(allErrs, field.Invalid(backupPath.Child("interval"), backup.Interval.Duration.String(), "must be at least 1m"))
+		}
+
+		if backup.MaxAge != nil && backup.MaxAge.Duration < backup.Interval.Duration {
+			allErrs = append(allErrs, field.Invalid(backupPath.Child("maxAge"), backup.MaxAge.Duration.String(), "must be at least the interval"))
+		}
+
+		if u, err := url.Parse(backup.S3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			allErrs = append(allErrs, field.Invalid(backupPath.Child("s3", "endpoint"), backup.S3.Endpoint, "must be an http or https URL"))
+		}
+
+		if verification := backup.Verification; verification != nil {
+			verificationPath := backupPath.Child("verification")
+
+			if verification.Interval.Duration < time.Hour {
+				allErrs = append(allErrs, field.Invalid(verificationPath.Child("interval"), verification.Interval.Duration.String(), "must be at least 1h"))
+			}
+
+			if verification.Timeout != nil && verification.Timeout.Duration <= 0 {
+				allErrs = append(allErrs, field.Invalid(verificationPath.Child("timeout"), verification.Timeout.Duration.String(), "must be positive"))
+			}
+
+			allErrs = append(allErrs, validateInfrastructureTemplate(verificationPath.Child("infrastructureTemplate"), verification.InfrastructureTemplate, namespace)...)
+		}
+	}
+
+	if install := spec.Install; install != nil && changed(func(s *TalosControlPlaneSpec) interface{} { return s.Install }) {
+		for image, pinned := range install.ImageDigests {
+			if _, err := digest.Parse(pinned); err != nil {
+				allErrs = append(allErrs, field.Invalid(specPath.Child("install", "imageDigests").Key(image), pinned, err.Error()))
+			}
+		}
+	}
+
+	if timeouts := spec.OperationTimeouts; timeouts != nil && changed(func(s *TalosControlPlaneSpec) interface{} { return s.OperationTimeouts }) {
+		timeoutsPath := specPath.Child("operationTimeouts")
+
+		for name, timeout := range map[string]*metav1.Duration{
+			"rollout": timeouts.Rollout,
+			"scaleUp": timeouts.ScaleUp,
+		} {
+			if timeout != nil && timeout.Duration <= 0 {
+				allErrs = append(allErrs, field.Invalid(timeoutsPath.Child(name), timeout.Duration.String(), "must be positive"))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateEtcdConfig checks the etcd election timeout is at least five times the heartbeat interval,
+// otherwise etcd refuses to start. The etcd defaults are used for the parameters which are not set.
+func validateEtcdConfig(etcdPath *field.Path, etcd *EtcdConfig) field.ErrorList {
+	var allErrs field.ErrorList
+
+	heartbeat, election := int64(100), int64(1000)
+	heartbeatPath, electionPath := etcdPath.Child("extraArgs").Key("heartbeat-interval"), etcdPath.Child("extraArgs").Key("election-timeout")
+
+	for _, arg := range []struct {
+		key   string
+		path  *field.Path
+		value *int64
+	}{
+		{"heartbeat-interval", heartbeatPath, &heartbeat},
+		{"election-timeout", electionPath, &election},
+	} {
+		value, ok := etcd.ExtraArgs[arg.key]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			allErrs = append(allErrs, field.Invalid(arg.path, value, "must be a positive number of milliseconds"))
+
+			continue
+		}
+
+		*arg.value = parsed
+	}
+
+	// the fields take precedence over the extra args
+	if etcd.HeartbeatIntervalMilliseconds != nil {
+		heartbeat, heartbeatPath = int64(*etcd.HeartbeatIntervalMilliseconds), etcdPath.Child("heartbeatIntervalMilliseconds")
+	}
+
+	if etcd.ElectionTimeoutMilliseconds != nil {
+		election, electionPath = int64(*etcd.ElectionTimeoutMilliseconds), etcdPath.Child("electionTimeoutMilliseconds")
+	}
+
+	if election < 5*heartbeat {
+		allErrs = append(allErrs, field.Invalid(electionPath, election,
+			fmt.Sprintf("must be at least five times the heartbeat interval (%s is %dms)", heartbeatPath, heartbeat)))
+	}
+
+	return allErrs
+}
+
+// validateReplicas checks the replica count is positive.
+//
+// It is shared by the full object and the scale subresource validation,
+// so that scaling with `kubectl scale` or autoscalers can't bypass it.
+// It's only checked when the replicas change.
+func validateReplicas(replicas int32) error {
+	if replicas <= 0 {
+		return fmt.Errorf("cannot be less than or equal to 0")
+	}
+
+	return nil
+}
+
+// replicasWarning discourages the even number of replicas, it's allowed for the migrations and the rollouts.
+func replicasWarning(replicas int32) string {
+	if replicas%2 == 0 {
+		return "an even number of replicas does not improve etcd fault tolerance"
+	}
+
+	return ""
+}
+
+// jsonPointer matches RFC 6901 JSON pointers referencing a value within the document.
+var jsonPointer = regexp.MustCompile(`^(/([^~/]|~[01])*)+$`)
+
+// validateVersion checks the Kubernetes version is a semantic version with the "v" prefix.
+func validateVersion(version string) error {
+	if !strings.HasPrefix(version, "v") {
+		return fmt.Errorf("must start with \"v\", e.g. v1.22.2")
+	}
+
+	if _, err := semver.NewVersion(strings.TrimPrefix(version, "v")); err != nil {
+		return fmt.Errorf("must be a semantic version, e.g. v1.22.2: %s", err)
+	}
+
+	return nil
+}
+
+// validateVersionSkew checks the version change follows the Kubernetes version skew policy:
+// the control plane is upgraded one minor version at a time, and the kubelets are never newer than the API server.
+func validateVersionSkew(current, desired string) error {
+	currentVersion, currentErr := semver.NewVersion(strings.TrimPrefix(current, "v"))
+	desiredVersion, desiredErr := semver.NewVersion(strings.TrimPrefix(desired, "v"))
+
+	// invalid desired versions are reported by validateVersion
+	if currentErr != nil || desiredErr != nil {
+		return nil
+	}
+
+	switch {
+	case desiredVersion.Major != currentVersion.Major:
+		return fmt.Errorf("changing the major version from %s to %s is not supported", current, desired)
+	case desiredVersion.Minor < currentVersion.Minor:
+		return fmt.Errorf("downgrading from %s to %s is not supported, the control plane machines run %s", current, desired, current)
+	case desiredVersion.Minor > currentVersion.Minor+1:
+		return fmt.Errorf("upgrading from %s to %s skips minor versions, the control plane machines run %s", current, desired, current)
+	}
+
+	return nil
+}
+
+// validateInfrastructureTemplate checks the infrastructure template reference is complete.
+func validateInfrastructureTemplate(path *field.Path, ref corev1.ObjectReference, namespace string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if ref.APIVersion == "" {
+		allErrs = append(allErrs, field.Required(path.Child("apiVersion"), "must be set"))
+	}
+
+	if ref.Kind == "" {
+		allErrs = append(allErrs, field.Required(path.Child("kind"), "must be set"))
+	}
+
+	if ref.Name == "" {
+		allErrs = append(allErrs, field.Required(path.Child("name"), "must be set"))
+	}
+
+	if ref.Namespace != "" && ref.Namespace != namespace {
+		allErrs = append(allErrs, field.Invalid(path.Child("namespace"), ref.Namespace, "must be the namespace of the TalosControlPlane"))
+	}
+
+	return allErrs
+}
+
+// talosVersion matches the Talos versions accepted by the bootstrap provider, e.g. v0.14 or v0.14.1.
+var talosVersion = regexp.MustCompile(`^v\d+\.\d+(\.\d+)?$`)
+
+// validateTalosConfigSpec checks the machine config generation settings: the config is either generated
+// with the expected type, or provided as is with the "none" type.
+func validateTalosConfigSpec(path *field.Path, spec *cabptv1.TalosConfigSpec, generateType string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	switch spec.GenerateType {
+	case generateType:
+		if spec.Data != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("data"), fmt.Sprintf("is not allowed with %q generate type", generateType)))
+		}
+	case "none":
+		if spec.Data == "" {
+			allErrs = append(allErrs, field.Required(path.Child("data"), "is required with \"none\" generate type"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("generateType"), spec.GenerateType, []string{generateType, "none"}))
+	}
+
+	if spec.TalosVersion != "" && !talosVersion.MatchString(spec.TalosVersion) {
+		allErrs = append(allErrs, field.Invalid(path.Child("talosVersion"), spec.TalosVersion, "must be a Talos version, e.g. v0.14"))
+	}
+
+	return allErrs
+}
+
+// validateConfigPatches checks the config patches the same way as the CRD schema does,
+// and additionally checks the patch values, which the schema keeps free-form.
+func validateConfigPatches(path *field.Path, patches []cabptv1.ConfigPatches) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, patch := range patches {
+		patchPath := path.Index(i)
+
+		switch patch.Op {
+		case "add", "replace", "test":
+			if len(patch.Value.Raw) == 0 {
+				allErrs = append(allErrs, field.Required(patchPath.Child("value"), fmt.Sprintf("is required for %q operation", patch.Op)))
+			} else if !json.Valid(patch.Value.Raw) {
+				allErrs = append(allErrs, field.Invalid(patchPath.Child("value"), string(patch.Value.Raw), "is not a valid JSON value"))
+			}
+		case "remove":
+			if len(patch.Value.Raw) != 0 {
+				allErrs = append(allErrs, field.Forbidden(patchPath.Child("value"), "is not allowed for \"remove\" operation"))
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(patchPath.Child("op"), patch.Op, []string{"add", "remove", "replace", "test"}))
+		}
+
+		if !jsonPointer.MatchString(patch.Path) {
+			allErrs = append(allErrs, field.Invalid(patchPath.Child("path"), patch.Path, "must be a JSON pointer, e.g. /machine/network/hostname"))
+		}
+	}
+
+	return allErrs
+}
+
+// scaleValidator validates updates of the TalosControlPlane scale subresource.
+//
+// The scale object doesn't carry the spec, so the TalosControlPlane is read to check the replicas transition.
+type scaleValidator struct {
+	reader client.Reader
+}
+
+// Handle implements admission.Handler.
+func (v *scaleValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var scale autoscalingv1.Scale
+
+	if err := json.Unmarshal(req.Object.Raw, &scale); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	var tcp TalosControlPlane
+
+	if err := v.reader.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: req.Name}, &tcp); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if tcp.Spec.Replicas != nil && *tcp.Spec.Replicas == scale.Spec.Replicas {
+		return admission.Allowed("")
+	}
+
+	if err := validateReplicas(scale.Spec.Replicas); err != nil {
+		return admission.Denied(fmt.Sprintf("spec.replicas: %s", err))
+	}
+
+	if err := validateReplicasTransition(&tcp, &scale.Spec.Replicas); err != nil {
+		return admission.Denied(fmt.Sprintf("spec.replicas: %s", err))
+	}
+
+	if warning := replicasWarning(scale.Spec.Replicas); warning != "" {
+		return admission.Allowed("").WithWarnings("spec.replicas: " + warning)
+	}
+
+	return admission.Allowed("")
+}
+
+// admissionWarner returns the admission warnings for the valid but discouraged changes:
+// the requests using the deprecated API version and the even number of replicas.
+// It also counts the requests by the API version to plan the removal of the deprecated version.
+//
+// The webhook matches the equivalent requests of all versions, they are converted to v1alpha3,
+// so the version used by the client is read from the request kind.
+type admissionWarner struct{}
+
+// Handle implements admission.Handler.
+func (w *admissionWarner) Handle(ctx context.Context, req admission.Request) admission.Response {
+	version := req.Kind.Version
+	if req.RequestKind != nil {
+		version = req.RequestKind.Version
+	}
+
+	apiRequests.WithLabelValues(version, string(req.Operation)).Inc()
+
+	var warnings []string
+
+	if version == GroupVersion.Version {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s TalosControlPlane is deprecated, use %s/v1beta1 instead: existing objects are converted automatically, "+
+				"manifests should move spec.infrastructureTemplate to spec.machineTemplate.infrastructureRef",
+			GroupVersion, GroupVersion.Group))
+	}
+
+	var tcp, old TalosControlPlane
+
+	if err := json.Unmarshal(req.Object.Raw, &tcp); err != nil {
+		return admission.Allowed("").WithWarnings(warnings...)
+	}
+
+	if len(req.OldObject.Raw) > 0 {
+		json.Unmarshal(req.OldObject.Raw, &old) //nolint:errcheck
+	}
+
+	if replicas := tcp.Spec.Replicas; replicas != nil && (old.Spec.Replicas == nil || *old.Spec.Replicas != *replicas) {
+		if warning := replicasWarning(*replicas); warning != "" {
+			warnings = append(warnings, "spec.replicas: "+warning)
+		}
+	}
+
+	return admission.Allowed("").WithWarnings(warnings...)
+}
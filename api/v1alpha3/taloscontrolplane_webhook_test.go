@@ -0,0 +1,406 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1alpha3
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestDefault(t *testing.T) {
+	maxSurge := intstr.FromInt(1)
+	noSurge := intstr.FromInt(0)
+	created := metav1.NewTime(time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name     string
+		tcp      TalosControlPlane
+		expected TalosControlPlaneSpec
+	}{
+		{
+			name: "new object",
+			tcp: TalosControlPlane{
+				Spec: TalosControlPlaneSpec{
+					Version: "1.23.1",
+				},
+			},
+			expected: TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(1),
+				Version:  "v1.23.1",
+				ControlPlaneConfig: ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+				},
+				RolloutStrategy: &RolloutStrategy{
+					Type:          RollingUpdateStrategyType,
+					RollingUpdate: &RollingUpdate{MaxSurge: &maxSurge},
+				},
+			},
+		},
+		{
+			name: "new object with the rollout strategy",
+			tcp: TalosControlPlane{
+				Spec: TalosControlPlaneSpec{
+					Replicas: pointer.Int32Ptr(3),
+					Version:  "v1.23.1",
+					RolloutStrategy: &RolloutStrategy{
+						RollingUpdate: &RollingUpdate{MaxSurge: &noSurge},
+					},
+				},
+			},
+			expected: TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.23.1",
+				ControlPlaneConfig: ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+				},
+				RolloutStrategy: &RolloutStrategy{
+					Type:          RollingUpdateStrategyType,
+					RollingUpdate: &RollingUpdate{MaxSurge: &noSurge},
+				},
+			},
+		},
+		{
+			name: "new object with the OnDelete rollout strategy",
+			tcp: TalosControlPlane{
+				Spec: TalosControlPlaneSpec{
+					Replicas: pointer.Int32Ptr(3),
+					Version:  "v1.23.1",
+					RolloutStrategy: &RolloutStrategy{
+						Type: OnDeleteStrategyType,
+					},
+				},
+			},
+			expected: TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.23.1",
+				ControlPlaneConfig: ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+				},
+				RolloutStrategy: &RolloutStrategy{
+					Type: OnDeleteStrategyType,
+				},
+			},
+		},
+		{
+			name: "existing object without the rollout strategy",
+			tcp: TalosControlPlane{
+				ObjectMeta: metav1.ObjectMeta{
+					CreationTimestamp: created,
+				},
+				Spec: TalosControlPlaneSpec{
+					Replicas: pointer.Int32Ptr(3),
+					Version:  "v1.23.1",
+					ControlPlaneConfig: ControlPlaneConfig{
+						ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+					},
+				},
+			},
+			expected: TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.23.1",
+				ControlPlaneConfig: ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+				},
+			},
+		},
+		{
+			name: "existing object with the partial rollout strategy",
+			tcp: TalosControlPlane{
+				ObjectMeta: metav1.ObjectMeta{
+					CreationTimestamp: created,
+				},
+				Spec: TalosControlPlaneSpec{
+					Replicas: pointer.Int32Ptr(3),
+					Version:  "v1.23.1",
+					ControlPlaneConfig: ControlPlaneConfig{
+						ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+					},
+					RolloutStrategy: &RolloutStrategy{
+						Type: RollingUpdateStrategyType,
+					},
+				},
+			},
+			expected: TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.23.1",
+				ControlPlaneConfig: ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+				},
+				RolloutStrategy: &RolloutStrategy{
+					Type: RollingUpdateStrategyType,
+				},
+			},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := tt.tcp.DeepCopy()
+			tcp.Default()
+
+			assert.Equal(t, tt.expected, tcp.Spec)
+		})
+	}
+}
+
+func TestValidateEtcdConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		etcd     EtcdConfig
+		expected []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "fields",
+			etcd: EtcdConfig{
+				HeartbeatIntervalMilliseconds: pointer.Int32Ptr(100),
+				ElectionTimeoutMilliseconds:   pointer.Int32Ptr(500),
+			},
+		},
+		{
+			name: "election timeout below five heartbeats",
+			etcd: EtcdConfig{
+				HeartbeatIntervalMilliseconds: pointer.Int32Ptr(200),
+				ElectionTimeoutMilliseconds:   pointer.Int32Ptr(500),
+			},
+			expected: []string{"spec.etcd.electionTimeoutMilliseconds"},
+		},
+		{
+			name: "heartbeat interval above the default election timeout",
+			etcd: EtcdConfig{
+				ExtraArgs: map[string]string{"heartbeat-interval": "300"},
+			},
+			expected: []string{"spec.etcd.extraArgs[election-timeout]"},
+		},
+		{
+			name: "extra args",
+			etcd: EtcdConfig{
+				ExtraArgs: map[string]string{"heartbeat-interval": "300", "election-timeout": "1500"},
+			},
+		},
+		{
+			name: "invalid extra args",
+			etcd: EtcdConfig{
+				ExtraArgs: map[string]string{"heartbeat-interval": "fast", "election-timeout": "-1"},
+			},
+			expected: []string{"spec.etcd.extraArgs[heartbeat-interval]", "spec.etcd.extraArgs[election-timeout]"},
+		},
+		{
+			name: "fields take precedence over the extra args",
+			etcd: EtcdConfig{
+				HeartbeatIntervalMilliseconds: pointer.Int32Ptr(100),
+				ExtraArgs:                     map[string]string{"heartbeat-interval": "500"},
+			},
+		},
+		{
+			name: "extra args checked against the fields",
+			etcd: EtcdConfig{
+				HeartbeatIntervalMilliseconds: pointer.Int32Ptr(300),
+				ExtraArgs:                     map[string]string{"election-timeout": "1000"},
+			},
+			expected: []string{"spec.etcd.extraArgs[election-timeout]"},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+
+			for _, err := range validateEtcdConfig(field.NewPath("spec", "etcd"), &tt.etcd) {
+				fields = append(fields, err.Field)
+			}
+
+			assert.Equal(t, tt.expected, fields)
+		})
+	}
+}
+
+func TestValidateVersionSkew(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		current string
+		desired string
+		err     bool
+	}{
+		{
+			name:    "same version",
+			current: "v1.22.2",
+			desired: "v1.22.2",
+		},
+		{
+			name:    "patch upgrade",
+			current: "v1.22.2",
+			desired: "v1.22.5",
+		},
+		{
+			name:    "patch downgrade",
+			current: "v1.22.5",
+			desired: "v1.22.2",
+		},
+		{
+			name:    "minor upgrade",
+			current: "v1.22.5",
+			desired: "v1.23.1",
+		},
+		{
+			name:    "minor upgrade without the prefix",
+			current: "1.22.5",
+			desired: "1.23.1",
+		},
+		{
+			name:    "minor version skipped",
+			current: "v1.22.5",
+			desired: "v1.24.0",
+			err:     true,
+		},
+		{
+			name:    "minor downgrade",
+			current: "v1.23.1",
+			desired: "v1.22.5",
+			err:     true,
+		},
+		{
+			name:    "major upgrade",
+			current: "v1.23.1",
+			desired: "v2.0.0",
+			err:     true,
+		},
+		{
+			name:    "invalid current version",
+			current: "latest",
+			desired: "v1.23.1",
+		},
+		{
+			name:    "invalid desired version",
+			current: "v1.22.5",
+			desired: "v1.24",
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVersionSkew(tt.current, tt.desired)
+
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAdmissionWarner(t *testing.T) {
+	rawTCP := func(replicas int32) []byte {
+		data, err := json.Marshal(&TalosControlPlane{Spec: TalosControlPlaneSpec{Replicas: pointer.Int32Ptr(replicas)}})
+		require.NoError(t, err)
+
+		return data
+	}
+
+	// the requests of all versions are converted to v1alpha3 before they are sent to the webhook
+	kind := metav1.GroupVersionKind{Group: GroupVersion.Group, Version: GroupVersion.Version, Kind: "TalosControlPlane"}
+	v1beta1Kind := metav1.GroupVersionKind{Group: GroupVersion.Group, Version: "v1beta1", Kind: "TalosControlPlane"}
+
+	for _, tt := range []struct {
+		name        string
+		requestKind *metav1.GroupVersionKind
+		operation   admissionv1.Operation
+		object      []byte
+		oldObject   []byte
+		version     string
+		deprecated  bool
+		replicas    bool
+	}{
+		{
+			name:       "v1alpha3 create",
+			operation:  admissionv1.Create,
+			object:     rawTCP(3),
+			version:    "v1alpha3",
+			deprecated: true,
+		},
+		{
+			name:        "v1beta1 create",
+			requestKind: &v1beta1Kind,
+			operation:   admissionv1.Create,
+			object:      rawTCP(3),
+			version:     "v1beta1",
+		},
+		{
+			name:        "v1beta1 create with even replicas",
+			requestKind: &v1beta1Kind,
+			operation:   admissionv1.Create,
+			object:      rawTCP(2),
+			version:     "v1beta1",
+			replicas:    true,
+		},
+		{
+			name:        "v1beta1 update keeping even replicas",
+			requestKind: &v1beta1Kind,
+			operation:   admissionv1.Update,
+			object:      rawTCP(2),
+			oldObject:   rawTCP(2),
+			version:     "v1beta1",
+		},
+		{
+			name:       "v1alpha3 update to even replicas",
+			operation:  admissionv1.Update,
+			object:     rawTCP(4),
+			oldObject:  rawTCP(3),
+			version:    "v1alpha3",
+			deprecated: true,
+			replicas:   true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			counter := apiRequests.WithLabelValues(tt.version, string(tt.operation))
+			before := testutil.ToFloat64(counter)
+
+			resp := (&admissionWarner{}).Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Kind:        kind,
+					RequestKind: tt.requestKind,
+					Operation:   tt.operation,
+					Object:      runtime.RawExtension{Raw: tt.object},
+					OldObject:   runtime.RawExtension{Raw: tt.oldObject},
+				},
+			})
+
+			assert.True(t, resp.Allowed)
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+			var deprecated, replicas int
+
+			for _, warning := range resp.Warnings {
+				if warning == "spec.replicas: "+replicasWarning(2) {
+					replicas++
+				} else if assert.Contains(t, warning, "is deprecated") {
+					deprecated++
+				}
+			}
+
+			assert.Equal(t, tt.deprecated, deprecated == 1)
+			assert.Equal(t, tt.replicas, replicas == 1)
+		})
+	}
+}
@@ -10,15 +10,135 @@
 package v1alpha3
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AdmissionConfig) DeepCopyInto(out *AdmissionConfig) {
+	*out = *in
+	if in.EnablePlugins != nil {
+		in, out := &in.EnablePlugins, &out.EnablePlugins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DisablePlugins != nil {
+		in, out := &in.DisablePlugins, &out.DisablePlugins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PodSecurity != nil {
+		in, out := &in.PodSecurity, &out.PodSecurity
+		*out = new(PodSecurityDefaults)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AdmissionConfig.
+func (in *AdmissionConfig) DeepCopy() *AdmissionConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AdmissionConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BootstrapConfigReference) DeepCopyInto(out *BootstrapConfigReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BootstrapConfigReference.
+func (in *BootstrapConfigReference) DeepCopy() *BootstrapConfigReference {
+	if in == nil {
+		return nil
+	}
+	out := new(BootstrapConfigReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CARotationStatus) DeepCopyInto(out *CARotationStatus) {
+	*out = *in
+	if in.Authorities != nil {
+		in, out := &in.Authorities, &out.Authorities
+		*out = make([]CertificateAuthority, len(*in))
+		copy(*out, *in)
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.UpdatedMachines != nil {
+		in, out := &in.UpdatedMachines, &out.UpdatedMachines
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AppliedTime != nil {
+		in, out := &in.AppliedTime, &out.AppliedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PublishedTime != nil {
+		in, out := &in.PublishedTime, &out.PublishedTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CARotationStatus.
+func (in *CARotationStatus) DeepCopy() *CARotationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CARotationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ComponentVersions) DeepCopyInto(out *ComponentVersions) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ComponentVersions.
+func (in *ComponentVersions) DeepCopy() *ComponentVersions {
+	if in == nil {
+		return nil
+	}
+	out := new(ComponentVersions)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ControlPlaneConfig) DeepCopyInto(out *ControlPlaneConfig) {
 	*out = *in
 	in.InitConfig.DeepCopyInto(&out.InitConfig)
 	in.ControlPlaneConfig.DeepCopyInto(&out.ControlPlaneConfig)
+	if in.TalosConfigSecretRef != nil {
+		in, out := &in.TalosConfigSecretRef, &out.TalosConfigSecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.APIServerCASecretRef != nil {
+		in, out := &in.APIServerCASecretRef, &out.APIServerCASecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.ExtraManifests != nil {
+		in, out := &in.ExtraManifests, &out.ExtraManifests
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.InlineManifests != nil {
+		in, out := &in.InlineManifests, &out.InlineManifests
+		*out = make([]InlineManifest, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ControlPlaneConfig.
@@ -31,6 +151,525 @@ func (in *ControlPlaneConfig) DeepCopy() *ControlPlaneConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdBackup) DeepCopyInto(out *EtcdBackup) {
+	*out = *in
+	out.Interval = in.Interval
+	out.S3 = in.S3
+	if in.MaxAge != nil {
+		in, out := &in.MaxAge, &out.MaxAge
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Verification != nil {
+		in, out := &in.Verification, &out.Verification
+		*out = new(EtcdBackupVerification)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdBackup.
+func (in *EtcdBackup) DeepCopy() *EtcdBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdBackupS3) DeepCopyInto(out *EtcdBackupS3) {
+	*out = *in
+	out.CredentialsSecretRef = in.CredentialsSecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdBackupS3.
+func (in *EtcdBackupS3) DeepCopy() *EtcdBackupS3 {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdBackupS3)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdBackupStatus) DeepCopyInto(out *EtcdBackupStatus) {
+	*out = *in
+	if in.LastAttemptTime != nil {
+		in, out := &in.LastAttemptTime, &out.LastAttemptTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessTime != nil {
+		in, out := &in.LastSuccessTime, &out.LastSuccessTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Verification != nil {
+		in, out := &in.Verification, &out.Verification
+		*out = new(EtcdBackupVerificationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdBackupStatus.
+func (in *EtcdBackupStatus) DeepCopy() *EtcdBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdBackupVerification) DeepCopyInto(out *EtcdBackupVerification) {
+	*out = *in
+	out.Interval = in.Interval
+	out.InfrastructureTemplate = in.InfrastructureTemplate
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdBackupVerification.
+func (in *EtcdBackupVerification) DeepCopy() *EtcdBackupVerification {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdBackupVerification)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdBackupVerificationStatus) DeepCopyInto(out *EtcdBackupVerificationStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastCompletionTime != nil {
+		in, out := &in.LastCompletionTime, &out.LastCompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdBackupVerificationStatus.
+func (in *EtcdBackupVerificationStatus) DeepCopy() *EtcdBackupVerificationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdBackupVerificationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdConfig) DeepCopyInto(out *EtcdConfig) {
+	*out = *in
+	if in.QuotaBackendBytes != nil {
+		in, out := &in.QuotaBackendBytes, &out.QuotaBackendBytes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.HeartbeatIntervalMilliseconds != nil {
+		in, out := &in.HeartbeatIntervalMilliseconds, &out.HeartbeatIntervalMilliseconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ElectionTimeoutMilliseconds != nil {
+		in, out := &in.ElectionTimeoutMilliseconds, &out.ElectionTimeoutMilliseconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SnapshotCount != nil {
+		in, out := &in.SnapshotCount, &out.SnapshotCount
+		*out = new(int64)
+		**out = **in
+	}
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdConfig.
+func (in *EtcdConfig) DeepCopy() *EtcdConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageOverrides) DeepCopyInto(out *ImageOverrides) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageOverrides.
+func (in *ImageOverrides) DeepCopy() *ImageOverrides {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageOverrides)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InlineManifest) DeepCopyInto(out *InlineManifest) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InlineManifest.
+func (in *InlineManifest) DeepCopy() *InlineManifest {
+	if in == nil {
+		return nil
+	}
+	out := new(InlineManifest)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstallConfig) DeepCopyInto(out *InstallConfig) {
+	*out = *in
+	if in.ExtraKernelArgs != nil {
+		in, out := &in.ExtraKernelArgs, &out.ExtraKernelArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Extensions != nil {
+		in, out := &in.Extensions, &out.Extensions
+		*out = make([]InstallExtension, len(*in))
+		copy(*out, *in)
+	}
+	if in.ImageDigests != nil {
+		in, out := &in.ImageDigests, &out.ImageDigests
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstallConfig.
+func (in *InstallConfig) DeepCopy() *InstallConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(InstallConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstallExtension) DeepCopyInto(out *InstallExtension) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstallExtension.
+func (in *InstallExtension) DeepCopy() *InstallExtension {
+	if in == nil {
+		return nil
+	}
+	out := new(InstallExtension)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KubeadmMigrationStatus) DeepCopyInto(out *KubeadmMigrationStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KubeadmMigrationStatus.
+func (in *KubeadmMigrationStatus) DeepCopy() *KubeadmMigrationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(KubeadmMigrationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MachineStatus) DeepCopyInto(out *MachineStatus) {
+	*out = *in
+	if in.LastTalosAPIContactTime != nil {
+		in, out := &in.LastTalosAPIContactTime, &out.LastTalosAPIContactTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastNodeContactTime != nil {
+		in, out := &in.LastNodeContactTime, &out.LastNodeContactTime
+		*out = (*in).DeepCopy()
+	}
+	if in.BootstrapConfig != nil {
+		in, out := &in.BootstrapConfig, &out.BootstrapConfig
+		*out = new(BootstrapConfigReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MachineStatus.
+func (in *MachineStatus) DeepCopy() *MachineStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MachineStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperationTimeouts) DeepCopyInto(out *OperationTimeouts) {
+	*out = *in
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ScaleUp != nil {
+		in, out := &in.ScaleUp, &out.ScaleUp
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperationTimeouts.
+func (in *OperationTimeouts) DeepCopy() *OperationTimeouts {
+	if in == nil {
+		return nil
+	}
+	out := new(OperationTimeouts)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingChange) DeepCopyInto(out *PendingChange) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingChange.
+func (in *PendingChange) DeepCopy() *PendingChange {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingChange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodSecurityDefaults) DeepCopyInto(out *PodSecurityDefaults) {
+	*out = *in
+	if in.ExemptNamespaces != nil {
+		in, out := &in.ExemptNamespaces, &out.ExemptNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodSecurityDefaults.
+func (in *PodSecurityDefaults) DeepCopy() *PodSecurityDefaults {
+	if in == nil {
+		return nil
+	}
+	out := new(PodSecurityDefaults)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreDrainHook) DeepCopyInto(out *PreDrainHook) {
+	*out = *in
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreDrainHook.
+func (in *PreDrainHook) DeepCopy() *PreDrainHook {
+	if in == nil {
+		return nil
+	}
+	out := new(PreDrainHook)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReconcileHint) DeepCopyInto(out *ReconcileHint) {
+	*out = *in
+	if in.After != nil {
+		in, out := &in.After, &out.After
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReconcileHint.
+func (in *ReconcileHint) DeepCopy() *ReconcileHint {
+	if in == nil {
+		return nil
+	}
+	out := new(ReconcileHint)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemediationStrategy) DeepCopyInto(out *RemediationStrategy) {
+	*out = *in
+	if in.MaxRetry != nil {
+		in, out := &in.MaxRetry, &out.MaxRetry
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RetryPeriodSeconds != nil {
+		in, out := &in.RetryPeriodSeconds, &out.RetryPeriodSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MinHealthyPeriodSeconds != nil {
+		in, out := &in.MinHealthyPeriodSeconds, &out.MinHealthyPeriodSeconds
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemediationStrategy.
+func (in *RemediationStrategy) DeepCopy() *RemediationStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RemediationStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResourcePressureThresholds) DeepCopyInto(out *ResourcePressureThresholds) {
+	*out = *in
+	if in.EtcdDiskUsagePercent != nil {
+		in, out := &in.EtcdDiskUsagePercent, &out.EtcdDiskUsagePercent
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MemoryUsagePercent != nil {
+		in, out := &in.MemoryUsagePercent, &out.MemoryUsagePercent
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResourcePressureThresholds.
+func (in *ResourcePressureThresholds) DeepCopy() *ResourcePressureThresholds {
+	if in == nil {
+		return nil
+	}
+	out := new(ResourcePressureThresholds)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RollingUpdate) DeepCopyInto(out *RollingUpdate) {
+	*out = *in
+	if in.MaxSurge != nil {
+		in, out := &in.MaxSurge, &out.MaxSurge
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RollingUpdate.
+func (in *RollingUpdate) DeepCopy() *RollingUpdate {
+	if in == nil {
+		return nil
+	}
+	out := new(RollingUpdate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutBefore) DeepCopyInto(out *RolloutBefore) {
+	*out = *in
+	if in.CertificatesExpiryDays != nil {
+		in, out := &in.CertificatesExpiryDays, &out.CertificatesExpiryDays
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutBefore.
+func (in *RolloutBefore) DeepCopy() *RolloutBefore {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutBefore)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStatus) DeepCopyInto(out *RolloutStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStatus.
+func (in *RolloutStatus) DeepCopy() *RolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStrategy) DeepCopyInto(out *RolloutStrategy) {
+	*out = *in
+	if in.RollingUpdate != nil {
+		in, out := &in.RollingUpdate, &out.RollingUpdate
+		*out = new(RollingUpdate)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStrategy.
+func (in *RolloutStrategy) DeepCopy() *RolloutStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TalosControlPlane) DeepCopyInto(out *TalosControlPlane) {
 	*out = *in
@@ -90,6 +729,34 @@ func (in *TalosControlPlaneList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TalosControlPlaneMachineTemplate) DeepCopyInto(out *TalosControlPlaneMachineTemplate) {
+	*out = *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.FailureDomainMetadata != nil {
+		in, out := &in.FailureDomainMetadata, &out.FailureDomainMetadata
+		*out = make(map[string]v1beta1.ObjectMeta, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.NodeDrainTimeout != nil {
+		in, out := &in.NodeDrainTimeout, &out.NodeDrainTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TalosControlPlaneMachineTemplate.
+func (in *TalosControlPlaneMachineTemplate) DeepCopy() *TalosControlPlaneMachineTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(TalosControlPlaneMachineTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TalosControlPlaneSpec) DeepCopyInto(out *TalosControlPlaneSpec) {
 	*out = *in
@@ -100,6 +767,86 @@ func (in *TalosControlPlaneSpec) DeepCopyInto(out *TalosControlPlaneSpec) {
 	}
 	out.InfrastructureTemplate = in.InfrastructureTemplate
 	in.ControlPlaneConfig.DeepCopyInto(&out.ControlPlaneConfig)
+	in.MachineTemplate.DeepCopyInto(&out.MachineTemplate)
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = new(ImageOverrides)
+		**out = **in
+	}
+	if in.ComponentVersions != nil {
+		in, out := &in.ComponentVersions, &out.ComponentVersions
+		*out = new(ComponentVersions)
+		**out = **in
+	}
+	if in.Etcd != nil {
+		in, out := &in.Etcd, &out.Etcd
+		*out = new(EtcdConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ResourcePressureThresholds != nil {
+		in, out := &in.ResourcePressureThresholds, &out.ResourcePressureThresholds
+		*out = new(ResourcePressureThresholds)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Admission != nil {
+		in, out := &in.Admission, &out.Admission
+		*out = new(AdmissionConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PreDrainHook != nil {
+		in, out := &in.PreDrainHook, &out.PreDrainHook
+		*out = new(PreDrainHook)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RolloutStrategy != nil {
+		in, out := &in.RolloutStrategy, &out.RolloutStrategy
+		*out = new(RolloutStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RolloutAfter != nil {
+		in, out := &in.RolloutAfter, &out.RolloutAfter
+		*out = (*in).DeepCopy()
+	}
+	if in.RolloutBefore != nil {
+		in, out := &in.RolloutBefore, &out.RolloutBefore
+		*out = new(RolloutBefore)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RemediationStrategy != nil {
+		in, out := &in.RemediationStrategy, &out.RemediationStrategy
+		*out = new(RemediationStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RemediationTemplate != nil {
+		in, out := &in.RemediationTemplate, &out.RemediationTemplate
+		*out = new(corev1.ObjectReference)
+		**out = **in
+	}
+	if in.Install != nil {
+		in, out := &in.Install, &out.Install
+		*out = new(InstallConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RequireApproval != nil {
+		in, out := &in.RequireApproval, &out.RequireApproval
+		*out = make([]ChangeStrategy, len(*in))
+		copy(*out, *in)
+	}
+	if in.EtcdBackup != nil {
+		in, out := &in.EtcdBackup, &out.EtcdBackup
+		*out = new(EtcdBackup)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AddressSources != nil {
+		in, out := &in.AddressSources, &out.AddressSources
+		*out = make([]AddressSourceName, len(*in))
+		copy(*out, *in)
+	}
+	if in.OperationTimeouts != nil {
+		in, out := &in.OperationTimeouts, &out.OperationTimeouts
+		*out = new(OperationTimeouts)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TalosControlPlaneSpec.
@@ -125,6 +872,56 @@ func (in *TalosControlPlaneStatus) DeepCopyInto(out *TalosControlPlaneStatus) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.NextReconcileHint != nil {
+		in, out := &in.NextReconcileHint, &out.NextReconcileHint
+		*out = new(ReconcileHint)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(RolloutStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ScaleUpStartTime != nil {
+		in, out := &in.ScaleUpStartTime, &out.ScaleUpStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PendingChanges != nil {
+		in, out := &in.PendingChanges, &out.PendingChanges
+		*out = make([]PendingChange, len(*in))
+		copy(*out, *in)
+	}
+	if in.EtcdBackup != nil {
+		in, out := &in.EtcdBackup, &out.EtcdBackup
+		*out = new(EtcdBackupStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MachineStatuses != nil {
+		in, out := &in.MachineStatuses, &out.MachineStatuses
+		*out = make([]MachineStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.KubeconfigExpiryTime != nil {
+		in, out := &in.KubeconfigExpiryTime, &out.KubeconfigExpiryTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CARotation != nil {
+		in, out := &in.CARotation, &out.CARotation
+		*out = new(CARotationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.KubeadmMigration != nil {
+		in, out := &in.KubeadmMigration, &out.KubeadmMigration
+		*out = new(KubeadmMigrationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TalosConfigSecretRef != nil {
+		in, out := &in.TalosConfigSecretRef, &out.TalosConfigSecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make(v1beta1.Conditions, len(*in))
@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// ConvertTo converts this TalosControlPlane to the Hub version (v1alpha3).
+func (src *TalosControlPlane) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha3.TalosControlPlane)
+
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = v1alpha3.TalosControlPlaneSpec{
+		Replicas:               src.Spec.Replicas,
+		Version:                src.Spec.Version,
+		InfrastructureTemplate: src.Spec.MachineTemplate.InfrastructureRef,
+		ControlPlaneConfig:     src.Spec.ControlPlaneConfig,
+		MachineTemplate: v1alpha3.TalosControlPlaneMachineTemplate{
+			ObjectMeta:            src.Spec.MachineTemplate.ObjectMeta,
+			FailureDomainMetadata: src.Spec.MachineTemplate.FailureDomainMetadata,
+			NodeDrainTimeout:      src.Spec.MachineTemplate.NodeDrainTimeout,
+		},
+		Images:                            src.Spec.Images,
+		ComponentVersions:                 src.Spec.ComponentVersions,
+		Etcd:                              src.Spec.Etcd,
+		ResourcePressureThresholds:        src.Spec.ResourcePressureThresholds,
+		Admission:                         src.Spec.Admission,
+		ApproveKubeletServingCertificates: src.Spec.ApproveKubeletServingCertificates,
+		MaintenanceModePolicy:             src.Spec.MaintenanceModePolicy,
+		PreDrainHook:                      src.Spec.PreDrainHook,
+		GeneratedSecretsPolicy:            src.Spec.GeneratedSecretsPolicy,
+		ChangeOrdering:                    src.Spec.ChangeOrdering,
+		RolloutStrategy:                   src.Spec.RolloutStrategy,
+		RolloutAfter:                      src.Spec.RolloutAfter,
+		RolloutBefore:                     src.Spec.RolloutBefore,
+		RemediationStrategy:               src.Spec.RemediationStrategy,
+		RemediationTemplate:               src.Spec.RemediationTemplate,
+		Install:                           src.Spec.Install,
+		RequireApproval:                   src.Spec.RequireApproval,
+		AddressSources:                    src.Spec.AddressSources,
+		OperationTimeouts:                 src.Spec.OperationTimeouts,
+	}
+
+	if backup := src.Spec.EtcdBackup; backup != nil {
+		dst.Spec.EtcdBackup = &v1alpha3.EtcdBackup{
+			Interval:            backup.Interval,
+			S3:                  backup.S3,
+			MaxAge:              backup.MaxAge,
+			StaleDeletionPolicy: backup.StaleDeletionPolicy,
+		}
+
+		if verification := backup.Verification; verification != nil {
+			dst.Spec.EtcdBackup.Verification = &v1alpha3.EtcdBackupVerification{
+				Interval:               verification.Interval,
+				InfrastructureTemplate: verification.InfrastructureRef,
+				Timeout:                verification.Timeout,
+			}
+		}
+	}
+
+	dst.Status = src.Status
+
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha3) to this version.
+func (dst *TalosControlPlane) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha3.TalosControlPlane)
+
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = TalosControlPlaneSpec{
+		Replicas: src.Spec.Replicas,
+		Version:  src.Spec.Version,
+		MachineTemplate: TalosControlPlaneMachineTemplate{
+			ObjectMeta:            src.Spec.MachineTemplate.ObjectMeta,
+			InfrastructureRef:     src.Spec.InfrastructureTemplate,
+			FailureDomainMetadata: src.Spec.MachineTemplate.FailureDomainMetadata,
+			NodeDrainTimeout:      src.Spec.MachineTemplate.NodeDrainTimeout,
+		},
+		ControlPlaneConfig:                src.Spec.ControlPlaneConfig,
+		Images:                            src.Spec.Images,
+		ComponentVersions:                 src.Spec.ComponentVersions,
+		Etcd:                              src.Spec.Etcd,
+		ResourcePressureThresholds:        src.Spec.ResourcePressureThresholds,
+		Admission:                         src.Spec.Admission,
+		ApproveKubeletServingCertificates: src.Spec.ApproveKubeletServingCertificates,
+		MaintenanceModePolicy:             src.Spec.MaintenanceModePolicy,
+		PreDrainHook:                      src.Spec.PreDrainHook,
+		GeneratedSecretsPolicy:            src.Spec.GeneratedSecretsPolicy,
+		ChangeOrdering:                    src.Spec.ChangeOrdering,
+		RolloutStrategy:                   src.Spec.RolloutStrategy,
+		RolloutAfter:                      src.Spec.RolloutAfter,
+		RolloutBefore:                     src.Spec.RolloutBefore,
+		RemediationStrategy:               src.Spec.RemediationStrategy,
+		RemediationTemplate:               src.Spec.RemediationTemplate,
+		Install:                           src.Spec.Install,
+		RequireApproval:                   src.Spec.RequireApproval,
+		AddressSources:                    src.Spec.AddressSources,
+		OperationTimeouts:                 src.Spec.OperationTimeouts,
+	}
+
+	if backup := src.Spec.EtcdBackup; backup != nil {
+		dst.Spec.EtcdBackup = &EtcdBackup{
+			Interval:            backup.Interval,
+			S3:                  backup.S3,
+			MaxAge:              backup.MaxAge,
+			StaleDeletionPolicy: backup.StaleDeletionPolicy,
+		}
+
+		if verification := backup.Verification; verification != nil {
+			dst.Spec.EtcdBackup.Verification = &EtcdBackupVerification{
+				Interval:          verification.Interval,
+				InfrastructureRef: verification.InfrastructureTemplate,
+				Timeout:           verification.Timeout,
+			}
+		}
+	}
+
+	dst.Status = src.Status
+
+	return nil
+}
+
+// ConvertTo converts this TalosControlPlaneList to the Hub version (v1alpha3).
+func (src *TalosControlPlaneList) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha3.TalosControlPlaneList)
+
+	dst.ListMeta = src.ListMeta
+	dst.Items = make([]v1alpha3.TalosControlPlane, len(src.Items))
+
+	for i := range src.Items {
+		if err := src.Items[i].ConvertTo(&dst.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha3) to this version.
+func (dst *TalosControlPlaneList) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha3.TalosControlPlaneList)
+
+	dst.ListMeta = src.ListMeta
+	dst.Items = make([]TalosControlPlane, len(src.Items))
+
+	for i := range src.Items {
+		if err := dst.Items[i].ConvertFrom(&src.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	"testing"
+)
+
+const roundTripIterations = 1000
+
+// TestFuzzRoundTrip checks the TalosControlPlane (including the config patches) survives the encoding
+// in every version and the conversion between the hub and the spoke unchanged.
+func TestFuzzRoundTrip(t *testing.T) {
+	if err := FuzzRoundTrip(DefaultRoundTripSeed, roundTripIterations); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,196 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	fuzz "github.com/google/gofuzz"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/apitesting/fuzzer"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metafuzzer "k8s.io/apimachinery/pkg/apis/meta/fuzzer"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// DefaultRoundTripSeed is the fuzzer seed which makes FuzzRoundTrip runs reproducible.
+const DefaultRoundTripSeed int64 = 1
+
+// FuzzerFuncs returns the fuzzer functions which keep the fuzzed TalosControlPlane objects serializable,
+// e.g. config patch values are generated as valid JSON documents instead of random bytes.
+func FuzzerFuncs(_ runtimeserializer.CodecFactory) []interface{} {
+	return []interface{}{
+		func(j *apiextensionsv1.JSON, c fuzz.Continue) {
+			var value interface{}
+
+			switch c.Intn(3) {
+			case 0:
+				value = c.RandString()
+			case 1:
+				value = c.Int63()
+			default:
+				value = map[string]interface{}{
+					c.RandString(): c.RandString(),
+				}
+			}
+
+			j.Raw, _ = json.Marshal(value) //nolint:errcheck
+		},
+	}
+}
+
+// NewRoundTripScheme returns the scheme with all the served TalosControlPlane API versions.
+func NewRoundTripScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+
+	if err := v1alpha3.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	if err := AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return scheme, nil
+}
+
+// NewFuzzer returns the fuzzer generating TalosControlPlane objects deterministically from the seed.
+//
+// Additional fuzzer functions might be passed to constrain the fields extended by the downstream forks.
+func NewFuzzer(scheme *runtime.Scheme, seed int64, funcs ...fuzzer.FuzzerFuncs) *fuzz.Fuzzer {
+	funcs = append([]fuzzer.FuzzerFuncs{metafuzzer.Funcs, FuzzerFuncs}, funcs...)
+
+	return fuzzer.FuzzerFor(fuzzer.MergeFuzzerFuncs(funcs...), rand.NewSource(seed), runtimeserializer.NewCodecFactory(scheme))
+}
+
+// VerifySerializationRoundTrip checks the object (including the config patches) survives the encoding
+// with the API scheme serializer in the given version unchanged.
+func VerifySerializationRoundTrip(scheme *runtime.Scheme, version schema.GroupVersion, obj runtime.Object) error {
+	gvks, _, err := scheme.ObjectKinds(obj)
+	if err != nil {
+		return err
+	}
+
+	codecs := runtimeserializer.NewCodecFactory(scheme)
+
+	data, err := runtime.Encode(codecs.LegacyCodec(version), obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %w", err)
+	}
+
+	decoded := obj.DeepCopyObject()
+
+	if err = runtime.DecodeInto(codecs.UniversalDecoder(version), data, decoded); err != nil {
+		return fmt.Errorf("failed to decode: %w", err)
+	}
+
+	// the serializer fills in the type information
+	expected := obj.DeepCopyObject()
+	expected.GetObjectKind().SetGroupVersionKind(version.WithKind(gvks[0].Kind))
+
+	if !apiequality.Semantic.DeepEqual(expected, decoded) {
+		return fmt.Errorf("object changed after the round trip: %s", diff.ObjectReflectDiff(expected, decoded))
+	}
+
+	return nil
+}
+
+// VerifyHubRoundTrip checks the hub TalosControlPlane survives the conversion to v1beta1 and back unchanged.
+func VerifyHubRoundTrip(hub *v1alpha3.TalosControlPlane) error {
+	spoke := &TalosControlPlane{}
+
+	if err := spoke.ConvertFrom(hub); err != nil {
+		return err
+	}
+
+	converted := &v1alpha3.TalosControlPlane{}
+
+	if err := spoke.ConvertTo(converted); err != nil {
+		return err
+	}
+
+	if !apiequality.Semantic.DeepEqual(hub, converted) {
+		return fmt.Errorf("object changed after the round trip: %s", diff.ObjectReflectDiff(hub, converted))
+	}
+
+	return nil
+}
+
+// VerifySpokeRoundTrip checks the v1beta1 TalosControlPlane survives the conversion to the hub and back unchanged.
+func VerifySpokeRoundTrip(spoke *TalosControlPlane) error {
+	hub := &v1alpha3.TalosControlPlane{}
+
+	if err := spoke.ConvertTo(hub); err != nil {
+		return err
+	}
+
+	converted := &TalosControlPlane{}
+
+	if err := converted.ConvertFrom(hub); err != nil {
+		return err
+	}
+
+	if !apiequality.Semantic.DeepEqual(spoke, converted) {
+		return fmt.Errorf("object changed after the round trip: %s", diff.ObjectReflectDiff(spoke, converted))
+	}
+
+	return nil
+}
+
+// FuzzRoundTrip verifies the given number of fuzzed TalosControlPlane objects survive the serialization
+// in every API version and the conversion between the hub and v1beta1 in both directions.
+func FuzzRoundTrip(seed int64, iterations int, funcs ...fuzzer.FuzzerFuncs) error {
+	scheme, err := NewRoundTripScheme()
+	if err != nil {
+		return err
+	}
+
+	for _, check := range []struct {
+		name   string
+		verify func(f *fuzz.Fuzzer) error
+	}{
+		{v1alpha3.GroupVersion.String(), func(f *fuzz.Fuzzer) error {
+			obj := &v1alpha3.TalosControlPlane{}
+			f.Fuzz(obj)
+
+			return VerifySerializationRoundTrip(scheme, v1alpha3.GroupVersion, obj)
+		}},
+		{GroupVersion.String(), func(f *fuzz.Fuzzer) error {
+			obj := &TalosControlPlane{}
+			f.Fuzz(obj)
+
+			return VerifySerializationRoundTrip(scheme, GroupVersion, obj)
+		}},
+		{"hub-spoke-hub", func(f *fuzz.Fuzzer) error {
+			obj := &v1alpha3.TalosControlPlane{}
+			f.Fuzz(obj)
+
+			return VerifyHubRoundTrip(obj)
+		}},
+		{"spoke-hub-spoke", func(f *fuzz.Fuzzer) error {
+			obj := &TalosControlPlane{}
+			f.Fuzz(obj)
+
+			return VerifySpokeRoundTrip(obj)
+		}},
+	} {
+		f := NewFuzzer(scheme, seed, funcs...)
+
+		for i := 0; i < iterations; i++ {
+			if err := check.verify(f); err != nil {
+				return fmt.Errorf("%s iteration %d (seed %d): %w", check.name, i, seed, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// TalosControlPlaneMachineTemplate defines the template of the control plane machines.
+type TalosControlPlaneMachineTemplate struct {
+	// Standard object's metadata.
+	// Labels and annotations are propagated to the control plane Machines and infrastructure machines,
+	// changes are applied to the existing machines without a rollout.
+	// +optional
+	ObjectMeta clusterv1.ObjectMeta `json:"metadata,omitempty"`
+
+	// InfrastructureRef is a required reference to a custom resource
+	// offered by an infrastructure provider.
+	InfrastructureRef corev1.ObjectReference `json:"infrastructureRef"`
+
+	// FailureDomainMetadata defines additional labels and annotations per failure domain name.
+	// They are merged over ObjectMeta for the machines placed into that failure domain.
+	// +optional
+	FailureDomainMetadata map[string]clusterv1.ObjectMeta `json:"failureDomainMetadata,omitempty"`
+
+	// NodeDrainTimeout is the total amount of time that the controller will spend on draining a control plane node.
+	// The default value is 0, meaning that the node can be drained without any time limitations.
+	// NOTE: NodeDrainTimeout is different from `kubectl drain --timeout`.
+	// Changes are applied to the existing machines without a rollout.
+	// +optional
+	NodeDrainTimeout *metav1.Duration `json:"nodeDrainTimeout,omitempty"`
+}
+
+// EtcdBackup defines the scheduled etcd backups.
+type EtcdBackup struct {
+	// Interval between the backups, at least one minute.
+	Interval metav1.Duration `json:"interval"`
+
+	// S3 is the S3-compatible storage (AWS S3, MinIO, GCS with HMAC keys) the backups are uploaded to.
+	S3 v1alpha3.EtcdBackupS3 `json:"s3"`
+
+	// MaxAge is the age of the last successful backup after which the backups are reported as stale,
+	// at least the interval. Backups are not checked for staleness if empty.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// StaleDeletionPolicy defines how the deletion of the TalosControlPlane is handled while the backups are stale.
+	// Defaults to Warn.
+	// +optional
+	StaleDeletionPolicy v1alpha3.StaleBackupDeletionPolicy `json:"staleDeletionPolicy,omitempty"`
+
+	// Verification periodically restores the last backup on a temporary single-node machine
+	// to check that the backup is restorable. Backups are not verified if empty.
+	// +optional
+	Verification *EtcdBackupVerification `json:"verification,omitempty"`
+}
+
+// EtcdBackupVerification defines the restore verification of the etcd backups.
+//
+// The temporary machine is created with a standalone Talos configuration, so it doesn't join the cluster,
+// but the restored Kubernetes control plane runs on it until the verification completes:
+// the infrastructure template should place the machine into an isolated network.
+type EtcdBackupVerification struct {
+	// Interval between the verifications, at least one hour. A backup is verified only once.
+	Interval metav1.Duration `json:"interval"`
+
+	// InfrastructureRef is the template of the temporary machine the backup is restored on.
+	InfrastructureRef corev1.ObjectReference `json:"infrastructureRef"`
+
+	// Timeout of a single verification, including the provisioning of the machine. Defaults to 30 minutes.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// TalosControlPlaneSpec defines the desired state of TalosControlPlane.
+//
+// Compared to v1alpha3, the infrastructure templates are referenced as "infrastructureRef"
+// following the Cluster API conventions, the control plane machine one is moved into the machine template.
+type TalosControlPlaneSpec struct {
+	// Number of desired machines. Defaults to 1. When stacked etcd is used only
+	// odd numbers are permitted, as per [etcd best practice](https://etcd.io/docs/v3.3.12/faq/#why-an-odd-number-of-cluster-members).
+	// This is a pointer to distinguish between explicit zero and not specified.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Version defines the desired Kubernetes version.
+	// +kubebuilder:validation:MinLength:=2
+	// +kubebuilder:validation:Pattern:=^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)([-0-9a-zA-Z_\.+]*)?$
+	Version string `json:"version"`
+
+	// MachineTemplate contains the infrastructure template and the metadata of the control plane machines.
+	MachineTemplate TalosControlPlaneMachineTemplate `json:"machineTemplate"`
+
+	// ControlPlaneConfig is a two TalosConfigSpecs
+	// to use for initializing and joining machines to the control plane.
+	ControlPlaneConfig v1alpha3.ControlPlaneConfig `json:"controlPlaneConfig"`
+
+	// Images overrides image references rendered into the machine configs
+	// of the control plane machines.
+	// Images the control plane nodes fail to pull are reported with the ImagesResolved condition,
+	// the installer image is not checked as it is pulled only on install and upgrade.
+	// +optional
+	Images *v1alpha3.ImageOverrides `json:"images,omitempty"`
+
+	// ComponentVersions pins control plane components to other Kubernetes versions.
+	// Image overrides take precedence over the pinned versions.
+	// +optional
+	ComponentVersions *v1alpha3.ComponentVersions `json:"componentVersions,omitempty"`
+
+	// Etcd defines etcd tuning parameters for the control plane machines.
+	// Changes are applied by rebooting the machines one at a time, arguments removed from the spec
+	// are left on the machines until they are replaced.
+	// +optional
+	Etcd *v1alpha3.EtcdConfig `json:"etcd,omitempty"`
+
+	// ResourcePressureThresholds configures when node resource usage is reported
+	// as unhealthy control plane components.
+	// +optional
+	ResourcePressureThresholds *v1alpha3.ResourcePressureThresholds `json:"resourcePressureThresholds,omitempty"`
+
+	// Admission defines kube-apiserver admission plugins and Pod Security Admission defaults.
+	// Changes are only applied to machines created after the change.
+	// +optional
+	Admission *v1alpha3.AdmissionConfig `json:"admission,omitempty"`
+
+	// ApproveKubeletServingCertificates enables automatic approval of pending kubelet serving
+	// certificate signing requests of the control plane nodes in the workload cluster.
+	// Requests are approved only if the requester and SANs match the control plane Machine.
+	// Useful when kubelet has rotate-server-certificates enabled.
+	// +optional
+	ApproveKubeletServingCertificates bool `json:"approveKubeletServingCertificates,omitempty"`
+
+	// MaintenanceModePolicy defines how control plane machines which dropped into Talos maintenance mode
+	// (e.g. machine config was lost after a disk replacement) are handled. Defaults to Report.
+	// +optional
+	MaintenanceModePolicy v1alpha3.MaintenanceModePolicy `json:"maintenanceModePolicy,omitempty"`
+
+	// PreDrainHook makes scale down wait for external controllers before the machine is removed.
+	// +optional
+	PreDrainHook *v1alpha3.PreDrainHook `json:"preDrainHook,omitempty"`
+
+	// GeneratedSecretsPolicy defines whether the secrets and config maps generated by the provider
+	// (e.g. kubeconfig) are deleted together with the TalosControlPlane. Defaults to Delete.
+	// +optional
+	GeneratedSecretsPolicy v1alpha3.GeneratedSecretsPolicy `json:"generatedSecretsPolicy,omitempty"`
+
+	// ChangeOrdering defines how simultaneous changes of version and replicas are sequenced.
+	// Defaults to UpgradeFirst.
+	// +optional
+	ChangeOrdering v1alpha3.ChangeOrdering `json:"changeOrdering,omitempty"`
+
+	// RolloutStrategy is the strategy to replace the outdated control plane machines.
+	// Defaults to RollingUpdate with maxSurge of 1.
+	// +optional
+	RolloutStrategy *v1alpha3.RolloutStrategy `json:"rolloutStrategy,omitempty"`
+
+	// RolloutAfter is a field to indicate a rollout should be performed
+	// after the specified time even if no changes have been made to the
+	// TalosControlPlane.
+	// +optional
+	RolloutAfter *metav1.Time `json:"rolloutAfter,omitempty"`
+
+	// RolloutBefore is a field to indicate a rollout should be performed
+	// if the specified criteria is met.
+	// +optional
+	RolloutBefore *v1alpha3.RolloutBefore `json:"rolloutBefore,omitempty"`
+
+	// RemediationStrategy bounds the remediation of the unhealthy control plane machines.
+	// +optional
+	RemediationStrategy *v1alpha3.RemediationStrategy `json:"remediationStrategy,omitempty"`
+
+	// RemediationTemplate references a template of the external remediation requests (e.g. Metal3RemediationTemplate).
+	// When set, an external remediation request named after the unhealthy machine is created instead of deleting the machine,
+	// and it is deleted once the machine is healthy again.
+	// +optional
+	RemediationTemplate *corev1.ObjectReference `json:"remediationTemplate,omitempty"`
+
+	// Install defines kernel arguments and system extensions of the control plane machines.
+	// Changes are applied by upgrading the machines in place one at a time, without replacing them.
+	// +optional
+	Install *v1alpha3.InstallConfig `json:"install,omitempty"`
+
+	// RequireApproval lists the change strategies which are not applied until approved.
+	// Pending changes are published in the status with their IDs, the change is approved
+	// by adding its ID to the "controlplane.cluster.x-k8s.io/approved-changes" annotation.
+	// +optional
+	RequireApproval []v1alpha3.ChangeStrategy `json:"requireApproval,omitempty"`
+
+	// EtcdBackup configures the scheduled etcd backups uploaded to S3-compatible storage.
+	// +optional
+	EtcdBackup *EtcdBackup `json:"etcdBackup,omitempty"`
+
+	// AddressSources lists the sources of the Talos API endpoints of the control plane machines in the order they are tried,
+	// the first source which knows the addresses of a machine is used. Besides the built-in sources, the names of the sources
+	// registered with the controller can be used. Defaults to MachineStatus, InfrastructureMachine, with NodeStatus tried first for the control planes with the init config.
+	// +optional
+	AddressSources []v1alpha3.AddressSourceName `json:"addressSources,omitempty"`
+
+	// OperationTimeouts defines the deadlines of the control plane changes, the OperationTimedOut condition
+	// is set once a change takes longer. The controller keeps working on the change after the deadline.
+	// +optional
+	OperationTimeouts *v1alpha3.OperationTimeouts `json:"operationTimeouts,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=taloscontrolplanes,shortName=tcp,scope=Namespaced,categories=cluster-api
+// +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
+// +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=".status.ready",description="TalosControlPlane API Server is ready to receive requests"
+// +kubebuilder:printcolumn:name="Initialized",type=boolean,JSONPath=".status.initialized",description="This denotes whether or not the control plane has the uploaded talos-config configmap"
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=".status.replicas",description="Total number of non-terminated machines targeted by this control plane"
+// +kubebuilder:printcolumn:name="Ready Replicas",type=integer,JSONPath=".status.readyReplicas",description="Total number of fully running and ready control plane machines"
+// +kubebuilder:printcolumn:name="Unavailable Replicas",type=integer,JSONPath=".status.unavailableReplicas",description="Total number of unavailable machines targeted by this control plane"
+
+// TalosControlPlane is the Schema for the taloscontrolplanes API.
+//
+// The status is the same as in v1alpha3, which stays the storage version.
+type TalosControlPlane struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TalosControlPlaneSpec            `json:"spec,omitempty"`
+	Status v1alpha3.TalosControlPlaneStatus `json:"status,omitempty"`
+}
+
+// GetConditions returns the set of conditions for this object.
+func (in *TalosControlPlane) GetConditions() clusterv1.Conditions {
+	return in.Status.Conditions
+}
+
+// SetConditions sets the conditions on this object.
+func (in *TalosControlPlane) SetConditions(conditions clusterv1.Conditions) {
+	in.Status.Conditions = conditions
+}
+
+// +kubebuilder:object:root=true
+
+// TalosControlPlaneList contains a list of TalosControlPlane
+type TalosControlPlaneList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TalosControlPlane `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TalosControlPlane{}, &TalosControlPlaneList{})
+}
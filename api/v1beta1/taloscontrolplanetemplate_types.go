@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// TalosControlPlaneTemplateSpec defines the desired state of TalosControlPlaneTemplate.
+type TalosControlPlaneTemplateSpec struct {
+	Template TalosControlPlaneTemplateResource `json:"template"`
+}
+
+// TalosControlPlaneTemplateResource describes the data needed to create a TalosControlPlane from a template.
+type TalosControlPlaneTemplateResource struct {
+	Spec TalosControlPlaneTemplateResourceSpec `json:"spec"`
+}
+
+// TalosControlPlaneTemplateMachineTemplate defines the template of the control plane machines in the TalosControlPlaneTemplate.
+//
+// The labels and annotations of the machines are set by the topology controller
+// from the control plane metadata of the ClusterClass and the Cluster topology.
+type TalosControlPlaneTemplateMachineTemplate struct {
+	// FailureDomainMetadata defines additional labels and annotations per failure domain name.
+	// They are merged over ObjectMeta for the machines placed into that failure domain.
+	// +optional
+	FailureDomainMetadata map[string]clusterv1.ObjectMeta `json:"failureDomainMetadata,omitempty"`
+
+	// NodeDrainTimeout is the total amount of time that the controller will spend on draining a control plane node.
+	// The default value is 0, meaning that the node can be drained without any time limitations.
+	// NOTE: NodeDrainTimeout is different from `kubectl drain --timeout`.
+	// Changes are applied to the existing machines without a rollout.
+	// +optional
+	NodeDrainTimeout *metav1.Duration `json:"nodeDrainTimeout,omitempty"`
+}
+
+// TalosControlPlaneTemplateResourceSpec defines the spec of the TalosControlPlane created from the template.
+//
+// The replicas, version and infrastructure template are managed by the ClusterClass topology controller,
+// so they are not a part of the template: the ClusterClass should define the control plane machine infrastructure.
+type TalosControlPlaneTemplateResourceSpec struct {
+	// MachineTemplate contains the per failure domain metadata of the control plane machines.
+	// +optional
+	MachineTemplate *TalosControlPlaneTemplateMachineTemplate `json:"machineTemplate,omitempty"`
+
+	// ControlPlaneConfig is a two TalosConfigSpecs
+	// to use for initializing and joining machines to the control plane.
+	ControlPlaneConfig v1alpha3.ControlPlaneConfig `json:"controlPlaneConfig"`
+
+	// Images overrides image references rendered into the machine configs
+	// of the control plane machines.
+	// Images the control plane nodes fail to pull are reported with the ImagesResolved condition,
+	// the installer image is not checked as it is pulled only on install and upgrade.
+	// +optional
+	Images *v1alpha3.ImageOverrides `json:"images,omitempty"`
+
+	// ComponentVersions pins control plane components to other Kubernetes versions.
+	// Image overrides take precedence over the pinned versions.
+	// +optional
+	ComponentVersions *v1alpha3.ComponentVersions `json:"componentVersions,omitempty"`
+
+	// Etcd defines etcd tuning parameters for the control plane machines.
+	// Changes are applied by rebooting the machines one at a time, arguments removed from the spec
+	// are left on the machines until they are replaced.
+	// +optional
+	Etcd *v1alpha3.EtcdConfig `json:"etcd,omitempty"`
+
+	// ResourcePressureThresholds configures when node resource usage is reported
+	// as unhealthy control plane components.
+	// +optional
+	ResourcePressureThresholds *v1alpha3.ResourcePressureThresholds `json:"resourcePressureThresholds,omitempty"`
+
+	// Admission defines kube-apiserver admission plugins and Pod Security Admission defaults.
+	// Changes are only applied to machines created after the change.
+	// +optional
+	Admission *v1alpha3.AdmissionConfig `json:"admission,omitempty"`
+
+	// ApproveKubeletServingCertificates enables automatic approval of pending kubelet serving
+	// certificate signing requests of the control plane nodes in the workload cluster.
+	// +optional
+	ApproveKubeletServingCertificates bool `json:"approveKubeletServingCertificates,omitempty"`
+
+	// MaintenanceModePolicy defines how control plane machines which dropped into Talos maintenance mode
+	// are handled. Defaults to Report.
+	// +optional
+	MaintenanceModePolicy v1alpha3.MaintenanceModePolicy `json:"maintenanceModePolicy,omitempty"`
+
+	// PreDrainHook makes scale down wait for external controllers before the machine is removed.
+	// +optional
+	PreDrainHook *v1alpha3.PreDrainHook `json:"preDrainHook,omitempty"`
+
+	// GeneratedSecretsPolicy defines whether the secrets and config maps generated by the provider
+	// (e.g. kubeconfig) are deleted together with the TalosControlPlane. Defaults to Delete.
+	// +optional
+	GeneratedSecretsPolicy v1alpha3.GeneratedSecretsPolicy `json:"generatedSecretsPolicy,omitempty"`
+
+	// ChangeOrdering defines how simultaneous changes of version and replicas are sequenced.
+	// Defaults to UpgradeFirst.
+	// +optional
+	ChangeOrdering v1alpha3.ChangeOrdering `json:"changeOrdering,omitempty"`
+
+	// RolloutStrategy is the strategy to replace the outdated control plane machines.
+	// Defaults to RollingUpdate with maxSurge of 1.
+	// +optional
+	RolloutStrategy *v1alpha3.RolloutStrategy `json:"rolloutStrategy,omitempty"`
+
+	// RolloutAfter is a field to indicate a rollout should be performed
+	// after the specified time even if no changes have been made to the
+	// TalosControlPlane.
+	// +optional
+	RolloutAfter *metav1.Time `json:"rolloutAfter,omitempty"`
+
+	// RolloutBefore is a field to indicate a rollout should be performed
+	// if the specified criteria is met.
+	// +optional
+	RolloutBefore *v1alpha3.RolloutBefore `json:"rolloutBefore,omitempty"`
+
+	// RemediationStrategy bounds the remediation of the unhealthy control plane machines.
+	// +optional
+	RemediationStrategy *v1alpha3.RemediationStrategy `json:"remediationStrategy,omitempty"`
+
+	// RemediationTemplate references a template of the external remediation requests (e.g. Metal3RemediationTemplate).
+	// +optional
+	RemediationTemplate *corev1.ObjectReference `json:"remediationTemplate,omitempty"`
+
+	// Install defines kernel arguments and system extensions of the control plane machines.
+	// +optional
+	Install *v1alpha3.InstallConfig `json:"install,omitempty"`
+
+	// RequireApproval lists the change strategies which are not applied until approved.
+	// +optional
+	RequireApproval []v1alpha3.ChangeStrategy `json:"requireApproval,omitempty"`
+
+	// EtcdBackup configures the scheduled etcd backups uploaded to S3-compatible storage.
+	// +optional
+	EtcdBackup *EtcdBackup `json:"etcdBackup,omitempty"`
+
+	// AddressSources lists the sources of the Talos API endpoints of the control plane machines in the order they are tried.
+	// +optional
+	AddressSources []v1alpha3.AddressSourceName `json:"addressSources,omitempty"`
+
+	// OperationTimeouts defines the deadlines of the control plane changes.
+	// +optional
+	OperationTimeouts *v1alpha3.OperationTimeouts `json:"operationTimeouts,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=taloscontrolplanetemplates,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description="Time duration since creation of TalosControlPlaneTemplate"
+
+// TalosControlPlaneTemplate is the Schema for the taloscontrolplanetemplates API.
+//
+// It is referenced by the ClusterClass as the control plane template.
+type TalosControlPlaneTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TalosControlPlaneTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TalosControlPlaneTemplateList contains a list of TalosControlPlaneTemplate.
+type TalosControlPlaneTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TalosControlPlaneTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TalosControlPlaneTemplate{}, &TalosControlPlaneTemplateList{})
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package v1beta1
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func (r *TalosControlPlaneTemplate) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/mutate-controlplane-cluster-x-k8s-io-v1beta1-taloscontrolplanetemplate,mutating=true,failurePolicy=fail,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanetemplates,versions=v1beta1,name=default.taloscontrolplanetemplate.controlplane.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Defaulter = &TalosControlPlaneTemplate{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+//
+// The template is defaulted the same way as the TalosControlPlane, otherwise the topology controller
+// would keep reverting the defaults of the control planes created from the template.
+func (r *TalosControlPlaneTemplate) Default() {
+	spec := v1alpha3.TalosControlPlaneSpec{
+		ControlPlaneConfig: r.Spec.Template.Spec.ControlPlaneConfig,
+		RolloutStrategy:    r.Spec.Template.Spec.RolloutStrategy,
+	}
+
+	v1alpha3.DefaultTemplateSpec(&spec)
+
+	// the template is immutable, so the existing templates are not defaulted on update
+	if r.CreationTimestamp.IsZero() {
+		v1alpha3.DefaultRolloutStrategy(&spec)
+	}
+
+	r.Spec.Template.Spec.ControlPlaneConfig = spec.ControlPlaneConfig
+	r.Spec.Template.Spec.RolloutStrategy = spec.RolloutStrategy
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-controlplane-cluster-x-k8s-io-v1beta1-taloscontrolplanetemplate,mutating=false,failurePolicy=fail,matchPolicy=Equivalent,groups=controlplane.cluster.x-k8s.io,resources=taloscontrolplanetemplates,versions=v1beta1,name=vtaloscontrolplanetemplate.cluster.x-k8s.io,sideEffects=None,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Validator = &TalosControlPlaneTemplate{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
+func (r *TalosControlPlaneTemplate) ValidateCreate() error {
+	spec, err := r.Spec.Template.Spec.hubSpec()
+	if err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+
+	allErrs := v1alpha3.ValidateTemplateSpec(field.NewPath("spec", "template", "spec"), spec, nil, r.Namespace)
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("TalosControlPlaneTemplate").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+//
+// The template is immutable, as the topology controller expects the templates to be rotated rather than changed.
+func (r *TalosControlPlaneTemplate) ValidateUpdate(old runtime.Object) error {
+	oldTemplate, ok := old.(*TalosControlPlaneTemplate)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a TalosControlPlaneTemplate but got a %T", old))
+	}
+
+	if reflect.DeepEqual(r.Spec.Template.Spec, oldTemplate.Spec.Template.Spec) {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("TalosControlPlaneTemplate").GroupKind(), r.Name, field.ErrorList{
+		field.Forbidden(field.NewPath("spec", "template", "spec"), "is immutable, create a new template instead"),
+	})
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+func (r *TalosControlPlaneTemplate) ValidateDelete() error {
+	return nil
+}
+
+// hubSpec returns the spec of the TalosControlPlane created from the template in the hub version,
+// the fields managed by the topology controller are left empty.
+//
+// The template spec shares the field names with the TalosControlPlane spec, so it is converted through JSON.
+func (r *TalosControlPlaneTemplateResourceSpec) hubSpec() (*v1alpha3.TalosControlPlaneSpec, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tcp TalosControlPlane
+
+	if err = json.Unmarshal(data, &tcp.Spec); err != nil {
+		return nil, err
+	}
+
+	var hub v1alpha3.TalosControlPlane
+
+	if err = tcp.ConvertTo(&hub); err != nil {
+		return nil, err
+	}
+
+	return &hub.Spec, nil
+}
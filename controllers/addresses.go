@@ -0,0 +1,323 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// AddressSource discovers the addresses of the control plane machines usable as the Talos API endpoints.
+//
+// Sources are tried in the order configured in the TalosControlPlane, each source is asked only about the machines
+// the previous sources didn't know the addresses of.
+type AddressSource interface {
+	// Addresses returns the addresses by the machine name, the machines the source doesn't know about are omitted.
+	Addresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error)
+}
+
+// AddressSourceFunc is an adapter to use functions as the address sources.
+type AddressSourceFunc func(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error)
+
+// Addresses implements AddressSource.
+func (f AddressSourceFunc) Addresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	return f(ctx, tcp, machines)
+}
+
+// addressSources returns the address sources of the TalosControlPlane in order.
+func (r *TalosControlPlaneReconciler) addressSources(tcp *controlplanev1.TalosControlPlane) ([]controlplanev1.AddressSourceName, error) {
+	names := tcp.Spec.AddressSources
+
+	if len(names) == 0 {
+		names = []controlplanev1.AddressSourceName{controlplanev1.MachineStatusAddressSource, controlplanev1.InfrastructureMachineAddressSource}
+
+		if !reflect.ValueOf(tcp.Spec.ControlPlaneConfig.InitConfig).IsZero() {
+			names = append([]controlplanev1.AddressSourceName{controlplanev1.NodeStatusAddressSource}, names...)
+		}
+	}
+
+	for _, name := range names {
+		if r.addressSource(name) == nil {
+			return nil, fmt.Errorf("unknown address source %q", name)
+		}
+	}
+
+	return names, nil
+}
+
+// addressSource returns the address source by the name, the sources registered with the controller take precedence.
+func (r *TalosControlPlaneReconciler) addressSource(name controlplanev1.AddressSourceName) AddressSource {
+	if source, ok := r.AddressSources[string(name)]; ok {
+		return source
+	}
+
+	switch name {
+	case controlplanev1.MachineStatusAddressSource:
+		return AddressSourceFunc(machineStatusAddresses)
+	case controlplanev1.NodeStatusAddressSource:
+		return AddressSourceFunc(r.nodeStatusAddresses)
+	case controlplanev1.InfrastructureMachineAddressSource:
+		return AddressSourceFunc(r.infrastructureMachineAddresses)
+	case controlplanev1.DiscoveryAddressSource:
+		return AddressSourceFunc(r.discoveryAddresses)
+	case controlplanev1.AnnotationAddressSource:
+		return AddressSourceFunc(annotationAddresses)
+	}
+
+	return nil
+}
+
+// discoverAddresses collects the Talos API endpoint candidates of the machines from the address sources.
+//
+// Failing sources are skipped, so that the next source can provide the addresses.
+// The machines none of the sources know the addresses of are omitted.
+func (r *TalosControlPlaneReconciler) discoverAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	names, err := r.addressSources(tcp)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]string{}
+	pending := append([]clusterv1.Machine(nil), machines...)
+
+	for _, name := range names {
+		if len(pending) == 0 {
+			break
+		}
+
+		addresses, err := r.addressSource(name).Addresses(ctx, tcp, pending)
+		if err != nil {
+			r.Log.Info("address source failed", "source", name, "error", err)
+
+			continue
+		}
+
+		remaining := pending[:0]
+
+		for _, machine := range pending {
+			if len(addresses[machine.Name]) > 0 {
+				result[machine.Name] = addresses[machine.Name]
+			} else {
+				remaining = append(remaining, machine)
+			}
+		}
+
+		pending = remaining
+	}
+
+	return result, nil
+}
+
+// machineStatusAddresses uses the addresses copied to the Machine from the infrastructure machine by Cluster API.
+func machineStatusAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	for _, machine := range machines {
+		result[machine.Name] = endpointAddresses(machine.Status.Addresses)
+	}
+
+	return result, nil
+}
+
+// infrastructureMachineAddresses reads the addresses from the infrastructure machines directly,
+// they are available before Cluster API copies them to the Machine.
+func (r *TalosControlPlaneReconciler) infrastructureMachineAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	for _, machine := range machines {
+		infraMachine, err := external.Get(ctx, r.Client, &machine.Spec.InfrastructureRef, machine.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		var addresses clusterv1.MachineAddresses
+
+		if err = util.UnstructuredUnmarshalField(infraMachine, &addresses, "status", "addresses"); err != nil && !errors.Is(err, util.ErrUnstructuredFieldNotFound) {
+			return nil, fmt.Errorf("failed to get addresses of %q: %w", infraMachine.GetName(), err)
+		}
+
+		result[machine.Name] = endpointAddresses(addresses)
+	}
+
+	return result, nil
+}
+
+func endpointAddresses(addresses clusterv1.MachineAddresses) []string {
+	result := []string{}
+
+	for _, addr := range addresses {
+		if addr.Type == clusterv1.MachineExternalIP || addr.Type == clusterv1.MachineInternalIP {
+			result = append(result, addr.Address)
+		}
+	}
+
+	return result
+}
+
+// nodeStatusAddresses uses the addresses of the workload cluster Nodes, unless the workload node lookups are disabled.
+func (r *TalosControlPlaneReconciler) nodeStatusAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	if r.DisableWorkloadNodeLookups {
+		return result, nil
+	}
+
+	clientset, err := r.kubeconfigForCluster(ctx, tcp, client.ObjectKey{Namespace: tcp.Namespace, Name: tcp.Labels[clusterv1.ClusterLabelName]})
+	if err != nil {
+		return nil, err
+	}
+
+	defer clientset.Close() //nolint:errcheck
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef == nil {
+			continue
+		}
+
+		node, err := clientset.CoreV1().Nodes().Get(ctx, machine.Status.NodeRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == corev1.NodeExternalIP || addr.Type == corev1.NodeInternalIP {
+				result[machine.Name] = append(result[machine.Name], addr.Address)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// annotationAddresses uses the addresses set by the user (or another controller) with the TalosEndpointsAnnotation.
+func annotationAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	for _, machine := range machines {
+		for _, address := range strings.Split(machine.Annotations[controlplanev1.TalosEndpointsAnnotation], ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				result[machine.Name] = append(result[machine.Name], address)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// affiliateSpec is the subset of the Talos cluster discovery Affiliate resource spec.
+type affiliateSpec struct {
+	Hostname  string   `yaml:"hostname"`
+	Nodename  string   `yaml:"nodename"`
+	Addresses []string `yaml:"addresses"`
+}
+
+// discoveryAddresses uses the addresses the nodes announced to the Talos cluster discovery.
+//
+// The affiliates are read from the other control plane machines reachable via their Machine addresses,
+// so the source helps when the addresses of some of the machines are not reported by the infrastructure provider.
+func (r *TalosControlPlaneReconciler) discoveryAddresses(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	all, err := r.getControlPlaneMachinesForCluster(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: tcp.Labels[clusterv1.ClusterLabelName]}, tcp.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []string{}
+
+	var reachable *clusterv1.Machine
+
+	for i := range all {
+		if addresses := endpointAddresses(all[i].Status.Addresses); len(addresses) > 0 {
+			endpoints = append(endpoints, addresses...)
+
+			if reachable == nil {
+				reachable = &all[i]
+			}
+		}
+	}
+
+	if reachable == nil {
+		return result, nil
+	}
+
+	t, err := r.machineTalosconfig(ctx, tcp, reachable)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterKey := client.ObjectKey{Namespace: tcp.Namespace, Name: tcp.Labels[clusterv1.ClusterLabelName]}
+
+	c, err := talosclient.New(ctx,
+		talosclient.WithEndpoints(endpoints...),
+		talosclient.WithConfig(t),
+		talosclient.WithGRPCDialOptions(r.talosRPCLimiter.dialOptions(clusterKey, r.MaxConcurrentTalosCalls)...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	list, err := c.Resources.List(ctx, "cluster", "Affiliates.cluster.talos.dev")
+	if err != nil {
+		return nil, err
+	}
+
+	affiliates := []affiliateSpec{}
+
+	for {
+		item, err := list.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		if item.Resource == nil {
+			continue
+		}
+
+		data, err := yaml.Marshal(item.Resource.Spec())
+		if err != nil {
+			return nil, err
+		}
+
+		var spec affiliateSpec
+
+		if err = yaml.Unmarshal(data, &spec); err != nil {
+			return nil, err
+		}
+
+		affiliates = append(affiliates, spec)
+	}
+
+	for _, machine := range machines {
+		for _, affiliate := range affiliates {
+			if (machine.Status.NodeRef != nil && affiliate.Nodename == machine.Status.NodeRef.Name) || affiliate.Hostname == machine.Name {
+				result[machine.Name] = affiliate.Addresses
+			}
+		}
+	}
+
+	return result, nil
+}
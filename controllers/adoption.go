@@ -0,0 +1,322 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+// reconcileMachineHandover adopts the Machines annotated with AdoptMachineAnnotation into the control plane
+// and ejects the control plane Machines annotated with EjectMachineAnnotation.
+//
+// Both change the set of the control plane machines, so the reconcile is restarted after any of them
+// to let the rest of the phases see the updated set.
+func (r *TalosControlPlaneReconciler) reconcileMachineHandover(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane) (ctrl.Result, error) {
+	var machineList clusterv1.MachineList
+
+	if err := r.Client.List(ctx, &machineList,
+		client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{clusterv1.ClusterLabelName: cluster.Name},
+	); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	controlPlaneMachines, err := r.getControlPlaneMachinesForCluster(ctx, util.ObjectKey(cluster), tcp.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var (
+		errs    error
+		changed bool
+	)
+
+	for _, machine := range machineList.Items {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if _, ok := machine.Annotations[controlplanev1.EjectMachineAnnotation]; ok && tcpclient.IsOwnedBy(&machine, tcp) {
+			ejected, err := r.ejectMachine(ctx, cluster, tcp, controlPlaneMachines, machine)
+			if err != nil {
+				errs = kerrors.NewAggregate([]error{errs, err})
+			}
+
+			changed = changed || ejected
+
+			continue
+		}
+
+		if machine.Annotations[controlplanev1.AdoptMachineAnnotation] == tcp.Name {
+			adopted, err := r.adoptJoinedMachine(ctx, cluster, tcp, controlPlaneMachines, machine)
+			if err != nil {
+				errs = kerrors.NewAggregate([]error{errs, err})
+			}
+
+			changed = changed || adopted
+		}
+	}
+
+	if errs != nil {
+		return ctrl.Result{}, errs
+	}
+
+	// the machines waiting to be adopted are checked again on the next reconcile, the rest of the reconcile goes on
+	return ctrl.Result{Requeue: changed}, nil
+}
+
+// adoptJoinedMachine takes the ownership of the Machine once its node is a member of the etcd cluster.
+//
+// It only waits for the node to join: Talos joins the control plane nodes to etcd on boot, the machine configuration
+// of the node is not changed by the provider.
+// It returns true if the Machine was adopted (or the adoption was refused).
+func (r *TalosControlPlaneReconciler) adoptJoinedMachine(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, controlPlaneMachines []clusterv1.Machine, m clusterv1.Machine) (bool, error) {
+	logger := r.Log.WithValues("machine", m.Name, "cluster", cluster.Name)
+
+	if owner := metav1.GetControllerOf(&m); owner != nil && !tcpclient.IsOwnerRef(*owner, tcp) {
+		logger.Info("refusing to adopt machine with another controller", "owner", fmt.Sprintf("%s/%s", owner.Kind, owner.Name))
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "AdoptionRefused", "Refusing to adopt machine %q controlled by %s %q", m.Name, owner.Kind, owner.Name)
+		}
+
+		// the annotation is removed, so that the refusal is reported once
+		return true, r.removeMachineAnnotation(ctx, &m, controlplanev1.AdoptMachineAnnotation)
+	}
+
+	if m.Status.NodeRef == nil {
+		logger.Info("waiting for adopted machine to get a node")
+
+		return false, nil
+	}
+
+	// the etcd members are listed via the current control plane, or via the adopted machine itself for the first one
+	via := make([]clusterv1.Machine, 0, len(controlPlaneMachines))
+
+	for _, machine := range controlPlaneMachines {
+		if machine.Status.NodeRef != nil && machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			via = append(via, machine)
+		}
+	}
+
+	if len(via) == 0 {
+		via = append(via, m)
+	}
+
+	memberNames, err := r.etcdMemberNames(ctx, tcp, via)
+	if err != nil {
+		return false, fmt.Errorf("failed to list etcd members to adopt machine %q: %w", m.Name, err)
+	}
+
+	hostname := strings.Split(m.Status.NodeRef.Name, ".")[0]
+	joined := false
+
+	for _, name := range memberNames {
+		joined = joined || name == hostname
+	}
+
+	if !joined {
+		logger.Info("waiting for adopted machine to join etcd, the node should run the control plane machine configuration", "node", m.Status.NodeRef.Name)
+
+		return false, nil
+	}
+
+	if r.dryRun(tcp, "adopting machine %q", m.Name) {
+		return false, nil
+	}
+
+	patchHelper, err := patch.NewHelper(&m, r.Client)
+	if err != nil {
+		return false, err
+	}
+
+	if m.Labels == nil {
+		m.Labels = map[string]string{}
+	}
+
+	m.Labels[clusterv1.MachineControlPlaneLabelName] = ""
+
+	if metav1.GetControllerOf(&m) == nil {
+		m.OwnerReferences = append(m.OwnerReferences, *metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")))
+	}
+
+	controllerutil.AddFinalizer(&m, controlplanev1.MachineEtcdFinalizer)
+
+	delete(m.Annotations, controlplanev1.AdoptMachineAnnotation)
+
+	if err := patchHelper.Patch(ctx, &m); err != nil {
+		return false, fmt.Errorf("failed to adopt machine %q: %w", m.Name, err)
+	}
+
+	if err := r.updateTalosConfigOwner(ctx, tcp, m, true); err != nil {
+		return true, err
+	}
+
+	logger.Info("adopted machine")
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "MachineAdopted", "Adopted machine %q", m.Name)
+	}
+
+	return true, nil
+}
+
+// ejectMachine removes the etcd member of the control plane Machine and releases the Machine
+// without deleting it, so that it can be taken over by another management tooling.
+//
+// It returns true if the Machine was ejected (or the ejection was refused).
+func (r *TalosControlPlaneReconciler) ejectMachine(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, controlPlaneMachines []clusterv1.Machine, m clusterv1.Machine) (bool, error) {
+	logger := r.Log.WithValues("machine", m.Name, "cluster", cluster.Name)
+
+	remaining := 0
+
+	for _, machine := range controlPlaneMachines {
+		if machine.Name != m.Name && machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			remaining++
+		}
+	}
+
+	if remaining == 0 {
+		logger.Info("refusing to eject the last control plane machine")
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EjectionRefused", "Refusing to eject the last control plane machine %q", m.Name)
+		}
+
+		return true, r.removeMachineAnnotation(ctx, &m, controlplanev1.EjectMachineAnnotation)
+	}
+
+	if r.dryRun(tcp, "ejecting machine %q", m.Name) {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if err := r.removeEtcdMemberForMachine(ctx, tcp, util.ObjectKey(cluster), controlPlaneMachines, m); err != nil {
+		return false, fmt.Errorf("failed to remove etcd member of ejected machine %q: %w", m.Name, err)
+	}
+
+	patchHelper, err := patch.NewHelper(&m, r.Client)
+	if err != nil {
+		return false, err
+	}
+
+	delete(m.Labels, clusterv1.MachineControlPlaneLabelName)
+	delete(m.Annotations, controlplanev1.EjectMachineAnnotation)
+
+	m.OwnerReferences = withoutTalosControlPlaneOwner(m.OwnerReferences, tcp)
+
+	controllerutil.RemoveFinalizer(&m, controlplanev1.MachineEtcdFinalizer)
+
+	if err := patchHelper.Patch(ctx, &m); err != nil {
+		return false, fmt.Errorf("failed to eject machine %q: %w", m.Name, err)
+	}
+
+	if err := r.updateTalosConfigOwner(ctx, tcp, m, false); err != nil {
+		return true, err
+	}
+
+	logger.Info("ejected machine")
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "MachineEjected", "Ejected machine %q", m.Name)
+	}
+
+	return true, nil
+}
+
+// updateTalosConfigOwner makes the TalosControlPlane the controller of the bootstrap TalosConfig of the Machine,
+// or drops the TalosControlPlane owner references from it.
+func (r *TalosControlPlaneReconciler) updateTalosConfigOwner(ctx context.Context, tcp *controlplanev1.TalosControlPlane, m clusterv1.Machine, owned bool) error {
+	configRef := m.Spec.Bootstrap.ConfigRef
+	if configRef == nil || configRef.Kind != "TalosConfig" {
+		return nil
+	}
+
+	var cfg cabptv1.TalosConfig
+
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: m.Namespace, Name: configRef.Name}, &cfg); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	patchHelper, err := patch.NewHelper(&cfg, r.Client)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !owned:
+		cfg.OwnerReferences = withoutTalosControlPlaneOwner(cfg.OwnerReferences, tcp)
+	case metav1.GetControllerOf(&cfg) == nil:
+		cfg.OwnerReferences = append(cfg.OwnerReferences, *metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")))
+	default:
+		return nil
+	}
+
+	return patchHelper.Patch(ctx, &cfg)
+}
+
+// removeMachineAnnotation removes the annotation from the Machine.
+func (r *TalosControlPlaneReconciler) removeMachineAnnotation(ctx context.Context, m *clusterv1.Machine, annotation string) error {
+	patchHelper, err := patch.NewHelper(m, r.Client)
+	if err != nil {
+		return err
+	}
+
+	delete(m.Annotations, annotation)
+
+	return patchHelper.Patch(ctx, m)
+}
+
+// withoutTalosControlPlaneOwner returns the owner references without the ones pointing to the TalosControlPlane.
+func withoutTalosControlPlaneOwner(refs []metav1.OwnerReference, tcp *controlplanev1.TalosControlPlane) []metav1.OwnerReference {
+	result := make([]metav1.OwnerReference, 0, len(refs))
+
+	for _, ref := range refs {
+		if !tcpclient.IsOwnerRef(ref, tcp) {
+			result = append(result, ref)
+		}
+	}
+
+	return result
+}
+
+// AdoptedMachineToTalosControlPlane is a handler.ToRequestsFunc to be used to enqueue requests for reconciliation
+// for TalosControlPlane based on updates to a Machine requested to be adopted.
+//
+// The owned Machines are covered by the ownership watch already, but the adopted ones are not owned yet.
+func (r *TalosControlPlaneReconciler) AdoptedMachineToTalosControlPlane(o client.Object) []ctrl.Request {
+	name, ok := o.GetAnnotations()[controlplanev1.AdoptMachineAnnotation]
+	if !ok || name == "" {
+		return nil
+	}
+
+	return []ctrl.Request{{NamespacedName: client.ObjectKey{Namespace: o.GetNamespace(), Name: name}}}
+}
@@ -0,0 +1,207 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestWithoutTalosControlPlaneOwner(t *testing.T) {
+	tcp := &controlplanev1.TalosControlPlane{ObjectMeta: metav1.ObjectMeta{Name: "test-cp"}}
+
+	refs := []metav1.OwnerReference{
+		{APIVersion: "controlplane.cluster.x-k8s.io/v1alpha3", Kind: "TalosControlPlane", Name: "test-cp", Controller: pointer.BoolPtr(true)},
+		{APIVersion: "controlplane.cluster.x-k8s.io/v1alpha3", Kind: "TalosControlPlane", Name: "other-cp"},
+		{APIVersion: "example.com/v1", Kind: "TalosControlPlane", Name: "test-cp"},
+		{APIVersion: "cluster.x-k8s.io/v1beta1", Kind: "MachineSet", Name: "test-cp"},
+	}
+
+	assert.Equal(t, refs[1:], withoutTalosControlPlaneOwner(refs, tcp))
+	assert.Empty(t, withoutTalosControlPlaneOwner(refs[:1], tcp))
+}
+
+func TestAdoptedMachineToTalosControlPlane(t *testing.T) {
+	r := &TalosControlPlaneReconciler{Log: logr.Discard()}
+
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		expected    []ctrl.Request
+	}{
+		{
+			name:        "adopted",
+			annotations: map[string]string{controlplanev1.AdoptMachineAnnotation: "test-cp"},
+			expected:    []ctrl.Request{{NamespacedName: client.ObjectKey{Namespace: "default", Name: "test-cp"}}},
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{controlplanev1.AdoptMachineAnnotation: ""},
+		},
+		{
+			name: "not adopted",
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			machine := &clusterv1.Machine{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "machine", Annotations: tt.annotations},
+			}
+
+			assert.Equal(t, tt.expected, r.AdoptedMachineToTalosControlPlane(machine))
+		})
+	}
+}
+
+var _ = Describe("Machine handover", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		recorder  *record.FakeRecorder
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+		recorder = record.NewFakeRecorder(8)
+
+		r = &TalosControlPlaneReconciler{
+			Client:   k8sClient,
+			Log:      logr.Discard(),
+			Scheme:   scheme.Scheme,
+			Recorder: recorder,
+		}
+
+		cluster = &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"}}
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp", UID: "test-cp-uid"},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				// the nodes are not reachable: the machines have no addresses
+				AddressSources: []controlplanev1.AddressSourceName{controlplanev1.AnnotationAddressSource},
+			},
+		}
+	})
+
+	getMachine := func(name string) *clusterv1.Machine {
+		var machine clusterv1.Machine
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &machine)).To(Succeed())
+
+		return &machine
+	}
+
+	newOwnedMachine := func(name string, annotations map[string]string) *clusterv1.Machine {
+		machine := newTestMachine(ctx, namespace, name, annotations)
+		machine.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane"))}
+		Expect(k8sClient.Update(ctx, machine)).To(Succeed())
+
+		return machine
+	}
+
+	adopted := map[string]string{controlplanev1.AdoptMachineAnnotation: "test-cp"}
+	ejected := map[string]string{controlplanev1.EjectMachineAnnotation: ""}
+
+	It("refuses to adopt the machine with another controller", func() {
+		machine := newTestMachine(ctx, namespace, "cp-1", adopted)
+		machine.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "cluster.x-k8s.io/v1beta1", Kind: "MachineSet", Name: "workers", UID: "workers-uid", Controller: pointer.BoolPtr(true)},
+		}
+		Expect(k8sClient.Update(ctx, machine)).To(Succeed())
+
+		result, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{Requeue: true}))
+
+		machine = getMachine("cp-1")
+		Expect(machine.Annotations).NotTo(HaveKey(controlplanev1.AdoptMachineAnnotation))
+		Expect(machine.OwnerReferences).To(HaveLen(1))
+		Expect(recorder.Events).To(Receive(ContainSubstring("AdoptionRefused")))
+	})
+
+	It("waits for the adopted machine to get a node", func() {
+		newTestMachine(ctx, namespace, "cp-1", adopted)
+
+		result, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(getMachine("cp-1").Annotations).To(HaveKey(controlplanev1.AdoptMachineAnnotation))
+	})
+
+	It("adopts the machine only once it has joined etcd", func() {
+		machine := newTestMachine(ctx, namespace, "cp-1", adopted)
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "cp-1"}
+		Expect(k8sClient.Status().Update(ctx, machine)).To(Succeed())
+
+		_, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).To(MatchError(ContainSubstring(`failed to list etcd members to adopt machine "cp-1"`)))
+
+		machine = getMachine("cp-1")
+		Expect(machine.Annotations).To(HaveKey(controlplanev1.AdoptMachineAnnotation))
+		Expect(machine.OwnerReferences).To(BeEmpty())
+		Expect(machine.Finalizers).To(BeEmpty())
+	})
+
+	It("refuses to eject the last control plane machine", func() {
+		newOwnedMachine("cp-1", ejected)
+
+		result, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{Requeue: true}))
+
+		machine := getMachine("cp-1")
+		Expect(machine.Annotations).NotTo(HaveKey(controlplanev1.EjectMachineAnnotation))
+		Expect(machine.OwnerReferences).To(HaveLen(1))
+		Expect(recorder.Events).To(Receive(ContainSubstring("EjectionRefused")))
+	})
+
+	It("ignores the ejection of the machine it doesn't own", func() {
+		newOwnedMachine("cp-1", nil)
+		newTestMachine(ctx, namespace, "cp-2", ejected)
+
+		result, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(getMachine("cp-2").Annotations).To(HaveKey(controlplanev1.EjectMachineAnnotation))
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("skips the ejection in the dry run", func() {
+		r.DryRun = true
+
+		newOwnedMachine("cp-1", nil)
+		newOwnedMachine("cp-2", ejected)
+
+		result, err := r.reconcileMachineHandover(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		machine := getMachine("cp-2")
+		Expect(machine.Annotations).To(HaveKey(controlplanev1.EjectMachineAnnotation))
+		Expect(machine.OwnerReferences).To(HaveLen(1))
+		Expect(recorder.Events).To(Receive(ContainSubstring("DryRun")))
+	})
+})
@@ -0,0 +1,318 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/talos-systems/talos/pkg/machinery/api/machine"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// membershipAuditInterval is the interval between the membership audits of a ready control plane.
+const membershipAuditInterval = 5 * time.Minute
+
+// Kinds of the membership discrepancies found by the audit.
+const (
+	nodeWithoutMachine     = "node_without_machine"
+	machineWithoutNode     = "machine_without_node"
+	memberWithoutMachine   = "member_without_machine"
+	machineWithoutMember   = "machine_without_member"
+	endpointWithoutMachine = "endpoint_without_machine"
+)
+
+// membershipDiscrepancyKinds lists the discrepancy kinds, so that the metrics are reset for the resolved ones.
+var membershipDiscrepancyKinds = []string{
+	nodeWithoutMachine,
+	machineWithoutNode,
+	memberWithoutMachine,
+	machineWithoutMember,
+	endpointWithoutMachine,
+}
+
+// auditTracker remembers when the membership of each control plane was audited last.
+type auditTracker struct {
+	mu   sync.Mutex
+	last map[types.UID]time.Time
+}
+
+// due checks whether the audit is due, and if so, records it as started.
+// Otherwise it returns the time left until the next audit.
+func (t *auditTracker) due(uid types.UID) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = map[types.UID]time.Time{}
+	}
+
+	if last, ok := t.last[uid]; ok && time.Since(last) < membershipAuditInterval {
+		return false, membershipAuditInterval - time.Since(last)
+	}
+
+	t.last[uid] = time.Now()
+
+	return true, 0
+}
+
+// seed records the audit performed at the given time, e.g. by the previous leader.
+func (t *auditTracker) seed(uid types.UID, last time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = map[types.UID]time.Time{}
+	}
+
+	t.last[uid] = last
+}
+
+// reconcileMembershipAudit periodically cross-checks the control plane Machines against the workload cluster
+// control plane Nodes, the etcd members and the talosconfig endpoints.
+//
+// Event-driven reconciles act on changes of the Machines, so the drift which happens outside of them
+// (ghost nodes, etcd members added or removed manually, stale endpoints) is only caught by the audit.
+// The audit doesn't fix anything, discrepancies are reported with the MembershipConsistent condition and metrics.
+func (r *TalosControlPlaneReconciler) reconcileMembershipAudit(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	// the kubeadm machines are not part of the control plane until the migration completes
+	if !tcp.Status.Ready || kubeadmMigrationInProgress(tcp) {
+		return ctrl.Result{}, nil
+	}
+
+	// machines being created or deleted are expected to be out of sync
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			return ctrl.Result{RequeueAfter: membershipAuditInterval}, nil
+		}
+	}
+
+	if due, wait := r.audits.due(tcp.UID); !due {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	discrepancies, err := r.auditMembership(ctx, cluster, tcp, machines)
+	if err != nil {
+		r.Log.Info("failed to audit control plane membership", "error", err)
+
+		conditions.MarkFalse(tcp, controlplanev1.MembershipConsistentCondition, errorReason(err, controlplanev1.MembershipAuditFailedReason),
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{RequeueAfter: membershipAuditInterval}, nil
+	}
+
+	for _, kind := range membershipDiscrepancyKinds {
+		clusterMembershipDiscrepancies.WithLabelValues(tcp.Namespace, cluster.Name, kind).Set(float64(len(discrepancies[kind])))
+	}
+
+	if len(discrepancies) == 0 {
+		conditions.MarkTrue(tcp, controlplanev1.MembershipConsistentCondition)
+
+		return ctrl.Result{RequeueAfter: membershipAuditInterval}, nil
+	}
+
+	summary := make([]string, 0, len(discrepancies))
+
+	for _, kind := range membershipDiscrepancyKinds {
+		if names := discrepancies[kind]; len(names) > 0 {
+			sort.Strings(names)
+
+			summary = append(summary, fmt.Sprintf("%s: %s", strings.ReplaceAll(kind, "_", " "), strings.Join(names, ", ")))
+		}
+	}
+
+	message := strings.Join(summary, "; ")
+
+	r.Log.Info("control plane membership drifted", "discrepancies", message)
+
+	if r.Recorder != nil && conditions.GetMessage(tcp, controlplanev1.MembershipConsistentCondition) != message {
+		r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "MembershipDrift", "Control plane membership drifted: %s", message)
+	}
+
+	conditions.MarkFalse(tcp, controlplanev1.MembershipConsistentCondition, controlplanev1.MembershipDriftReason, clusterv1.ConditionSeverityWarning, message)
+
+	return ctrl.Result{RequeueAfter: membershipAuditInterval}, nil
+}
+
+// auditMembership returns the names of the mismatched objects by the discrepancy kind.
+func (r *TalosControlPlaneReconciler) auditMembership(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (map[string][]string, error) {
+	discrepancies := map[string][]string{}
+
+	// nodes and etcd members are named after the short hostname
+	machinesByHostname := map[string]string{}
+
+	for _, machine := range machines {
+		machinesByHostname[strings.Split(machine.Status.NodeRef.Name, ".")[0]] = machine.Name
+	}
+
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return nil, err
+	}
+
+	defer kubeclient.Close() //nolint:errcheck
+
+	req, err := labels.NewRequirement(constants.LabelNodeRoleMaster, selection.Exists, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := kubeclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labels.NewSelector().Add(*req).String()})
+	if err != nil {
+		return nil, err
+	}
+
+	memberNames, err := r.etcdMemberNames(ctx, tcp, machines)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeNames := make([]string, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		nodeNames = append(nodeNames, strings.Split(node.Name, ".")[0])
+	}
+
+	for kind, names := range map[string][]string{
+		nodeWithoutMachine:   missingFrom(nodeNames, machinesByHostname),
+		machineWithoutNode:   machinesMissingFrom(machinesByHostname, nodeNames),
+		memberWithoutMachine: missingFrom(memberNames, machinesByHostname),
+		machineWithoutMember: machinesMissingFrom(machinesByHostname, memberNames),
+	} {
+		if len(names) > 0 {
+			discrepancies[kind] = names
+		}
+	}
+
+	endpoints, err := r.staleTalosconfigEndpoints(ctx, tcp, machines)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(endpoints) > 0 {
+		discrepancies[endpointWithoutMachine] = endpoints
+	}
+
+	return discrepancies, nil
+}
+
+// etcdMemberNames returns the names of the etcd members.
+func (r *TalosControlPlaneReconciler) etcdMemberNames(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) ([]string, error) {
+	c, err := r.talosconfigForMachines(ctx, tcp, machines...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	resp, err := c.EtcdMemberList(ctx, &machine.EtcdMemberListRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Messages) == 0 {
+		return nil, fmt.Errorf("empty etcd member list response")
+	}
+
+	memberNames := make([]string, 0, len(resp.Messages[0].Members))
+	for _, member := range resp.Messages[0].Members {
+		memberNames = append(memberNames, member.Hostname)
+	}
+
+	return memberNames, nil
+}
+
+// staleTalosconfigEndpoints returns the IP endpoints of the talosconfig from TalosConfigSecretRef
+// which don't belong to any of the control plane machines. DNS endpoints (e.g. load balancers) are not checked.
+func (r *TalosControlPlaneReconciler) staleTalosconfigEndpoints(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) ([]string, error) {
+	t, err := r.talosconfigFromSecretRef(ctx, tcp)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	configContext, ok := t.Contexts[t.Context]
+	if !ok {
+		return nil, nil
+	}
+
+	addresses := map[string]struct{}{}
+
+	discovered, err := r.discoverAddresses(ctx, tcp, machines)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, machineAddrs := range discovered {
+		for _, addr := range machineAddrs {
+			addresses[addr] = struct{}{}
+		}
+	}
+
+	var stale []string
+
+	for _, endpoint := range configContext.Endpoints {
+		host := endpoint
+
+		if h, _, err := net.SplitHostPort(endpoint); err == nil {
+			host = h
+		}
+
+		if net.ParseIP(host) == nil {
+			continue
+		}
+
+		if _, ok := addresses[host]; !ok {
+			stale = append(stale, endpoint)
+		}
+	}
+
+	return stale, nil
+}
+
+// missingFrom returns the names which are not among the machine hostnames.
+func missingFrom(names []string, machinesByHostname map[string]string) []string {
+	var missing []string
+
+	for _, name := range names {
+		if _, ok := machinesByHostname[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// machinesMissingFrom returns the machines whose hostname is not among the names.
+func machinesMissingFrom(machinesByHostname map[string]string, names []string) []string {
+	present := map[string]struct{}{}
+	for _, name := range names {
+		present[name] = struct{}{}
+	}
+
+	var missing []string
+
+	for hostname, machineName := range machinesByHostname {
+		if _, ok := present[hostname]; !ok {
+			missing = append(missing, machineName)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,212 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestAuditTracker(t *testing.T) {
+	var tracker auditTracker
+
+	due, _ := tracker.due("tcp-1")
+	assert.True(t, due)
+
+	due, wait := tracker.due("tcp-1")
+	assert.False(t, due)
+	assert.InDelta(t, membershipAuditInterval, wait, float64(time.Second))
+
+	// the control planes are audited independently
+	due, _ = tracker.due("tcp-2")
+	assert.True(t, due)
+
+	// the previous leader audited the control plane a minute ago
+	tracker.seed("tcp-3", time.Now().Add(-time.Minute))
+
+	due, wait = tracker.due("tcp-3")
+	assert.False(t, due)
+	assert.InDelta(t, membershipAuditInterval-time.Minute, wait, float64(time.Second))
+
+	tracker.seed("tcp-3", time.Now().Add(-membershipAuditInterval))
+
+	due, _ = tracker.due("tcp-3")
+	assert.True(t, due)
+}
+
+func TestMembershipMismatches(t *testing.T) {
+	machinesByHostname := map[string]string{
+		"cp-1": "test-cp-abcde",
+		"cp-2": "test-cp-fghij",
+		"cp-3": "test-cp-klmno",
+	}
+
+	assert.Equal(t, []string{"ghost"}, missingFrom([]string{"cp-1", "ghost", "cp-3"}, machinesByHostname))
+	assert.Empty(t, missingFrom([]string{"cp-1", "cp-2"}, machinesByHostname))
+
+	missing := machinesMissingFrom(machinesByHostname, []string{"cp-2", "ghost"})
+	sort.Strings(missing)
+
+	assert.Equal(t, []string{"test-cp-abcde", "test-cp-klmno"}, missing)
+	assert.Empty(t, machinesMissingFrom(machinesByHostname, []string{"cp-1", "cp-2", "cp-3"}))
+}
+
+func TestStaleTalosconfigEndpoints(t *testing.T) {
+	ctx := context.Background()
+
+	talosconfigSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-talosconfig"},
+		Data: map[string][]byte{
+			talosconfigSecretKey: []byte(`context: test
+contexts:
+  test:
+    endpoints:
+      - 10.5.0.2
+      - 10.5.0.3:50000
+      - 10.5.0.9:50000
+      - 10.5.0.10
+      - lb.example.com
+`),
+		},
+	}
+
+	r := &TalosControlPlaneReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(talosconfigSecret).Build(),
+		Log:    logr.Discard(),
+	}
+
+	tcp := &controlplanev1.TalosControlPlane{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-cp"},
+		Spec: controlplanev1.TalosControlPlaneSpec{
+			AddressSources: []controlplanev1.AddressSourceName{controlplanev1.AnnotationAddressSource},
+		},
+	}
+
+	machines := []clusterv1.Machine{
+		{ObjectMeta: metav1.ObjectMeta{Name: "cp-1", Annotations: map[string]string{controlplanev1.TalosEndpointsAnnotation: "10.5.0.2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cp-2", Annotations: map[string]string{controlplanev1.TalosEndpointsAnnotation: "10.5.0.3"}}},
+	}
+
+	// the talosconfig is generated from the machines
+	stale, err := r.staleTalosconfigEndpoints(ctx, tcp, machines)
+	require.NoError(t, err)
+	assert.Empty(t, stale)
+
+	tcp.Spec.ControlPlaneConfig.TalosConfigSecretRef = &corev1.LocalObjectReference{Name: "test-talosconfig"}
+
+	// the DNS endpoints are not checked
+	stale, err = r.staleTalosconfigEndpoints(ctx, tcp, machines)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.5.0.9:50000", "10.5.0.10"}, stale)
+}
+
+var _ = Describe("Membership audit", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+		machines  []clusterv1.Machine
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+
+		r = &TalosControlPlaneReconciler{
+			Client:   k8sClient,
+			Log:      logr.Discard(),
+			Scheme:   scheme.Scheme,
+			Recorder: record.NewFakeRecorder(8),
+		}
+
+		cluster = &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"}}
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp", UID: "test-cp-uid"},
+			Status:     controlplanev1.TalosControlPlaneStatus{Ready: true},
+		}
+
+		machines = nil
+
+		for _, name := range []string{"cp-1", "cp-2", "cp-3"} {
+			machine := newTestMachine(ctx, namespace, name, nil)
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: name}
+
+			machines = append(machines, *machine)
+		}
+	})
+
+	It("skips the control plane which is not ready", func() {
+		tcp.Status.Ready = false
+
+		result, err := r.reconcileMembershipAudit(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(conditions.Has(tcp, controlplanev1.MembershipConsistentCondition)).To(BeFalse())
+	})
+
+	It("skips the control plane being migrated from KubeadmControlPlane", func() {
+		tcp.Status.KubeadmMigration = &controlplanev1.KubeadmMigrationStatus{Phase: controlplanev1.KubeadmMigrationInProgress}
+
+		result, err := r.reconcileMembershipAudit(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+
+	It("postpones the audit while the machines are changing", func() {
+		machines[1].Status.NodeRef = nil
+
+		result, err := r.reconcileMembershipAudit(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: membershipAuditInterval}))
+
+		Expect(conditions.Has(tcp, controlplanev1.MembershipConsistentCondition)).To(BeFalse())
+
+		// the postponed audit is still due
+		due, _ := r.audits.due(tcp.UID)
+		Expect(due).To(BeTrue())
+	})
+
+	It("reports the failed audit", func() {
+		// there is no kubeconfig Secret of the cluster
+		result, err := r.reconcileMembershipAudit(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: membershipAuditInterval}))
+
+		Expect(conditions.IsFalse(tcp, controlplanev1.MembershipConsistentCondition)).To(BeTrue())
+		Expect(conditions.GetReason(tcp, controlplanev1.MembershipConsistentCondition)).To(Equal(controlplanev1.MembershipAuditFailedReason))
+	})
+
+	It("audits the control plane once per interval", func() {
+		r.audits.seed(tcp.UID, time.Now().Add(-time.Minute))
+
+		result, err := r.reconcileMembershipAudit(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically("~", membershipAuditInterval-time.Minute, time.Second))
+
+		Expect(conditions.Has(tcp, controlplanev1.MembershipConsistentCondition)).To(BeFalse())
+	})
+})
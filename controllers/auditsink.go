@@ -0,0 +1,239 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// Operations reported in the audit records.
+const (
+	auditInitialize  = "initialize"
+	auditBootstrap   = "bootstrap"
+	auditScaleUp     = "scale_up"
+	auditScaleDown   = "scale_down"
+	auditRollout     = "rollout"
+	auditRemediation = "remediation"
+
+	auditKubeadmMigration = "kubeadm_migration"
+)
+
+// Outcomes reported in the audit records.
+const (
+	auditSucceeded = "succeeded"
+	auditFailed    = "failed"
+)
+
+const (
+	// auditSinkQueueSize is the number of records buffered for delivery, records are dropped when it's full.
+	auditSinkQueueSize = 1000
+	// auditSinkAttempts is the number of delivery attempts of a record.
+	auditSinkAttempts = 5
+)
+
+var auditRecordsDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "cacppt_audit_records_dropped_total",
+		Help: "Number of audit records which were not delivered to the audit sink.",
+	},
+)
+
+func init() {
+	metrics.Registry.MustRegister(auditRecordsDropped)
+}
+
+// AuditRecord is the structured record of an operation on the control plane machines.
+type AuditRecord struct {
+	Time         time.Time         `json:"time"`
+	Operation    string            `json:"operation"`
+	Outcome      string            `json:"outcome"`
+	Namespace    string            `json:"namespace"`
+	Cluster      string            `json:"cluster"`
+	ControlPlane string            `json:"controlPlane"`
+	Machine      string            `json:"machine,omitempty"`
+	Message      string            `json:"message,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	DryRun       bool              `json:"dryRun,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// AuditSink receives the audit records, Record must not block the reconcile.
+type AuditSink interface {
+	Record(record AuditRecord)
+}
+
+// HTTPAuditSink posts the audit records as JSON to the URL, one record per request.
+//
+// Records are delivered in the background in order, failed deliveries are retried a few times
+// before the record is dropped.
+type HTTPAuditSink struct {
+	URL    string
+	Client *http.Client
+	Log    logr.Logger
+
+	once    sync.Once
+	records chan AuditRecord
+}
+
+func (s *HTTPAuditSink) queue() chan AuditRecord {
+	s.once.Do(func() {
+		s.records = make(chan AuditRecord, auditSinkQueueSize)
+	})
+
+	return s.records
+}
+
+// Record implements AuditSink.
+func (s *HTTPAuditSink) Record(record AuditRecord) {
+	select {
+	case s.queue() <- record:
+	default:
+		auditRecordsDropped.Inc()
+
+		s.Log.Info("audit sink queue is full, dropping record", "operation", record.Operation, "controlPlane", record.ControlPlane)
+	}
+}
+
+// Start implements manager.Runnable.
+func (s *HTTPAuditSink) Start(ctx context.Context) error {
+	if s.Client == nil {
+		s.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	s.Log.Info("streaming audit records", "url", s.URL)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case record := <-s.queue():
+			s.deliver(ctx, record)
+		}
+	}
+}
+
+func (s *HTTPAuditSink) deliver(ctx context.Context, record AuditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		auditRecordsDropped.Inc()
+
+		s.Log.Error(err, "failed to marshal audit record")
+
+		return
+	}
+
+	backoff := time.Second
+
+	for attempt := 1; ; attempt++ {
+		if err = s.post(ctx, data); err == nil {
+			return
+		}
+
+		if attempt == auditSinkAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+
+	auditRecordsDropped.Inc()
+
+	s.Log.Error(err, "failed to deliver audit record", "operation", record.Operation, "controlPlane", record.ControlPlane)
+}
+
+func (s *HTTPAuditSink) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit sink responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// audit emits the audit record of the operation to the audit sink, the outcome is derived from the error.
+func (r *TalosControlPlaneReconciler) audit(tcp *controlplanev1.TalosControlPlane, clusterName, operation, machine string, err error, message string) {
+	if r.AuditSink == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:         time.Now().UTC(),
+		Operation:    operation,
+		Outcome:      auditSucceeded,
+		Namespace:    tcp.Namespace,
+		Cluster:      clusterName,
+		ControlPlane: tcp.Name,
+		Machine:      machine,
+		Message:      message,
+		DryRun:       r.DryRun,
+		Annotations:  userAnnotations(tcp.Annotations),
+	}
+
+	if err != nil {
+		record.Outcome = auditFailed
+		record.Error = err.Error()
+	}
+
+	r.AuditSink.Record(record)
+}
+
+// controllerAnnotations are the TalosControlPlane annotations managed by the controller.
+var controllerAnnotations = map[string]struct{}{
+	controlplanev1.EtcdMaintenanceAnnotation:       {},
+	controlplanev1.RemediationInProgressAnnotation: {},
+	corev1.LastAppliedConfigAnnotation:             {},
+}
+
+// userAnnotations returns the annotations set by the users (e.g. approvals and skipped checks),
+// the annotations managed by the controller and kubectl are left out.
+func userAnnotations(annotations map[string]string) map[string]string {
+	var filtered map[string]string
+
+	for key, value := range annotations {
+		if _, ok := controllerAnnotations[key]; ok {
+			continue
+		}
+
+		if filtered == nil {
+			filtered = map[string]string{}
+		}
+
+		filtered[key] = value
+	}
+
+	return filtered
+}
@@ -0,0 +1,271 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const (
+	// etcdBackupAccessKeyIDKey is the key of the access key ID in the etcd backup credentials secret.
+	etcdBackupAccessKeyIDKey = "accessKeyID"
+
+	// etcdBackupSecretAccessKeyKey is the key of the secret access key in the etcd backup credentials secret.
+	etcdBackupSecretAccessKeyKey = "secretAccessKey"
+
+	// etcdBackupRetryInterval is the delay before the failed backup is retried.
+	etcdBackupRetryInterval = 5 * time.Minute
+)
+
+// reconcileEtcdBackup takes the etcd snapshot on the configured interval and uploads it to S3-compatible storage.
+//
+// The schedule is tracked in the status, so that the backups are not repeated when the controller restarts.
+// Failed backups are retried after etcdBackupRetryInterval (or the backup interval, if shorter).
+func (r *TalosControlPlaneReconciler) reconcileEtcdBackup(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	backup := tcp.Spec.EtcdBackup
+	if backup == nil {
+		tcp.Status.EtcdBackup = nil
+
+		conditions.Delete(tcp, controlplanev1.EtcdBackupFreshCondition)
+
+		return ctrl.Result{}, nil
+	}
+
+	if !tcp.Status.Bootstrapped {
+		return ctrl.Result{}, nil
+	}
+
+	defer updateEtcdBackupFreshness(tcp)
+
+	if tcp.Status.EtcdBackup == nil {
+		tcp.Status.EtcdBackup = &controlplanev1.EtcdBackupStatus{}
+	}
+
+	status := tcp.Status.EtcdBackup
+
+	if next := nextEtcdBackup(backup, status); time.Now().Before(next) {
+		return ctrl.Result{RequeueAfter: time.Until(next)}, nil
+	}
+
+	if operation, ok := etcdMaintenanceInProgress(tcp); ok {
+		r.Log.Info("postponing etcd backup until etcd maintenance completes", "operation", operation)
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	if r.dryRun(tcp, "uploading etcd backup to bucket %q", backup.S3.Bucket) {
+		return ctrl.Result{RequeueAfter: backup.Interval.Duration}, nil
+	}
+
+	now := metav1.Now()
+	status.LastAttemptTime = &now
+
+	key, err := r.uploadEtcdBackup(ctx, cluster, tcp, machines)
+	if err != nil {
+		r.Log.Info("etcd backup failed", "error", err)
+
+		status.LastError = err.Error()
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdBackupFailed", "Etcd backup failed: %s", err)
+		}
+
+		return ctrl.Result{RequeueAfter: time.Until(nextEtcdBackup(backup, status))}, nil
+	}
+
+	r.Log.Info("uploaded etcd backup", "bucket", backup.S3.Bucket, "object", key)
+
+	status.LastError = ""
+	status.LastSuccessTime = &now
+	status.LastObject = key
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "EtcdBackupUploaded", "Uploaded etcd backup to %s/%s", backup.S3.Bucket, key)
+	}
+
+	return ctrl.Result{RequeueAfter: backup.Interval.Duration}, nil
+}
+
+// nextEtcdBackup returns the time the next backup is due at.
+func nextEtcdBackup(backup *controlplanev1.EtcdBackup, status *controlplanev1.EtcdBackupStatus) time.Time {
+	if status.LastError != "" && status.LastAttemptTime != nil {
+		retry := etcdBackupRetryInterval
+		if backup.Interval.Duration < retry {
+			retry = backup.Interval.Duration
+		}
+
+		return status.LastAttemptTime.Add(retry)
+	}
+
+	if status.LastSuccessTime != nil {
+		return status.LastSuccessTime.Add(backup.Interval.Duration)
+	}
+
+	return time.Time{}
+}
+
+// etcdBackupStale reports whether the last successful etcd backup is older than MaxAge.
+// Control planes which were never bootstrapped have no data to back up, so their backups are never stale.
+func etcdBackupStale(tcp *controlplanev1.TalosControlPlane) bool {
+	backup := tcp.Spec.EtcdBackup
+	if backup == nil || backup.MaxAge == nil || !tcp.Status.Bootstrapped {
+		return false
+	}
+
+	status := tcp.Status.EtcdBackup
+	if status == nil || status.LastSuccessTime == nil {
+		return true
+	}
+
+	return time.Since(status.LastSuccessTime.Time) > backup.MaxAge.Duration
+}
+
+// etcdBackupStaleMessage describes the stale etcd backups.
+func etcdBackupStaleMessage(tcp *controlplanev1.TalosControlPlane) string {
+	status := tcp.Status.EtcdBackup
+	if status == nil || status.LastSuccessTime == nil {
+		return "no etcd backup has succeeded yet"
+	}
+
+	return fmt.Sprintf("last successful etcd backup is %s old, older than %s",
+		time.Since(status.LastSuccessTime.Time).Truncate(time.Second), tcp.Spec.EtcdBackup.MaxAge.Duration)
+}
+
+// updateEtcdBackupFreshness sets the EtcdBackupFresh condition if MaxAge is configured.
+func updateEtcdBackupFreshness(tcp *controlplanev1.TalosControlPlane) {
+	if tcp.Spec.EtcdBackup == nil || tcp.Spec.EtcdBackup.MaxAge == nil {
+		conditions.Delete(tcp, controlplanev1.EtcdBackupFreshCondition)
+
+		return
+	}
+
+	if !etcdBackupStale(tcp) {
+		conditions.MarkTrue(tcp, controlplanev1.EtcdBackupFreshCondition)
+
+		return
+	}
+
+	conditions.MarkFalse(tcp, controlplanev1.EtcdBackupFreshCondition, controlplanev1.EtcdBackupStaleReason,
+		clusterv1.ConditionSeverityWarning, "%s", etcdBackupStaleMessage(tcp))
+}
+
+// holdDeletionForEtcdBackup applies the StaleDeletionPolicy to the deletion of the TalosControlPlane with stale etcd backups,
+// it reports whether the deletion should be held.
+//
+// The control plane is still running at this point, so with the Block policy a final backup is attempted first.
+func (r *TalosControlPlaneReconciler) holdDeletionForEtcdBackup(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (bool, error) {
+	if !etcdBackupStale(tcp) {
+		return false, nil
+	}
+
+	_, skip := tcp.Annotations[controlplanev1.SkipStaleBackupCheckAnnotation]
+
+	if tcp.Spec.EtcdBackup.StaleDeletionPolicy != controlplanev1.StaleBackupDeletionBlock || skip {
+		message := etcdBackupStaleMessage(tcp)
+
+		r.Log.Info("deleting control plane with stale etcd backups", "reason", message)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdBackupStale", "Deleting control plane with stale etcd backups: %s", message)
+		}
+
+		return false, nil
+	}
+
+	if _, err := r.reconcileEtcdBackup(ctx, cluster, tcp, machines); err != nil {
+		return true, err
+	}
+
+	if !etcdBackupStale(tcp) {
+		return false, nil
+	}
+
+	message := etcdBackupStaleMessage(tcp)
+
+	r.Log.Info("control plane deletion is blocked by stale etcd backups", "reason", message)
+
+	if r.Recorder != nil && conditions.GetReason(tcp, controlplanev1.EtcdBackupFreshCondition) != controlplanev1.DeletionBlockedReason {
+		r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "DeletionBlocked", "Deletion is blocked until an etcd backup succeeds: %s", message)
+	}
+
+	conditions.MarkFalse(tcp, controlplanev1.EtcdBackupFreshCondition, controlplanev1.DeletionBlockedReason, clusterv1.ConditionSeverityError,
+		"deletion is blocked until an etcd backup succeeds: %s; set the %q annotation to delete anyway", message, controlplanev1.SkipStaleBackupCheckAnnotation)
+
+	return true, nil
+}
+
+// etcdBackupStorage returns the client of the etcd backup storage with the configured credentials.
+func (r *TalosControlPlaneReconciler) etcdBackupStorage(ctx context.Context, tcp *controlplanev1.TalosControlPlane) (*s3Client, error) {
+	s3 := tcp.Spec.EtcdBackup.S3
+
+	var credentials corev1.Secret
+
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: s3.CredentialsSecretRef.Name}, &credentials); err != nil {
+		return nil, errors.Wrap(err, "Failed to get etcd backup credentials")
+	}
+
+	for _, key := range []string{etcdBackupAccessKeyIDKey, etcdBackupSecretAccessKeyKey} {
+		if len(credentials.Data[key]) == 0 {
+			return nil, fmt.Errorf("etcd backup credentials secret %q has no %q key", credentials.Name, key)
+		}
+	}
+
+	storage, err := newS3Client(s3.Endpoint, s3.Region, string(credentials.Data[etcdBackupAccessKeyIDKey]), string(credentials.Data[etcdBackupSecretAccessKeyKey]))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid etcd backup endpoint")
+	}
+
+	return storage, nil
+}
+
+// uploadEtcdBackup takes the etcd snapshot and uploads it to the bucket, it returns the object key.
+func (r *TalosControlPlaneReconciler) uploadEtcdBackup(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (string, error) {
+	s3 := tcp.Spec.EtcdBackup.S3
+
+	uploader, err := r.etcdBackupStorage(ctx, tcp)
+	if err != nil {
+		return "", err
+	}
+
+	nodes := []clusterv1.Machine{}
+
+	for _, machine := range machines {
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() && machine.Status.NodeRef != nil {
+			nodes = append(nodes, machine)
+		}
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, nodes...)
+	if err != nil {
+		return "", err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	snapshot, err := readEtcdSnapshot(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s%s/%s/etcd-%s.db.gz", s3.Prefix, tcp.Namespace, cluster.Name, time.Now().UTC().Format("20060102T150405Z"))
+
+	if err = uploader.PutObject(ctx, s3.Bucket, key, snapshot); err != nil {
+		return "", errors.Wrapf(err, "Failed to upload etcd backup to %s/%s", s3.Bucket, key)
+	}
+
+	return key, nil
+}
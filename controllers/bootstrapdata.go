@@ -0,0 +1,186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// reconcileBootstrapData detects control plane machines which lost their bootstrap resources.
+//
+// Deleted TalosConfigs are re-created, the bootstrap provider picks up the existing bootstrap data secret of the machine.
+// Deleted bootstrap data secrets can't be re-generated for the already provisioned machine, so they are reported
+// with the BootstrapDataAvailable condition on the machine.
+func (r *TalosControlPlaneReconciler) reconcileBootstrapData(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	var errs error
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := r.recreateTalosConfig(ctx, tcp, &machine); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+
+		if err := r.updateBootstrapDataCondition(ctx, &machine); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
+
+// recreateTalosConfig creates the TalosConfig referenced by the machine again if it was deleted.
+func (r *TalosControlPlaneReconciler) recreateTalosConfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	configRef := machine.Spec.Bootstrap.ConfigRef
+	if configRef == nil || configRef.Kind != "TalosConfig" {
+		return nil
+	}
+
+	var cfg cabptv1.TalosConfig
+
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: machine.Namespace, Name: configRef.Name}, &cfg)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	spec, err := renderConfigSpec(tcp, &tcp.Spec.ControlPlaneConfig.ControlPlaneConfig)
+	if err != nil {
+		return errors.Wrap(err, "Failed to render bootstrap configuration")
+	}
+
+	cfg = cabptv1.TalosConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configRef.Name,
+			Namespace: machine.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion:         controlplanev1.GroupVersion.String(),
+					Kind:               "TalosControlPlane",
+					Name:               tcp.Name,
+					UID:                tcp.UID,
+					BlockOwnerDeletion: pointer.BoolPtr(true),
+				},
+				{
+					APIVersion: clusterv1.GroupVersion.String(),
+					Kind:       "Machine",
+					Name:       machine.Name,
+					UID:        machine.UID,
+				},
+			},
+		},
+		Spec: *spec,
+	}
+
+	if err = r.Client.Create(ctx, &cfg); err != nil {
+		return errors.Wrapf(err, "Failed to re-create bootstrap configuration for machine %q", machine.Name)
+	}
+
+	r.Log.Info("re-created deleted bootstrap configuration", "machine", machine.Name, "talosConfig", cfg.Name)
+
+	return nil
+}
+
+// updateBootstrapDataCondition reports whether the bootstrap data secret of the machine exists.
+func (r *TalosControlPlaneReconciler) updateBootstrapDataCondition(ctx context.Context, machine *clusterv1.Machine) error {
+	// bootstrap data is not generated yet
+	if machine.Spec.Bootstrap.DataSecretName == nil {
+		return nil
+	}
+
+	var secret corev1.Secret
+
+	getErr := r.Client.Get(ctx, client.ObjectKey{Namespace: machine.Namespace, Name: *machine.Spec.Bootstrap.DataSecretName}, &secret)
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
+
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	if apierrors.IsNotFound(getErr) {
+		r.Log.Info("bootstrap data secret is missing", "machine", machine.Name, "secret", *machine.Spec.Bootstrap.DataSecretName)
+
+		conditions.MarkFalse(machine, controlplanev1.MachineBootstrapDataAvailableCondition, controlplanev1.BootstrapDataMissingReason,
+			clusterv1.ConditionSeverityError, "Bootstrap data secret %q is missing, the machine can't be re-provisioned", *machine.Spec.Bootstrap.DataSecretName)
+	} else {
+		conditions.MarkTrue(machine, controlplanev1.MachineBootstrapDataAvailableCondition)
+	}
+
+	return patchHelper.Patch(ctx, machine, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{
+		controlplanev1.MachineBootstrapDataAvailableCondition,
+	}})
+}
+
+// reconcileMachineBootstrapConfigs records the TalosConfig each control plane machine was created with in the machine statuses.
+//
+// The reference is recorded once, when the TalosConfig is first observed: a TalosConfig re-created for the machine later
+// is not what the machine booted with.
+func (r *TalosControlPlaneReconciler) reconcileMachineBootstrapConfigs(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	machinesByName := map[string]*clusterv1.Machine{}
+
+	for i := range machines {
+		machinesByName[machines[i].Name] = &machines[i]
+	}
+
+	var errs error
+
+	for i := range tcp.Status.MachineStatuses {
+		status := &tcp.Status.MachineStatuses[i]
+
+		machine, ok := machinesByName[status.Name]
+		if !ok || status.BootstrapConfig != nil {
+			continue
+		}
+
+		configRef := machine.Spec.Bootstrap.ConfigRef
+		if configRef == nil || configRef.Kind != "TalosConfig" {
+			continue
+		}
+
+		var cfg cabptv1.TalosConfig
+
+		if err := r.Client.Get(ctx, client.ObjectKey{Namespace: machine.Namespace, Name: configRef.Name}, &cfg); err != nil {
+			if !apierrors.IsNotFound(err) {
+				errs = kerrors.NewAggregate([]error{errs, err})
+			}
+
+			continue
+		}
+
+		// the TalosConfig was re-created after the machine
+		if configRef.UID != "" && configRef.UID != cfg.UID {
+			continue
+		}
+
+		status.BootstrapConfig = &controlplanev1.BootstrapConfigReference{
+			Name:       cfg.Name,
+			UID:        cfg.UID,
+			Generation: cfg.Generation,
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+)
+
+var (
+	// etcdStopsOnLeaveVersion is the first Talos version which stops etcd and the API server
+	// on etcd leave, so that the node doesn't need to be shut down.
+	etcdStopsOnLeaveVersion = semver.Version{Major: 0, Minor: 12, Patch: 2}
+
+	// machineStatusVersion is the first Talos version which publishes the MachineStatus resource.
+	machineStatusVersion = semver.Version{Major: 1, Minor: 2}
+)
+
+// talosCapabilities describes the Talos API features available on a set of nodes.
+//
+// Capabilities are derived from the oldest Talos version found, so that the features are only used
+// when every node supports them.
+type talosCapabilities struct {
+	version *semver.Version
+}
+
+// detectTalosCapabilities queries the Talos version of the nodes targeted by the context.
+func detectTalosCapabilities(ctx context.Context, c *talosclient.Client) (*talosCapabilities, error) {
+	resp, err := c.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &talosCapabilities{}
+
+	for _, message := range resp.Messages {
+		version, err := semver.NewVersion(strings.TrimPrefix(message.GetVersion().GetTag(), "v"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Talos version of node %s: %w", message.GetMetadata().GetHostname(), err)
+		}
+
+		if caps.version == nil || version.LessThan(*caps.version) {
+			caps.version = version
+		}
+	}
+
+	if caps.version == nil {
+		return nil, fmt.Errorf("no Talos version reported")
+	}
+
+	return caps, nil
+}
+
+// atLeast checks whether all nodes run the given Talos version or newer.
+//
+// Pre-releases of the version are considered to support it.
+func (caps *talosCapabilities) atLeast(version semver.Version) bool {
+	current := *caps.version
+	current.PreRelease = ""
+
+	return !current.LessThan(version)
+}
+
+// etcdStopsOnLeave reports whether Talos stops etcd on the node leaving the etcd cluster.
+func (caps *talosCapabilities) etcdStopsOnLeave() bool {
+	return caps.atLeast(etcdStopsOnLeaveVersion)
+}
+
+// machineStatus reports whether Talos publishes the MachineStatus resource.
+func (caps *talosCapabilities) machineStatus() bool {
+	return caps.atLeast(machineStatusVersion)
+}
@@ -0,0 +1,691 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	talosx509 "github.com/talos-systems/crypto/x509"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	talosconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	"github.com/talos-systems/talos/pkg/machinery/config"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/generate"
+	"github.com/talos-systems/talos/pkg/machinery/role"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+const (
+	// caRotationOperation is the etcd maintenance operation set while the certificate authorities are rotated.
+	caRotationOperation = "ca-rotation"
+
+	// caRotationAdminCertificateTTL is the lifetime of the talosconfig client certificate issued by the new Talos CA.
+	caRotationAdminCertificateTTL = 87600 * time.Hour
+)
+
+// caKeyPair is a PEM-encoded certificate authority.
+type caKeyPair struct {
+	crt, key []byte
+}
+
+// caPair is the old and the new certificate authority.
+type caPair struct {
+	old, new caKeyPair
+}
+
+// phase returns the trusted certificates bundle and the issuing key for the rotation phase.
+//
+// The issuing certificate always goes first in the bundle, as the consumers pick the first certificate to issue with.
+func (p caPair) phase(phase controlplanev1.CARotationPhase) caKeyPair {
+	switch phase {
+	case controlplanev1.CARotationTrustNew:
+		return caKeyPair{crt: joinPEM(p.old.crt, p.new.crt), key: p.old.key}
+	case controlplanev1.CARotationIssueNew:
+		return caKeyPair{crt: joinPEM(p.new.crt, p.old.crt), key: p.new.key}
+	default:
+		return p.new
+	}
+}
+
+func joinPEM(blocks ...[]byte) []byte {
+	var buf bytes.Buffer
+
+	for _, block := range blocks {
+		buf.Write(bytes.TrimSpace(block))
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// nextCARotationPhase returns the phase following the given one.
+func nextCARotationPhase(phase controlplanev1.CARotationPhase) controlplanev1.CARotationPhase {
+	if phase == controlplanev1.CARotationTrustNew {
+		return controlplanev1.CARotationIssueNew
+	}
+
+	return controlplanev1.CARotationDropOld
+}
+
+// reconcileCARotation rotates the certificate authorities requested with the RotateCAAnnotation.
+//
+// Talos v0.14 has no notion of additional accepted CAs, so the trust is moved over with certificate bundles
+// in three phases: trust both CAs, issue with the new CA, drop the old CA. Each phase is applied to the control plane
+// machines one at a time by updating the machine configuration on the node and rebooting it, waiting for the node
+// to boot and etcd to be healthy before the next machine.
+//
+// Once all control plane machines are updated, the secrets used for the new machines (the secrets bundle,
+// the cluster CA and the talosconfig used by the controller) are updated for the phase. The worker machines are
+// not managed by the control plane, so before the next phase starts, the workers created before have to be replaced
+// (e.g. by rolling out the MachineDeployments) to pick up the published secrets.
+func (r *TalosControlPlaneReconciler) reconcileCARotation(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	rotation := tcp.Status.CARotation
+
+	if rotation == nil {
+		return r.startCARotation(ctx, cluster, tcp)
+	}
+
+	pairs, err := r.loadCARotation(ctx, tcp, rotation)
+	if err != nil {
+		return r.caRotationFailed(tcp, err)
+	}
+
+	if rotation.PendingMachine != "" {
+		rebooted, err := r.caRotationMachineRebooted(ctx, tcp, machines, rotation)
+		if err != nil {
+			return r.caRotationFailed(tcp, err)
+		}
+
+		if !rebooted {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+
+		r.Log.Info("machine rebooted with rotated certificate authorities", "machine", rotation.PendingMachine, "phase", rotation.Phase)
+
+		rotation.UpdatedMachines = append(rotation.UpdatedMachines, rotation.PendingMachine)
+		rotation.PendingMachine = ""
+		rotation.AppliedTime = nil
+	}
+
+	if next := nextCARotationMachine(machines, rotation); next != nil {
+		return r.rotateMachineCA(ctx, cluster, tcp, machines, next, pairs)
+	}
+
+	if rotation.PublishedTime == nil {
+		if err = r.publishCARotation(ctx, cluster, tcp, machines, pairs, rotation.Phase); err != nil {
+			return r.caRotationFailed(tcp, err)
+		}
+
+		now := metav1.Now()
+		rotation.PublishedTime = &now
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "CARotationPhaseCompleted", "Completed the %s phase of the certificate authority rotation", rotation.Phase)
+		}
+	}
+
+	if rotation.Phase == controlplanev1.CARotationDropOld {
+		r.Log.Info("certificate authority rotation completed", "authorities", rotation.Authorities)
+
+		tcp.Status.CARotation = nil
+
+		delete(tcp.Annotations, controlplanev1.RotateCAAnnotation)
+		finishEtcdMaintenance(tcp, caRotationOperation)
+
+		conditions.MarkTrue(tcp, controlplanev1.CARotatedCondition)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "CARotationCompleted", "Rotated certificate authorities %v", rotation.Authorities)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	outdated, err := r.workersCreatedBefore(ctx, cluster, rotation.PublishedTime.Time)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(outdated) > 0 {
+		conditions.MarkFalse(tcp, controlplanev1.CARotatedCondition, controlplanev1.WaitingForWorkerRolloutReason, clusterv1.ConditionSeverityWarning,
+			"worker machines %s were created before the %s phase completed, replace them to continue the rotation", strings.Join(outdated, ", "), rotation.Phase)
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	rotation.Phase = nextCARotationPhase(rotation.Phase)
+	rotation.UpdatedMachines = nil
+	rotation.PublishedTime = nil
+
+	r.Log.Info("starting certificate authority rotation phase", "phase", rotation.Phase)
+
+	return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+}
+
+// startCARotation generates the new certificate authorities if the rotation is requested.
+func (r *TalosControlPlaneReconciler) startCARotation(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane) (ctrl.Result, error) {
+	value, ok := tcp.Annotations[controlplanev1.RotateCAAnnotation]
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	authorities, err := parseCertificateAuthorities(value)
+	if err != nil {
+		conditions.MarkFalse(tcp, controlplanev1.CARotatedCondition, controlplanev1.CARotationFailedReason, clusterv1.ConditionSeverityError,
+			"invalid %s annotation: %s", controlplanev1.RotateCAAnnotation, err)
+
+		return ctrl.Result{}, nil
+	}
+
+	if !tcp.Status.Bootstrapped || tcp.Status.Rollout != nil {
+		r.Log.Info("postponing certificate authority rotation until the control plane is bootstrapped and up to date")
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	if operation, ok := etcdMaintenanceInProgress(tcp); ok {
+		r.Log.Info("postponing certificate authority rotation until etcd maintenance completes", "operation", operation)
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	if r.dryRun(tcp, "rotating certificate authorities %s", value) {
+		return ctrl.Result{}, nil
+	}
+
+	bundle, _, err := r.secretsBundle(ctx, cluster)
+	if err != nil {
+		return r.caRotationFailed(tcp, err)
+	}
+
+	now := time.Now()
+	data := map[string][]byte{}
+
+	for _, authority := range authorities {
+		var (
+			old *talosx509.PEMEncodedCertificateAndKey
+			ca  *talosx509.CertificateAuthority
+		)
+
+		switch authority {
+		case controlplanev1.TalosCertificateAuthority:
+			old = bundle.Certs.OS
+			ca, err = generate.NewTalosCA(now)
+		case controlplanev1.KubernetesCertificateAuthority:
+			old = bundle.Certs.K8s
+			ca, err = generate.NewKubernetesCA(now, config.TalosVersionCurrent)
+		}
+
+		if err != nil {
+			return r.caRotationFailed(tcp, fmt.Errorf("failed to generate %s certificate authority: %w", authority, err))
+		}
+
+		if old == nil {
+			return r.caRotationFailed(tcp, fmt.Errorf("secrets bundle has no %s certificate authority", authority))
+		}
+
+		data[string(authority)+"-old.crt"] = old.Crt
+		data[string(authority)+"-old.key"] = old.Key
+		data[string(authority)+".crt"] = ca.CrtPEM
+		data[string(authority)+".key"] = ca.KeyPEM
+	}
+
+	owner := metav1.OwnerReference{
+		APIVersion: controlplanev1.GroupVersion.String(),
+		Kind:       "TalosControlPlane",
+		Name:       tcp.Name,
+		UID:        tcp.UID,
+	}
+
+	if err = r.secretsBackend().Put(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: caRotationSecretName(tcp)}, data, owner); err != nil {
+		return r.caRotationFailed(tcp, err)
+	}
+
+	start := metav1.NewTime(now)
+
+	tcp.Status.CARotation = &controlplanev1.CARotationStatus{
+		Authorities: authorities,
+		Phase:       controlplanev1.CARotationTrustNew,
+		StartTime:   &start,
+	}
+
+	startEtcdMaintenance(tcp, caRotationOperation)
+
+	conditions.MarkFalse(tcp, controlplanev1.CARotatedCondition, controlplanev1.CARotationInProgressReason, clusterv1.ConditionSeverityInfo,
+		"starting the %s phase", controlplanev1.CARotationTrustNew)
+
+	r.Log.Info("started certificate authority rotation", "authorities", authorities)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "CARotationStarted", "Started rotation of certificate authorities %v", authorities)
+	}
+
+	return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+}
+
+// caRotationFailed reports the rotation failure, the step is retried on the next reconcile.
+func (r *TalosControlPlaneReconciler) caRotationFailed(tcp *controlplanev1.TalosControlPlane, err error) (ctrl.Result, error) {
+	conditions.MarkFalse(tcp, controlplanev1.CARotatedCondition, controlplanev1.CARotationFailedReason, clusterv1.ConditionSeverityError, "%s", err)
+
+	return ctrl.Result{}, err
+}
+
+// parseCertificateAuthorities parses the value of the RotateCAAnnotation.
+func parseCertificateAuthorities(value string) ([]controlplanev1.CertificateAuthority, error) {
+	seen := map[controlplanev1.CertificateAuthority]struct{}{}
+	authorities := []controlplanev1.CertificateAuthority{}
+
+	for _, field := range strings.Split(value, ",") {
+		authority := controlplanev1.CertificateAuthority(strings.TrimSpace(field))
+
+		switch authority {
+		case controlplanev1.TalosCertificateAuthority, controlplanev1.KubernetesCertificateAuthority:
+		default:
+			return nil, fmt.Errorf("unknown certificate authority %q, expected %q or %q",
+				authority, controlplanev1.TalosCertificateAuthority, controlplanev1.KubernetesCertificateAuthority)
+		}
+
+		if _, ok := seen[authority]; ok {
+			continue
+		}
+
+		seen[authority] = struct{}{}
+		authorities = append(authorities, authority)
+	}
+
+	sort.Slice(authorities, func(i, j int) bool { return authorities[i] < authorities[j] })
+
+	return authorities, nil
+}
+
+func caRotationSecretName(tcp *controlplanev1.TalosControlPlane) string {
+	return tcp.Name + "-ca-rotation"
+}
+
+func rotatedTalosconfigSecretName(tcp *controlplanev1.TalosControlPlane) string {
+	return tcp.Name + "-rotated-talosconfig"
+}
+
+// loadCARotation loads the old and the new certificate authorities generated when the rotation started.
+func (r *TalosControlPlaneReconciler) loadCARotation(ctx context.Context, tcp *controlplanev1.TalosControlPlane, rotation *controlplanev1.CARotationStatus) (map[controlplanev1.CertificateAuthority]caPair, error) {
+	data, err := r.secretsBackend().Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: caRotationSecretName(tcp)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the rotated certificate authorities: %w", err)
+	}
+
+	pairs := map[controlplanev1.CertificateAuthority]caPair{}
+
+	for _, authority := range rotation.Authorities {
+		pair := caPair{
+			old: caKeyPair{crt: data[string(authority)+"-old.crt"], key: data[string(authority)+"-old.key"]},
+			new: caKeyPair{crt: data[string(authority)+".crt"], key: data[string(authority)+".key"]},
+		}
+
+		if len(pair.old.crt) == 0 || len(pair.old.key) == 0 || len(pair.new.crt) == 0 || len(pair.new.key) == 0 {
+			return nil, fmt.Errorf("secret %q is missing the %s certificate authority", caRotationSecretName(tcp), authority)
+		}
+
+		pairs[authority] = pair
+	}
+
+	return pairs, nil
+}
+
+// nextCARotationMachine picks the next control plane machine to apply the current phase to.
+func nextCARotationMachine(machines []clusterv1.Machine, rotation *controlplanev1.CARotationStatus) *clusterv1.Machine {
+	updated := map[string]struct{}{}
+
+	for _, name := range rotation.UpdatedMachines {
+		updated[name] = struct{}{}
+	}
+
+	var next *clusterv1.Machine
+
+	for i := range machines {
+		machine := &machines[i]
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if _, ok := updated[machine.Name]; ok {
+			continue
+		}
+
+		if next == nil || machine.Name < next.Name {
+			next = machine
+		}
+	}
+
+	return next
+}
+
+// rotateMachineCA applies the configuration of the current phase to the machine, once the control plane is healthy.
+func (r *TalosControlPlaneReconciler) rotateMachineCA(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine,
+	machine *clusterv1.Machine, pairs map[controlplanev1.CertificateAuthority]caPair,
+) (ctrl.Result, error) {
+	rotation := tcp.Status.CARotation
+
+	for _, m := range machines {
+		if m.Status.NodeRef == nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+		}
+	}
+
+	if err := r.ensureNodesBooted(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for all nodes to finish boot sequence before rotating certificate authorities", "error", err)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if !conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) {
+		r.Log.Info("waiting for etcd to become healthy before rotating certificate authorities")
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	r.Log.Info("applying rotated certificate authorities", "machine", machine.Name, "phase", rotation.Phase)
+
+	if err := r.applyMachineCA(ctx, tcp, machine, pairs, rotation.Phase); err != nil {
+		return r.caRotationFailed(tcp, fmt.Errorf("failed to apply the %s phase to machine %q: %w", rotation.Phase, machine.Name, err))
+	}
+
+	now := metav1.Now()
+
+	rotation.PendingMachine = machine.Name
+	rotation.AppliedTime = &now
+
+	conditions.MarkFalse(tcp, controlplanev1.CARotatedCondition, controlplanev1.CARotationInProgressReason, clusterv1.ConditionSeverityInfo,
+		"applying the %s phase to machine %q (%d of %d updated)", rotation.Phase, machine.Name, len(rotation.UpdatedMachines), len(machines))
+
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+// applyMachineCA updates the certificate authorities in the machine configuration on the node, the node reboots to apply it.
+func (r *TalosControlPlaneReconciler) applyMachineCA(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine,
+	pairs map[controlplanev1.CertificateAuthority]caPair, phase controlplanev1.CARotationPhase,
+) error {
+	if r.dryRun(tcp, "applying the %s phase of the certificate authority rotation to machine %q", phase, machine.Name) {
+		return nil
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	current, err := readNodeFile(ctx, c, "/system/state/config.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read machine configuration: %w", err)
+	}
+
+	data, err := patchCAConfig(current, pairs, phase)
+	if err != nil {
+		return err
+	}
+
+	// the configuration is applied with a reboot
+	if _, err = c.ApplyConfiguration(ctx, &machineapi.ApplyConfigurationRequest{
+		Data: data,
+	}); err != nil {
+		return fmt.Errorf("failed to apply machine configuration: %w", err)
+	}
+
+	return nil
+}
+
+// patchCAConfig replaces the certificate authorities in the machine configuration with the ones of the phase.
+func patchCAConfig(data []byte, pairs map[controlplanev1.CertificateAuthority]caPair, phase controlplanev1.CARotationPhase) ([]byte, error) {
+	var cfg map[string]interface{}
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse machine configuration: %w", err)
+	}
+
+	sections := map[controlplanev1.CertificateAuthority]string{
+		controlplanev1.TalosCertificateAuthority:      "machine",
+		controlplanev1.KubernetesCertificateAuthority: "cluster",
+	}
+
+	for authority, pair := range pairs {
+		section, _ := cfg[sections[authority]].(map[string]interface{}) //nolint:errcheck
+		if section == nil {
+			return nil, fmt.Errorf("machine configuration has no %s section", sections[authority])
+		}
+
+		ca := pair.phase(phase)
+
+		section["ca"] = map[string]interface{}{
+			"crt": base64.StdEncoding.EncodeToString(ca.crt),
+			"key": base64.StdEncoding.EncodeToString(ca.key),
+		}
+	}
+
+	return yaml.Marshal(cfg)
+}
+
+// caRotationMachineRebooted checks whether the pending machine rebooted after the configuration was applied.
+func (r *TalosControlPlaneReconciler) caRotationMachineRebooted(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, rotation *controlplanev1.CARotationStatus) (bool, error) {
+	var machine *clusterv1.Machine
+
+	for i := range machines {
+		if machines[i].Name == rotation.PendingMachine {
+			machine = &machines[i]
+		}
+	}
+
+	// the machine is gone (e.g. remediated), its replacement is picked up as a machine to update
+	if machine == nil || !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+		rotation.PendingMachine = ""
+		rotation.AppliedTime = nil
+
+		return false, nil
+	}
+
+	if r.DryRun {
+		return true, nil
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		r.Log.Info("waiting for machine to come back", "machine", machine.Name, "error", err)
+
+		return false, nil
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	bootTime, err := nodeBootTime(ctx, c)
+	if err != nil || rotation.AppliedTime == nil || bootTime.Before(rotation.AppliedTime.Time) {
+		r.Log.Info("waiting for machine to reboot", "machine", machine.Name, "error", err)
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// publishCARotation updates the secrets used for the new machines and by the controller with the certificate authorities of the phase.
+//
+// The secrets bundle and the cluster CA are always written to Kubernetes Secrets, as the bootstrap provider reads them from there,
+// only the rotated talosconfig used by the controller is kept in the secrets backend.
+func (r *TalosControlPlaneReconciler) publishCARotation(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine,
+	pairs map[controlplanev1.CertificateAuthority]caPair, phase controlplanev1.CARotationPhase,
+) error {
+	bundle, bundleSecret, err := r.secretsBundle(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	owner := metav1.OwnerReference{
+		APIVersion: controlplanev1.GroupVersion.String(),
+		Kind:       "TalosControlPlane",
+		Name:       tcp.Name,
+		UID:        tcp.UID,
+	}
+
+	if pair, ok := pairs[controlplanev1.TalosCertificateAuthority]; ok {
+		ca := pair.phase(phase)
+
+		bundle.Certs.OS = &talosx509.PEMEncodedCertificateAndKey{Crt: ca.crt, Key: ca.key}
+
+		t, err := rotatedTalosconfig(cluster, machines, ca.crt, pair.new)
+		if err != nil {
+			return err
+		}
+
+		data, err := t.Bytes()
+		if err != nil {
+			return err
+		}
+
+		name := rotatedTalosconfigSecretName(tcp)
+
+		if err = r.secretsBackend().Put(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: name}, map[string][]byte{talosconfigSecretKey: data}, owner); err != nil {
+			return err
+		}
+
+		tcp.Status.TalosConfigSecretRef = &corev1.LocalObjectReference{Name: name}
+	}
+
+	if pair, ok := pairs[controlplanev1.KubernetesCertificateAuthority]; ok {
+		ca := pair.phase(phase)
+
+		bundle.Certs.K8s = &talosx509.PEMEncodedCertificateAndKey{Crt: ca.crt, Key: ca.key}
+
+		caKey := client.ObjectKey{Namespace: cluster.Namespace, Name: secret.Name(cluster.Name, secret.ClusterCA)}
+
+		// the cluster CA is read by the bootstrap provider and CAPI from Kubernetes whatever the secrets backend is
+		clusterCA, err := r.kubernetesSecrets().Get(ctx, caKey)
+		if err != nil {
+			return err
+		}
+
+		clusterCA[secret.TLSCrtDataName] = ca.crt
+		clusterCA[secret.TLSKeyDataName] = ca.key
+
+		if err = r.kubernetesSecrets().Put(ctx, caKey, clusterCA, owner); err != nil {
+			return err
+		}
+
+		// the kubeconfig is regenerated with the published cluster CA
+		kubeconfigSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: cluster.Namespace,
+				Name:      secret.Name(cluster.Name, secret.Kubeconfig),
+			},
+		}
+
+		if err = r.Client.Delete(ctx, kubeconfigSecret); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	data, err := yaml.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	bundleSecret.Data[secretsBundleKey] = data
+
+	return r.Client.Update(ctx, bundleSecret)
+}
+
+// rotatedTalosconfig builds the talosconfig trusting the CA bundle with the client certificate issued by the new Talos CA.
+func rotatedTalosconfig(cluster *clusterv1.Cluster, machines []clusterv1.Machine, trusted []byte, ca caKeyPair) (*talosconfig.Config, error) {
+	admin, err := generate.NewAdminCertificateAndKey(time.Now(), &talosx509.PEMEncodedCertificateAndKey{Crt: ca.crt, Key: ca.key},
+		role.MakeSet(role.Admin), caRotationAdminCertificateTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue talosconfig certificate: %w", err)
+	}
+
+	return &talosconfig.Config{
+		Context: cluster.Name,
+		Contexts: map[string]*talosconfig.Context{
+			cluster.Name: {
+				Endpoints: machineAddresses(machines),
+				CA:        base64.StdEncoding.EncodeToString(trusted),
+				Crt:       base64.StdEncoding.EncodeToString(admin.Crt),
+				Key:       base64.StdEncoding.EncodeToString(admin.Key),
+			},
+		},
+	}, nil
+}
+
+// secretsBundleKey is the key of the secrets bundle in the "<cluster>-talos" secret written by the bootstrap provider.
+const secretsBundleKey = "bundle"
+
+// secretsBundle loads the cluster secrets bundle the bootstrap provider generates the machine configurations from.
+func (r *TalosControlPlaneReconciler) secretsBundle(ctx context.Context, cluster *clusterv1.Cluster) (*generate.SecretsBundle, *corev1.Secret, error) {
+	var s corev1.Secret
+
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Name + "-talos"}, &s); err != nil {
+		return nil, nil, fmt.Errorf("failed to load the secrets bundle: %w", err)
+	}
+
+	data, ok := s.Data[secretsBundleKey]
+	if !ok {
+		return nil, nil, tcpclient.Terminal(fmt.Errorf("secret %q doesn't have the %q key, secrets in the legacy format can't be rotated", s.Name, secretsBundleKey))
+	}
+
+	var bundle generate.SecretsBundle
+
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the secrets bundle: %w", err)
+	}
+
+	if bundle.Certs == nil {
+		return nil, nil, fmt.Errorf("secrets bundle has no certificates")
+	}
+
+	return &bundle, &s, nil
+}
+
+// workersCreatedBefore returns the names of the worker machines of the cluster created before the given time.
+func (r *TalosControlPlaneReconciler) workersCreatedBefore(ctx context.Context, cluster *clusterv1.Cluster, t time.Time) ([]string, error) {
+	var machines clusterv1.MachineList
+
+	if err := r.Client.List(ctx, &machines, client.InNamespace(cluster.Namespace), client.MatchingLabels{clusterv1.ClusterLabelName: cluster.Name}); err != nil {
+		return nil, err
+	}
+
+	outdated := []string{}
+
+	for _, machine := range machines.Items {
+		if _, ok := machine.Labels[clusterv1.MachineControlPlaneLabelName]; ok {
+			continue
+		}
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if machine.CreationTimestamp.Time.Before(t) {
+			outdated = append(outdated, machine.Name)
+		}
+	}
+
+	sort.Strings(outdated)
+
+	return outdated, nil
+}
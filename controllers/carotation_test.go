@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/talos/pkg/machinery/config"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/generate"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestParseCertificateAuthorities(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		value    string
+		expected []controlplanev1.CertificateAuthority
+		err      bool
+	}{
+		{
+			name:     "single",
+			value:    "talos",
+			expected: []controlplanev1.CertificateAuthority{controlplanev1.TalosCertificateAuthority},
+		},
+		{
+			name:  "sorted",
+			value: "talos,kubernetes",
+			expected: []controlplanev1.CertificateAuthority{
+				controlplanev1.KubernetesCertificateAuthority,
+				controlplanev1.TalosCertificateAuthority,
+			},
+		},
+		{
+			name:  "spaces",
+			value: " kubernetes , talos ",
+			expected: []controlplanev1.CertificateAuthority{
+				controlplanev1.KubernetesCertificateAuthority,
+				controlplanev1.TalosCertificateAuthority,
+			},
+		},
+		{
+			name:     "duplicates",
+			value:    "kubernetes,kubernetes",
+			expected: []controlplanev1.CertificateAuthority{controlplanev1.KubernetesCertificateAuthority},
+		},
+		{
+			name:  "empty",
+			value: "",
+			err:   true,
+		},
+		{
+			name:  "empty item",
+			value: "talos,",
+			err:   true,
+		},
+		{
+			name:  "unknown",
+			value: "talos,etcd",
+			err:   true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			authorities, err := parseCertificateAuthorities(tt.value)
+			if tt.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, authorities)
+		})
+	}
+}
+
+func newTestCA(t *testing.T) caKeyPair {
+	t.Helper()
+
+	ca, err := generate.NewKubernetesCA(time.Now(), config.TalosVersionCurrent)
+	require.NoError(t, err)
+
+	return caKeyPair{crt: ca.CrtPEM, key: ca.KeyPEM}
+}
+
+// pemCertificates returns the DER-encoded certificates of the PEM bundles in order.
+func pemCertificates(t *testing.T, bundles ...[]byte) [][]byte {
+	t.Helper()
+
+	var certificates [][]byte
+
+	for _, data := range bundles {
+		for {
+			var block *pem.Block
+
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			require.Equal(t, "CERTIFICATE", block.Type)
+
+			certificates = append(certificates, block.Bytes)
+		}
+	}
+
+	return certificates
+}
+
+// TestCARotationPhases walks the rotation phases checking the trusted bundle and the issuing key of each phase,
+// and that they are published to the Kubernetes Secrets read by the bootstrap provider even if the secrets backend is Vault.
+func TestCARotationPhases(t *testing.T) {
+	ctx := context.Background()
+
+	pair := caPair{old: newTestCA(t), new: newTestCA(t)}
+
+	bundle, err := generate.NewSecretsBundle(generate.NewClock())
+	require.NoError(t, err)
+
+	bundleData, err := yaml.Marshal(bundle)
+	require.NoError(t, err)
+
+	cluster := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"}}
+	tcp := &controlplanev1.TalosControlPlane{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-cp", UID: "tcp-uid"}}
+
+	caKey := client.ObjectKey{Namespace: "default", Name: secret.Name(cluster.Name, secret.ClusterCA)}
+	bundleKey := client.ObjectKey{Namespace: "default", Name: cluster.Name + "-talos"}
+
+	vault, server := newFakeVault(t, "token")
+
+	r := &TalosControlPlaneReconciler{
+		Client: fake.NewClientBuilder().WithObjects(
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: caKey.Namespace, Name: caKey.Name},
+				Data: map[string][]byte{
+					secret.TLSCrtDataName: pair.old.crt,
+					secret.TLSKeyDataName: pair.old.key,
+				},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: bundleKey.Namespace, Name: bundleKey.Name},
+				Data:       map[string][]byte{secretsBundleKey: bundleData},
+			},
+		).Build(),
+		SecretsBackend: &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "token"},
+	}
+
+	phase := controlplanev1.CARotationTrustNew
+
+	for _, expected := range []struct {
+		phase   controlplanev1.CARotationPhase
+		trusted [][]byte
+		key     []byte
+	}{
+		{controlplanev1.CARotationTrustNew, [][]byte{pair.old.crt, pair.new.crt}, pair.old.key},
+		{controlplanev1.CARotationIssueNew, [][]byte{pair.new.crt, pair.old.crt}, pair.new.key},
+		{controlplanev1.CARotationDropOld, [][]byte{pair.new.crt}, pair.new.key},
+	} {
+		require.Equal(t, expected.phase, phase)
+
+		ca := pair.phase(phase)
+
+		// the issuing certificate goes first in the bundle
+		assert.Equal(t, pemCertificates(t, expected.trusted...), pemCertificates(t, ca.crt), "phase %s", phase)
+		assert.Equal(t, expected.key, ca.key, "phase %s", phase)
+
+		require.NoError(t, r.publishCARotation(ctx, cluster, tcp, nil, map[controlplanev1.CertificateAuthority]caPair{
+			controlplanev1.KubernetesCertificateAuthority: pair,
+		}, phase))
+
+		var clusterCA corev1.Secret
+
+		require.NoError(t, r.Client.Get(ctx, caKey, &clusterCA))
+		assert.Equal(t, ca.crt, clusterCA.Data[secret.TLSCrtDataName], "phase %s", phase)
+		assert.Equal(t, ca.key, clusterCA.Data[secret.TLSKeyDataName], "phase %s", phase)
+
+		published, _, err := r.secretsBundle(ctx, cluster)
+		require.NoError(t, err)
+		assert.Equal(t, ca.crt, published.Certs.K8s.Crt, "phase %s", phase)
+		assert.Equal(t, ca.key, published.Certs.K8s.Key, "phase %s", phase)
+
+		phase = nextCARotationPhase(phase)
+	}
+
+	// the last phase is final
+	assert.Equal(t, controlplanev1.CARotationDropOld, phase)
+
+	assert.Zero(t, vault.requestCount())
+}
@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// reconcileAPIServerCertificate verifies that the serving certificate presented at the control plane endpoint
+// is valid for the endpoint host.
+//
+// The check catches control plane endpoints changed after the cluster creation,
+// as the certificate SANs are only generated once.
+func (r *TalosControlPlaneReconciler) reconcileAPIServerCertificate(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if !tcp.Status.Initialized {
+		return ctrl.Result{}, nil
+	}
+
+	endpoint := cluster.Spec.ControlPlaneEndpoint
+	address := net.JoinHostPort(endpoint.Host, strconv.Itoa(int(endpoint.Port)))
+
+	cert, err := peerCertificate(address)
+	if err != nil {
+		conditions.MarkFalse(tcp, controlplanev1.APIServerCertificateValidCondition, controlplanev1.APIServerCertificateInspectionFailedReason,
+			clusterv1.ConditionSeverityInfo, err.Error())
+
+		return ctrl.Result{}, nil
+	}
+
+	if err = cert.VerifyHostname(endpoint.Host); err != nil {
+		r.Log.Info("API server certificate doesn't match control plane endpoint", "endpoint", address, "error", err)
+
+		conditions.MarkFalse(tcp, controlplanev1.APIServerCertificateValidCondition, controlplanev1.CertificateSANMismatchReason,
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{}, nil
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.APIServerCertificateValidCondition)
+
+	return ctrl.Result{}, nil
+}
+
+// peerCertificate returns the serving certificate presented at the address.
+//
+// The certificate chain is not verified, as only the certificate fields are inspected.
+func peerCertificate(address string) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	defer conn.Close() //nolint:errcheck
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate presented at %s", address)
+	}
+
+	return certs[0], nil
+}
+
+// reconcileCertificatesExpiry records the earliest expiry of the Talos API and Kubernetes API server certificates
+// of each control plane machine, so that machines with expiring certificates are replaced by the rollout.
+func (r *TalosControlPlaneReconciler) reconcileCertificatesExpiry(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if tcp.Spec.RolloutBefore == nil || tcp.Spec.RolloutBefore.CertificatesExpiryDays == nil {
+		return ctrl.Result{}, nil
+	}
+
+	var errs error
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			continue
+		}
+
+		addresses := machineAddresses([]clusterv1.Machine{machine})
+		if len(addresses) == 0 {
+			continue
+		}
+
+		var expiry time.Time
+
+		for _, port := range []int{constants.ApidPort, constants.DefaultControlPlanePort} {
+			cert, err := peerCertificate(net.JoinHostPort(addresses[0], strconv.Itoa(port)))
+			if err != nil {
+				r.Log.Info("failed to inspect machine certificate", "machine", machine.Name, "error", err)
+
+				continue
+			}
+
+			if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+				expiry = cert.NotAfter
+			}
+		}
+
+		if expiry.IsZero() {
+			continue
+		}
+
+		if err := r.syncObjectMetadata(ctx, &machine, nil, map[string]string{
+			controlplanev1.CertificatesExpiryAnnotation: expiry.UTC().Format(time.RFC3339),
+		}); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
+
+// certificatesExpiring checks whether the recorded certificates expiry of the machine is within the RolloutBefore window.
+func certificatesExpiring(tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) (time.Time, bool) {
+	if tcp.Spec.RolloutBefore == nil || tcp.Spec.RolloutBefore.CertificatesExpiryDays == nil {
+		return time.Time{}, false
+	}
+
+	expiry, err := time.Parse(time.RFC3339, machine.Annotations[controlplanev1.CertificatesExpiryAnnotation])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	threshold := time.Now().Add(time.Duration(*tcp.Spec.RolloutBefore.CertificatesExpiryDays) * 24 * time.Hour)
+
+	return expiry, expiry.Before(threshold)
+}
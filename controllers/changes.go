@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// reconcileChangeStrategy classifies the pending spec changes by how they are applied and publishes them
+// in the status before the following phases act on them, so that operators know in advance whether
+// the change is applied in place, requires a reboot or replaces the machines.
+//
+// Changes of the strategies listed in RequireApproval are held until their ID is approved with the annotation.
+func (r *TalosControlPlaneReconciler) reconcileChangeStrategy(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	// the initial machines are created from the spec, there is nothing to change yet
+	if !tcp.Status.Bootstrapped {
+		tcp.Status.PendingChanges = nil
+
+		return ctrl.Result{}, nil
+	}
+
+	var changes []controlplanev1.PendingChange
+
+	if rollout := tcp.Status.Rollout; rollout != nil {
+		hash, err := configHash(tcp)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		target := fmt.Sprintf("%s/%s/%s", tcp.Spec.Version, tcp.Spec.InfrastructureTemplate.Name, hash)
+		if tcp.Spec.RolloutAfter != nil {
+			target += "/" + tcp.Spec.RolloutAfter.Format(time.RFC3339)
+		}
+
+		changes = append(changes, pendingChange(controlplanev1.ReplacementChangeStrategy, target, rollout.Reason, rollout.OutdatedReplicas))
+	}
+
+	hash, err := installHash(tcp.Spec.Install)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var reboots int32
+
+	for _, machine := range machines {
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() && machine.Annotations[controlplanev1.InstallHashAnnotation] != hash {
+			reboots++
+		}
+	}
+
+	if reboots > 0 {
+		changes = append(changes, pendingChange(controlplanev1.RebootChangeStrategy, hash, "kernel arguments and system extensions", reboots))
+	}
+
+	if hash, err = etcdConfigHash(tcp.Spec.Etcd); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	reboots = 0
+
+	for _, machine := range machines {
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() && machine.Annotations[controlplanev1.EtcdConfigHashAnnotation] != hash {
+			reboots++
+		}
+	}
+
+	if reboots > 0 {
+		changes = append(changes, etcdConfigChange(hash, reboots))
+	}
+
+	hashes, err := machineConfigHashes(tcp)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var restarts int32
+
+	for _, machine := range machines {
+		if hash, ok := machine.Annotations[controlplanev1.StaticPodConfigHashAnnotation]; ok && machine.ObjectMeta.DeletionTimestamp.IsZero() && hash != hashes.staticPods {
+			restarts++
+		}
+	}
+
+	if restarts > 0 {
+		changes = append(changes, staticPodConfigChange(hashes, restarts))
+	}
+
+	if config := &tcp.Spec.ControlPlaneConfig; len(config.ExtraManifests) > 0 || len(config.InlineManifests) > 0 {
+		checksum, err := manifestsChecksum(config)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if checksum != tcp.Status.ManifestsChecksum {
+			changes = append(changes, pendingChange(controlplanev1.InPlaceChangeStrategy, checksum, "extra and inline manifests", 0))
+		}
+	}
+
+	approved := approvedChanges(tcp)
+
+	for i := range changes {
+		if _, ok := approved[changes[i].ID]; ok && changeRequiresApproval(tcp, changes[i].Strategy) {
+			changes[i].Approved = true
+		}
+	}
+
+	if r.Recorder != nil {
+		for _, change := range changes {
+			if hasPendingChange(tcp.Status.PendingChanges, change.ID) {
+				continue
+			}
+
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "ChangeClassified", "%s change %s (%s) affects %d machine(s)", change.Strategy, change.ID, change.Reason, change.Machines)
+
+			if changeRequiresApproval(tcp, change.Strategy) && !change.Approved {
+				r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "ChangeApprovalRequired", "%s change %s is held until approved with the %s annotation",
+					change.Strategy, change.ID, controlplanev1.ApprovedChangesAnnotation)
+			}
+		}
+	}
+
+	tcp.Status.PendingChanges = changes
+
+	return ctrl.Result{}, nil
+}
+
+// pendingChange builds the pending change, the ID is derived from the strategy and the desired state.
+func pendingChange(strategy controlplanev1.ChangeStrategy, target, reason string, machines int32) controlplanev1.PendingChange {
+	sum := sha256.Sum256([]byte(string(strategy) + "/" + target))
+
+	return controlplanev1.PendingChange{
+		ID:       hex.EncodeToString(sum[:])[:10],
+		Strategy: strategy,
+		Reason:   reason,
+		Machines: machines,
+	}
+}
+
+func hasPendingChange(changes []controlplanev1.PendingChange, id string) bool {
+	for _, change := range changes {
+		if change.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// approvedChanges returns the change IDs listed in the approval annotation.
+func approvedChanges(tcp *controlplanev1.TalosControlPlane) map[string]struct{} {
+	approved := map[string]struct{}{}
+
+	for _, id := range strings.Split(tcp.Annotations[controlplanev1.ApprovedChangesAnnotation], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			approved[id] = struct{}{}
+		}
+	}
+
+	return approved
+}
+
+func changeRequiresApproval(tcp *controlplanev1.TalosControlPlane, strategy controlplanev1.ChangeStrategy) bool {
+	for _, s := range tcp.Spec.RequireApproval {
+		if s == strategy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pendingChangeApproved checks whether the pending change can be applied, the change is matched by the ID.
+func pendingChangeApproved(tcp *controlplanev1.TalosControlPlane, change controlplanev1.PendingChange) bool {
+	if !changeRequiresApproval(tcp, change.Strategy) {
+		return true
+	}
+
+	_, ok := approvedChanges(tcp)[change.ID]
+
+	return ok
+}
+
+// changeApproved checks whether the pending change of the strategy can be applied.
+func changeApproved(tcp *controlplanev1.TalosControlPlane, strategy controlplanev1.ChangeStrategy) bool {
+	if !changeRequiresApproval(tcp, strategy) {
+		return true
+	}
+
+	for _, change := range tcp.Status.PendingChanges {
+		if change.Strategy == strategy {
+			return change.Approved
+		}
+	}
+
+	return false
+}
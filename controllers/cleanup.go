@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+// cleanupGeneratedObjects deletes or releases the secrets and config maps generated for the TalosControlPlane
+// according to the generated secrets policy.
+//
+// Objects are matched by the owner reference UID, objects labeled with the TalosControlPlane name are matched
+// by the owner reference name, so that objects created before a management cluster restore (with a different
+// owner UID) are cleaned up as well.
+func (r *TalosControlPlaneReconciler) cleanupGeneratedObjects(ctx context.Context, tcp *controlplanev1.TalosControlPlane) error {
+	var (
+		secrets    corev1.SecretList
+		configMaps corev1.ConfigMapList
+	)
+
+	if err := r.Client.List(ctx, &secrets, client.InNamespace(tcp.Namespace)); err != nil {
+		return err
+	}
+
+	if err := r.Client.List(ctx, &configMaps, client.InNamespace(tcp.Namespace)); err != nil {
+		return err
+	}
+
+	objects := []client.Object{}
+
+	for i := range secrets.Items {
+		if generatedFor(&secrets.Items[i], tcp) {
+			objects = append(objects, &secrets.Items[i])
+		}
+	}
+
+	for i := range configMaps.Items {
+		if generatedFor(&configMaps.Items[i], tcp) {
+			objects = append(objects, &configMaps.Items[i])
+		}
+	}
+
+	for _, obj := range objects {
+		if tcp.Spec.GeneratedSecretsPolicy == controlplanev1.GeneratedSecretsRetain {
+			r.Log.Info("retaining generated object", "object", client.ObjectKeyFromObject(obj))
+
+			if err := r.releaseOwnership(ctx, obj, tcp); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		r.Log.Info("deleting generated object", "object", client.ObjectKeyFromObject(obj))
+
+		if err := r.Client.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// generatedFor checks whether the object was generated for the TalosControlPlane.
+func generatedFor(obj metav1.Object, tcp *controlplanev1.TalosControlPlane) bool {
+	labeled := obj.GetLabels()[controlplanev1.TalosControlPlaneLabel] == tcp.Name
+
+	for _, ref := range obj.GetOwnerReferences() {
+		if tcpclient.IsOwnerRef(ref, tcp) && (ref.UID == tcp.UID || labeled) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releaseOwnership removes the TalosControlPlane owner references, so that the object is not garbage collected.
+func (r *TalosControlPlaneReconciler) releaseOwnership(ctx context.Context, obj client.Object, tcp *controlplanev1.TalosControlPlane) error {
+	patchHelper, err := patch.NewHelper(obj, r.Client)
+	if err != nil {
+		return err
+	}
+
+	refs := []metav1.OwnerReference{}
+
+	for _, ref := range obj.GetOwnerReferences() {
+		if !tcpclient.IsOwnerRef(ref, tcp) {
+			refs = append(refs, ref)
+		}
+	}
+
+	obj.SetOwnerReferences(refs)
+
+	return patchHelper.Patch(ctx, obj)
+}
@@ -8,18 +8,19 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"reflect"
 	"time"
 
 	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
 	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
 	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
 	talosconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
 	"k8s.io/client-go/util/connrotation"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -28,12 +29,15 @@ import (
 type kubernetesClient struct {
 	*kubernetes.Clientset
 
-	dialer *connrotation.Dialer
+	config  *rest.Config
+	dialer  *connrotation.Dialer
+	release func()
 }
 
 // Close kubernetes client.
 func (k *kubernetesClient) Close() error {
 	k.dialer.CloseAll()
+	k.release()
 
 	return nil
 }
@@ -44,7 +48,9 @@ func newDialer() *connrotation.Dialer {
 
 // kubeconfigForCluster will fetch a kubeconfig secret based on cluster name/namespace,
 // use it to create a clientset, and return it.
-func (r *TalosControlPlaneReconciler) kubeconfigForCluster(ctx context.Context, cluster client.ObjectKey) (*kubernetesClient, error) {
+//
+// The API server CA from the kubeconfig is replaced with the CA pinned in the TalosControlPlane, if any.
+func (r *TalosControlPlaneReconciler) kubeconfigForCluster(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey) (*kubernetesClient, error) {
 	kubeconfigSecret := &corev1.Secret{}
 
 	err := r.Client.Get(ctx,
@@ -60,7 +66,17 @@ func (r *TalosControlPlaneReconciler) kubeconfigForCluster(ctx context.Context,
 
 	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfigSecret.Data["value"])
 	if err != nil {
-		return nil, err
+		return nil, tcpclient.Terminal(err)
+	}
+
+	if ref := tcp.Spec.ControlPlaneConfig.APIServerCASecretRef; ref != nil {
+		ca, err := r.apiServerCAFromSecretRef(ctx, tcp.Namespace, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		config.TLSClientConfig.CAData = ca
+		config.TLSClientConfig.CAFile = ""
 	}
 
 	dialer := newDialer()
@@ -73,34 +89,37 @@ func (r *TalosControlPlaneReconciler) kubeconfigForCluster(ctx context.Context,
 
 	return &kubernetesClient{
 		Clientset: clientset,
+		config:    config,
 		dialer:    dialer,
+		release:   r.workloadConnections.register(cluster, kubeconfigSecret.ResourceVersion, dialer),
 	}, nil
 }
 
-// talosconfigForMachine will generate a talosconfig that uses *all* found addresses as the endpoints.
+// talosconfigForMachine will generate a talosconfig that uses the best address of each machine as the endpoints.
 func (r *TalosControlPlaneReconciler) talosconfigForMachines(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines ...clusterv1.Machine) (*talosclient.Client, error) {
 	if len(machines) == 0 {
-		return nil, fmt.Errorf("at least one machine should be provided")
+		return nil, tcpclient.Terminal(fmt.Errorf("at least one machine should be provided"))
 	}
 
-	if !reflect.ValueOf(tcp.Spec.ControlPlaneConfig.InitConfig).IsZero() {
-		return r.talosconfigFromWorkloadCluster(ctx, client.ObjectKey{Namespace: tcp.GetNamespace(), Name: tcp.GetLabels()["cluster.x-k8s.io/cluster-name"]}, machines...)
+	t, err := r.talosconfigFromSecretRef(ctx, tcp)
+	if err != nil {
+		return nil, err
 	}
 
-	addrList := []string{}
+	discovered, err := r.discoverAddresses(ctx, tcp, machines)
+	if err != nil {
+		return nil, err
+	}
 
-	var t *talosconfig.Config
+	addrList := []string{}
 
 	for _, machine := range machines {
-		for _, addr := range machine.Status.Addresses {
-			if addr.Type == clusterv1.MachineExternalIP || addr.Type == clusterv1.MachineInternalIP {
-				addrList = append(addrList, addr.Address)
-			}
+		machineAddrs := discovered[machine.Name]
+		if len(machineAddrs) == 0 {
+			return nil, tcpclient.Retriable(fmt.Errorf("no addresses were found for node %q", machine.Name))
 		}
 
-		if len(addrList) == 0 {
-			return nil, fmt.Errorf("no addresses were found for node %q", machine.Name)
-		}
+		addrList = append(addrList, r.selectEndpoint(ctx, tcp, machine.Name, machineAddrs))
 
 		if t == nil {
 			var (
@@ -125,86 +144,82 @@ func (r *TalosControlPlaneReconciler) talosconfigForMachines(ctx context.Context
 			}
 
 			if found == nil {
-				return nil, fmt.Errorf("failed to find TalosConfig for %q", machine.Name)
+				return nil, tcpclient.Retriable(fmt.Errorf("failed to find TalosConfig for %q", machine.Name))
 			}
 
 			t, err = talosconfig.FromString(found.Status.TalosConfig)
 			if err != nil {
-				return nil, err
+				return nil, tcpclient.Terminal(err)
 			}
 		}
 	}
 
-	return talosclient.New(ctx, talosclient.WithEndpoints(addrList...), talosclient.WithConfig(t))
-}
+	clusterKey := client.ObjectKey{Namespace: tcp.Namespace, Name: tcp.Labels[clusterv1.ClusterLabelName]}
 
-// talosconfigFromWorkloadCluster gets talosconfig and populates endoints using workload cluster nodes.
-func (r *TalosControlPlaneReconciler) talosconfigFromWorkloadCluster(ctx context.Context, cluster client.ObjectKey, machines ...clusterv1.Machine) (*talosclient.Client, error) {
-	if len(machines) == 0 {
-		return nil, fmt.Errorf("at least one machine should be provided")
-	}
+	return talosclient.New(ctx,
+		talosclient.WithEndpoints(addrList...),
+		talosclient.WithConfig(t),
+		talosclient.WithGRPCDialOptions(r.talosRPCLimiter.dialOptions(clusterKey, r.MaxConcurrentTalosCalls)...),
+	)
+}
 
-	clientset, err := r.kubeconfigForCluster(ctx, cluster)
+// apiServerCAFromSecretRef loads the pinned workload cluster API server CA bundle.
+func (r *TalosControlPlaneReconciler) apiServerCAFromSecretRef(ctx context.Context, namespace, name string) ([]byte, error) {
+	secret, err := r.kubernetesSecrets().Get(ctx, client.ObjectKey{Namespace: namespace, Name: name})
 	if err != nil {
 		return nil, err
 	}
 
-	addrList := []string{}
-
-	var t *talosconfig.Config
+	data, ok := secret[apiServerCASecretKey]
+	if !ok {
+		return nil, tcpclient.Terminal(fmt.Errorf("secret %q doesn't have the %q key", name, apiServerCASecretKey))
+	}
 
-	for _, machine := range machines {
-		if machine.Status.NodeRef == nil {
-			return nil, fmt.Errorf("%q machine does not have a nodeRef", machine.Name)
-		}
+	if _, err = certutil.ParseCertsPEM(data); err != nil {
+		return nil, fmt.Errorf("secret %q has invalid CA bundle: %w", name, err)
+	}
 
-		// grab all addresses as endpoints
-		node, err := clientset.CoreV1().Nodes().Get(ctx, machine.Status.NodeRef.Name, metav1.GetOptions{})
-		if err != nil {
-			return nil, err
-		}
+	return data, nil
+}
 
-		for _, addr := range node.Status.Addresses {
-			if addr.Type == corev1.NodeExternalIP || addr.Type == corev1.NodeInternalIP {
-				addrList = append(addrList, addr.Address)
-			}
-		}
+// talosconfigSecrets returns the backend keeping the talosconfig secret: the talosconfig published
+// for the rotated Talos CA is kept in the secrets backend, the ones provided by the users are Kubernetes Secrets.
+func (r *TalosControlPlaneReconciler) talosconfigSecrets(tcp *controlplanev1.TalosControlPlane, name string) SecretsBackend {
+	if name == rotatedTalosconfigSecretName(tcp) {
+		return r.secretsBackend()
+	}
 
-		if len(addrList) == 0 {
-			return nil, fmt.Errorf("no addresses were found for node %q", node.Name)
-		}
+	return r.kubernetesSecrets()
+}
 
-		if t == nil {
-			var (
-				cfgs  cabptv1.TalosConfigList
-				found *cabptv1.TalosConfig
-			)
+// talosconfigFromSecretRef loads the talosconfig referenced by the TalosControlPlane,
+// the one published by the controller in the status takes precedence over the spec.
+//
+// It returns nil if there is no reference, so that the generated talosconfig is used.
+func (r *TalosControlPlaneReconciler) talosconfigFromSecretRef(ctx context.Context, tcp *controlplanev1.TalosControlPlane) (*talosconfig.Config, error) {
+	ref := tcp.Status.TalosConfigSecretRef
+	if ref == nil {
+		ref = tcp.Spec.ControlPlaneConfig.TalosConfigSecretRef
+	}
 
-			// find talosconfig in the machine's namespace
-			err = r.Client.List(ctx, &cfgs, client.InNamespace(machine.Namespace))
-			if err != nil {
-				return nil, err
-			}
+	if ref == nil {
+		return nil, nil
+	}
 
-			for _, cfg := range cfgs.Items {
-				for _, ref := range cfg.OwnerReferences {
-					if ref.Kind == "Machine" && ref.Name == machine.Name {
-						found = &cfg
-						break
-					}
-				}
-			}
+	secret, err := r.talosconfigSecrets(tcp, ref.Name).Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: ref.Name})
+	if err != nil {
+		return nil, err
+	}
 
-			if found == nil {
-				return nil, fmt.Errorf("failed to find TalosConfig for %q", machine.Name)
-			}
+	data, ok := secret[talosconfigSecretKey]
+	if !ok {
+		return nil, tcpclient.Terminal(fmt.Errorf("secret %q doesn't have the %q key", ref.Name, talosconfigSecretKey))
+	}
 
-			t, err = talosconfig.FromString(found.Status.TalosConfig)
-			if err != nil {
-				return nil, err
-			}
-		}
+	t, err := talosconfig.FromBytes(data)
+	if err != nil {
+		return nil, tcpclient.Terminal(err)
 	}
 
-	return talosclient.New(ctx, talosclient.WithEndpoints(addrList...), talosclient.WithConfig(t))
+	return t, nil
 }
@@ -4,7 +4,11 @@
 
 package controllers
 
-import "time"
+import (
+	"time"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
 
 const (
 	// deleteRequeueAfter is how long to wait before checking again to see if
@@ -18,4 +22,58 @@ const (
 	// dependentCertRequeueAfter is how long to wait before checking again to see if
 	// dependent certificates have been created.
 	dependentCertRequeueAfter = 30 * time.Second
+
+	// maxClockOffset is the maximum allowed difference between the control plane node clock
+	// and its time server before the clock is reported as drifted.
+	maxClockOffset = 500 * time.Millisecond
+
+	// defaultPreDrainHookTimeout is how long to wait for the pre-drain hook to be acknowledged by default.
+	defaultPreDrainHookTimeout = 5 * time.Minute
+
+	// orphanedObjectGracePeriod is how long the objects created for a new control plane machine might exist
+	// without the Machine before they are deleted as orphaned.
+	orphanedObjectGracePeriod = 10 * time.Minute
+
+	// terminalErrorRequeueAfter is how long to wait before checking again after a reconcile failed
+	// with an error which is not fixed by retrying, watched changes trigger the reconcile earlier.
+	terminalErrorRequeueAfter = 5 * time.Minute
+
+	// defaultRemediationMinHealthyPeriod is how long the replacement of a remediated machine should stay healthy
+	// by default to reset the remediation retry count.
+	defaultRemediationMinHealthyPeriod = time.Hour
+
+	// machineRebootTimeout is how long to wait for the machine changed in place to reboot before the change
+	// is considered failed and is retried.
+	machineRebootTimeout = 30 * time.Minute
 )
+
+const (
+	// defaultEtcdDiskUsagePercent is the etcd data filesystem usage reported as disk pressure by default.
+	defaultEtcdDiskUsagePercent = 85
+
+	// defaultMemoryUsagePercent is the memory usage reported as memory pressure by default.
+	defaultMemoryUsagePercent = 90
+)
+
+// defaultDegradedFailureThreshold is the number of consecutive reconcile failures reported as degraded by default.
+const defaultDegradedFailureThreshold = 5
+
+const (
+	// admissionConfigHostPath is the directory on the host which holds the admission control config file.
+	admissionConfigHostPath = "/var/etc/kubernetes/admission"
+
+	// admissionConfigMountPath is the directory admissionConfigHostPath is mounted to in the kube-apiserver pod.
+	admissionConfigMountPath = "/etc/kubernetes/admission"
+
+	admissionConfigFile = "admission-control-config.yaml"
+)
+
+// talosconfigSecretKey is the key of the talosconfig in the secrets referenced by TalosControlPlane.
+const talosconfigSecretKey = "talosconfig"
+
+// apiServerCASecretKey is the key of the CA bundle in the secrets referenced by APIServerCASecretRef.
+const apiServerCASecretKey = "ca.crt"
+
+// legacyEtcdClusterHealthyCondition is the former type of the EtcdClusterHealthy condition,
+// it is removed from the status of the existing TalosControlPlanes.
+const legacyEtcdClusterHealthyCondition clusterv1.ConditionType = "EtcdClusterHealthyCondition"
@@ -0,0 +1,176 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// contactRecordInterval is the precision of the last contact times recorded in the status,
+// it limits the status updates while the machines are reachable.
+const contactRecordInterval = time.Minute
+
+// reconcileMachineContacts records the last time the Talos API of each control plane machine responded,
+// and the last time its kubelet renewed the node lease.
+//
+// Failures to reach the machines are expected here (that's what is tracked), so they are not reported as errors.
+func (r *TalosControlPlaneReconciler) reconcileMachineContacts(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	previous := map[string]controlplanev1.MachineStatus{}
+
+	for _, status := range tcp.Status.MachineStatuses {
+		previous[status.Name] = status
+	}
+
+	talosContacts := r.talosAPIContacts(ctx, tcp, machines)
+	nodeContacts := r.nodeContacts(ctx, cluster, tcp)
+
+	statuses := make([]controlplanev1.MachineStatus, 0, len(machines))
+
+	for _, machine := range machines {
+		status := previous[machine.Name]
+		status.Name = machine.Name
+
+		delete(previous, machine.Name)
+
+		if contact, ok := talosContacts[machine.Name]; ok {
+			status.LastTalosAPIContactTime = recordContact(status.LastTalosAPIContactTime, contact)
+		}
+
+		if machine.Status.NodeRef != nil {
+			if contact, ok := nodeContacts[machine.Status.NodeRef.Name]; ok {
+				status.LastNodeContactTime = recordContact(status.LastNodeContactTime, contact)
+			}
+		}
+
+		if !r.DisablePerMachineMetrics {
+			if status.LastTalosAPIContactTime != nil {
+				machineLastTalosAPIContact.WithLabelValues(tcp.Namespace, cluster.Name, machine.Name).Set(float64(status.LastTalosAPIContactTime.Unix()))
+			}
+
+			if status.LastNodeContactTime != nil {
+				machineLastNodeContact.WithLabelValues(tcp.Namespace, cluster.Name, machine.Name).Set(float64(status.LastNodeContactTime.Unix()))
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	// machines which are gone
+	for name := range previous {
+		machineLastTalosAPIContact.DeleteLabelValues(tcp.Namespace, cluster.Name, name)
+		machineLastNodeContact.DeleteLabelValues(tcp.Namespace, cluster.Name, name)
+	}
+
+	tcp.Status.MachineStatuses = statuses
+
+	return ctrl.Result{}, nil
+}
+
+// recordContact returns the new last contact time, the recorded time is kept if it's recent enough.
+func recordContact(recorded *metav1.Time, contact time.Time) *metav1.Time {
+	if recorded != nil && contact.Sub(recorded.Time) < contactRecordInterval {
+		return recorded
+	}
+
+	t := metav1.NewTime(contact.Truncate(time.Second))
+
+	return &t
+}
+
+// talosAPIContacts returns the machines which responded to the Talos API request with the time of the response.
+func (r *TalosControlPlaneReconciler) talosAPIContacts(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) map[string]time.Time {
+	contacts := map[string]time.Time{}
+
+	machinesByAddress := map[string]string{}
+	addresses := []string{}
+	reachable := []clusterv1.Machine{}
+
+	for _, machine := range machines {
+		machineAddrs := machineAddresses([]clusterv1.Machine{machine})
+		if len(machineAddrs) == 0 || machine.Status.NodeRef == nil {
+			continue
+		}
+
+		machinesByAddress[machineAddrs[0]] = machine.Name
+		addresses = append(addresses, machineAddrs[0])
+		reachable = append(reachable, machine)
+	}
+
+	if len(reachable) == 0 {
+		return contacts
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, reachable...)
+	if err != nil {
+		r.Log.Info("failed to contact Talos API", "error", err)
+
+		return contacts
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	// responses of the unreachable nodes are dropped
+	resp, err := c.Version(talosclient.WithNodes(ctx, addresses...))
+	if err != nil {
+		r.Log.Info("failed to contact Talos API of some machines", "error", err)
+	}
+
+	if resp == nil {
+		return contacts
+	}
+
+	now := time.Now()
+
+	for _, message := range resp.Messages {
+		if name, ok := machinesByAddress[message.Metadata.GetHostname()]; ok {
+			contacts[name] = now
+		}
+	}
+
+	return contacts
+}
+
+// nodeContacts returns the last renew time of the node leases by the node name.
+func (r *TalosControlPlaneReconciler) nodeContacts(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane) map[string]time.Time {
+	contacts := map[string]time.Time{}
+
+	if !tcp.Status.Initialized {
+		return contacts
+	}
+
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		r.Log.Info("failed to get node leases", "error", err)
+
+		return contacts
+	}
+
+	defer kubeclient.Close() //nolint:errcheck
+
+	leases, err := kubeclient.CoordinationV1().Leases(corev1.NamespaceNodeLease).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		r.Log.Info("failed to get node leases", "error", err)
+
+		return contacts
+	}
+
+	for _, lease := range leases.Items {
+		if lease.Spec.RenewTime != nil {
+			contacts[lease.Name] = lease.Spec.RenewTime.Time
+		}
+	}
+
+	return contacts
+}
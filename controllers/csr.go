@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const nodeUserPrefix = "system:node:"
+
+// reconcileKubeletServingCertificates approves pending kubelet serving certificate signing requests
+// which were issued by the control plane nodes.
+func (r *TalosControlPlaneReconciler) reconcileKubeletServingCertificates(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if !tcp.Spec.ApproveKubeletServingCertificates || !tcp.Status.Initialized {
+		return ctrl.Result{}, nil
+	}
+
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	defer kubeclient.Close() //nolint:errcheck
+
+	machinesByNode := map[string]clusterv1.Machine{}
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef != nil {
+			machinesByNode[machine.Status.NodeRef.Name] = machine
+		}
+	}
+
+	csrs, err := kubeclient.CertificatesV1().CertificateSigningRequests().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	for i := range csrs.Items {
+		csr := &csrs.Items[i]
+
+		if csr.Spec.SignerName != certificatesv1.KubeletServingSignerName || isCSRFinished(csr) {
+			continue
+		}
+
+		if !strings.HasPrefix(csr.Spec.Username, nodeUserPrefix) {
+			continue
+		}
+
+		nodeName := strings.TrimPrefix(csr.Spec.Username, nodeUserPrefix)
+
+		machine, ok := machinesByNode[nodeName]
+		if !ok {
+			// not a control plane node
+			continue
+		}
+
+		if err = validateKubeletServingCSR(csr, nodeName, machine); err != nil {
+			r.Log.Info("not approving kubelet serving certificate request", "csr", csr.Name, "node", nodeName, "error", err)
+
+			continue
+		}
+
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:    certificatesv1.CertificateApproved,
+			Status:  corev1.ConditionTrue,
+			Reason:  "TalosControlPlaneApproved",
+			Message: fmt.Sprintf("kubelet serving certificate of control plane machine %q approved by TalosControlPlane", machine.Name),
+		})
+
+		r.Log.Info("approving kubelet serving certificate request", "csr", csr.Name, "node", nodeName)
+
+		if _, err = kubeclient.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, csr.Name, csr, metav1.UpdateOptions{DryRun: r.dryRunAll()}); err != nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// isCSRFinished checks whether the CSR was already approved or denied.
+func isCSRFinished(csr *certificatesv1.CertificateSigningRequest) bool {
+	for _, c := range csr.Status.Conditions {
+		if c.Type == certificatesv1.CertificateApproved || c.Type == certificatesv1.CertificateDenied {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateKubeletServingCSR verifies that the kubelet serving certificate request was issued by the node
+// and only requests SANs which belong to the machine.
+func validateKubeletServingCSR(csr *certificatesv1.CertificateSigningRequest, nodeName string, machine clusterv1.Machine) error {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("PEM block type must be CERTIFICATE REQUEST")
+	}
+
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if req.Subject.CommonName != nodeUserPrefix+nodeName {
+		return fmt.Errorf("unexpected common name %q", req.Subject.CommonName)
+	}
+
+	if len(req.Subject.Organization) != 1 || req.Subject.Organization[0] != "system:nodes" {
+		return fmt.Errorf("unexpected organization %v", req.Subject.Organization)
+	}
+
+	if len(req.EmailAddresses) > 0 || len(req.URIs) > 0 {
+		return fmt.Errorf("email and URI SANs are not allowed")
+	}
+
+	for _, usage := range csr.Spec.Usages {
+		switch usage { //nolint:exhaustive
+		case certificatesv1.UsageDigitalSignature, certificatesv1.UsageKeyEncipherment, certificatesv1.UsageServerAuth:
+		default:
+			return fmt.Errorf("usage %q is not allowed", usage)
+		}
+	}
+
+	allowedNames := map[string]struct{}{
+		nodeName: {},
+	}
+	allowedIPs := map[string]struct{}{}
+
+	for _, addr := range machine.Status.Addresses {
+		switch addr.Type {
+		case clusterv1.MachineHostName, clusterv1.MachineInternalDNS, clusterv1.MachineExternalDNS:
+			allowedNames[addr.Address] = struct{}{}
+		case clusterv1.MachineInternalIP, clusterv1.MachineExternalIP:
+			if ip := net.ParseIP(addr.Address); ip != nil {
+				allowedIPs[ip.String()] = struct{}{}
+			}
+		}
+	}
+
+	for _, name := range req.DNSNames {
+		if _, ok := allowedNames[name]; !ok {
+			return fmt.Errorf("DNS name %q does not belong to the machine", name)
+		}
+	}
+
+	for _, ip := range req.IPAddresses {
+		if _, ok := allowedIPs[ip.String()]; !ok {
+			return fmt.Errorf("IP address %q does not belong to the machine", ip)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// dryRun reports whether the Talos API action should be skipped in the dry-run mode.
+//
+// The skipped action is logged, and recorded as an event if the TalosControlPlane is known.
+func (r *TalosControlPlaneReconciler) dryRun(tcp *controlplanev1.TalosControlPlane, format string, args ...interface{}) bool {
+	if !r.DryRun {
+		return false
+	}
+
+	action := fmt.Sprintf(format, args...)
+
+	r.Log.Info("dry run, skipping action", "action", action)
+
+	if r.Recorder != nil && tcp != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "DryRun", "Skipped %s", action)
+	}
+
+	return true
+}
+
+// dryRunAll returns the dry-run option of the workload cluster API requests,
+// so that the requests are validated by the API server without being persisted.
+func (r *TalosControlPlaneReconciler) dryRunAll() []string {
+	if !r.DryRun {
+		return nil
+	}
+
+	return []string{metav1.DryRunAll}
+}
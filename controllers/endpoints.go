@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// endpointProbeTimeout is the timeout to connect to the Talos API of each probed address.
+const endpointProbeTimeout = 2 * time.Second
+
+// endpointResolveTimeout is the timeout to resolve the control plane endpoint DNS name.
+const endpointResolveTimeout = 5 * time.Second
+
+// errEndpointNotResolved is returned when the control plane endpoint DNS name doesn't resolve.
+type errEndpointNotResolved struct {
+	host string
+	err  error
+}
+
+func (e *errEndpointNotResolved) Error() string {
+	return fmt.Sprintf("control plane endpoint %q doesn't resolve: %s", e.host, e.err)
+}
+
+func (e *errEndpointNotResolved) Unwrap() error {
+	return e.err
+}
+
+// verifyEndpointResolves checks the control plane endpoint DNS name resolves.
+//
+// Bootstrapping the cluster with the endpoint which never resolves leaves it half-initialized,
+// as the nodes can't reach the Kubernetes API.
+func verifyEndpointResolves(ctx context.Context, host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, endpointResolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses found")
+	}
+
+	if err != nil {
+		return &errEndpointNotResolved{host: host, err: err}
+	}
+
+	return nil
+}
+
+// endpointProbe is the result of probing a single machine address.
+type endpointProbe struct {
+	address string
+	latency time.Duration
+	err     error
+}
+
+// probeEndpoint measures the time to establish a connection to the Talos API on the address.
+func probeEndpoint(ctx context.Context, address string) endpointProbe {
+	dialer := &net.Dialer{Timeout: endpointProbeTimeout}
+
+	start := time.Now()
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(constants.ApidPort)))
+	if err != nil {
+		return endpointProbe{address: address, err: err}
+	}
+
+	conn.Close() //nolint:errcheck
+
+	return endpointProbe{address: address, latency: time.Since(start)}
+}
+
+// selectEndpoint picks the reachable address with the lowest latency out of the addresses of a single machine.
+//
+// Talos client balances requests across all endpoints, so multi-homed machines
+// should contribute a single working endpoint instead of all of their addresses.
+// If none of the addresses are reachable, the first one is returned, so that the Talos client reports the error.
+//
+// The selected address is recorded in the machine status.
+func (r *TalosControlPlaneReconciler) selectEndpoint(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine string, addresses []string) string {
+	if len(addresses) == 1 {
+		recordTalosEndpoint(tcp, machine, addresses[0])
+
+		return addresses[0]
+	}
+
+	probes := make([]endpointProbe, len(addresses))
+
+	var wg sync.WaitGroup
+
+	for i, address := range addresses {
+		wg.Add(1)
+
+		go func(i int, address string) {
+			defer wg.Done()
+
+			probes[i] = probeEndpoint(ctx, address)
+		}(i, address)
+	}
+
+	wg.Wait()
+
+	var best *endpointProbe
+
+	for i := range probes {
+		if probes[i].err != nil {
+			continue
+		}
+
+		if best == nil || probes[i].latency < best.latency {
+			best = &probes[i]
+		}
+	}
+
+	if best == nil {
+		r.Log.V(1).Info("no reachable Talos endpoint found", "machine", machine, "addresses", addresses)
+
+		return addresses[0]
+	}
+
+	if recordTalosEndpoint(tcp, machine, best.address) {
+		r.Log.Info("selected Talos endpoint", "machine", machine, "endpoint", best.address, "latency", best.latency)
+	} else {
+		r.Log.V(1).Info("selected Talos endpoint", "machine", machine, "endpoint", best.address, "latency", best.latency)
+	}
+
+	return best.address
+}
+
+// recordTalosEndpoint records the selected address in the machine status, it returns true if the address changed.
+//
+// Machines without a status are skipped, the status is created by the machine contacts phase.
+func recordTalosEndpoint(tcp *controlplanev1.TalosControlPlane, machine, address string) bool {
+	for i := range tcp.Status.MachineStatuses {
+		status := &tcp.Status.MachineStatuses[i]
+
+		if status.Name != machine {
+			continue
+		}
+
+		if status.TalosEndpoint == address {
+			return false
+		}
+
+		status.TalosEndpoint = address
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// errorReason maps common Talos API failures to the condition reasons.
+//
+// gRPC flattens the underlying errors into the status message, so the message is inspected
+// when the error chain doesn't carry the original error.
+// The fallback reason is returned if the error isn't recognized.
+func errorReason(err error, fallback string) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		unhealthy        *errServiceUnhealthy
+	)
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return controlplanev1.CertificateUnknownAuthorityReason
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return controlplanev1.ConnectionRefusedReason
+	case errors.Is(err, context.DeadlineExceeded):
+		return controlplanev1.DeadlineExceededReason
+	case errors.As(err, &unhealthy) && unhealthy.service == "etcd":
+		return controlplanev1.EtcdNotRunningReason
+	}
+
+	message := err.Error()
+
+	if s, ok := status.FromError(errors.Cause(err)); ok {
+		message = s.Message()
+
+		if s.Code() == codes.DeadlineExceeded {
+			return controlplanev1.DeadlineExceededReason
+		}
+	}
+
+	switch {
+	case strings.Contains(message, "certificate signed by unknown authority"):
+		return controlplanev1.CertificateUnknownAuthorityReason
+	case strings.Contains(message, "connection refused"):
+		return controlplanev1.ConnectionRefusedReason
+	case strings.Contains(message, "context deadline exceeded"):
+		return controlplanev1.DeadlineExceededReason
+	case strings.Contains(message, "etcd") && strings.Contains(message, "not running"):
+		return controlplanev1.EtcdNotRunningReason
+	}
+
+	return fallback
+}
+
+// certificateUntrusted checks whether the error is caused by the TLS server certificate verification failure.
+func certificateUntrusted(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+	)
+
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
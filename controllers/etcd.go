@@ -7,24 +7,68 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
 	"github.com/talos-systems/talos/pkg/machinery/api/machine"
 	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
-	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func (r *TalosControlPlaneReconciler) etcdHealthcheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, ownedMachines []clusterv1.Machine) error {
-	kubeclient, err := r.kubeconfigForCluster(ctx, util.ObjectKey(cluster))
-	if err != nil {
-		return err
+// errEtcdMembersUnhealthy is returned by the etcd health check with the problems of each etcd member.
+type errEtcdMembersUnhealthy struct {
+	problems map[string][]error
+}
+
+func (e *errEtcdMembersUnhealthy) Error() string {
+	messages := []string{}
+
+	for _, name := range e.machines() {
+		for _, problem := range e.problems[name] {
+			messages = append(messages, fmt.Sprintf("%s: %s", name, problem))
+		}
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the first problem, so that the condition reason reflects it.
+func (e *errEtcdMembersUnhealthy) Unwrap() error {
+	machines := e.machines()
+	if len(machines) == 0 {
+		return nil
 	}
 
-	defer kubeclient.Close() //nolint:errcheck
+	return e.problems[machines[0]][0]
+}
+
+func (e *errEtcdMembersUnhealthy) machines() []string {
+	names := make([]string, 0, len(e.problems))
+
+	for name, problems := range e.problems {
+		if len(problems) > 0 {
+			names = append(names, name)
+		}
+	}
 
+	sort.Strings(names)
+
+	return names
+}
+
+// etcdHealthcheck checks the etcd member of each control plane machine over the Talos API: the etcd service is reachable,
+// running and healthy, the member is listed in the cluster and sees the same members as the other nodes.
+//
+// The problems are returned by the machine name, each machine checked is present in the map.
+// etcd alarms and raft indexes are not exposed by the Talos API, so they are not checked.
+func (r *TalosControlPlaneReconciler) etcdHealthcheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, ownedMachines []clusterv1.Machine) (map[string][]error, error) {
 	machines := []clusterv1.Machine{}
 
 	for _, machine := range ownedMachines {
@@ -35,72 +79,231 @@ func (r *TalosControlPlaneReconciler) etcdHealthcheck(ctx context.Context, tcp *
 
 	c, err := r.talosconfigForMachines(ctx, tcp, machines...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer c.Close() //nolint:errcheck
 
-	service := "etcd"
+	problems := map[string][]error{}
+	machinesByAddress := map[string]string{}
+	addresses := []string{}
 
-	params := make([]interface{}, 0, len(machines)*2)
 	for _, machine := range machines {
-		params = append(params, "node", machine.Name)
+		problems[machine.Name] = nil
+
+		machineAddrs := machineAddresses([]clusterv1.Machine{machine})
+		if len(machineAddrs) == 0 {
+			problems[machine.Name] = append(problems[machine.Name], fmt.Errorf("no address to reach the etcd member"))
+
+			continue
+		}
+
+		machinesByAddress[machineAddrs[0]] = machine.Name
+		addresses = append(addresses, machineAddrs[0])
 	}
 
-	r.Log.Info("verifying etcd health on all nodes", params...)
+	r.Log.Info("verifying etcd health on all nodes", "nodes", addresses)
 
-	svcs, err := c.ServiceInfo(ctx, service)
-	if err != nil {
-		return err
+	nodesCtx := talosclient.WithNodes(ctx, addresses...)
+
+	service := "etcd"
+
+	// responses of the unreachable nodes are dropped, and their errors are aggregated
+	svcs, err := c.ServiceInfo(nodesCtx, service)
+	if err != nil && len(svcs) == 0 {
+		return nil, err
 	}
 
-	// check that etcd service is healthy on all nodes
+	reached := map[string]struct{}{}
+
 	for _, svc := range svcs {
 		node := svc.Metadata.GetHostname()
+		reached[node] = struct{}{}
+
+		name, ok := machinesByAddress[node]
+		if !ok {
+			continue
+		}
 
 		if len(svc.Service.Events.Events) == 0 {
-			return fmt.Errorf("%s: no events recorded yet for service %q", node, service)
+			problems[name] = append(problems[name], fmt.Errorf("no events recorded yet for service %q", service))
+
+			continue
 		}
 
 		lastEvent := svc.Service.Events.Events[len(svc.Service.Events.Events)-1]
 		if lastEvent.State != "Running" {
-			return fmt.Errorf("%s: service %q not in expected state %q: current state [%s] %s", node, service, "Running", lastEvent.State, lastEvent.Msg)
+			problems[name] = append(problems[name], &errServiceUnhealthy{
+				service: service,
+				reason:  fmt.Sprintf("not in expected state %q: current state [%s] %s", "Running", lastEvent.State, lastEvent.Msg),
+			})
+
+			continue
 		}
 
 		if !svc.Service.GetHealth().GetHealthy() {
-			return fmt.Errorf("%s: service is not healthy: %s", node, service)
+			problems[name] = append(problems[name], fmt.Errorf("service is not healthy: %s", service))
 		}
 	}
 
-	resp, err := c.EtcdMemberList(ctx, &machine.EtcdMemberListRequest{})
-	if err != nil {
-		return err
+	for address, name := range machinesByAddress {
+		if _, ok := reached[address]; !ok {
+			problems[name] = append(problems[name], fmt.Errorf("etcd member is unreachable: %s", nodeError(err, address)))
+		}
 	}
 
-	members := map[string]struct{}{}
+	resp, err := c.EtcdMemberList(nodesCtx, &machine.EtcdMemberListRequest{})
+	if err != nil && (resp == nil || len(resp.Messages) == 0) {
+		return nil, err
+	}
 
-	for i, message := range resp.Messages {
-		actualMembers := len(message.Members)
-		expectedMembers := len(machines)
+	var (
+		learners     []uint64
+		learnerNames []string
+	)
+
+	members := map[string]*machine.EtcdMember{}
 
-		node := message.Metadata.GetHostname()
+	for _, message := range resp.Messages {
+		name := machinesByAddress[message.Metadata.GetHostname()]
 
-		// check that the count of members is the same on all nodes
-		if actualMembers != expectedMembers {
-			return fmt.Errorf("%s: expected to have %d members, got %d", node, expectedMembers, actualMembers)
+		// check that all nodes see the same members
+		if name != "" && len(message.Members) != len(machines) {
+			problems[name] = append(problems[name], fmt.Errorf("sees %d etcd members, expected %d", len(message.Members), len(machines)))
 		}
 
-		// check that member list is the same on all nodes
 		for _, member := range message.Members {
-			if _, found := members[member.Hostname]; i > 0 && !found {
-				return fmt.Errorf("%s: found extra etcd member %s", node, member.Hostname)
+			members[member.Hostname] = member
+		}
+	}
+
+	for _, m := range machines {
+		if m.Status.NodeRef == nil {
+			continue
+		}
+
+		member, ok := members[strings.Split(m.Status.NodeRef.Name, ".")[0]]
+
+		switch {
+		case !ok:
+			problems[m.Name] = append(problems[m.Name], fmt.Errorf("not an etcd member"))
+		case member.IsLearner:
+			learners = append(learners, member.Id)
+			learnerNames = append(learnerNames, member.Hostname)
+		}
+	}
+
+	unhealthy := &errEtcdMembersUnhealthy{problems: problems}
+	if len(unhealthy.machines()) > 0 {
+		return problems, unhealthy
+	}
+
+	if waiting := r.learners.observe(tcp.UID, learners); len(learners) > 0 {
+		return problems, &errEtcdLearner{members: learnerNames, waiting: waiting}
+	}
+
+	return problems, nil
+}
+
+// updateEtcdMemberConditions mirrors the health of the etcd members to the EtcdMemberHealthy condition of the machines.
+func (r *TalosControlPlaneReconciler) updateEtcdMemberConditions(ctx context.Context, machines []clusterv1.Machine, problems map[string][]error, learner *errEtcdLearner) error {
+	learners := map[string]struct{}{}
+
+	if learner != nil {
+		for _, name := range learner.members {
+			learners[name] = struct{}{}
+		}
+	}
+
+	var errs error
+
+	for _, m := range machines {
+		m := m
+
+		memberProblems, ok := problems[m.Name]
+		if !ok {
+			continue
+		}
+
+		patchHelper, err := patch.NewHelper(&m, r.Client)
+		if err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		// the condition is updated in place, so it is copied
+		previous := conditions.Get(&m, controlplanev1.MachineEtcdMemberHealthyCondition).DeepCopy()
+
+		_, isLearner := learners[strings.Split(nodeName(&m), ".")[0]]
+
+		switch {
+		case len(memberProblems) > 0:
+			messages := make([]string, 0, len(memberProblems))
+			for _, problem := range memberProblems {
+				messages = append(messages, problem.Error())
 			}
 
-			members[member.Hostname] = struct{}{}
+			conditions.MarkFalse(&m, controlplanev1.MachineEtcdMemberHealthyCondition, errorReason(memberProblems[0], controlplanev1.EtcdMemberUnhealthyReason),
+				clusterv1.ConditionSeverityWarning, "%s", strings.Join(messages, "; "))
+		case isLearner && learner.stuck():
+			conditions.MarkFalse(&m, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdLearnerNotPromotedReason,
+				clusterv1.ConditionSeverityError, "etcd learner waiting for promotion for %s", learner.waiting.Round(time.Second))
+		case isLearner:
+			conditions.MarkFalse(&m, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdLearnerPromotingReason,
+				clusterv1.ConditionSeverityInfo, "etcd learner waiting for promotion")
+		default:
+			conditions.MarkTrue(&m, controlplanev1.MachineEtcdMemberHealthyCondition)
+		}
+
+		if sameConditionState(previous, conditions.Get(&m, controlplanev1.MachineEtcdMemberHealthyCondition)) {
+			continue
+		}
+
+		if err = patchHelper.Patch(ctx, &m, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{
+			controlplanev1.MachineEtcdMemberHealthyCondition,
+		}}); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
 		}
 	}
 
-	return nil
+	return errs
+}
+
+// sameConditionState checks whether the conditions have the same status, reason, severity and message.
+func sameConditionState(a, b *clusterv1.Condition) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Status == b.Status && a.Reason == b.Reason && a.Severity == b.Severity && a.Message == b.Message
+}
+
+// nodeName returns the name of the node of the machine, empty if it has not joined yet.
+func nodeName(m *clusterv1.Machine) string {
+	if m.Status.NodeRef == nil {
+		return ""
+	}
+
+	return m.Status.NodeRef.Name
+}
+
+// nodeError returns the error of the node from the errors aggregated over the nodes of a Talos API call.
+func nodeError(err error, node string) error {
+	aggregate, ok := err.(interface{ WrappedErrors() []error }) //nolint:errorlint
+	if !ok {
+		return err
+	}
+
+	for _, e := range aggregate.WrappedErrors() {
+		var nodeErr *talosclient.NodeError
+
+		if errors.As(e, &nodeErr) && nodeErr.Node == node {
+			return nodeErr.Err
+		}
+	}
+
+	return err
 }
 
 // gracefulEtcdLeave removes a given machine from the etcd cluster by forfeiting leadership
@@ -115,10 +318,11 @@ func (r *TalosControlPlaneReconciler) gracefulEtcdLeave(ctx context.Context, c *
 
 	for _, svc := range svcs {
 		if svc.Service.State != "Finished" {
-			r.Log.Info("forfeiting leadership", "machine", machineToLeave.Status.NodeRef.Name)
+			if r.dryRun(nil, "leaving etcd on machine %q", machineToLeave.Name) {
+				return nil
+			}
 
-			_, err = c.EtcdForfeitLeadership(ctx, &machine.EtcdForfeitLeadershipRequest{})
-			if err != nil {
+			if err = r.forfeitEtcdLeadership(ctx, c, machineToLeave); err != nil {
 				return err
 			}
 
@@ -134,11 +338,64 @@ func (r *TalosControlPlaneReconciler) gracefulEtcdLeave(ctx context.Context, c *
 	return nil
 }
 
+// etcdForfeitLeadershipTimeout is the timeout to forfeit the leadership of a member which is about to be removed.
+// The node of a deleted machine might be gone already, so it's kept short.
+const etcdForfeitLeadershipTimeout = 15 * time.Second
+
+// forfeitEtcdLeadership asks the member running on the machine to transfer the etcd leadership to another member.
+// It is a no-op if the member is not the leader.
+//
+// Removing the leader forces a new election, during which etcd doesn't serve writes; the transfer
+// avoids the election timeout, so the API server doesn't see errors while the member is removed.
+func (r *TalosControlPlaneReconciler) forfeitEtcdLeadership(ctx context.Context, c *talosclient.Client, machineToLeave clusterv1.Machine) error {
+	if r.dryRun(nil, "forfeiting etcd leadership on machine %q", machineToLeave.Name) {
+		return nil
+	}
+
+	r.Log.Info("forfeiting leadership", "machine", machineToLeave.Name, "node", machineToLeave.Status.NodeRef.Name)
+
+	resp, err := c.EtcdForfeitLeadership(ctx, &machine.EtcdForfeitLeadershipRequest{})
+	if err != nil {
+		return fmt.Errorf("error forfeiting etcd leadership on machine %q: %w", machineToLeave.Name, err)
+	}
+
+	for _, msg := range resp.Messages {
+		if msg.Member != "" {
+			r.Log.Info("transferred etcd leadership", "machine", machineToLeave.Name, "leader", msg.Member)
+		}
+	}
+
+	return nil
+}
+
+// forfeitEtcdLeadershipOfDeletedMachine transfers the etcd leadership away from a machine which was deleted
+// out from under us before its member is removed.
+// The node might be unreachable at this point, so the failures are only logged.
+func (r *TalosControlPlaneReconciler) forfeitEtcdLeadershipOfDeletedMachine(ctx context.Context, tcp *controlplanev1.TalosControlPlane, deletedMachine clusterv1.Machine) {
+	ctx, cancel := context.WithTimeout(ctx, etcdForfeitLeadershipTimeout)
+	defer cancel()
+
+	c, err := r.talosconfigForMachines(ctx, tcp, deletedMachine)
+	if err == nil {
+		defer c.Close() //nolint:errcheck
+
+		err = r.forfeitEtcdLeadership(ctx, c, deletedMachine)
+	}
+
+	if err != nil {
+		r.Log.Info("failed to forfeit etcd leadership, removing the member anyway", "machine", deletedMachine.Name, "error", err)
+	}
+}
+
 // forceEtcdLeave removes a given machine from the etcd cluster by telling another CP node to remove the member.
 // This is used in times when the machine was deleted out from under us.
 func (r *TalosControlPlaneReconciler) forceEtcdLeave(ctx context.Context, c *talosclient.Client, cluster client.ObjectKey, memberName string) error {
 	r.Log.Info("removing etcd member", "memberName", memberName)
 
+	if r.dryRun(nil, "removing etcd member %q", memberName) {
+		return nil
+	}
+
 	return c.EtcdRemoveMember(
 		ctx,
 		&machine.EtcdRemoveMemberRequest{
@@ -196,6 +453,10 @@ func (r *TalosControlPlaneReconciler) auditEtcd(ctx context.Context, tcp *contro
 	}
 
 	// Only querying one CP node, so only 1 message should return.
+	if len(response.Messages) == 0 {
+		return fmt.Errorf("no etcd members returned via %q", designatedCPMachine.Name)
+	}
+
 	memberList := response.Messages[0]
 
 	if len(memberList.Members) == 0 {
@@ -226,3 +487,65 @@ func (r *TalosControlPlaneReconciler) auditEtcd(ctx context.Context, tcp *contro
 
 	return nil
 }
+
+// removeEtcdMemberForMachine removes the etcd member of a deleted machine by asking one of the remaining
+// control plane machines to remove it. It is a no-op if the member is already gone.
+func (r *TalosControlPlaneReconciler) removeEtcdMemberForMachine(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, machines []clusterv1.Machine, deletedMachine clusterv1.Machine) error {
+	// machine without a noderef has never joined the etcd cluster
+	if deletedMachine.Status.NodeRef == nil {
+		return nil
+	}
+
+	var designatedCPMachine clusterv1.Machine
+
+	for _, machine := range machines {
+		if machine.Name == deletedMachine.Name || !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			continue
+		}
+
+		designatedCPMachine = machine
+
+		break
+	}
+
+	// no other control plane machines left, so there is no etcd cluster to remove the member from
+	if designatedCPMachine.Name == "" {
+		return nil
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, designatedCPMachine)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	response, err := c.EtcdMemberList(ctx, &machine.EtcdMemberListRequest{})
+	if err != nil {
+		return fmt.Errorf("error getting etcd members via %q (endpoints %v): %w", designatedCPMachine.Name, c.GetConfigContext().Endpoints, err)
+	}
+
+	if len(response.Messages) == 0 {
+		return fmt.Errorf("no etcd members returned via %q", designatedCPMachine.Name)
+	}
+
+	hostname := strings.Split(deletedMachine.Status.NodeRef.Name, ".")[0]
+
+	for _, member := range response.Messages[0].Members {
+		if member.Hostname != hostname {
+			continue
+		}
+
+		if err = r.snapshotEtcd(ctx, c, tcp, cluster, fmt.Sprintf("before removing the etcd member of machine %q", deletedMachine.Name)); err != nil {
+			return err
+		}
+
+		r.forfeitEtcdLeadershipOfDeletedMachine(ctx, tcp, deletedMachine)
+
+		if err = r.forceEtcdLeave(ctx, c, cluster, member.Hostname); err != nil {
+			return fmt.Errorf("error removing etcd member %q via machine %q: %w", member.Hostname, designatedCPMachine.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// etcdMaintenanceInProgress returns the name of the etcd maintenance operation in progress, if any.
+func etcdMaintenanceInProgress(tcp *controlplanev1.TalosControlPlane) (operation string, ok bool) {
+	operation, ok = tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation]
+
+	return operation, ok
+}
+
+// startEtcdMaintenance marks the etcd maintenance operation in progress, so that scaling is postponed.
+//
+// The annotation is persisted together with the TalosControlPlane status at the end of the reconcile.
+func startEtcdMaintenance(tcp *controlplanev1.TalosControlPlane, operation string) {
+	if tcp.Annotations == nil {
+		tcp.Annotations = map[string]string{}
+	}
+
+	tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation] = operation
+}
+
+// finishEtcdMaintenance clears the etcd maintenance state set by startEtcdMaintenance.
+func finishEtcdMaintenance(tcp *controlplanev1.TalosControlPlane, operation string) {
+	if tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation] == operation {
+		delete(tcp.Annotations, controlplanev1.EtcdMaintenanceAnnotation)
+	}
+}
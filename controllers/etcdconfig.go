@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// etcdConfigOperation is the etcd maintenance operation set while the etcd configuration is applied in place.
+const etcdConfigOperation = "etcd-config"
+
+// etcdConfigHash returns a short hash of the etcd configuration, it's empty if there is nothing to configure.
+func etcdConfigHash(etcd *controlplanev1.EtcdConfig) (string, error) {
+	args := etcdArgs(etcd)
+	if len(args) == 0 {
+		return "", nil
+	}
+
+	return shortHash(args)
+}
+
+// etcdConfigChange builds the pending in-place change of the etcd configuration.
+func etcdConfigChange(hash string, machines int32) controlplanev1.PendingChange {
+	return pendingChange(controlplanev1.RebootChangeStrategy, "etcd/"+hash, "etcd configuration", machines)
+}
+
+// reconcileEtcdConfig applies the changed etcd tuning parameters to the control plane machines.
+//
+// Talos restarts etcd with the new arguments only on boot, so the machine configuration is updated
+// and the machine is rebooted. Machines are rebooted one at a time to keep the etcd quorum: the next machine
+// is picked only after the previous one rebooted, all nodes finished booting and etcd is healthy.
+//
+// Arguments removed from the spec are left in the node configuration until the machine is replaced.
+func (r *TalosControlPlaneReconciler) reconcileEtcdConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	operation, maintenance := etcdMaintenanceInProgress(tcp)
+
+	if maintenance && operation == etcdConfigOperation {
+		pending, err := r.pendingMachineReboots(ctx, tcp, machines, controlplanev1.EtcdConfigAppliedAtAnnotation, controlplanev1.EtcdConfigHashAnnotation)
+		if err != nil {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, err
+		}
+
+		if pending {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+
+		finishEtcdMaintenance(tcp, etcdConfigOperation)
+	} else if maintenance {
+		return ctrl.Result{}, nil
+	}
+
+	// machine replacement takes care of the etcd configuration as well
+	if !tcp.Status.Bootstrapped || tcp.Status.Rollout != nil {
+		return ctrl.Result{}, nil
+	}
+
+	hash, err := etcdConfigHash(tcp.Spec.Etcd)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var outdated *clusterv1.Machine
+
+	for i := range machines {
+		machine := &machines[i]
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Annotations[controlplanev1.EtcdConfigHashAnnotation] == hash {
+			continue
+		}
+
+		if outdated == nil || machine.CreationTimestamp.Before(&outdated.CreationTimestamp) {
+			outdated = machine
+		}
+	}
+
+	if outdated == nil {
+		return ctrl.Result{}, nil
+	}
+
+	if !pendingChangeApproved(tcp, etcdConfigChange(hash, 0)) {
+		r.Log.Info("postponing etcd configuration until the change is approved", "machine", outdated.Name)
+
+		return ctrl.Result{}, nil
+	}
+
+	if len(machines) != int(*tcp.Spec.Replicas) {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+		}
+	}
+
+	if err = r.ensureNodesBooted(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for all nodes to finish boot sequence before applying etcd configuration", "error", err)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if !conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) {
+		r.Log.Info("waiting for etcd to become healthy before applying etcd configuration")
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	r.Log.Info("applying etcd configuration in place", "machine", outdated.Name)
+
+	if err = r.applyEtcdConfig(ctx, tcp, outdated); err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	patchHelper, err := patch.NewHelper(outdated, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if outdated.Annotations == nil {
+		outdated.Annotations = map[string]string{}
+	}
+
+	outdated.Annotations[controlplanev1.EtcdConfigHashAnnotation] = hash
+	outdated.Annotations[controlplanev1.EtcdConfigAppliedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	startEtcdMaintenance(tcp, etcdConfigOperation)
+
+	if err = patchHelper.Patch(ctx, outdated); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "EtcdConfig", "Applying etcd configuration to machine %q and rebooting it", outdated.Name)
+	}
+
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+// applyEtcdConfig updates the etcd arguments in the machine configuration on the node and reboots it.
+func (r *TalosControlPlaneReconciler) applyEtcdConfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	if r.dryRun(tcp, "applying etcd configuration to machine %q", machine.Name) {
+		return nil
+	}
+
+	patches, err := etcdPatches(&tcp.Spec)
+	if err != nil {
+		return err
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	current, err := readNodeFile(ctx, c, "/system/state/config.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read machine configuration: %w", err)
+	}
+
+	data, err := patchNodeConfig(current, patches)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.ApplyConfiguration(ctx, &machineapi.ApplyConfigurationRequest{
+		Data:     data,
+		OnReboot: true,
+	}); err != nil {
+		return fmt.Errorf("failed to apply machine configuration: %w", err)
+	}
+
+	if err = c.Reboot(ctx); err != nil {
+		return fmt.Errorf("failed to reboot machine: %w", err)
+	}
+
+	return nil
+}
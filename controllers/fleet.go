@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// FleetStatusServer serves a read-only JSON summary of all TalosControlPlanes.
+//
+// It lets fleet dashboards consume control plane status without RBAC access to the CRDs.
+type FleetStatusServer struct {
+	Client client.Reader
+	Log    logr.Logger
+	Addr   string
+}
+
+// ControlPlaneSummary is the compact status of a single TalosControlPlane.
+type ControlPlaneSummary struct {
+	Namespace           string             `json:"namespace"`
+	Name                string             `json:"name"`
+	Cluster             string             `json:"cluster,omitempty"`
+	Version             string             `json:"version"`
+	Replicas            int32              `json:"replicas"`
+	ReadyReplicas       int32              `json:"readyReplicas"`
+	UnavailableReplicas int32              `json:"unavailableReplicas"`
+	Initialized         bool               `json:"initialized"`
+	Ready               bool               `json:"ready"`
+	FailureMessage      string             `json:"failureMessage,omitempty"`
+	Problems            []ConditionProblem `json:"problems,omitempty"`
+}
+
+// ConditionProblem is a condition reporting a problem.
+type ConditionProblem struct {
+	Type               string    `json:"type"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// Start implements manager.Runnable.
+func (s *FleetStatusServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		s.Log.Info("serving fleet status", "addr", s.Addr)
+
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return err
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+//
+// Status is served by all replicas.
+func (s *FleetStatusServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *FleetStatusServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var tcps controlplanev1.TalosControlPlaneList
+
+	if err := s.Client.List(req.Context(), &tcps); err != nil {
+		s.Log.Error(err, "failed to list control planes")
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	summaries := make([]ControlPlaneSummary, 0, len(tcps.Items))
+
+	for _, tcp := range tcps.Items {
+		summaries = append(summaries, summarizeControlPlane(&tcp))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		s.Log.Error(err, "failed to write fleet status")
+	}
+}
+
+func summarizeControlPlane(tcp *controlplanev1.TalosControlPlane) ControlPlaneSummary {
+	summary := ControlPlaneSummary{
+		Namespace:           tcp.Namespace,
+		Name:                tcp.Name,
+		Cluster:             tcp.Labels[clusterv1.ClusterLabelName],
+		Version:             tcp.Spec.Version,
+		Replicas:            tcp.Status.Replicas,
+		ReadyReplicas:       tcp.Status.ReadyReplicas,
+		UnavailableReplicas: tcp.Status.UnavailableReplicas,
+		Initialized:         tcp.Status.Initialized,
+		Ready:               tcp.Status.Ready,
+	}
+
+	if tcp.Status.FailureMessage != nil {
+		summary.FailureMessage = *tcp.Status.FailureMessage
+	}
+
+	for _, condition := range tcp.Status.Conditions {
+		// degraded and timed out conditions have negative polarity
+		healthy := condition.Status == corev1.ConditionTrue
+		if condition.Type == controlplanev1.OperatorDegradedCondition || condition.Type == controlplanev1.OperationTimedOutCondition {
+			healthy = !healthy
+		}
+
+		if healthy {
+			continue
+		}
+
+		summary.Problems = append(summary.Problems, ConditionProblem{
+			Type:               string(condition.Type),
+			Reason:             condition.Reason,
+			Message:            condition.Message,
+			LastTransitionTime: condition.LastTransitionTime.Time,
+		})
+	}
+
+	return summary
+}
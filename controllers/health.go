@@ -8,14 +8,17 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
 	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
 	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
@@ -28,6 +31,52 @@ func (e *errServiceUnhealthy) Error() string {
 	return fmt.Sprintf("Service %s is unhealthy: %s", e.service, e.reason)
 }
 
+type errClockDrift struct {
+	node   string
+	offset time.Duration
+}
+
+func (e *errClockDrift) Error() string {
+	return fmt.Sprintf("Node %s clock is off by %s", e.node, e.offset)
+}
+
+type errResourcePressure struct {
+	node      string
+	reason    string
+	usage     float64
+	threshold int32
+}
+
+func (e *errResourcePressure) Error() string {
+	return fmt.Sprintf("Node %s is under pressure (%s): %.1f%% used, threshold %d%%", e.node, e.reason, e.usage, e.threshold)
+}
+
+type errMachineNotReady struct {
+	node            string
+	stage           string
+	unmetConditions []string
+}
+
+func (e *errMachineNotReady) Error() string {
+	if len(e.unmetConditions) == 0 {
+		return fmt.Sprintf("Node %s is not ready: stage %s", e.node, e.stage)
+	}
+
+	return fmt.Sprintf("Node %s is not ready: stage %s, unmet conditions: %s", e.node, e.stage, strings.Join(e.unmetConditions, ", "))
+}
+
+// machineStatusSpec is the subset of the Talos runtime MachineStatus resource spec used in health checks.
+type machineStatusSpec struct {
+	Stage  string `yaml:"stage"`
+	Status struct {
+		Ready           bool `yaml:"ready"`
+		UnmetConditions []struct {
+			Name   string `yaml:"name"`
+			Reason string `yaml:"reason"`
+		} `yaml:"unmetConditions"`
+	} `yaml:"status"`
+}
+
 func (r *TalosControlPlaneReconciler) nodesHealthcheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, machines []clusterv1.Machine) error {
 	client, err := r.talosconfigForMachines(ctx, tcp, machines...)
 	if err != nil {
@@ -36,6 +85,11 @@ func (r *TalosControlPlaneReconciler) nodesHealthcheck(ctx context.Context, tcp
 
 	defer client.Close() //nolint:errcheck
 
+	supported, err := machineStatusHealthcheck(ctx, client, machines)
+	if supported {
+		return err
+	}
+
 	serviceList, err := client.ServiceList(ctx)
 	if err != nil {
 		return err
@@ -126,3 +180,245 @@ func (r *TalosControlPlaneReconciler) ensureNodesBooted(ctx context.Context, tcp
 
 	return nil
 }
+
+// timeSyncHealthcheck verifies that clocks of all control plane nodes are in sync with their time servers.
+func (r *TalosControlPlaneReconciler) timeSyncHealthcheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, machines []clusterv1.Machine) error {
+	client, err := r.talosconfigForMachines(ctx, tcp, machines...)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close() //nolint:errcheck
+
+	nodes := machineAddresses(machines)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no machine addresses to check time on")
+	}
+
+	resp, err := client.Time(talosclient.WithNodes(ctx, nodes...))
+	if err != nil {
+		return err
+	}
+
+	var (
+		drift     error
+		maxOffset time.Duration
+	)
+
+	reported := map[string]struct{}{}
+
+	for _, message := range resp.Messages {
+		node := message.Metadata.GetHostname()
+		reported[node] = struct{}{}
+		offset := message.GetRemotetime().AsTime().Sub(message.GetLocaltime().AsTime())
+
+		if !r.DisablePerMachineMetrics {
+			nodeClockOffset.WithLabelValues(cluster.Namespace, cluster.Name, node).Set(offset.Seconds())
+		}
+
+		if offset < 0 {
+			offset = -offset
+		}
+
+		if offset > maxOffset {
+			maxOffset = offset
+		}
+
+		if offset > maxClockOffset && drift == nil {
+			drift = &errClockDrift{
+				node:   node,
+				offset: offset,
+			}
+		}
+	}
+
+	clusterClockOffset.WithLabelValues(cluster.Namespace, cluster.Name).Set(maxOffset.Seconds())
+
+	// nodes which didn't respond keep their series as long as the machine exists
+	machineNodes := map[string]struct{}{}
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef != nil {
+			machineNodes[machine.Status.NodeRef.Name] = struct{}{}
+		}
+	}
+
+	for _, node := range r.clockOffsetNodes.update(tcp.UID, reported, machineNodes) {
+		nodeClockOffset.DeleteLabelValues(cluster.Namespace, cluster.Name, node)
+	}
+
+	return drift
+}
+
+// machineAddresses returns the internal address of each machine which has one.
+func machineAddresses(machines []clusterv1.Machine) []string {
+	addresses := []string{}
+
+	for _, machine := range machines {
+		for _, addr := range machine.Status.Addresses {
+			if addr.Type == clusterv1.MachineInternalIP {
+				addresses = append(addresses, addr.Address)
+
+				break
+			}
+		}
+	}
+
+	return addresses
+}
+
+// resourcePressureCheck verifies that control plane nodes are not running out of etcd disk space or memory.
+func (r *TalosControlPlaneReconciler) resourcePressureCheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) error {
+	diskThreshold := int32(defaultEtcdDiskUsagePercent)
+	memoryThreshold := int32(defaultMemoryUsagePercent)
+
+	if thresholds := tcp.Spec.ResourcePressureThresholds; thresholds != nil {
+		if thresholds.EtcdDiskUsagePercent != nil {
+			diskThreshold = *thresholds.EtcdDiskUsagePercent
+		}
+
+		if thresholds.MemoryUsagePercent != nil {
+			memoryThreshold = *thresholds.MemoryUsagePercent
+		}
+	}
+
+	client, err := r.talosconfigForMachines(ctx, tcp, machines...)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close() //nolint:errcheck
+
+	nodes := machineAddresses(machines)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no machine addresses to check resources on")
+	}
+
+	nodesCtx := talosclient.WithNodes(ctx, nodes...)
+
+	mounts, err := client.Mounts(nodesCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range mounts.Messages {
+		var etcdMount *machineapi.MountStat
+
+		// pick the most specific mount containing the etcd data directory
+		for _, stat := range message.Stats {
+			if !isSubPath(constants.EtcdDataPath, stat.MountedOn) {
+				continue
+			}
+
+			if etcdMount == nil || len(stat.MountedOn) > len(etcdMount.MountedOn) {
+				etcdMount = stat
+			}
+		}
+
+		if etcdMount == nil || etcdMount.Size == 0 {
+			continue
+		}
+
+		usage := float64(etcdMount.Size-etcdMount.Available) / float64(etcdMount.Size) * 100
+		if usage > float64(diskThreshold) {
+			return &errResourcePressure{
+				node:      message.Metadata.GetHostname(),
+				reason:    controlplanev1.EtcdDiskPressureReason,
+				usage:     usage,
+				threshold: diskThreshold,
+			}
+		}
+	}
+
+	memory, err := client.Memory(nodesCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range memory.Messages {
+		meminfo := message.GetMeminfo()
+		if meminfo.GetMemtotal() == 0 {
+			continue
+		}
+
+		usage := float64(meminfo.GetMemtotal()-meminfo.GetMemavailable()) / float64(meminfo.GetMemtotal()) * 100
+		if usage > float64(memoryThreshold) {
+			return &errResourcePressure{
+				node:      message.Metadata.GetHostname(),
+				reason:    controlplanev1.MemoryPressureReason,
+				usage:     usage,
+				threshold: memoryThreshold,
+			}
+		}
+	}
+
+	return nil
+}
+
+// isSubPath checks whether the path is located under the mount point.
+func isSubPath(path, mountPoint string) bool {
+	if mountPoint == "/" || path == mountPoint {
+		return true
+	}
+
+	return strings.HasPrefix(path, mountPoint+"/")
+}
+
+// machineStatusHealthcheck checks the Talos MachineStatus resource of the nodes.
+//
+// The resource is not available in older Talos versions, in that case the check reports
+// it isn't supported without querying it, so that the caller falls back to other checks.
+func machineStatusHealthcheck(ctx context.Context, client *talosclient.Client, machines []clusterv1.Machine) (supported bool, err error) {
+	nodes := machineAddresses(machines)
+	if len(nodes) == 0 {
+		return false, nil
+	}
+
+	nodesCtx := talosclient.WithNodes(ctx, nodes...)
+
+	caps, err := detectTalosCapabilities(nodesCtx, client)
+	if err != nil || !caps.machineStatus() {
+		return false, nil
+	}
+
+	items, err := client.Resources.Get(nodesCtx, "runtime", "MachineStatuses.runtime.talos.dev", "machine")
+	if err != nil {
+		// older Talos versions don't have the resource, or some of the nodes can't be reached:
+		// services check will report a more precise failure
+		return false, nil
+	}
+
+	for _, item := range items {
+		if item.Resource == nil {
+			continue
+		}
+
+		data, err := yaml.Marshal(item.Resource.Spec())
+		if err != nil {
+			return true, err
+		}
+
+		var spec machineStatusSpec
+
+		if err = yaml.Unmarshal(data, &spec); err != nil {
+			return true, err
+		}
+
+		if spec.Stage == "running" && spec.Status.Ready {
+			continue
+		}
+
+		notReady := &errMachineNotReady{
+			node:  item.Metadata.GetHostname(),
+			stage: spec.Stage,
+		}
+
+		for _, condition := range spec.Status.UnmetConditions {
+			notReady.unmetConditions = append(notReady.unmetConditions, fmt.Sprintf("%s (%s)", condition.Name, condition.Reason))
+		}
+
+		return true, notReady
+	}
+
+	return true, nil
+}
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/patch"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// preDrainHookAnnotation returns the annotation set on the machines removed on scale down.
+func preDrainHookAnnotation(hook *controlplanev1.PreDrainHook) string {
+	return clusterv1.PreDrainDeleteHookAnnotationPrefix + "/" + hook.Name
+}
+
+// preDrainHookPending checks whether the removal of the deleted machine wasn't yet acknowledged
+// by the external controllers and the hook didn't time out.
+func preDrainHookPending(tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) bool {
+	hook := tcp.Spec.PreDrainHook
+	if hook == nil || machine.ObjectMeta.DeletionTimestamp.IsZero() {
+		return false
+	}
+
+	if _, ok := machine.Annotations[preDrainHookAnnotation(hook)]; !ok {
+		return false
+	}
+
+	timeout := defaultPreDrainHookTimeout
+	if hook.Timeout != nil {
+		timeout = hook.Timeout.Duration
+	}
+
+	return time.Since(machine.ObjectMeta.DeletionTimestamp.Time) < timeout
+}
+
+// setPreDrainHook adds the pre-drain hook annotation to the machine before it gets deleted.
+func (r *TalosControlPlaneReconciler) setPreDrainHook(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+
+	machine.Annotations[preDrainHookAnnotation(tcp.Spec.PreDrainHook)] = "TalosControlPlane/" + tcp.Name
+
+	return patchHelper.Patch(ctx, machine)
+}
+
+// reconcilePreDrainHook reports whether the deleted machine is still waiting for the pre-drain hook
+// and removes the hook once it times out.
+func (r *TalosControlPlaneReconciler) reconcilePreDrainHook(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) (pending bool, err error) {
+	hook := tcp.Spec.PreDrainHook
+	if hook == nil || machine.ObjectMeta.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+
+	annotation := preDrainHookAnnotation(hook)
+
+	if _, ok := machine.Annotations[annotation]; !ok {
+		return false, nil
+	}
+
+	if preDrainHookPending(tcp, machine) {
+		return true, nil
+	}
+
+	r.Log.Info("pre-drain hook timed out, removing it", "machine", machine.Name, "hook", annotation)
+
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return false, err
+	}
+
+	delete(machine.Annotations, annotation)
+
+	return false, patchHelper.Patch(ctx, machine)
+}
@@ -0,0 +1,255 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	talosconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+// reconcileTalosIdentity verifies that the Talos API certificates of the control plane machines are signed
+// by the CA of the talosconfig used by the controller.
+//
+// Nodes reinstalled out-of-band come up with a new Talos CA, and every Talos API call fails the TLS handshake.
+// The mismatch is reported with the remediation guidance instead of the generic connection errors,
+// and the machines are re-adopted once the talosconfig for the new CA is provided with the ReadoptTalosconfigAnnotation.
+//
+// Once the identities are verified to match, they are checked again only if Talos API calls fail the certificate verification.
+func (r *TalosControlPlaneReconciler) reconcileTalosIdentity(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if !tcp.Status.Bootstrapped {
+		return ctrl.Result{}, nil
+	}
+
+	if name, ok := tcp.Annotations[controlplanev1.ReadoptTalosconfigAnnotation]; ok {
+		return r.readoptMachines(ctx, tcp, machines, name)
+	}
+
+	if !talosIdentityCheckNeeded(tcp) {
+		return ctrl.Result{}, nil
+	}
+
+	mismatched, _, err := r.mismatchedTalosIdentities(ctx, tcp, machines, nil)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(mismatched) == 0 {
+		conditions.MarkTrue(tcp, controlplanev1.TalosIdentityMatchedCondition)
+
+		return ctrl.Result{}, nil
+	}
+
+	message := fmt.Sprintf("machines %s present Talos API certificates not signed by the talosconfig CA, the nodes were likely reinstalled out-of-band; "+
+		"to re-adopt them, put the talosconfig for the new CA into a secret under the %q key and set the %q annotation to the secret name",
+		strings.Join(mismatched, ", "), talosconfigSecretKey, controlplanev1.ReadoptTalosconfigAnnotation)
+
+	r.Log.Info("Talos identity mismatch", "machines", mismatched)
+
+	if r.Recorder != nil && conditions.GetReason(tcp, controlplanev1.TalosIdentityMatchedCondition) != controlplanev1.TalosIdentityMismatchReason {
+		r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "TalosIdentityMismatch", "%s", message)
+	}
+
+	conditions.MarkFalse(tcp, controlplanev1.TalosIdentityMatchedCondition, controlplanev1.TalosIdentityMismatchReason,
+		clusterv1.ConditionSeverityError, "%s", message)
+
+	return ctrl.Result{RequeueAfter: time.Minute}, nil
+}
+
+// talosIdentityCheckNeeded checks whether the Talos identities of the machines have to be verified:
+// until they are verified to match, and whenever a condition reports the certificate signed by an unknown authority.
+func talosIdentityCheckNeeded(tcp *controlplanev1.TalosControlPlane) bool {
+	if !conditions.IsTrue(tcp, controlplanev1.TalosIdentityMatchedCondition) {
+		return true
+	}
+
+	for _, condition := range tcp.Status.Conditions {
+		if condition.Reason == controlplanev1.CertificateUnknownAuthorityReason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readoptMachines switches the controller to the talosconfig from the secret, if the machines match its CA.
+func (r *TalosControlPlaneReconciler) readoptMachines(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, name string) (ctrl.Result, error) {
+	err := r.verifyReadoptTalosconfig(ctx, tcp, machines, name)
+	if err != nil {
+		r.Log.Info("failed to re-adopt control plane machines", "secret", name, "error", err)
+
+		conditions.MarkFalse(tcp, controlplanev1.TalosIdentityMatchedCondition, controlplanev1.TalosIdentityReadoptFailedReason,
+			clusterv1.ConditionSeverityError, "failed to re-adopt machines with the talosconfig from secret %q: %s", name, err)
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	if r.dryRun(tcp, "re-adopting control plane machines with the talosconfig from secret %q", name) {
+		return ctrl.Result{}, nil
+	}
+
+	r.Log.Info("re-adopted control plane machines", "secret", name)
+
+	tcp.Status.TalosConfigSecretRef = &corev1.LocalObjectReference{Name: name}
+	delete(tcp.Annotations, controlplanev1.ReadoptTalosconfigAnnotation)
+
+	conditions.MarkTrue(tcp, controlplanev1.TalosIdentityMatchedCondition)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "TalosIdentityReadopted", "Re-adopted control plane machines with the talosconfig from secret %q", name)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// verifyReadoptTalosconfig checks that the talosconfig from the secret matches all of the reachable machines.
+func (r *TalosControlPlaneReconciler) verifyReadoptTalosconfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, name string) error {
+	secret, err := r.kubernetesSecrets().Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: name})
+	if err != nil {
+		return err
+	}
+
+	data, ok := secret[talosconfigSecretKey]
+	if !ok {
+		return fmt.Errorf("secret doesn't have the %q key", talosconfigSecretKey)
+	}
+
+	t, err := talosconfig.FromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	mismatched, verified, err := r.mismatchedTalosIdentities(ctx, tcp, machines, t)
+	if err != nil {
+		return err
+	}
+
+	if len(mismatched) > 0 {
+		return fmt.Errorf("machines %s don't match the talosconfig CA", strings.Join(mismatched, ", "))
+	}
+
+	if verified == 0 {
+		return fmt.Errorf("none of the machines are reachable")
+	}
+
+	return nil
+}
+
+// mismatchedTalosIdentities returns the names of the machines with the Talos API certificate not signed by the talosconfig CA,
+// and the number of the machines verified.
+//
+// If t is nil, the talosconfig used by the controller for each machine is checked.
+// Unreachable machines are skipped, as their identity can't be checked.
+func (r *TalosControlPlaneReconciler) mismatchedTalosIdentities(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, t *talosconfig.Config) ([]string, int, error) {
+	var (
+		mismatched []string
+		verified   int
+	)
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			continue
+		}
+
+		addresses := machineAddresses([]clusterv1.Machine{machine})
+		if len(addresses) == 0 {
+			continue
+		}
+
+		cert, err := peerCertificate(net.JoinHostPort(addresses[0], strconv.Itoa(constants.ApidPort)))
+		if err != nil {
+			r.Log.Info("failed to inspect Talos API certificate", "machine", machine.Name, "error", err)
+
+			continue
+		}
+
+		cfg := t
+		if cfg == nil {
+			if cfg, err = r.machineTalosconfig(ctx, tcp, &machine); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		roots, err := talosconfigCA(cfg)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		verified++
+
+		if _, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			mismatched = append(mismatched, machine.Name)
+		}
+	}
+
+	sort.Strings(mismatched)
+
+	return mismatched, verified, nil
+}
+
+// machineTalosconfig returns the talosconfig used by the controller to access the machine:
+// the one from TalosConfigSecretRef, or the one generated for the machine.
+func (r *TalosControlPlaneReconciler) machineTalosconfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) (*talosconfig.Config, error) {
+	t, err := r.talosconfigFromSecretRef(ctx, tcp)
+	if err != nil || t != nil {
+		return t, err
+	}
+
+	var cfgs cabptv1.TalosConfigList
+
+	if err = r.Client.List(ctx, &cfgs, client.InNamespace(machine.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for _, cfg := range cfgs.Items {
+		for _, ref := range cfg.OwnerReferences {
+			if ref.Kind == "Machine" && ref.Name == machine.Name {
+				return talosconfig.FromString(cfg.Status.TalosConfig)
+			}
+		}
+	}
+
+	return nil, tcpclient.Retriable(fmt.Errorf("failed to find TalosConfig for %q", machine.Name))
+}
+
+// talosconfigCA returns the CA of the current talosconfig context.
+func talosconfigCA(t *talosconfig.Config) (*x509.CertPool, error) {
+	configContext, ok := t.Contexts[t.Context]
+	if !ok {
+		return nil, tcpclient.Terminal(fmt.Errorf("talosconfig context %q not found", t.Context))
+	}
+
+	ca, err := base64.StdEncoding.DecodeString(configContext.CA)
+	if err != nil {
+		return nil, tcpclient.Terminal(fmt.Errorf("failed to decode talosconfig CA: %w", err))
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, tcpclient.Terminal(fmt.Errorf("talosconfig CA is not a valid PEM certificate"))
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// imagePullWaitingReasons are the container waiting reasons reported by the kubelet when the image can't be pulled.
+var imagePullWaitingReasons = map[string]struct{}{
+	"ErrImagePull":     {},
+	"ImagePullBackOff": {},
+	"InvalidImageName": {},
+}
+
+type errImagePull struct {
+	node   string
+	image  string
+	reason string
+}
+
+func (e *errImagePull) Error() string {
+	return fmt.Sprintf("Node %s failed to pull image %q: %s", e.node, e.image, e.reason)
+}
+
+// reconcileImages verifies that the control plane nodes pull the images overridden in the TalosControlPlane.
+//
+// Talos pulls the etcd and kubelet images before starting the services, so the failures are read from the service events.
+// The control plane static pod and kube-proxy images are pulled by the kubelet, so the failures are read from the pod
+// container statuses. The installer image is pulled only on install and upgrade, so it's not checked.
+func (r *TalosControlPlaneReconciler) reconcileImages(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if tcp.Spec.Images == nil {
+		conditions.Delete(tcp, controlplanev1.ImagesResolvedCondition)
+
+		return ctrl.Result{}, nil
+	}
+
+	if !tcp.Status.Bootstrapped {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.imagesCheck(ctx, tcp, cluster, machines); err != nil {
+		var pull *errImagePull
+
+		if errors.As(err, &pull) {
+			conditions.MarkFalse(tcp, controlplanev1.ImagesResolvedCondition, controlplanev1.ImagePullFailedReason,
+				clusterv1.ConditionSeverityError, err.Error())
+
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+
+		r.Log.Info("failed to inspect images pulled by the control plane nodes", "error", err)
+
+		conditions.MarkFalse(tcp, controlplanev1.ImagesResolvedCondition, errorReason(err, controlplanev1.ImagesInspectionFailedReason),
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{}, nil
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.ImagesResolvedCondition)
+
+	return ctrl.Result{}, nil
+}
+
+// imagesCheck returns an error if any control plane node fails to pull an overridden image.
+func (r *TalosControlPlaneReconciler) imagesCheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, machines []clusterv1.Machine) error {
+	images := tcp.Spec.Images
+
+	if images.Etcd != "" || images.Kubelet != "" {
+		if err := r.serviceImagesCheck(ctx, tcp, machines, []serviceImage{
+			{"etcd", images.Etcd},
+			{"kubelet", images.Kubelet},
+		}); err != nil {
+			return err
+		}
+	}
+
+	podImages := map[string]struct{}{}
+
+	for _, image := range []string{images.APIServer, images.ControllerManager, images.Scheduler, images.Proxy} {
+		if image != "" {
+			podImages[image] = struct{}{}
+		}
+	}
+
+	if len(podImages) == 0 {
+		return nil
+	}
+
+	nodes := map[string]struct{}{}
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef != nil {
+			nodes[machine.Status.NodeRef.Name] = struct{}{}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	clientset, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return err
+	}
+
+	defer clientset.Close() //nolint:errcheck
+
+	pods, err := clientset.CoreV1().Pods(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods.Items {
+		if _, ok := nodes[pod.Spec.NodeName]; !ok {
+			continue
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if _, ok := podImages[status.Image]; !ok || status.State.Waiting == nil {
+				continue
+			}
+
+			if _, ok := imagePullWaitingReasons[status.State.Waiting.Reason]; ok {
+				return &errImagePull{
+					node:   pod.Spec.NodeName,
+					image:  status.Image,
+					reason: status.State.Waiting.Message,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+type serviceImage struct {
+	service string
+	image   string
+}
+
+// serviceImagesCheck returns an error if any control plane node fails to pull the image of a Talos service.
+func (r *TalosControlPlaneReconciler) serviceImagesCheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, images []serviceImage) error {
+	nodes := machineAddresses(machines)
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, machines...)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	nodesCtx := talosclient.WithNodes(ctx, nodes...)
+
+	for _, si := range images {
+		if si.image == "" {
+			continue
+		}
+
+		// responses of the unreachable nodes are dropped, they are reported by the node health check
+		svcs, err := c.ServiceInfo(nodesCtx, si.service)
+		if err != nil && len(svcs) == 0 {
+			return err
+		}
+
+		for _, svc := range svcs {
+			events := svc.Service.GetEvents().GetEvents()
+			if len(events) == 0 {
+				continue
+			}
+
+			// Talos reports the image which failed to pull in the event of the service pre stage
+			lastEvent := events[len(events)-1]
+			if lastEvent.State != "Running" && strings.Contains(lastEvent.Msg, si.image) {
+				return &errImagePull{
+					node:   svc.Metadata.GetHostname(),
+					image:  si.image,
+					reason: lastEvent.Msg,
+				}
+			}
+		}
+	}
+
+	return nil
+}
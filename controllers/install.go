@@ -0,0 +1,414 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// installUpgradeOperation is the etcd maintenance operation set while the machine is upgraded in place.
+const installUpgradeOperation = "install-upgrade"
+
+// nodeFileReader reads the files from the node, it's implemented by the Talos client.
+type nodeFileReader interface {
+	Read(ctx context.Context, path string) (io.ReadCloser, <-chan error, error)
+}
+
+// nodeUpgrader is the part of the Talos client used to upgrade the node in place.
+type nodeUpgrader interface {
+	nodeFileReader
+	ApplyConfiguration(ctx context.Context, req *machineapi.ApplyConfigurationRequest, callOptions ...grpc.CallOption) (*machineapi.ApplyConfigurationResponse, error)
+	Upgrade(ctx context.Context, image string, preserve, stage, force bool, callOptions ...grpc.CallOption) (*machineapi.UpgradeResponse, error)
+}
+
+// installHash returns a short hash of the install configuration, it's empty if there is nothing to install.
+func installHash(install *controlplanev1.InstallConfig) (string, error) {
+	if install == nil || (len(install.ExtraKernelArgs) == 0 && len(install.Extensions) == 0 && len(install.ImageDigests) == 0) {
+		return "", nil
+	}
+
+	data, err := json.Marshal(install)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])[:10], nil
+}
+
+// reconcileInstallConfig applies the changed kernel arguments and system extensions to the control plane machines.
+//
+// Talos applies them only on install, so the machine configuration is updated and the machine is upgraded in place
+// to the same installer image preserving the data, which avoids re-provisioning the machine.
+// Machines are upgraded one at a time: the next machine is picked only after the previous one rebooted,
+// all nodes finished booting and etcd is healthy. Scaling is postponed while the machine is upgraded.
+func (r *TalosControlPlaneReconciler) reconcileInstallConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	operation, maintenance := etcdMaintenanceInProgress(tcp)
+
+	if maintenance && operation == installUpgradeOperation {
+		pending, err := r.pendingMachineReboots(ctx, tcp, machines, controlplanev1.InstallUpgradedAtAnnotation, controlplanev1.InstallHashAnnotation)
+		if err != nil {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, err
+		}
+
+		if pending {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+
+		finishEtcdMaintenance(tcp, installUpgradeOperation)
+	} else if maintenance {
+		return ctrl.Result{}, nil
+	}
+
+	// machine replacement takes care of the install configuration as well
+	if !tcp.Status.Bootstrapped || tcp.Status.Rollout != nil {
+		return ctrl.Result{}, nil
+	}
+
+	hash, err := installHash(tcp.Spec.Install)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var outdated *clusterv1.Machine
+
+	for i := range machines {
+		machine := &machines[i]
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Annotations[controlplanev1.InstallHashAnnotation] == hash {
+			continue
+		}
+
+		if outdated == nil || machine.CreationTimestamp.Before(&outdated.CreationTimestamp) {
+			outdated = machine
+		}
+	}
+
+	if outdated == nil {
+		return ctrl.Result{}, nil
+	}
+
+	if !changeApproved(tcp, controlplanev1.RebootChangeStrategy) {
+		r.Log.Info("postponing in-place upgrade until the change is approved", "machine", outdated.Name)
+
+		return ctrl.Result{}, nil
+	}
+
+	if len(machines) != int(*tcp.Spec.Replicas) {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+		}
+	}
+
+	if err = r.ensureNodesBooted(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for all nodes to finish boot sequence before upgrading", "error", err)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if !conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) {
+		r.Log.Info("waiting for etcd to become healthy before upgrading")
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	r.Log.Info("upgrading machine in place to apply install configuration", "machine", outdated.Name)
+
+	if err = r.upgradeInstallConfig(ctx, tcp, outdated); err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	patchHelper, err := patch.NewHelper(outdated, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if outdated.Annotations == nil {
+		outdated.Annotations = map[string]string{}
+	}
+
+	outdated.Annotations[controlplanev1.InstallHashAnnotation] = hash
+	outdated.Annotations[controlplanev1.InstallUpgradedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	startEtcdMaintenance(tcp, installUpgradeOperation)
+
+	if err = patchHelper.Patch(ctx, outdated); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "InstallUpgrade", "Upgrading machine %q in place to apply kernel arguments and system extensions", outdated.Name)
+	}
+
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+// pendingMachineReboots checks whether the machines changed in place have rebooted and finished booting,
+// the time of the change is recorded on the machines with the annotation, which is removed after the reboot.
+//
+// If the machine doesn't reboot within machineRebootTimeout, the change is considered failed: both annotations
+// are removed, so that the change is retried once all nodes are booted and etcd is healthy.
+func (r *TalosControlPlaneReconciler) pendingMachineReboots(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, annotation, hashAnnotation string) (bool, error) {
+	pending := false
+
+	for i := range machines {
+		machine := &machines[i]
+
+		value, ok := machine.Annotations[annotation]
+		if !ok {
+			continue
+		}
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		changedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false, fmt.Errorf("machine %q has invalid %s annotation: %w", machine.Name, annotation, err)
+		}
+
+		rebooted, err := r.machineRebootedSince(ctx, tcp, machine, changedAt)
+		if !rebooted && time.Since(changedAt) < machineRebootTimeout {
+			r.Log.Info("waiting for machine to reboot", "machine", machine.Name, "error", err)
+
+			pending = true
+
+			continue
+		}
+
+		patchHelper, err := patch.NewHelper(machine, r.Client)
+		if err != nil {
+			return false, err
+		}
+
+		delete(machine.Annotations, annotation)
+
+		if !rebooted {
+			delete(machine.Annotations, hashAnnotation)
+		}
+
+		if err = patchHelper.Patch(ctx, machine); err != nil {
+			return false, err
+		}
+
+		if rebooted {
+			r.Log.Info("machine rebooted", "machine", machine.Name)
+
+			continue
+		}
+
+		r.Log.Info("machine didn't reboot in time, the change will be retried", "machine", machine.Name, "timeout", machineRebootTimeout)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "RebootTimedOut", "Machine %q didn't reboot within %s after the change, the change will be retried", machine.Name, machineRebootTimeout)
+		}
+	}
+
+	return pending, nil
+}
+
+// machineRebootedSince checks whether the node of the machine booted after the given time.
+func (r *TalosControlPlaneReconciler) machineRebootedSince(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine, since time.Time) (bool, error) {
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return false, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	bootTime, err := nodeBootTime(ctx, c)
+	if err != nil {
+		return false, err
+	}
+
+	return !bootTime.Before(since), nil
+}
+
+// upgradeInstallConfig updates the install section of the machine configuration on the node
+// and upgrades the node in place to the installer image it runs.
+func (r *TalosControlPlaneReconciler) upgradeInstallConfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	if r.dryRun(tcp, "upgrading machine %q in place", machine.Name) {
+		return nil
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	return upgradeNode(ctx, c, tcp.Spec.Install)
+}
+
+// upgradeNode updates the install section of the machine configuration applied on the next reboot
+// and upgrades the node to the installer image, so that the configuration is applied by the upgrade reboot.
+func upgradeNode(ctx context.Context, c nodeUpgrader, install *controlplanev1.InstallConfig) error {
+	current, err := readNodeFile(ctx, c, "/system/state/config.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read machine configuration: %w", err)
+	}
+
+	data, image, err := patchInstallConfig(current, install)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.ApplyConfiguration(ctx, &machineapi.ApplyConfigurationRequest{
+		Data:     data,
+		OnReboot: true,
+	}); err != nil {
+		return fmt.Errorf("failed to apply machine configuration: %w", err)
+	}
+
+	if _, err = c.Upgrade(ctx, image, true, false, false); err != nil {
+		return fmt.Errorf("failed to upgrade machine: %w", err)
+	}
+
+	return nil
+}
+
+// patchInstallConfig replaces kernel arguments and system extensions in the machine configuration
+// and pins the digests of the installer and extension images.
+//
+// It returns the updated machine configuration and the installer image.
+func patchInstallConfig(data []byte, install *controlplanev1.InstallConfig) ([]byte, string, error) {
+	var config map[string]interface{}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, "", fmt.Errorf("failed to parse machine configuration: %w", err)
+	}
+
+	machine, _ := config["machine"].(map[string]interface{}) //nolint:errcheck
+	if machine == nil {
+		return nil, "", fmt.Errorf("machine configuration has no machine section")
+	}
+
+	section, _ := machine["install"].(map[string]interface{}) //nolint:errcheck
+	if section == nil {
+		section = map[string]interface{}{}
+		machine["install"] = section
+	}
+
+	image, _ := section["image"].(string) //nolint:errcheck
+	if image == "" {
+		return nil, "", fmt.Errorf("machine configuration has no installer image")
+	}
+
+	image = pinnedImage(install, image)
+	section["image"] = image
+
+	delete(section, "extraKernelArgs")
+	delete(section, "extensions")
+
+	if install != nil && len(install.ExtraKernelArgs) > 0 {
+		section["extraKernelArgs"] = install.ExtraKernelArgs
+	}
+
+	if install != nil && len(install.Extensions) > 0 {
+		extensions := make([]map[string]string, 0, len(install.Extensions))
+
+		for _, extension := range install.Extensions {
+			extensions = append(extensions, map[string]string{"image": pinnedImage(install, extension.Image)})
+		}
+
+		section["extensions"] = extensions
+	}
+
+	patched, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return patched, image, nil
+}
+
+// pinnedImage returns the image reference with the digest pinned in the install configuration,
+// the reference is returned as is if no digest is pinned for it.
+//
+// The nodes pull the pinned images by the digest, so an image pushed again with the same tag is not installed.
+func pinnedImage(install *controlplanev1.InstallConfig, image string) string {
+	if install == nil {
+		return image
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+
+	pinned, ok := install.ImageDigests[name]
+	if !ok {
+		return image
+	}
+
+	return name + "@" + pinned
+}
+
+// nodeBootTime returns the time the node booted at.
+func nodeBootTime(ctx context.Context, c nodeFileReader) (time.Time, error) {
+	data, err := readNodeFile(ctx, c, "/proc/uptime")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("unexpected uptime %q", data)
+	}
+
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(-time.Duration(uptime * float64(time.Second))), nil
+}
+
+// readNodeFile reads the file from the node via the Talos API.
+func readNodeFile(ctx context.Context, c nodeFileReader, path string) ([]byte, error) {
+	r, errCh, err := c.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = <-errCh; err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,390 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const (
+	testInstallerImage = "ghcr.io/siderolabs/installer:v1.0.0"
+	testDigest         = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	testOtherDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+func TestInstallHash(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		install *controlplanev1.InstallConfig
+		empty   bool
+	}{
+		{
+			name:  "nil",
+			empty: true,
+		},
+		{
+			name:    "empty",
+			install: &controlplanev1.InstallConfig{},
+			empty:   true,
+		},
+		{
+			name:    "kernel arguments",
+			install: &controlplanev1.InstallConfig{ExtraKernelArgs: []string{"console=ttyS0"}},
+		},
+		{
+			name:    "extensions",
+			install: &controlplanev1.InstallConfig{Extensions: []controlplanev1.InstallExtension{{Image: "ghcr.io/siderolabs/gvisor:v1.0.0"}}},
+		},
+		{
+			name:    "image digests",
+			install: &controlplanev1.InstallConfig{ImageDigests: map[string]string{testInstallerImage: testDigest}},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := installHash(tt.install)
+			require.NoError(t, err)
+
+			if tt.empty {
+				assert.Empty(t, hash)
+			} else {
+				assert.Len(t, hash, 10)
+			}
+		})
+	}
+}
+
+func TestInstallHashDigestChange(t *testing.T) {
+	install := &controlplanev1.InstallConfig{
+		ImageDigests: map[string]string{testInstallerImage: testDigest},
+	}
+
+	before, err := installHash(install)
+	require.NoError(t, err)
+
+	install.ImageDigests[testInstallerImage] = testOtherDigest
+
+	after, err := installHash(install)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, before, after)
+
+	again, err := installHash(install.DeepCopy())
+	require.NoError(t, err)
+
+	assert.Equal(t, after, again)
+}
+
+func TestPinnedImage(t *testing.T) {
+	install := &controlplanev1.InstallConfig{
+		ImageDigests: map[string]string{testInstallerImage: testDigest},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		install  *controlplanev1.InstallConfig
+		image    string
+		expected string
+	}{
+		{
+			name:     "no install config",
+			image:    testInstallerImage,
+			expected: testInstallerImage,
+		},
+		{
+			name:     "pinned",
+			install:  install,
+			image:    testInstallerImage,
+			expected: testInstallerImage + "@" + testDigest,
+		},
+		{
+			name:     "digest replaced",
+			install:  install,
+			image:    testInstallerImage + "@" + testOtherDigest,
+			expected: testInstallerImage + "@" + testDigest,
+		},
+		{
+			name:     "not pinned",
+			install:  install,
+			image:    "ghcr.io/siderolabs/installer:v1.0.1",
+			expected: "ghcr.io/siderolabs/installer:v1.0.1",
+		},
+		{
+			name:     "not pinned with digest",
+			install:  install,
+			image:    "ghcr.io/siderolabs/installer:v1.0.1@" + testOtherDigest,
+			expected: "ghcr.io/siderolabs/installer:v1.0.1@" + testOtherDigest,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, pinnedImage(tt.install, tt.image))
+		})
+	}
+}
+
+const testMachineConfig = `version: v1alpha1
+machine:
+  type: controlplane
+  install:
+    disk: /dev/sda
+    image: ghcr.io/siderolabs/installer:v1.0.0
+    extraKernelArgs:
+      - console=tty0
+`
+
+// fakeNodeUpgrader records the calls upgrading the node in place.
+type fakeNodeUpgrader struct {
+	config   string
+	applyErr error
+
+	calls    []string
+	applied  *machineapi.ApplyConfigurationRequest
+	image    string
+	preserve bool
+	stage    bool
+}
+
+func (f *fakeNodeUpgrader) Read(ctx context.Context, path string) (io.ReadCloser, <-chan error, error) {
+	if path != "/system/state/config.yaml" {
+		return nil, nil, fmt.Errorf("unexpected path %q", path)
+	}
+
+	errCh := make(chan error)
+	close(errCh)
+
+	return io.NopCloser(bytes.NewBufferString(f.config)), errCh, nil
+}
+
+func (f *fakeNodeUpgrader) ApplyConfiguration(ctx context.Context, req *machineapi.ApplyConfigurationRequest, callOptions ...grpc.CallOption) (*machineapi.ApplyConfigurationResponse, error) {
+	f.calls = append(f.calls, "apply")
+
+	if f.applyErr != nil {
+		return nil, f.applyErr
+	}
+
+	f.applied = req
+
+	return &machineapi.ApplyConfigurationResponse{}, nil
+}
+
+func (f *fakeNodeUpgrader) Upgrade(ctx context.Context, image string, preserve, stage, force bool, callOptions ...grpc.CallOption) (*machineapi.UpgradeResponse, error) {
+	f.calls = append(f.calls, "upgrade")
+
+	f.image, f.preserve, f.stage = image, preserve, stage
+
+	return &machineapi.UpgradeResponse{}, nil
+}
+
+func TestUpgradeNode(t *testing.T) {
+	ctx := context.Background()
+
+	install := &controlplanev1.InstallConfig{
+		ExtraKernelArgs: []string{"console=ttyS0"},
+		ImageDigests:    map[string]string{testInstallerImage: testDigest},
+	}
+
+	node := &fakeNodeUpgrader{config: testMachineConfig}
+
+	require.NoError(t, upgradeNode(ctx, node, install))
+
+	// the configuration is staged for the reboot of the upgrade, so that both are applied at once
+	assert.Equal(t, []string{"apply", "upgrade"}, node.calls)
+	assert.True(t, node.applied.OnReboot)
+
+	assert.Equal(t, testInstallerImage+"@"+testDigest, node.image)
+	assert.True(t, node.preserve, "the node should keep the ephemeral partition, etcd data is stored there")
+	assert.False(t, node.stage)
+
+	var applied struct {
+		Machine struct {
+			Install struct {
+				Disk            string   `yaml:"disk"`
+				Image           string   `yaml:"image"`
+				ExtraKernelArgs []string `yaml:"extraKernelArgs"`
+			} `yaml:"install"`
+		} `yaml:"machine"`
+	}
+
+	require.NoError(t, yaml.Unmarshal(node.applied.Data, &applied))
+	assert.Equal(t, "/dev/sda", applied.Machine.Install.Disk)
+	assert.Equal(t, testInstallerImage+"@"+testDigest, applied.Machine.Install.Image)
+	assert.Equal(t, []string{"console=ttyS0"}, applied.Machine.Install.ExtraKernelArgs)
+}
+
+func TestUpgradeNodeFailure(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name     string
+		node     *fakeNodeUpgrader
+		expected []string
+	}{
+		{
+			name:     "apply failed",
+			node:     &fakeNodeUpgrader{config: testMachineConfig, applyErr: errors.New("connection refused")},
+			expected: []string{"apply"},
+		},
+		{
+			name: "no installer image",
+			node: &fakeNodeUpgrader{config: "version: v1alpha1\nmachine:\n  type: controlplane\n"},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, upgradeNode(ctx, tt.node, &controlplanev1.InstallConfig{}))
+
+			// the node is never upgraded without the updated configuration
+			assert.Equal(t, tt.expected, tt.node.calls)
+		})
+	}
+}
+
+func TestPendingMachineReboots(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterv1.AddToScheme(scheme))
+
+	const (
+		annotation     = controlplanev1.InstallUpgradedAtAnnotation
+		hashAnnotation = controlplanev1.InstallHashAnnotation
+	)
+
+	newMachine := func(name string, changedAt time.Time) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Annotations: map[string]string{
+					annotation:     changedAt.Format(time.RFC3339),
+					hashAnnotation: "0123456789",
+				},
+			},
+		}
+	}
+
+	// the nodes are not reachable: the machines have no addresses, so they are never seen rebooted
+	tcp := &controlplanev1.TalosControlPlane{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-cp"},
+		Spec: controlplanev1.TalosControlPlaneSpec{
+			AddressSources: []controlplanev1.AddressSourceName{controlplanev1.AnnotationAddressSource},
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		machine  *clusterv1.Machine
+		deleted  bool
+		pending  bool
+		err      bool
+		removed  bool
+		timedOut bool
+	}{
+		{
+			name:    "not rebooted yet",
+			machine: newMachine("recent", time.Now().Add(-time.Minute)),
+			pending: true,
+		},
+		{
+			name:     "reboot timed out",
+			machine:  newMachine("stale", time.Now().Add(-machineRebootTimeout-time.Minute)),
+			removed:  true,
+			timedOut: true,
+		},
+		{
+			name:    "deleted",
+			machine: newMachine("deleted", time.Now().Add(-time.Minute)),
+			deleted: true,
+		},
+		{
+			name: "invalid annotation",
+			machine: &clusterv1.Machine{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "invalid",
+					Annotations: map[string]string{annotation: "yesterday"},
+				},
+			},
+			err: true,
+		},
+		{
+			name:    "not changed",
+			machine: &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unchanged"}},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(1)
+
+			r := &TalosControlPlaneReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.machine.DeepCopy()).Build(),
+				Log:      logr.Discard(),
+				Recorder: recorder,
+			}
+
+			machine := tt.machine.DeepCopy()
+
+			if tt.deleted {
+				now := metav1.Now()
+				machine.DeletionTimestamp = &now
+			}
+
+			pending, err := r.pendingMachineReboots(ctx, tcp, []clusterv1.Machine{*machine}, annotation, hashAnnotation)
+			if tt.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.pending, pending)
+
+			var stored clusterv1.Machine
+
+			require.NoError(t, r.Client.Get(ctx, client.ObjectKeyFromObject(tt.machine), &stored))
+
+			if tt.removed {
+				// both annotations are removed, so that the change is retried
+				assert.NotContains(t, stored.Annotations, annotation)
+				assert.NotContains(t, stored.Annotations, hashAnnotation)
+			} else {
+				assert.Equal(t, tt.machine.Annotations, stored.Annotations)
+			}
+
+			if tt.timedOut {
+				require.Len(t, recorder.Events, 1)
+				assert.Contains(t, <-recorder.Events, "RebootTimedOut")
+			} else {
+				assert.Empty(t, recorder.Events)
+			}
+		})
+	}
+}
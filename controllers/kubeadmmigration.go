@@ -0,0 +1,350 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// kubeadmMigrationOperation is the etcd maintenance operation set while the migration waits for a Talos machine
+// to join etcd or for a kubeadm machine to be deleted, so that scaling is postponed.
+const kubeadmMigrationOperation = "kubeadm-migration"
+
+// kubeadmControlPlaneKind is the kind of the Cluster API kubeadm control plane provider.
+var kubeadmControlPlaneKind = schema.GroupVersionKind{
+	Group:   "controlplane.cluster.x-k8s.io",
+	Version: "v1beta1",
+	Kind:    "KubeadmControlPlane",
+}
+
+// kubeadmControlPlaneOf returns the name of the KubeadmControlPlane controlling the Machine, if any.
+func kubeadmControlPlaneOf(machine *clusterv1.Machine) (string, bool) {
+	owner := metav1.GetControllerOf(machine)
+	if owner == nil || owner.Kind != kubeadmControlPlaneKind.Kind || !strings.HasPrefix(owner.APIVersion, kubeadmControlPlaneKind.Group+"/") {
+		return "", false
+	}
+
+	return owner.Name, true
+}
+
+// kubeadmMigrationInProgress checks whether the kubeadm machines are still being replaced.
+func kubeadmMigrationInProgress(tcp *controlplanev1.TalosControlPlane) bool {
+	migration := tcp.Status.KubeadmMigration
+
+	return migration != nil && migration.Phase != controlplanev1.KubeadmMigrationCompleted
+}
+
+// kubeadmMigrationBlocksMachines checks whether the requested migration hasn't started yet,
+// no machines are created meanwhile, as the first one would bootstrap a new cluster.
+func kubeadmMigrationBlocksMachines(tcp *controlplanev1.TalosControlPlane) bool {
+	if _, ok := tcp.Annotations[controlplanev1.MigrateFromKCPAnnotation]; !ok {
+		return false
+	}
+
+	migration := tcp.Status.KubeadmMigration
+
+	return migration == nil || migration.Phase == controlplanev1.KubeadmMigrationPending
+}
+
+// reconcileKubeadmMigration takes over the cluster from the KubeadmControlPlane named by MigrateFromKCPAnnotation.
+//
+// The cluster is expected to point its control plane reference to the TalosControlPlane and the KubeadmControlPlane
+// to be paused, the control plane configuration has to carry the secrets of the cluster (certificate authorities,
+// service account key, tokens) so that the Talos machines join it.
+// The cluster is considered bootstrapped, the Talos machines are added one at a time: the next kubeadm machine is retired
+// (its etcd member removed and the Machine deleted) only after the Talos machine joined etcd, so that the number of
+// etcd members never drops below the desired replicas. The KubeadmControlPlane is left for the user to delete.
+//
+// The migration is experimental and is only performed if EnableKCPMigration is set.
+func (r *TalosControlPlaneReconciler) reconcileKubeadmMigration(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	source, ok := tcp.Annotations[controlplanev1.MigrateFromKCPAnnotation]
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	if !r.EnableKCPMigration {
+		r.Log.Info("ignoring migration from KubeadmControlPlane, it's not enabled in the controller", "source", source)
+
+		return ctrl.Result{}, nil
+	}
+
+	migration := tcp.Status.KubeadmMigration
+	if migration == nil || migration.Source != source {
+		migration = &controlplanev1.KubeadmMigrationStatus{
+			Source: source,
+			Phase:  controlplanev1.KubeadmMigrationPending,
+		}
+
+		tcp.Status.KubeadmMigration = migration
+	}
+
+	if migration.Phase == controlplanev1.KubeadmMigrationCompleted {
+		return ctrl.Result{}, nil
+	}
+
+	kubeadmMachines, err := r.kubeadmMachines(ctx, cluster, source)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	migration.KubeadmReplicas = int32(len(kubeadmMachines))
+
+	if migration.Phase == controlplanev1.KubeadmMigrationPending {
+		blocked, err := r.kubeadmMigrationBlocked(ctx, tcp, source, machines, kubeadmMachines)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if blocked != "" {
+			r.Log.Info("waiting for migration prerequisites", "source", source, "reason", blocked)
+
+			migration.Message = blocked
+
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+
+		now := metav1.Now()
+
+		migration.Phase = controlplanev1.KubeadmMigrationInProgress
+		migration.StartTime = &now
+		migration.Message = ""
+
+		// the cluster was bootstrapped by kubeadm, the Talos machines join it
+		tcp.Status.Bootstrapped = true
+		conditions.MarkTrue(tcp, controlplanev1.MachinesBootstrapped)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "KubeadmMigrationStarted", "Started taking over the control plane from KubeadmControlPlane %q", source)
+		}
+	}
+
+	if operation, ok := etcdMaintenanceInProgress(tcp); ok && operation != kubeadmMigrationOperation {
+		migration.Message = fmt.Sprintf("waiting for etcd %s to complete", operation)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	wait, err := r.kubeadmMigrationWait(ctx, tcp, machines, kubeadmMachines)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	if wait != "" {
+		migration.Message = wait
+
+		startEtcdMaintenance(tcp, kubeadmMigrationOperation)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if len(kubeadmMachines) == 0 {
+		now := metav1.Now()
+
+		migration.Phase = controlplanev1.KubeadmMigrationCompleted
+		migration.CompletionTime = &now
+		migration.Message = ""
+
+		finishEtcdMaintenance(tcp, kubeadmMigrationOperation)
+
+		r.audit(tcp, cluster.Name, auditKubeadmMigration, "", nil, fmt.Sprintf("Took over the control plane from KubeadmControlPlane %q", source))
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "KubeadmMigrationCompleted", "Retired all machines of KubeadmControlPlane %q, it can be deleted now", source)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	talos := 0
+
+	for _, machine := range machines {
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			talos++
+		}
+	}
+
+	replicas := int(*tcp.Spec.Replicas)
+
+	// a Talos machine is added before the next kubeadm machine is retired, the etcd members are removed via the Talos machines
+	if talos == 0 || (talos < replicas && talos+len(kubeadmMachines) <= replicas) {
+		migration.Message = "adding Talos machine"
+
+		finishEtcdMaintenance(tcp, kubeadmMigrationOperation)
+
+		return ctrl.Result{}, nil
+	}
+
+	retired := &kubeadmMachines[0]
+
+	for i := range kubeadmMachines {
+		if kubeadmMachines[i].CreationTimestamp.Before(&retired.CreationTimestamp) {
+			retired = &kubeadmMachines[i]
+		}
+	}
+
+	migration.Message = fmt.Sprintf("retiring kubeadm machine %q", retired.Name)
+
+	startEtcdMaintenance(tcp, kubeadmMigrationOperation)
+
+	if err = r.retireKubeadmMachine(ctx, cluster, tcp, machines, retired); err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+}
+
+// kubeadmMachines returns the Machines of the cluster controlled by the KubeadmControlPlane.
+func (r *TalosControlPlaneReconciler) kubeadmMachines(ctx context.Context, cluster *clusterv1.Cluster, source string) ([]clusterv1.Machine, error) {
+	var machineList clusterv1.MachineList
+
+	if err := r.Client.List(ctx, &machineList,
+		client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{clusterv1.ClusterLabelName: cluster.Name},
+	); err != nil {
+		return nil, err
+	}
+
+	machines := []clusterv1.Machine{}
+
+	for _, machine := range machineList.Items {
+		if name, ok := kubeadmControlPlaneOf(&machine); ok && name == source {
+			machines = append(machines, machine)
+		}
+	}
+
+	return machines, nil
+}
+
+// kubeadmMigrationBlocked returns the reason the migration can't be started, empty if it can.
+func (r *TalosControlPlaneReconciler) kubeadmMigrationBlocked(ctx context.Context, tcp *controlplanev1.TalosControlPlane, source string, machines, kubeadmMachines []clusterv1.Machine) (string, error) {
+	if len(machines) > 0 {
+		return "the control plane already has Talos machines", nil
+	}
+
+	if !reflect.ValueOf(tcp.Spec.ControlPlaneConfig.InitConfig).IsZero() {
+		return "the init config must not be set, the Talos machines join the existing cluster", nil
+	}
+
+	kcp := &unstructured.Unstructured{}
+	kcp.SetGroupVersionKind(kubeadmControlPlaneKind)
+
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: tcp.Namespace, Name: source}, kcp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf("KubeadmControlPlane %q is not found", source), nil
+		}
+
+		return "", err
+	}
+
+	if !annotations.HasPausedAnnotation(kcp) {
+		return fmt.Sprintf("KubeadmControlPlane %q must be paused with the %s annotation", source, clusterv1.PausedAnnotation), nil
+	}
+
+	if len(kubeadmMachines) == 0 {
+		return fmt.Sprintf("KubeadmControlPlane %q has no machines", source), nil
+	}
+
+	for _, machine := range kubeadmMachines {
+		if machine.Status.NodeRef == nil {
+			return fmt.Sprintf("kubeadm machine %q has no node", machine.Name), nil
+		}
+	}
+
+	return "", nil
+}
+
+// kubeadmMigrationWait returns what the migration waits for before the next step, empty if nothing:
+// the Talos machines have to join etcd and the retired kubeadm machines have to be deleted.
+func (r *TalosControlPlaneReconciler) kubeadmMigrationWait(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines, kubeadmMachines []clusterv1.Machine) (string, error) {
+	for _, machine := range kubeadmMachines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			return fmt.Sprintf("waiting for kubeadm machine %q to be deleted", machine.Name), nil
+		}
+	}
+
+	joining := make([]clusterv1.Machine, 0, len(machines))
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if machine.Status.NodeRef == nil {
+			return fmt.Sprintf("waiting for Talos machine %q to get a node", machine.Name), nil
+		}
+
+		joining = append(joining, machine)
+	}
+
+	if len(joining) == 0 {
+		return "", nil
+	}
+
+	memberNames, err := r.etcdMemberNames(ctx, tcp, joining)
+	if err != nil {
+		return "", fmt.Errorf("failed to list etcd members: %w", err)
+	}
+
+	members := map[string]struct{}{}
+	for _, name := range memberNames {
+		members[name] = struct{}{}
+	}
+
+	for _, machine := range joining {
+		if _, ok := members[strings.Split(machine.Status.NodeRef.Name, ".")[0]]; !ok {
+			return fmt.Sprintf("waiting for Talos machine %q to join etcd", machine.Name), nil
+		}
+	}
+
+	return "", nil
+}
+
+// retireKubeadmMachine removes the etcd member of the kubeadm machine via the Talos machines and deletes the Machine.
+func (r *TalosControlPlaneReconciler) retireKubeadmMachine(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, machine *clusterv1.Machine) error {
+	if r.dryRun(tcp, "retiring kubeadm machine %q", machine.Name) {
+		return nil
+	}
+
+	r.Log.Info("retiring kubeadm machine", "machine", machine.Name)
+
+	if err := r.removeEtcdMemberForMachine(ctx, tcp, util.ObjectKey(cluster), machines, *machine); err != nil {
+		r.audit(tcp, cluster.Name, auditKubeadmMigration, machine.Name, err, "Failed to remove the etcd member of the kubeadm machine")
+
+		return fmt.Errorf("failed to remove etcd member of kubeadm machine %q: %w", machine.Name, err)
+	}
+
+	err := r.Client.Delete(ctx, machine)
+
+	r.audit(tcp, cluster.Name, auditKubeadmMigration, machine.Name, err, "Deleting retired kubeadm machine")
+
+	if err != nil {
+		return err
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "KubeadmMachineRetired", "Removed the etcd member and deleted kubeadm machine %q", machine.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestKubeadmControlPlaneOf(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		owners   []metav1.OwnerReference
+		expected string
+	}{
+		{
+			name: "controlled by KubeadmControlPlane",
+			owners: []metav1.OwnerReference{
+				{APIVersion: "controlplane.cluster.x-k8s.io/v1alpha4", Kind: "KubeadmControlPlane", Name: "kcp", Controller: pointer.BoolPtr(true)},
+			},
+			expected: "kcp",
+		},
+		{
+			name: "owned, but not controlled",
+			owners: []metav1.OwnerReference{
+				{APIVersion: "controlplane.cluster.x-k8s.io/v1beta1", Kind: "KubeadmControlPlane", Name: "kcp"},
+			},
+		},
+		{
+			name: "controlled by TalosControlPlane",
+			owners: []metav1.OwnerReference{
+				{APIVersion: "controlplane.cluster.x-k8s.io/v1alpha3", Kind: "TalosControlPlane", Name: "tcp", Controller: pointer.BoolPtr(true)},
+			},
+		},
+		{
+			name: "kind of another group",
+			owners: []metav1.OwnerReference{
+				{APIVersion: "example.com/v1", Kind: "KubeadmControlPlane", Name: "kcp", Controller: pointer.BoolPtr(true)},
+			},
+		},
+		{
+			name: "no owner",
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok := kubeadmControlPlaneOf(&clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{OwnerReferences: tt.owners}})
+
+			assert.Equal(t, tt.expected != "", ok)
+			assert.Equal(t, tt.expected, name)
+		})
+	}
+}
+
+func TestKubeadmMigrationPhases(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		annotated  bool
+		migration  *controlplanev1.KubeadmMigrationStatus
+		inProgress bool
+		blocks     bool
+	}{
+		{
+			name: "not requested",
+		},
+		{
+			name:      "requested",
+			annotated: true,
+			blocks:    true,
+		},
+		{
+			name:       "pending",
+			annotated:  true,
+			migration:  &controlplanev1.KubeadmMigrationStatus{Phase: controlplanev1.KubeadmMigrationPending},
+			inProgress: true,
+			blocks:     true,
+		},
+		{
+			name:       "in progress",
+			annotated:  true,
+			migration:  &controlplanev1.KubeadmMigrationStatus{Phase: controlplanev1.KubeadmMigrationInProgress},
+			inProgress: true,
+		},
+		{
+			name:      "completed",
+			annotated: true,
+			migration: &controlplanev1.KubeadmMigrationStatus{Phase: controlplanev1.KubeadmMigrationCompleted},
+		},
+		{
+			name:       "annotation removed while in progress",
+			migration:  &controlplanev1.KubeadmMigrationStatus{Phase: controlplanev1.KubeadmMigrationInProgress},
+			inProgress: true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := &controlplanev1.TalosControlPlane{
+				Status: controlplanev1.TalosControlPlaneStatus{KubeadmMigration: tt.migration},
+			}
+
+			if tt.annotated {
+				tcp.Annotations = map[string]string{controlplanev1.MigrateFromKCPAnnotation: "kcp"}
+			}
+
+			assert.Equal(t, tt.inProgress, kubeadmMigrationInProgress(tcp))
+			assert.Equal(t, tt.blocks, kubeadmMigrationBlocksMachines(tcp))
+		})
+	}
+}
+
+var _ = Describe("Migration from KubeadmControlPlane", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		recorder  *record.FakeRecorder
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+		recorder = record.NewFakeRecorder(8)
+
+		r = &TalosControlPlaneReconciler{
+			Client:             k8sClient,
+			Log:                logr.Discard(),
+			Scheme:             scheme.Scheme,
+			Recorder:           recorder,
+			EnableKCPMigration: true,
+		}
+
+		cluster = &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"}}
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        "test-cp",
+				Annotations: map[string]string{controlplanev1.MigrateFromKCPAnnotation: "test-kcp"},
+			},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.22.2",
+			},
+		}
+	})
+
+	newKubeadmControlPlane := func(paused bool) {
+		kcp := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"version":           "v1.22.2",
+					"kubeadmConfigSpec": map[string]interface{}{},
+					"machineTemplate": map[string]interface{}{
+						"infrastructureRef": map[string]interface{}{
+							"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta1",
+							"kind":       "GenericMachineTemplate",
+							"name":       "test-kcp",
+						},
+					},
+				},
+			},
+		}
+
+		kcp.SetGroupVersionKind(kubeadmControlPlaneKind)
+		kcp.SetNamespace(namespace)
+		kcp.SetName("test-kcp")
+
+		if paused {
+			kcp.SetAnnotations(map[string]string{clusterv1.PausedAnnotation: ""})
+		}
+
+		Expect(k8sClient.Create(ctx, kcp)).To(Succeed())
+	}
+
+	// newKubeadmMachine creates the Machine controlled by the KubeadmControlPlane, the Machine with a node has joined the cluster.
+	newKubeadmMachine := func(name string, node bool, finalizers ...string) *clusterv1.Machine {
+		machine := &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:  namespace,
+				Name:       name,
+				Labels:     map[string]string{clusterv1.ClusterLabelName: "test"},
+				Finalizers: finalizers,
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: kubeadmControlPlaneKind.GroupVersion().String(),
+						Kind:       kubeadmControlPlaneKind.Kind,
+						Name:       "test-kcp",
+						UID:        "test-kcp-uid",
+						Controller: pointer.BoolPtr(true),
+					},
+				},
+			},
+			Spec: clusterv1.MachineSpec{
+				ClusterName: "test",
+				Bootstrap:   clusterv1.Bootstrap{DataSecretName: pointer.StringPtr(name + "-bootstrap")},
+				InfrastructureRef: corev1.ObjectReference{
+					APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+					Kind:       "GenericMachine",
+					Name:       name,
+				},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, machine)).To(Succeed())
+
+		if node {
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: name}
+			Expect(k8sClient.Status().Update(ctx, machine)).To(Succeed())
+		}
+
+		return machine
+	}
+
+	inProgress := func() {
+		tcp.Status.Bootstrapped = true
+		tcp.Status.KubeadmMigration = &controlplanev1.KubeadmMigrationStatus{
+			Source: "test-kcp",
+			Phase:  controlplanev1.KubeadmMigrationInProgress,
+		}
+	}
+
+	It("ignores the migration unless it's enabled in the controller", func() {
+		r.EnableKCPMigration = false
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(tcp.Status.KubeadmMigration).To(BeNil())
+	})
+
+	It("waits for the KubeadmControlPlane to be paused", func() {
+		newKubeadmControlPlane(false)
+		newKubeadmMachine("kcp-1", true)
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 30 * time.Second}))
+
+		migration := tcp.Status.KubeadmMigration
+		Expect(migration.Phase).To(Equal(controlplanev1.KubeadmMigrationPending))
+		Expect(migration.KubeadmReplicas).To(BeEquivalentTo(1))
+		Expect(migration.Message).To(ContainSubstring("must be paused"))
+
+		Expect(tcp.Status.Bootstrapped).To(BeFalse())
+		Expect(kubeadmMigrationBlocksMachines(tcp)).To(BeTrue())
+	})
+
+	It("waits for the kubeadm machines to get a node", func() {
+		newKubeadmControlPlane(true)
+		newKubeadmMachine("kcp-1", true)
+		newKubeadmMachine("kcp-2", false)
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 30 * time.Second}))
+
+		Expect(tcp.Status.KubeadmMigration.Message).To(ContainSubstring(`"kcp-2" has no node`))
+	})
+
+	It("takes over the bootstrapped cluster and adds the first Talos machine", func() {
+		newKubeadmControlPlane(true)
+		newKubeadmMachine("kcp-1", true)
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		migration := tcp.Status.KubeadmMigration
+		Expect(migration.Phase).To(Equal(controlplanev1.KubeadmMigrationInProgress))
+		Expect(migration.StartTime).NotTo(BeNil())
+		Expect(migration.Message).To(Equal("adding Talos machine"))
+
+		Expect(tcp.Status.Bootstrapped).To(BeTrue())
+		Expect(kubeadmMigrationBlocksMachines(tcp)).To(BeFalse())
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.EtcdMaintenanceAnnotation))
+		Expect(recorder.Events).To(Receive(ContainSubstring("KubeadmMigrationStarted")))
+	})
+
+	It("waits for the other etcd maintenance operation", func() {
+		inProgress()
+		newKubeadmMachine("kcp-1", true)
+
+		tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation] = "defragmentation"
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(tcp.Status.KubeadmMigration.Message).To(Equal("waiting for etcd defragmentation to complete"))
+		Expect(tcp.Annotations).To(HaveKeyWithValue(controlplanev1.EtcdMaintenanceAnnotation, "defragmentation"))
+	})
+
+	It("waits for the Talos machine to get a node", func() {
+		inProgress()
+		newKubeadmMachine("kcp-1", true)
+
+		talos := clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "cp-1"}}
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, []clusterv1.Machine{talos})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(tcp.Status.KubeadmMigration.Message).To(ContainSubstring(`Talos machine "cp-1" to get a node`))
+		// scaling is postponed meanwhile
+		Expect(tcp.Annotations).To(HaveKeyWithValue(controlplanev1.EtcdMaintenanceAnnotation, kubeadmMigrationOperation))
+	})
+
+	It("waits for the retired kubeadm machine to be deleted", func() {
+		inProgress()
+
+		machine := newKubeadmMachine("kcp-1", true, "test.cluster.x-k8s.io/machine")
+		Expect(k8sClient.Delete(ctx, machine)).To(Succeed())
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(tcp.Status.KubeadmMigration.Message).To(ContainSubstring(`kubeadm machine "kcp-1" to be deleted`))
+		Expect(tcp.Annotations).To(HaveKeyWithValue(controlplanev1.EtcdMaintenanceAnnotation, kubeadmMigrationOperation))
+
+		machine.Finalizers = nil
+		Expect(k8sClient.Update(ctx, machine)).To(Succeed())
+	})
+
+	It("completes once all kubeadm machines are retired", func() {
+		inProgress()
+
+		tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation] = kubeadmMigrationOperation
+
+		result, err := r.reconcileKubeadmMigration(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		migration := tcp.Status.KubeadmMigration
+		Expect(migration.Phase).To(Equal(controlplanev1.KubeadmMigrationCompleted))
+		Expect(migration.CompletionTime).NotTo(BeNil())
+		Expect(kubeadmMigrationInProgress(tcp)).To(BeFalse())
+
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.EtcdMaintenanceAnnotation))
+		Expect(recorder.Events).To(Receive(ContainSubstring("KubeadmMigrationCompleted")))
+	})
+})
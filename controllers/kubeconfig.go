@@ -0,0 +1,163 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/certs"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// renewKubeconfig records the expiry of the client certificate in the kubeconfig secret,
+// and regenerates the kubeconfig once the certificate is past the renewal threshold.
+//
+// The kubeconfig is fetched from the Talos API of a control plane machine, so it's issued the same way
+// as the admin kubeconfig of the cluster. If none of the machines can provide it, the kubeconfig is generated
+// from the cluster CA instead.
+func (r *TalosControlPlaneReconciler) renewKubeconfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane,
+	machines []clusterv1.Machine, kubeconfigSecret *corev1.Secret,
+) (ctrl.Result, error) {
+	notBefore, notAfter, err := kubeconfigClientCertificateValidity(kubeconfigSecret.Data[secret.KubeconfigDataName])
+	if err != nil {
+		// kubeconfigs without client certificates (e.g. tokens) are not managed here
+		r.Log.Info("failed to inspect kubeconfig client certificate", "secret", kubeconfigSecret.Name, "error", err)
+
+		tcp.Status.KubeconfigExpiryTime = nil
+
+		return ctrl.Result{}, nil
+	}
+
+	expiry := metav1.NewTime(notAfter)
+	tcp.Status.KubeconfigExpiryTime = &expiry
+
+	if time.Until(notAfter) >= kubeconfigRenewalThreshold(notBefore, notAfter) {
+		return ctrl.Result{}, nil
+	}
+
+	if r.dryRun(tcp, "regenerating kubeconfig expiring at %s", notAfter.Format(time.RFC3339)) {
+		return ctrl.Result{}, nil
+	}
+
+	data, err := r.talosKubeconfig(ctx, tcp, machines)
+	if err != nil {
+		r.Log.Info("failed to fetch kubeconfig via Talos API, generating it from the cluster CA", "error", err)
+
+		if data, err = r.generateKubeconfig(ctx, util.ObjectKey(cluster), cluster.Spec.ControlPlaneEndpoint.String()); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	_, newExpiry, err := kubeconfigClientCertificateValidity(data)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to inspect regenerated kubeconfig")
+	}
+
+	if !newExpiry.After(notAfter) {
+		return ctrl.Result{}, fmt.Errorf("regenerated kubeconfig expires at %s, not later than the current one", newExpiry.Format(time.RFC3339))
+	}
+
+	kubeconfigSecret.Data[secret.KubeconfigDataName] = data
+
+	if err = r.Client.Update(ctx, kubeconfigSecret); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	expiry = metav1.NewTime(newExpiry)
+	tcp.Status.KubeconfigExpiryTime = &expiry
+
+	r.Log.Info("regenerated kubeconfig", "secret", kubeconfigSecret.Name, "expiry", newExpiry)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "KubeconfigRegenerated", "Regenerated kubeconfig expiring at %s, new one expires at %s",
+			notAfter.Format(time.RFC3339), newExpiry.Format(time.RFC3339))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// kubeconfigRenewalThreshold is the time before the expiry the kubeconfig is regenerated at:
+// the Cluster API default for the client certificates, capped at the half of the certificate lifetime,
+// so that short-lived certificates are not regenerated on every reconcile.
+func kubeconfigRenewalThreshold(notBefore, notAfter time.Time) time.Duration {
+	threshold := certs.ClientCertificateRenewalDuration
+
+	if lifetime := notAfter.Sub(notBefore); lifetime/2 < threshold {
+		threshold = lifetime / 2
+	}
+
+	return threshold
+}
+
+// kubeconfigClientCertificateValidity returns the validity of the client certificate which expires first.
+func kubeconfigClientCertificateValidity(data []byte) (notBefore, notAfter time.Time, err error) {
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return notBefore, notAfter, errors.Wrap(err, "failed to parse kubeconfig")
+	}
+
+	for name, authInfo := range config.AuthInfos {
+		if len(authInfo.ClientCertificateData) == 0 {
+			continue
+		}
+
+		cert, err := certs.DecodeCertPEM(authInfo.ClientCertificateData)
+		if err != nil || cert == nil {
+			return notBefore, notAfter, fmt.Errorf("failed to decode client certificate of user %q", name)
+		}
+
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notBefore, notAfter = cert.NotBefore, cert.NotAfter
+		}
+	}
+
+	if notAfter.IsZero() {
+		return notBefore, notAfter, fmt.Errorf("kubeconfig has no client certificates")
+	}
+
+	return notBefore, notAfter, nil
+}
+
+// talosKubeconfig fetches the admin kubeconfig from the Talos API of the first control plane machine which provides it.
+func (r *TalosControlPlaneReconciler) talosKubeconfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) ([]byte, error) {
+	var lastErr error = fmt.Errorf("no control plane machines with nodes")
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			continue
+		}
+
+		data, err := r.machineKubeconfig(ctx, tcp, machine)
+		if err == nil {
+			return data, nil
+		}
+
+		lastErr = fmt.Errorf("machine %q: %w", machine.Name, err)
+	}
+
+	return nil, lastErr
+}
+
+func (r *TalosControlPlaneReconciler) machineKubeconfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine clusterv1.Machine) ([]byte, error) {
+	c, err := r.talosconfigForMachines(ctx, tcp, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	return c.Kubeconfig(ctx)
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// leaderElectedComponents are the control plane components running with the leader election,
+// the leases are named after the components.
+var leaderElectedComponents = []string{"kube-controller-manager", "kube-scheduler"}
+
+// leadersCheck verifies that each leader elected component has an active leader on one of the control plane machines
+// which is not being deleted.
+//
+// It's checked before the next machine is rolled out, so that the leadership moved away from the replaced machine
+// is acquired again before another instance is restarted.
+func (r *TalosControlPlaneReconciler) leadersCheck(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster, machines []clusterv1.Machine) error {
+	clientset, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return err
+	}
+
+	defer clientset.Close() //nolint:errcheck
+
+	return checkLeaders(ctx, clientset.CoordinationV1(), machines)
+}
+
+// checkLeaders verifies the leases of the leader elected components against the control plane machines.
+func checkLeaders(ctx context.Context, leases coordinationv1client.LeasesGetter, machines []clusterv1.Machine) error {
+	nodes := map[string]struct{}{}
+
+	for i := range machines {
+		if machines[i].ObjectMeta.DeletionTimestamp.IsZero() && machines[i].Status.NodeRef != nil {
+			nodes[strings.Split(nodeName(&machines[i]), ".")[0]] = struct{}{}
+		}
+	}
+
+	for _, component := range leaderElectedComponents {
+		lease, err := leases.Leases(metav1.NamespaceSystem).Get(ctx, component, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		spec := lease.Spec
+
+		if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			return fmt.Errorf("%s has no leader", component)
+		}
+
+		if time.Since(spec.RenewTime.Time) > time.Duration(*spec.LeaseDurationSeconds)*time.Second {
+			return fmt.Errorf("%s leader %q didn't renew the lease since %s", component, *spec.HolderIdentity, spec.RenewTime.Time.Format(time.RFC3339))
+		}
+
+		// the identity is the hostname followed by a random suffix
+		holder := strings.Split(strings.SplitN(*spec.HolderIdentity, "_", 2)[0], ".")[0]
+
+		if _, ok := nodes[holder]; !ok {
+			return fmt.Errorf("%s leader %q doesn't run on a control plane machine which is kept", component, *spec.HolderIdentity)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+func newTestLease(component, holder string, renewed time.Time) *coordinationv1.Lease {
+	renewTime := metav1.NewMicroTime(renewed)
+
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: metav1.NamespaceSystem, Name: component},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       pointer.StringPtr(holder),
+			LeaseDurationSeconds: pointer.Int32Ptr(15),
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func TestCheckLeaders(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	deleted := metav1.NewTime(now)
+
+	machines := []clusterv1.Machine{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cp-1"},
+			Status:     clusterv1.MachineStatus{NodeRef: &corev1.ObjectReference{Name: "cp-1"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cp-2"},
+			Status:     clusterv1.MachineStatus{NodeRef: &corev1.ObjectReference{Name: "cp-2.example.com"}},
+		},
+		{
+			// the machine being replaced by the rollout
+			ObjectMeta: metav1.ObjectMeta{Name: "cp-0", DeletionTimestamp: &deleted},
+			Status:     clusterv1.MachineStatus{NodeRef: &corev1.ObjectReference{Name: "cp-0"}},
+		},
+		{
+			// the replacement which has no node yet
+			ObjectMeta: metav1.ObjectMeta{Name: "cp-3"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		leases []runtime.Object
+		err    bool
+	}{
+		{
+			name: "leaders on the kept machines",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-1_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now),
+				newTestLease("kube-scheduler", "cp-2.example.com_3d7c9a56-6f8c-4c8e-8a8e-5c2d3a1b7e9f", now),
+			},
+		},
+		{
+			name: "leases not acquired yet",
+			err:  true,
+		},
+		{
+			name: "scheduler lease not acquired yet",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-1_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now),
+			},
+			err: true,
+		},
+		{
+			name: "lease released",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-1_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now),
+				newTestLease("kube-scheduler", "", now),
+			},
+			err: true,
+		},
+		{
+			name: "lease expired",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-1_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now.Add(-time.Minute)),
+				newTestLease("kube-scheduler", "cp-1_3d7c9a56-6f8c-4c8e-8a8e-5c2d3a1b7e9f", now),
+			},
+			err: true,
+		},
+		{
+			name: "leader on the replaced machine",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-0_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now),
+				newTestLease("kube-scheduler", "cp-1_3d7c9a56-6f8c-4c8e-8a8e-5c2d3a1b7e9f", now),
+			},
+			err: true,
+		},
+		{
+			name: "leader on an unknown node",
+			leases: []runtime.Object{
+				newTestLease("kube-controller-manager", "cp-1_0c5d5f6a-0d5a-4a4b-9ad3-6a0a2c1c5a43", now),
+				newTestLease("kube-scheduler", "worker-1_3d7c9a56-6f8c-4c8e-8a8e-5c2d3a1b7e9f", now),
+			},
+			err: true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := k8sfake.NewSimpleClientset(tt.leases...)
+
+			err := checkLeaders(ctx, clientset.CoordinationV1(), machines)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// etcdLearnerPromotionTimeout is how long an etcd learner may wait for the promotion before it's reported as stuck.
+const etcdLearnerPromotionTimeout = 10 * time.Minute
+
+// errEtcdLearner is returned by the etcd health check while some of the members are learners.
+//
+// Learners don't vote, so they don't count towards the quorum: the cluster is not considered healthy
+// (and scaling or rollouts don't proceed) until they are promoted.
+type errEtcdLearner struct {
+	members []string
+	waiting time.Duration
+}
+
+func (e *errEtcdLearner) Error() string {
+	return fmt.Sprintf("etcd learner(s) %s waiting for promotion for %s", strings.Join(e.members, ", "), e.waiting.Round(time.Second))
+}
+
+// stuck reports whether the learners wait for the promotion for too long.
+func (e *errEtcdLearner) stuck() bool {
+	return e.waiting >= etcdLearnerPromotionTimeout
+}
+
+// learnerTracker remembers when the etcd learners of each control plane were first seen.
+type learnerTracker struct {
+	mu    sync.Mutex
+	since map[types.UID]map[uint64]time.Time
+}
+
+// observe records the current learners of the control plane and returns how long the oldest of them waits.
+// Members which are not learners anymore are forgotten.
+func (t *learnerTracker) observe(uid types.UID, learners []uint64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.since == nil {
+		t.since = map[types.UID]map[uint64]time.Time{}
+	}
+
+	if len(learners) == 0 {
+		delete(t.since, uid)
+
+		return 0
+	}
+
+	previous := t.since[uid]
+	current := make(map[uint64]time.Time, len(learners))
+
+	var waiting time.Duration
+
+	for _, id := range learners {
+		since, ok := previous[id]
+		if !ok {
+			since = time.Now()
+		}
+
+		current[id] = since
+
+		if time.Since(since) > waiting {
+			waiting = time.Since(since)
+		}
+	}
+
+	t.since[uid] = current
+
+	return waiting
+}
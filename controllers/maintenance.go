@@ -0,0 +1,180 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	talosx509 "github.com/talos-systems/crypto/x509"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// reconcileMaintenanceMode detects control plane machines which are running Talos in maintenance mode
+// and optionally applies the machine config to them again.
+//
+// Maintenance mode is only probed for when the control plane components are not healthy,
+// as it is the only case when a node might have lost its config.
+func (r *TalosControlPlaneReconciler) reconcileMaintenanceMode(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if conditions.IsTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition) {
+		conditions.MarkTrue(tcp, controlplanev1.MachinesConfiguredCondition)
+
+		return ctrl.Result{}, nil
+	}
+
+	inMaintenance := []string{}
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		addresses := machineAddresses([]clusterv1.Machine{machine})
+		if len(addresses) == 0 {
+			continue
+		}
+
+		if !inMaintenanceMode(ctx, addresses[0]) {
+			continue
+		}
+
+		r.Log.Info("machine is running in maintenance mode", "machine", machine.Name, "address", addresses[0])
+
+		if tcp.Spec.MaintenanceModePolicy != controlplanev1.MaintenanceModeReapplyConfig {
+			inMaintenance = append(inMaintenance, machine.Name)
+
+			continue
+		}
+
+		if err := r.reapplyMachineConfig(ctx, machine, addresses[0]); err != nil {
+			conditions.MarkFalse(tcp, controlplanev1.MachinesConfiguredCondition, controlplanev1.ConfigReapplyFailedReason,
+				clusterv1.ConditionSeverityError, "failed to apply machine config to %q: %s", machine.Name, err)
+
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+		}
+
+		r.Log.Info("re-applied machine config", "machine", machine.Name)
+	}
+
+	if len(inMaintenance) > 0 {
+		conditions.MarkFalse(tcp, controlplanev1.MachinesConfiguredCondition, controlplanev1.MaintenanceModeReason,
+			clusterv1.ConditionSeverityError, "machines are running in maintenance mode: %s", strings.Join(inMaintenance, ", "))
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.MachinesConfiguredCondition)
+
+	return ctrl.Result{}, nil
+}
+
+// maintenanceClient creates the Talos client which connects to the node without client certificates.
+//
+// Only Talos in maintenance mode accepts such connections. Talos generates a self-signed certificate in maintenance mode,
+// so the certificate is verified only against the SPKI fingerprints if any are given.
+func maintenanceClient(ctx context.Context, address string, fingerprints ...talosx509.Fingerprint) (*talosclient.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+
+	if len(fingerprints) > 0 {
+		tlsConfig.VerifyConnection = talosx509.MatchSPKIFingerprints(fingerprints...)
+	}
+
+	return talosclient.New(ctx,
+		talosclient.WithEndpoints(address),
+		talosclient.WithTLSConfig(tlsConfig),
+	)
+}
+
+// inMaintenanceMode checks whether the node accepts unauthenticated connections.
+func inMaintenanceMode(ctx context.Context, address string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	c, err := maintenanceClient(ctx, address)
+	if err != nil {
+		return false
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	_, err = c.Version(ctx)
+	if err == nil {
+		return true
+	}
+
+	// maintenance mode only implements a subset of the API
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Unimplemented {
+		return true
+	}
+
+	return false
+}
+
+// reapplyMachineConfig applies the bootstrap data of the machine to the node in maintenance mode.
+//
+// The bootstrap data contains the cluster secrets, so the node certificate is verified against the fingerprint
+// from MaintenanceCertificateFingerprintAnnotation, unless the controller allows applying it insecurely.
+func (r *TalosControlPlaneReconciler) reapplyMachineConfig(ctx context.Context, machine clusterv1.Machine, address string) error {
+	if machine.Spec.Bootstrap.DataSecretName == nil {
+		return fmt.Errorf("machine has no bootstrap data")
+	}
+
+	var fingerprints []talosx509.Fingerprint
+
+	if value, ok := machine.Annotations[controlplanev1.MaintenanceCertificateFingerprintAnnotation]; ok {
+		fingerprint, err := talosx509.ParseFingerprint(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", controlplanev1.MaintenanceCertificateFingerprintAnnotation, err)
+		}
+
+		fingerprints = append(fingerprints, fingerprint)
+	} else if !r.InsecureMaintenanceApply {
+		return fmt.Errorf("the node certificate can't be verified, set the %s annotation to the certificate fingerprint printed on the node console",
+			controlplanev1.MaintenanceCertificateFingerprintAnnotation)
+	}
+
+	var secret corev1.Secret
+
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: machine.Namespace, Name: *machine.Spec.Bootstrap.DataSecretName}, &secret); err != nil {
+		return err
+	}
+
+	data, ok := secret.Data["value"]
+	if !ok {
+		return fmt.Errorf("bootstrap data secret %q has no value", secret.Name)
+	}
+
+	if r.dryRun(nil, "applying configuration to machine %q in maintenance mode", machine.Name) {
+		return nil
+	}
+
+	c, err := maintenanceClient(ctx, address, fingerprints...)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	_, err = c.ApplyConfiguration(ctx, &machineapi.ApplyConfigurationRequest{
+		Data: data,
+	})
+
+	return err
+}
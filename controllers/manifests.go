@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const (
+	// manifestsFieldOwner is the server-side apply field manager of the manifests applied by the provider.
+	manifestsFieldOwner = "cacppt"
+
+	// manifestFetchTimeout is the timeout to download a single extra manifest.
+	manifestFetchTimeout = 30 * time.Second
+)
+
+// manifestsChecksum returns the checksum of the extra and inline manifests.
+func manifestsChecksum(config *controlplanev1.ControlPlaneConfig) (string, error) {
+	data, err := json.Marshal([]interface{}{config.ExtraManifests, config.InlineManifests})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reconcileManifests applies the extra and inline manifests to the workload cluster when they change.
+//
+// Talos applies the manifests only on bootstrap, so the changes made later are applied by the provider
+// with server-side apply. Manifests removed from the spec are not deleted from the workload cluster.
+func (r *TalosControlPlaneReconciler) reconcileManifests(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	config := &tcp.Spec.ControlPlaneConfig
+
+	if len(config.ExtraManifests) == 0 && len(config.InlineManifests) == 0 {
+		tcp.Status.ManifestsChecksum = ""
+
+		return ctrl.Result{}, nil
+	}
+
+	if !tcp.Status.Bootstrapped || !conditions.IsTrue(tcp, controlplanev1.AvailableCondition) {
+		return ctrl.Result{}, nil
+	}
+
+	checksum, err := manifestsChecksum(config)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if checksum == tcp.Status.ManifestsChecksum {
+		return ctrl.Result{}, nil
+	}
+
+	if !changeApproved(tcp, controlplanev1.InPlaceChangeStrategy) {
+		r.Log.Info("postponing manifests until the change is approved", "checksum", checksum)
+
+		return ctrl.Result{}, nil
+	}
+
+	objects, err := manifestObjects(ctx, config)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	defer kubeclient.Close() //nolint:errcheck
+
+	c, err := client.New(kubeclient.config, client.Options{})
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	if r.DryRun {
+		c = client.NewDryRunClient(c)
+	}
+
+	for _, obj := range objects {
+		if err = c.Patch(ctx, obj, client.Apply, client.FieldOwner(manifestsFieldOwner), client.ForceOwnership); err != nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, errors.Wrapf(err, "failed to apply %s %q", obj.GetKind(), obj.GetName())
+		}
+	}
+
+	r.Log.Info("applied manifests to the workload cluster", "objects", len(objects), "checksum", checksum)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "ManifestsApplied", "Applied %d object(s) from the extra and inline manifests", len(objects))
+	}
+
+	tcp.Status.ManifestsChecksum = checksum
+
+	return ctrl.Result{}, nil
+}
+
+// manifestObjects downloads the extra manifests and parses all manifests into objects.
+func manifestObjects(ctx context.Context, config *controlplanev1.ControlPlaneConfig) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	for _, url := range config.ExtraManifests {
+		data, err := fetchManifest(ctx, url)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to download manifest %q", url)
+		}
+
+		parsed, err := parseManifest(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse manifest %q", url)
+		}
+
+		objects = append(objects, parsed...)
+	}
+
+	for _, manifest := range config.InlineManifests {
+		parsed, err := parseManifest([]byte(manifest.Contents))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse inline manifest %q", manifest.Name)
+		}
+
+		objects = append(objects, parsed...)
+	}
+
+	return objects, nil
+}
+
+func fetchManifest(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, manifestFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// parseManifest splits the multi-document YAML into objects, empty documents are skipped.
+func parseManifest(data []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+
+	for {
+		obj := &unstructured.Unstructured{}
+
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
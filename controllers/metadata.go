@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// machineMetadata returns labels and annotations from the machine template for a machine in the failure domain.
+func machineMetadata(tcp *controlplanev1.TalosControlPlane, failureDomain *string) (labels, annotations map[string]string) {
+	labels = map[string]string{}
+	annotations = map[string]string{}
+
+	merge := func(meta clusterv1.ObjectMeta) {
+		for k, v := range meta.Labels {
+			labels[k] = v
+		}
+
+		for k, v := range meta.Annotations {
+			annotations[k] = v
+		}
+	}
+
+	merge(tcp.Spec.MachineTemplate.ObjectMeta)
+
+	if failureDomain != nil {
+		if meta, ok := tcp.Spec.MachineTemplate.FailureDomainMetadata[*failureDomain]; ok {
+			merge(meta)
+		}
+	}
+
+	// labels used to select control plane machines are always managed by the controller
+	delete(labels, clusterv1.ClusterLabelName)
+	delete(labels, clusterv1.MachineControlPlaneLabelName)
+
+	return labels, annotations
+}
+
+// reconcileMachineMetadata keeps labels and annotations of the control plane Machines and infrastructure machines,
+// and the node drain timeout of the Machines in sync with the machine template.
+//
+// Keys which were removed from the template are left untouched, as they can't be told apart from
+// the keys set by other controllers.
+func (r *TalosControlPlaneReconciler) reconcileMachineMetadata(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	var errs error
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := r.syncNodeDrainTimeout(ctx, &machine, tcp.Spec.MachineTemplate.NodeDrainTimeout); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+
+		labels, annotations := machineMetadata(tcp, machine.Spec.FailureDomain)
+		if len(labels) == 0 && len(annotations) == 0 {
+			continue
+		}
+
+		if err := r.syncObjectMetadata(ctx, &machine, labels, annotations); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+
+		infraMachine, err := external.Get(ctx, r.Client, &machine.Spec.InfrastructureRef, machine.Namespace)
+		if err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		if err := r.syncObjectMetadata(ctx, infraMachine, labels, annotations); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
+
+// syncNodeDrainTimeout updates the node drain timeout of the Machine, it's used by the Machine controller
+// only when the Machine is deleted, so the change doesn't need a rollout.
+func (r *TalosControlPlaneReconciler) syncNodeDrainTimeout(ctx context.Context, machine *clusterv1.Machine, timeout *metav1.Duration) error {
+	if reflect.DeepEqual(machine.Spec.NodeDrainTimeout, timeout) {
+		return nil
+	}
+
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	machine.Spec.NodeDrainTimeout = timeout
+
+	r.Log.Info("updating machine node drain timeout", "machine", machine.Name, "timeout", timeout)
+
+	return patchHelper.Patch(ctx, machine)
+}
+
+// syncObjectMetadata adds or updates the labels and annotations of the object.
+func (r *TalosControlPlaneReconciler) syncObjectMetadata(ctx context.Context, obj client.Object, labels, annotations map[string]string) error {
+	patchHelper, err := patch.NewHelper(obj, r.Client)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+
+	merge := func(dst, src map[string]string) map[string]string {
+		if dst == nil {
+			dst = map[string]string{}
+		}
+
+		for k, v := range src {
+			if current, ok := dst[k]; !ok || current != v {
+				dst[k] = v
+				changed = true
+			}
+		}
+
+		return dst
+	}
+
+	obj.SetLabels(merge(obj.GetLabels(), labels))
+	obj.SetAnnotations(merge(obj.GetAnnotations(), annotations))
+
+	if !changed {
+		return nil
+	}
+
+	r.Log.Info("updating machine metadata", "object", client.ObjectKeyFromObject(obj))
+
+	return patchHelper.Patch(ctx, obj)
+}
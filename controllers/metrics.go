@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+var (
+	// nodeClockOffset tracks the clock offset of control plane nodes against their time server.
+	nodeClockOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_node_clock_offset_seconds",
+			Help: "Clock offset of the control plane node against its time server in seconds.",
+		},
+		[]string{"namespace", "cluster", "node"},
+	)
+
+	// clusterClockOffset tracks the largest clock offset across the control plane nodes of the cluster.
+	clusterClockOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_cluster_max_clock_offset_seconds",
+			Help: "Largest absolute clock offset of the control plane nodes against their time servers in seconds.",
+		},
+		[]string{"namespace", "cluster"},
+	)
+
+	// clusterTimeToInitialized tracks the time from the TalosControlPlane creation until the first control plane node registered.
+	clusterTimeToInitialized = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_cluster_time_to_initialized_seconds",
+			Help: "Time from the TalosControlPlane creation until the control plane was initialized in seconds.",
+		},
+		[]string{"namespace", "cluster"},
+	)
+
+	// clusterTimeToReady tracks the time from the TalosControlPlane creation until the first control plane node became ready.
+	clusterTimeToReady = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_cluster_time_to_ready_seconds",
+			Help: "Time from the TalosControlPlane creation until the control plane became ready for the first time in seconds.",
+		},
+		[]string{"namespace", "cluster"},
+	)
+
+	// clusterRolloutDuration tracks the duration of the last completed rollout.
+	clusterRolloutDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_cluster_last_rollout_duration_seconds",
+			Help: "Time from the control plane machines being outdated until all of them were replaced in seconds.",
+		},
+		[]string{"namespace", "cluster"},
+	)
+
+	// clusterMembershipDiscrepancies tracks the discrepancies found by the last membership audit.
+	clusterMembershipDiscrepancies = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_cluster_membership_discrepancies",
+			Help: "Number of control plane Nodes, etcd members, talosconfig endpoints and Machines without a match found by the last membership audit.",
+		},
+		[]string{"namespace", "cluster", "kind"},
+	)
+
+	// machineLastTalosAPIContact is the last time the Talos API of the control plane machine responded.
+	machineLastTalosAPIContact = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_machine_last_talos_api_contact_timestamp_seconds",
+			Help: "Unix time the Talos API of the control plane machine last responded.",
+		},
+		[]string{"namespace", "cluster", "machine"},
+	)
+
+	// machineLastNodeContact is the last time the kubelet of the control plane machine renewed its node lease.
+	machineLastNodeContact = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cacppt_machine_last_node_contact_timestamp_seconds",
+			Help: "Unix time the kubelet of the control plane machine last renewed its node lease.",
+		},
+		[]string{"namespace", "cluster", "machine"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		nodeClockOffset,
+		clusterClockOffset,
+		clusterTimeToInitialized,
+		clusterTimeToReady,
+		clusterRolloutDuration,
+		clusterMembershipDiscrepancies,
+		machineLastTalosAPIContact,
+		machineLastNodeContact,
+	)
+}
+
+// provisioningTracker reports the time it took to provision the control planes.
+//
+// The ready state is reset on every reconcile, so the control planes which were seen ready are remembered
+// to report only the first time they became ready. Control planes already ready when the controller
+// starts are not reported.
+type provisioningTracker struct {
+	mu    sync.Mutex
+	ready map[types.UID]struct{}
+}
+
+// seed remembers the control plane as ready, so that it's not reported as provisioned.
+func (t *provisioningTracker) seed(uid types.UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ready == nil {
+		t.ready = map[types.UID]struct{}{}
+	}
+
+	t.ready[uid] = struct{}{}
+}
+
+// observe reports the provisioning durations on the transitions of the control plane status.
+func (t *provisioningTracker) observe(tcp *controlplanev1.TalosControlPlane, clusterName string, wasInitialized, wasReady bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ready == nil {
+		t.ready = map[types.UID]struct{}{}
+	}
+
+	elapsed := time.Since(tcp.CreationTimestamp.Time).Seconds()
+
+	if !wasInitialized && tcp.Status.Initialized {
+		clusterTimeToInitialized.WithLabelValues(tcp.Namespace, clusterName).Set(elapsed)
+	}
+
+	if _, seen := t.ready[tcp.UID]; seen {
+		return
+	}
+
+	switch {
+	case wasReady:
+		// ready before the controller observed it for the first time
+		t.ready[tcp.UID] = struct{}{}
+	case tcp.Status.Ready:
+		clusterTimeToReady.WithLabelValues(tcp.Namespace, clusterName).Set(elapsed)
+
+		t.ready[tcp.UID] = struct{}{}
+	}
+}
+
+// nodeSeriesTracker remembers the nodes reported in the per-node metrics of each control plane,
+// so that the series of the nodes which are gone are deleted.
+type nodeSeriesTracker struct {
+	mu    sync.Mutex
+	nodes map[types.UID]map[string]struct{}
+}
+
+// update records the nodes reported for the control plane and returns the previously reported nodes
+// which are neither reported now nor kept.
+func (t *nodeSeriesTracker) update(uid types.UID, reported, keep map[string]struct{}) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.nodes == nil {
+		t.nodes = map[types.UID]map[string]struct{}{}
+	}
+
+	current := map[string]struct{}{}
+
+	for node := range reported {
+		current[node] = struct{}{}
+	}
+
+	var removed []string
+
+	for node := range t.nodes[uid] {
+		if _, ok := current[node]; ok {
+			continue
+		}
+
+		if _, ok := keep[node]; ok {
+			current[node] = struct{}{}
+
+			continue
+		}
+
+		removed = append(removed, node)
+	}
+
+	t.nodes[uid] = current
+
+	return removed
+}
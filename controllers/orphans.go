@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+// reconcileOrphanedObjects deletes the infrastructure machines and TalosConfigs created for a control plane
+// Machine which was never created, e.g. when the controller was interrupted in the middle of the scale up.
+//
+// Objects are considered orphaned if they are owned by the TalosControlPlane, are not referenced by any of
+// the control plane Machines and are older than orphanedObjectGracePeriod, so that objects of the Machine
+// being created right now are not affected.
+//
+// Orphaned infrastructure machines cloned from the current infrastructure template are kept while the control plane
+// has less machines than desired, they are adopted by the next scale up instead of cloning the template again.
+func (r *TalosControlPlaneReconciler) reconcileOrphanedObjects(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	var errs error
+
+	infraRefs := map[string]struct{}{}
+	configRefs := map[string]struct{}{}
+	infraKinds := map[schema.GroupVersionKind]struct{}{
+		infrastructureKind(tcp.Spec.InfrastructureTemplate): {},
+	}
+
+	for _, machine := range machines {
+		infraRefs[machine.Spec.InfrastructureRef.Name] = struct{}{}
+		infraKinds[machine.Spec.InfrastructureRef.GroupVersionKind()] = struct{}{}
+
+		if machine.Spec.Bootstrap.ConfigRef != nil {
+			configRefs[machine.Spec.Bootstrap.ConfigRef.Name] = struct{}{}
+		}
+	}
+
+	objects := []client.Object{}
+
+	for gvk := range infraKinds {
+		infraMachines := &unstructured.UnstructuredList{}
+		infraMachines.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+		if err := r.Client.List(ctx, infraMachines, client.InNamespace(tcp.Namespace), client.MatchingLabels{clusterv1.ClusterLabelName: cluster.Name}); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		for i := range infraMachines.Items {
+			if _, ok := infraRefs[infraMachines.Items[i].GetName()]; !ok {
+				objects = append(objects, &infraMachines.Items[i])
+			}
+		}
+	}
+
+	var configs cabptv1.TalosConfigList
+
+	if err := r.Client.List(ctx, &configs, client.InNamespace(tcp.Namespace)); err != nil {
+		errs = kerrors.NewAggregate([]error{errs, err})
+	}
+
+	for i := range configs.Items {
+		if _, ok := configRefs[configs.Items[i].Name]; !ok {
+			configs.Items[i].SetGroupVersionKind(cabptv1.GroupVersion.WithKind("TalosConfig"))
+
+			objects = append(objects, &configs.Items[i])
+		}
+	}
+
+	adopting := tcp.Spec.Replicas != nil && len(machines) < int(*tcp.Spec.Replicas)
+
+	for _, obj := range objects {
+		if !orphanedByControlPlane(obj, tcp) {
+			continue
+		}
+
+		if _, ok := obj.(*unstructured.Unstructured); ok && adopting && clonedFromTemplate(obj, tcp) {
+			r.Log.V(1).Info("keeping orphaned infrastructure machine for adoption", "object", client.ObjectKeyFromObject(obj))
+
+			continue
+		}
+
+		r.Log.Info("deleting orphaned object", "kind", obj.GetObjectKind().GroupVersionKind().Kind, "object", client.ObjectKeyFromObject(obj))
+
+		if err := r.Client.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "OrphanDeleted", "Deleted %s %q which is not used by any control plane machine",
+				obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
+
+// adoptableInfrastructureMachine returns the oldest orphaned infrastructure machine cloned from the current
+// infrastructure template, or nil if there is none.
+func (r *TalosControlPlaneReconciler) adoptableInfrastructureMachine(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (*corev1.ObjectReference, error) {
+	infraRefs := map[string]struct{}{}
+
+	for _, machine := range machines {
+		infraRefs[machine.Spec.InfrastructureRef.Name] = struct{}{}
+	}
+
+	gvk := infrastructureKind(tcp.Spec.InfrastructureTemplate)
+
+	infraMachines := &unstructured.UnstructuredList{}
+	infraMachines.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+	if err := r.Client.List(ctx, infraMachines, client.InNamespace(tcp.Namespace), client.MatchingLabels{clusterv1.ClusterLabelName: cluster.Name}); err != nil {
+		return nil, err
+	}
+
+	var adoptable *unstructured.Unstructured
+
+	for i := range infraMachines.Items {
+		infraMachine := &infraMachines.Items[i]
+
+		if _, ok := infraRefs[infraMachine.GetName()]; ok || !orphanedByControlPlane(infraMachine, tcp) || !clonedFromTemplate(infraMachine, tcp) {
+			continue
+		}
+
+		if adoptable == nil || infraMachine.GetCreationTimestamp().Time.Before(adoptable.GetCreationTimestamp().Time) {
+			adoptable = infraMachine
+		}
+	}
+
+	if adoptable == nil {
+		return nil, nil
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: adoptable.GetAPIVersion(),
+		Kind:       adoptable.GetKind(),
+		Name:       adoptable.GetName(),
+		Namespace:  adoptable.GetNamespace(),
+		UID:        adoptable.GetUID(),
+	}, nil
+}
+
+// clonedFromTemplate checks whether the infrastructure machine was cloned from the current infrastructure template.
+func clonedFromTemplate(obj client.Object, tcp *controlplanev1.TalosControlPlane) bool {
+	return obj.GetAnnotations()[clusterv1.TemplateClonedFromNameAnnotation] == tcp.Spec.InfrastructureTemplate.Name &&
+		obj.GetObjectKind().GroupVersionKind().GroupKind() == infrastructureKind(tcp.Spec.InfrastructureTemplate).GroupKind()
+}
+
+// infrastructureKind returns the kind of the infrastructure machines cloned from the template.
+func infrastructureKind(template corev1.ObjectReference) schema.GroupVersionKind {
+	gvk := template.GroupVersionKind()
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, clusterv1.TemplateSuffix)
+
+	return gvk
+}
+
+// orphanedByControlPlane checks whether the object was created by the TalosControlPlane for a Machine,
+// but the Machine was never created or doesn't own the object.
+func orphanedByControlPlane(obj client.Object, tcp *controlplanev1.TalosControlPlane) bool {
+	if !obj.GetDeletionTimestamp().IsZero() || time.Since(obj.GetCreationTimestamp().Time) < orphanedObjectGracePeriod {
+		return false
+	}
+
+	owned := false
+
+	for _, ref := range obj.GetOwnerReferences() {
+		switch {
+		case ref.Kind == "Machine":
+			return false
+		case tcpclient.IsOwnerRef(ref, tcp):
+			owned = true
+		}
+	}
+
+	return owned
+}
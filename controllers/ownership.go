@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// reconcileOwnerReferences re-links control plane machines and their bootstrap configs which reference
+// a TalosControlPlane with the same name, but a different UID.
+//
+// This happens when the management cluster is restored from a backup: all objects get new UIDs,
+// so existing machines would otherwise be orphaned (or garbage collected) instead of being managed again.
+func (r *TalosControlPlaneReconciler) reconcileOwnerReferences(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	var errs error
+
+	for _, machine := range machines {
+		machine := machine
+
+		if err := r.relinkOwnerReferences(ctx, &machine, tcp); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+
+		configRef := machine.Spec.Bootstrap.ConfigRef
+		if configRef == nil || configRef.Kind != "TalosConfig" {
+			continue
+		}
+
+		var cfg cabptv1.TalosConfig
+
+		if err := r.Client.Get(ctx, client.ObjectKey{Namespace: machine.Namespace, Name: configRef.Name}, &cfg); err != nil {
+			if !apierrors.IsNotFound(err) {
+				errs = kerrors.NewAggregate([]error{errs, err})
+			}
+
+			continue
+		}
+
+		if err := r.relinkOwnerReferences(ctx, &cfg, tcp); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	return ctrl.Result{}, errs
+}
+
+// relinkOwnerReferences points stale TalosControlPlane owner references of the object to the current TalosControlPlane.
+func (r *TalosControlPlaneReconciler) relinkOwnerReferences(ctx context.Context, obj client.Object, tcp *controlplanev1.TalosControlPlane) error {
+	patchHelper, err := patch.NewHelper(obj, r.Client)
+	if err != nil {
+		return err
+	}
+
+	refs := obj.GetOwnerReferences()
+	changed := false
+
+	for i, ref := range refs {
+		if ref.Kind != "TalosControlPlane" || ref.Name != tcp.Name || ref.UID == tcp.UID {
+			continue
+		}
+
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || gv.Group != controlplanev1.GroupVersion.Group {
+			continue
+		}
+
+		r.Log.Info("re-linking object to the restored control plane", "object", client.ObjectKeyFromObject(obj), "oldUID", ref.UID, "newUID", tcp.UID)
+
+		refs[i].APIVersion = controlplanev1.GroupVersion.String()
+		refs[i].UID = tcp.UID
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	obj.SetOwnerReferences(refs)
+
+	return patchHelper.Patch(ctx, obj)
+}
+
+// reconcileSecretsAvailability detects the secrets referenced by the TalosControlPlane or generated for the cluster
+// which are missing, e.g. because the management cluster was restored from a backup which doesn't include them.
+//
+// Missing secrets are reported with the SecretsAvailable condition. The machines are not re-provisioned because
+// of missing secrets: the kubeconfig and the talosconfig secrets are generated again by the later phases,
+// the cluster CA and the referenced secrets have to be restored.
+func (r *TalosControlPlaneReconciler) reconcileSecretsAvailability(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	missing, err := r.missingSecrets(ctx, cluster, tcp, machines)
+	if err != nil {
+		conditions.MarkFalse(tcp, controlplanev1.SecretsAvailableCondition, controlplanev1.SecretsInspectionFailedReason,
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{}, err
+	}
+
+	if len(missing) > 0 {
+		r.Log.Info("secrets are missing", "secrets", missing)
+
+		conditions.MarkFalse(tcp, controlplanev1.SecretsAvailableCondition, controlplanev1.SecretsMissingReason,
+			clusterv1.ConditionSeverityError, "Secrets %s are missing", strings.Join(missing, ", "))
+
+		return ctrl.Result{}, nil
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.SecretsAvailableCondition)
+
+	return ctrl.Result{}, nil
+}
+
+// missingSecrets returns the names of the secrets the TalosControlPlane depends on which don't exist.
+//
+// The secrets generated for the cluster are expected only once the control plane is bootstrapped.
+func (r *TalosControlPlaneReconciler) missingSecrets(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) ([]string, error) {
+	var missing []string
+
+	refs := []*corev1.LocalObjectReference{
+		tcp.Spec.ControlPlaneConfig.TalosConfigSecretRef,
+		tcp.Spec.ControlPlaneConfig.APIServerCASecretRef,
+	}
+
+	// the talosconfig published for the rotated Talos CA might be stored outside of the Kubernetes secrets
+	if ref := tcp.Status.TalosConfigSecretRef; ref != nil {
+		if _, err := r.talosconfigSecrets(tcp, ref.Name).Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: ref.Name}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, fmt.Errorf("failed to read the talosconfig: %w", err)
+			}
+
+			missing = append(missing, ref.Name)
+		}
+	}
+
+	if tcp.Spec.EtcdBackup != nil {
+		refs = append(refs, &tcp.Spec.EtcdBackup.S3.CredentialsSecretRef)
+	}
+
+	names := []string{}
+
+	for _, ref := range refs {
+		if ref != nil && ref.Name != "" {
+			names = append(names, ref.Name)
+		}
+	}
+
+	if tcp.Status.Bootstrapped && len(machines) > 0 {
+		names = append(names,
+			secret.Name(cluster.Name, secret.Kubeconfig),
+			secret.Name(cluster.Name, secret.ClusterCA),
+			clusterTalosconfigSecretName(cluster),
+		)
+	}
+
+	for _, name := range names {
+		var s corev1.Secret
+
+		if err := r.Client.Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: name}, &s); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+
+			missing = append(missing, name)
+		}
+	}
+
+	return missing, nil
+}
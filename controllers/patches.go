@@ -0,0 +1,510 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"sigs.k8s.io/yaml"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// configPatch builds a single JSON patch for the Talos machine configuration.
+func configPatch(op, path string, value interface{}) (cabptv1.ConfigPatches, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return cabptv1.ConfigPatches{}, err
+	}
+
+	return cabptv1.ConfigPatches{
+		Op:    op,
+		Path:  path,
+		Value: apiextensionsv1.JSON{Raw: raw},
+	}, nil
+}
+
+// imagePatches renders image overrides into machine configuration patches.
+func imagePatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	images := spec.Images
+	if images == nil {
+		return nil, nil
+	}
+
+	paths := []struct {
+		path  string
+		image string
+	}{
+		{"/machine/install/image", images.Installer},
+		{"/machine/kubelet/image", images.Kubelet},
+		{"/cluster/apiServer/image", images.APIServer},
+		{"/cluster/controllerManager/image", images.ControllerManager},
+		{"/cluster/scheduler/image", images.Scheduler},
+		{"/cluster/proxy/image", images.Proxy},
+		{"/cluster/etcd/image", images.Etcd},
+	}
+
+	patches := []cabptv1.ConfigPatches{}
+
+	for _, p := range paths {
+		if p.image == "" {
+			continue
+		}
+
+		patch, err := configPatch("add", p.path, p.image)
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// componentVersionPatches renders pinned control plane component versions into machine configuration patches.
+func componentVersionPatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	versions := spec.ComponentVersions
+	if versions == nil {
+		return nil, nil
+	}
+
+	version, err := parseKubernetesVersion(spec.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	components := []struct {
+		name    string
+		path    string
+		image   string
+		version string
+	}{
+		{"apiServer", "/cluster/apiServer/image", constants.KubernetesAPIServerImage, versions.APIServer},
+		{"controllerManager", "/cluster/controllerManager/image", constants.KubernetesControllerManagerImage, versions.ControllerManager},
+		{"scheduler", "/cluster/scheduler/image", constants.KubernetesSchedulerImage, versions.Scheduler},
+	}
+
+	patches := []cabptv1.ConfigPatches{}
+
+	for _, c := range components {
+		if c.version == "" {
+			continue
+		}
+
+		pinned, err := parseKubernetesVersion(c.version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s version %q: %w", c.name, c.version, err)
+		}
+
+		if version.LessThan(*pinned) {
+			return nil, fmt.Errorf("%s version %s is newer than the control plane version %s", c.name, c.version, spec.Version)
+		}
+
+		if pinned.Major != version.Major || pinned.Minor+1 < version.Minor {
+			return nil, fmt.Errorf("%s version %s is more than one minor version older than the control plane version %s", c.name, c.version, spec.Version)
+		}
+
+		patch, err := configPatch("add", c.path, c.image+":v"+pinned.String())
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// etcdArgs returns the etcd command line arguments set by the etcd tuning parameters.
+func etcdArgs(etcd *controlplanev1.EtcdConfig) map[string]string {
+	args := map[string]string{}
+
+	if etcd == nil {
+		return args
+	}
+
+	for k, v := range etcd.ExtraArgs {
+		args[k] = v
+	}
+
+	if etcd.QuotaBackendBytes != nil {
+		args["quota-backend-bytes"] = strconv.FormatInt(*etcd.QuotaBackendBytes, 10)
+	}
+
+	if etcd.HeartbeatIntervalMilliseconds != nil {
+		args["heartbeat-interval"] = strconv.FormatInt(int64(*etcd.HeartbeatIntervalMilliseconds), 10)
+	}
+
+	if etcd.ElectionTimeoutMilliseconds != nil {
+		args["election-timeout"] = strconv.FormatInt(int64(*etcd.ElectionTimeoutMilliseconds), 10)
+	}
+
+	if etcd.SnapshotCount != nil {
+		args["snapshot-count"] = strconv.FormatInt(*etcd.SnapshotCount, 10)
+	}
+
+	return args
+}
+
+// etcdPatches renders etcd tuning parameters into machine configuration patches.
+func etcdPatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	return extraArgsPatches("/cluster/etcd/extraArgs", etcdArgs(spec.Etcd))
+}
+
+// admissionPatches renders kube-apiserver admission settings into machine configuration patches.
+//
+// Pod Security Admission defaults can only be set with the admission control config file,
+// so it's written to the host and mounted into the kube-apiserver pod. Talos writes the file
+// only on boot, so the file is changed by replacing the machines, while the admission plugins
+// are applied in place with the rest of the static pod configuration.
+func admissionPatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	admission := spec.Admission
+	if admission == nil {
+		return nil, nil
+	}
+
+	args := map[string]string{}
+
+	if len(admission.EnablePlugins) > 0 {
+		args["enable-admission-plugins"] = strings.Join(admission.EnablePlugins, ",")
+	}
+
+	if len(admission.DisablePlugins) > 0 {
+		args["disable-admission-plugins"] = strings.Join(admission.DisablePlugins, ",")
+	}
+
+	patches := []cabptv1.ConfigPatches{}
+
+	if admission.PodSecurity != nil {
+		content, err := admissionControlConfig(spec.Version, admission.PodSecurity)
+		if err != nil {
+			return nil, err
+		}
+
+		args["admission-control-config-file"] = admissionConfigMountPath + "/" + admissionConfigFile
+
+		filesPatch, err := configPatch("add", "/machine/files/-", map[string]interface{}{
+			"content":     content,
+			"permissions": 0o444,
+			"path":        admissionConfigHostPath + "/" + admissionConfigFile,
+			"op":          "create",
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		volumesPatch, err := configPatch("add", "/cluster/apiServer/extraVolumes/-", map[string]interface{}{
+			"hostPath":  admissionConfigHostPath,
+			"mountPath": admissionConfigMountPath,
+			"readonly":  true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, filesPatch, volumesPatch)
+	}
+
+	argsPatches, err := extraArgsPatches("/cluster/apiServer/extraArgs", args)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(patches, argsPatches...), nil
+}
+
+// extraArgsPatches renders the arguments into the patches setting each of them in the extraArgs section.
+func extraArgsPatches(section string, args map[string]string) ([]cabptv1.ConfigPatches, error) {
+	keys := make([]string, 0, len(args))
+
+	for k := range args {
+		keys = append(keys, k)
+	}
+
+	// keep the rendered config stable, so that the config hash doesn't change
+	sort.Strings(keys)
+
+	patches := make([]cabptv1.ConfigPatches, 0, len(keys))
+
+	for _, k := range keys {
+		patch, err := configPatch("add", section+"/"+strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1"), args[k])
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// admissionControlConfig builds the kube-apiserver AdmissionConfiguration with PodSecurity plugin defaults.
+func admissionControlConfig(kubernetesVersion string, podSecurity *controlplanev1.PodSecurityDefaults) (string, error) {
+	version, err := parseKubernetesVersion(kubernetesVersion)
+	if err != nil {
+		return "", err
+	}
+
+	// PodSecurityConfiguration graduated together with the admission plugin
+	apiVersion := "pod-security.admission.config.k8s.io/v1"
+
+	switch {
+	case version.LessThan(semver.Version{Major: 1, Minor: 23}):
+		apiVersion = "pod-security.admission.config.k8s.io/v1alpha1"
+	case version.LessThan(semver.Version{Major: 1, Minor: 25}):
+		apiVersion = "pod-security.admission.config.k8s.io/v1beta1"
+	}
+
+	defaults := map[string]string{}
+
+	for level, value := range map[string]string{
+		"enforce": podSecurity.Enforce,
+		"audit":   podSecurity.Audit,
+		"warn":    podSecurity.Warn,
+	} {
+		if value == "" {
+			continue
+		}
+
+		defaults[level] = value
+		defaults[level+"-version"] = "latest"
+	}
+
+	exemptNamespaces := podSecurity.ExemptNamespaces
+	if exemptNamespaces == nil {
+		exemptNamespaces = []string{}
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "apiserver.config.k8s.io/v1",
+		"kind":       "AdmissionConfiguration",
+		"plugins": []map[string]interface{}{
+			{
+				"name": "PodSecurity",
+				"configuration": map[string]interface{}{
+					"apiVersion": apiVersion,
+					"kind":       "PodSecurityConfiguration",
+					"defaults":   defaults,
+					"exemptions": map[string]interface{}{
+						"usernames":      []string{},
+						"runtimeClasses": []string{},
+						"namespaces":     exemptNamespaces,
+					},
+				},
+			},
+		},
+	})
+
+	return string(data), err
+}
+
+// manifestPatches renders extra and inline manifests into machine configuration patches, so that Talos
+// applies them on bootstrap.
+func manifestPatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	patches := []cabptv1.ConfigPatches{}
+
+	for _, manifest := range spec.ControlPlaneConfig.ExtraManifests {
+		patch, err := configPatch("add", "/cluster/extraManifests/-", manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	for _, manifest := range spec.ControlPlaneConfig.InlineManifests {
+		patch, err := configPatch("add", "/cluster/inlineManifests/-", map[string]string{
+			"name":     manifest.Name,
+			"contents": manifest.Contents,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// installPatches renders kernel arguments and system extensions into machine configuration patches.
+func installPatches(spec *controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error) {
+	patches := []cabptv1.ConfigPatches{}
+
+	if spec.Install == nil {
+		return patches, nil
+	}
+
+	// the installer image is overridden by the image patches, it's pinned only if it's set there
+	if images := spec.Images; images != nil && images.Installer != "" {
+		if pinned := pinnedImage(spec.Install, images.Installer); pinned != images.Installer {
+			patch, err := configPatch("add", "/machine/install/image", pinned)
+			if err != nil {
+				return nil, err
+			}
+
+			patches = append(patches, patch)
+		}
+	}
+
+	for _, arg := range spec.Install.ExtraKernelArgs {
+		patch, err := configPatch("add", "/machine/install/extraKernelArgs/-", arg)
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	for _, extension := range spec.Install.Extensions {
+		extension.Image = pinnedImage(spec.Install, extension.Image)
+
+		patch, err := configPatch("add", "/machine/install/extensions/-", extension)
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// renderConfigSpec returns a copy of the given TalosConfigSpec with the patches derived from
+// the TalosControlPlane spec appended after user-provided patches.
+//
+// Patches are applied in order as RFC 6902 patches, so the derived patches set single keys and append
+// list items instead of replacing whole sections. Sections missing from the machine configuration are
+// created by the patches inserted before the ones adding values to them.
+func renderConfigSpec(tcp *controlplanev1.TalosControlPlane, spec *cabptv1.TalosConfigSpec) (*cabptv1.TalosConfigSpec, error) {
+	rendered := spec.DeepCopy()
+
+	config, err := baseConfig(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, patch := range spec.ConfigPatches {
+		// patches failing here fail when the config is generated as well
+		config, _ = applyConfigPatch(config, patch) //nolint:errcheck
+	}
+
+	for _, render := range []func(*controlplanev1.TalosControlPlaneSpec) ([]cabptv1.ConfigPatches, error){
+		componentVersionPatches,
+		imagePatches,
+		etcdPatches,
+		admissionPatches,
+		manifestPatches,
+		installPatches,
+	} {
+		patches, err := render(&tcp.Spec)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, patch := range patches {
+			if patch.Op == "add" {
+				for _, parent := range parentPatches(config, patch.Path) {
+					rendered.ConfigPatches = append(rendered.ConfigPatches, parent)
+
+					config, _ = applyConfigPatch(config, parent) //nolint:errcheck
+				}
+			}
+
+			rendered.ConfigPatches = append(rendered.ConfigPatches, patch)
+
+			config, _ = applyConfigPatch(config, patch) //nolint:errcheck
+		}
+	}
+
+	return rendered, nil
+}
+
+// baseConfig returns the machine configuration the patches are applied to.
+//
+// The configuration generated by the bootstrap provider is not known in advance, so the sections
+// are taken from the configuration generated the same way for the generate type and the Talos version.
+func baseConfig(spec *cabptv1.TalosConfigSpec) (interface{}, error) {
+	data := []byte(spec.Data)
+
+	if spec.GenerateType != "none" {
+		var err error
+
+		data, err = generatedConfig(spec.GenerateType, spec.TalosVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate machine configuration: %w", err)
+		}
+	}
+
+	var config interface{}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse machine configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+// parentPatches returns the patches creating the sections missing in the config for the patch path.
+//
+// Adding the whole section would replace the values set by the previous patches, so sections are created
+// only if they are missing.
+func parentPatches(config interface{}, patchPath string) []cabptv1.ConfigPatches {
+	tokens := strings.Split(strings.TrimPrefix(patchPath, "/"), "/")
+	patches := []cabptv1.ConfigPatches{}
+	node := config
+
+	for i := 0; i < len(tokens)-1; i++ {
+		var (
+			child   interface{}
+			present bool
+		)
+
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, present = n[decodePathToken(tokens[i])]
+		case []interface{}:
+			index, err := strconv.Atoi(tokens[i])
+			if err != nil || index < 0 || index >= len(n) {
+				return patches
+			}
+
+			child, present = n[index], true
+		case nil:
+		default:
+			// patching a scalar value fails anyway
+			return patches
+		}
+
+		if !present || child == nil {
+			var value interface{} = map[string]interface{}{}
+
+			if _, err := strconv.Atoi(tokens[i+1]); err == nil || tokens[i+1] == "-" {
+				value = []interface{}{}
+			}
+
+			patch, err := configPatch("add", "/"+strings.Join(tokens[:i+1], "/"), value)
+			if err != nil {
+				return patches
+			}
+
+			patches = append(patches, patch)
+			child = value
+		}
+
+		node = child
+	}
+
+	return patches
+}
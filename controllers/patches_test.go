@@ -0,0 +1,424 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/talos/pkg/machinery/config/configpatcher"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/yaml"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func mustConfigPatch(t *testing.T, op, path string, value interface{}) cabptv1.ConfigPatches {
+	t.Helper()
+
+	patch, err := configPatch(op, path, value)
+	require.NoError(t, err)
+
+	return patch
+}
+
+func mustParseConfig(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	var config interface{}
+
+	require.NoError(t, yaml.Unmarshal([]byte(data), &config))
+
+	return config
+}
+
+func TestParentPatches(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   string
+		path     string
+		expected func(t *testing.T) []cabptv1.ConfigPatches
+	}{
+		{
+			name:   "missing sections are created from the top",
+			config: "cluster: {}",
+			path:   "/cluster/etcd/extraArgs/foo",
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/cluster/etcd", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs", map[string]interface{}{}),
+				}
+			},
+		},
+		{
+			name:   "list is created for the appended item",
+			config: "machine: {}",
+			path:   "/machine/files/-",
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/machine/files", []interface{}{}),
+				}
+			},
+		},
+		{
+			name:   "list is created for the item index",
+			config: "machine: {}",
+			path:   "/machine/certSANs/0",
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/machine/certSANs", []interface{}{}),
+				}
+			},
+		},
+		{
+			name:   "null sections are created",
+			config: "machine:\n  install: null",
+			path:   "/machine/install/extensions/-",
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/machine/install", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/machine/install/extensions", []interface{}{}),
+				}
+			},
+		},
+		{
+			name:   "existing sections are kept",
+			config: "cluster:\n  etcd:\n    extraArgs:\n      election-timeout: \"5000\"",
+			path:   "/cluster/etcd/extraArgs/foo",
+		},
+		{
+			name:   "escaped tokens",
+			config: "cluster:\n  a/b: {}",
+			path:   "/cluster/a~1b/c",
+		},
+		{
+			name:   "scalar values",
+			config: "machine:\n  install: none",
+			path:   "/machine/install/image",
+		},
+		{
+			name:   "list index out of range",
+			config: "machine:\n  files: []",
+			path:   "/machine/files/0/content",
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			expected := []cabptv1.ConfigPatches{}
+			if tt.expected != nil {
+				expected = tt.expected(t)
+			}
+
+			assert.Equal(t, expected, parentPatches(mustParseConfig(t, tt.config), tt.path))
+		})
+	}
+}
+
+func TestApplyConfigPatchErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config string
+		patch  cabptv1.ConfigPatches
+	}{
+		{
+			name:   "unsupported operation",
+			config: "cluster: {}",
+			patch:  cabptv1.ConfigPatches{Op: "move", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte("{}")}},
+		},
+		{
+			name:   "invalid value",
+			config: "cluster: {}",
+			patch:  cabptv1.ConfigPatches{Op: "add", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte("{")}},
+		},
+		{
+			name:   "scalar value",
+			config: "machine:\n  install: none",
+			patch:  cabptv1.ConfigPatches{Op: "add", Path: "/machine/install/image", Value: apiextensionsv1.JSON{Raw: []byte(`"installer"`)}},
+		},
+		{
+			name:   "list index out of range",
+			config: "machine:\n  files: []",
+			patch:  cabptv1.ConfigPatches{Op: "replace", Path: "/machine/files/0", Value: apiextensionsv1.JSON{Raw: []byte("{}")}},
+		},
+		{
+			name:   "list end replaced",
+			config: "machine:\n  files: []",
+			patch:  cabptv1.ConfigPatches{Op: "replace", Path: "/machine/files/-", Value: apiextensionsv1.JSON{Raw: []byte("{}")}},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := applyConfigPatch(mustParseConfig(t, tt.config), tt.patch)
+			assert.Error(t, err)
+
+			// failed patches keep the config unchanged, so that the following patches see the same sections
+			assert.Equal(t, mustParseConfig(t, tt.config), patched)
+		})
+	}
+}
+
+func TestRenderConfigSpec(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     string
+		patches  []cabptv1.ConfigPatches
+		spec     controlplanev1.TalosControlPlaneSpec
+		expected func(t *testing.T) []cabptv1.ConfigPatches
+	}{
+		{
+			name: "no derived patches",
+			data: "machine: {}\ncluster: {}",
+			patches: []cabptv1.ConfigPatches{
+				{Op: "add", Path: "/machine/network", Value: apiextensionsv1.JSON{Raw: []byte("{}")}},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					{Op: "add", Path: "/machine/network", Value: apiextensionsv1.JSON{Raw: []byte("{}")}},
+				}
+			},
+		},
+		{
+			name: "sections are created before the values",
+			data: "machine: {}\ncluster: {}",
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Etcd: &controlplanev1.EtcdConfig{
+					ExtraArgs: map[string]string{"b": "2", "a": "1"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/cluster/etcd", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/a", "1"),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/b", "2"),
+				}
+			},
+		},
+		{
+			name: "lists are created before the items",
+			data: "machine: {}\ncluster: {}",
+			spec: controlplanev1.TalosControlPlaneSpec{
+				ControlPlaneConfig: controlplanev1.ControlPlaneConfig{
+					ExtraManifests: []string{"https://example.com/a.yaml", "https://example.com/b.yaml"},
+				},
+				Install: &controlplanev1.InstallConfig{
+					ExtraKernelArgs: []string{"console=ttyS0"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/cluster/extraManifests", []interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/extraManifests/-", "https://example.com/a.yaml"),
+					mustConfigPatch(t, "add", "/cluster/extraManifests/-", "https://example.com/b.yaml"),
+					mustConfigPatch(t, "add", "/machine/install", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/machine/install/extraKernelArgs", []interface{}{}),
+					mustConfigPatch(t, "add", "/machine/install/extraKernelArgs/-", "console=ttyS0"),
+				}
+			},
+		},
+		{
+			name: "existing sections are kept",
+			data: "machine:\n  install:\n    extraKernelArgs:\n    - console=tty0",
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Install: &controlplanev1.InstallConfig{
+					ExtraKernelArgs: []string{"console=ttyS0"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/machine/install/extraKernelArgs/-", "console=ttyS0"),
+				}
+			},
+		},
+		{
+			name: "sections created by the user patches are kept",
+			data: "machine: {}\ncluster: {}",
+			patches: []cabptv1.ConfigPatches{
+				{Op: "add", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte(`{"extraArgs":{"c":"3"}}`)}},
+			},
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Etcd: &controlplanev1.EtcdConfig{
+					ExtraArgs: map[string]string{"a": "1"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					{Op: "add", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte(`{"extraArgs":{"c":"3"}}`)}},
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/a", "1"),
+				}
+			},
+		},
+		{
+			name: "sections removed by the user patches are created",
+			data: "cluster:\n  etcd:\n    extraArgs: {}",
+			patches: []cabptv1.ConfigPatches{
+				{Op: "remove", Path: "/cluster/etcd"},
+			},
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Etcd: &controlplanev1.EtcdConfig{
+					ExtraArgs: map[string]string{"a": "1"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					{Op: "remove", Path: "/cluster/etcd"},
+					mustConfigPatch(t, "add", "/cluster/etcd", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/a", "1"),
+				}
+			},
+		},
+		{
+			name: "failing user patches are kept",
+			data: "machine: {}\ncluster: {}",
+			patches: []cabptv1.ConfigPatches{
+				{Op: "move", Path: "/cluster/etcd"},
+				{Op: "add", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte("{")}},
+			},
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Etcd: &controlplanev1.EtcdConfig{
+					ExtraArgs: map[string]string{"a": "1"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					{Op: "move", Path: "/cluster/etcd"},
+					{Op: "add", Path: "/cluster/etcd", Value: apiextensionsv1.JSON{Raw: []byte("{")}},
+					mustConfigPatch(t, "add", "/cluster/etcd", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs", map[string]interface{}{}),
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/a", "1"),
+				}
+			},
+		},
+		{
+			name: "scalar sections",
+			data: "cluster:\n  etcd: none",
+			spec: controlplanev1.TalosControlPlaneSpec{
+				Etcd: &controlplanev1.EtcdConfig{
+					ExtraArgs: map[string]string{"a": "1"},
+				},
+			},
+			expected: func(t *testing.T) []cabptv1.ConfigPatches {
+				return []cabptv1.ConfigPatches{
+					mustConfigPatch(t, "add", "/cluster/etcd/extraArgs/a", "1"),
+				}
+			},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := &controlplanev1.TalosControlPlane{Spec: tt.spec}
+
+			spec := &cabptv1.TalosConfigSpec{
+				GenerateType:  "none",
+				Data:          tt.data,
+				ConfigPatches: tt.patches,
+			}
+
+			rendered, err := renderConfigSpec(tcp, spec)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected(t), rendered.ConfigPatches)
+			assert.Len(t, spec.ConfigPatches, len(tt.patches))
+		})
+	}
+}
+
+// TestRenderConfigSpecGenerated checks the rendered patches apply to the machine configuration generated by Talos
+// the same way the bootstrap provider applies them.
+func TestRenderConfigSpecGenerated(t *testing.T) {
+	tcp := &controlplanev1.TalosControlPlane{
+		Spec: controlplanev1.TalosControlPlaneSpec{
+			Version: "v1.23.1",
+			ControlPlaneConfig: controlplanev1.ControlPlaneConfig{
+				ExtraManifests: []string{"https://example.com/a.yaml"},
+				InlineManifests: []controlplanev1.InlineManifest{
+					{Name: "b", Contents: "kind: Namespace"},
+				},
+			},
+			Images: &controlplanev1.ImageOverrides{
+				Kubelet: "ghcr.io/talos-systems/kubelet:v1.23.1",
+				Etcd:    "gcr.io/etcd-development/etcd:v3.5.1",
+			},
+			Etcd: &controlplanev1.EtcdConfig{
+				QuotaBackendBytes: pointer.Int64Ptr(8589934592),
+				ExtraArgs:         map[string]string{"auto-compaction-retention": "1"},
+			},
+			Admission: &controlplanev1.AdmissionConfig{
+				EnablePlugins: []string{"NodeRestriction"},
+				PodSecurity: &controlplanev1.PodSecurityDefaults{
+					Enforce: "baseline",
+				},
+			},
+			Install: &controlplanev1.InstallConfig{
+				ExtraKernelArgs: []string{"console=ttyS0"},
+				Extensions: []controlplanev1.InstallExtension{
+					{Image: "ghcr.io/siderolabs/gvisor:v0.1.0"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		generateType string
+		talosVersion string
+	}{
+		{"init", ""},
+		{"controlplane", ""},
+		{"init", "v0.13"},
+		{"controlplane", "v0.13"},
+	} {
+		tt := tt
+
+		t.Run(tt.generateType+tt.talosVersion, func(t *testing.T) {
+			rendered, err := renderConfigSpec(tcp, &cabptv1.TalosConfigSpec{
+				GenerateType: tt.generateType,
+				TalosVersion: tt.talosVersion,
+			})
+			require.NoError(t, err)
+
+			data, err := generatedConfig(tt.generateType, tt.talosVersion)
+			require.NoError(t, err)
+
+			marshalledPatches, err := json.Marshal(rendered.ConfigPatches)
+			require.NoError(t, err)
+
+			patch, err := jsonpatch.DecodePatch(marshalledPatches)
+			require.NoError(t, err)
+
+			patched, err := configpatcher.JSON6902(data, patch)
+			require.NoError(t, err)
+
+			var cfg struct {
+				Machine struct {
+					Install struct {
+						ExtraKernelArgs []string `json:"extraKernelArgs"`
+					} `json:"install"`
+				} `json:"machine"`
+				Cluster struct {
+					Etcd struct {
+						ExtraArgs map[string]string `json:"extraArgs"`
+					} `json:"etcd"`
+					ExtraManifests []string `json:"extraManifests"`
+				} `json:"cluster"`
+			}
+
+			require.NoError(t, yaml.Unmarshal(patched, &cfg))
+
+			assert.Equal(t, []string{"console=ttyS0"}, cfg.Machine.Install.ExtraKernelArgs)
+			assert.Equal(t, "8589934592", cfg.Cluster.Etcd.ExtraArgs["quota-backend-bytes"])
+			assert.Equal(t, "1", cfg.Cluster.Etcd.ExtraArgs["auto-compaction-retention"])
+			assert.Equal(t, []string{"https://example.com/a.yaml"}, cfg.Cluster.ExtraManifests)
+		})
+	}
+}
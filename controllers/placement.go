@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"sort"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// controlPlaneFailureDomains returns the sorted names of the cluster failure domains eligible for the control plane.
+func controlPlaneFailureDomains(cluster *clusterv1.Cluster) []string {
+	domains := []string{}
+
+	for name, spec := range cluster.Status.FailureDomains {
+		if spec.ControlPlane {
+			domains = append(domains, name)
+		}
+	}
+
+	sort.Strings(domains)
+
+	return domains
+}
+
+// machinesPerFailureDomain counts the machines which are not being deleted in each failure domain.
+// Each of them runs an etcd voting member, so the counts are the etcd spread across the domains.
+func machinesPerFailureDomain(machines []clusterv1.Machine) map[string]int {
+	counts := map[string]int{}
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Spec.FailureDomain == nil {
+			continue
+		}
+
+		counts[*machine.Spec.FailureDomain]++
+	}
+
+	return counts
+}
+
+// scaleUpFailureDomain picks the failure domain for a new control plane machine: the one with the fewest machines,
+// ties are broken by the name, so the placement is deterministic.
+//
+// Placing each machine into the least populated domain keeps the etcd members spread as evenly as possible
+// even when there are more replicas than domains (e.g. 5 replicas in 3 domains are placed 2/2/1),
+// so that losing any single domain loses as few voting members as possible.
+func scaleUpFailureDomain(cluster *clusterv1.Cluster, machines []clusterv1.Machine) *string {
+	domains := controlPlaneFailureDomains(cluster)
+	if len(domains) == 0 {
+		return nil
+	}
+
+	counts := machinesPerFailureDomain(machines)
+
+	picked := domains[0]
+
+	for _, domain := range domains[1:] {
+		if counts[domain] < counts[picked] {
+			picked = domain
+		}
+	}
+
+	return &picked
+}
+
+// scaleDownPreferred reports whether the candidate should be removed rather than the current pick:
+// machines from the most populated failure domain go first, the oldest machine is picked among them.
+//
+// During rollouts the new machines are placed into the least populated domains and the outdated ones are removed
+// from the most populated ones, so an unbalanced control plane is rebalanced without any extra machine replacements.
+func scaleDownPreferred(candidate, current *clusterv1.Machine, counts map[string]int) bool {
+	if current == nil {
+		return true
+	}
+
+	candidateCount, currentCount := failureDomainCount(candidate, counts), failureDomainCount(current, counts)
+	if candidateCount != currentCount {
+		return candidateCount > currentCount
+	}
+
+	return candidate.CreationTimestamp.Before(&current.CreationTimestamp)
+}
+
+func failureDomainCount(machine *clusterv1.Machine, counts map[string]int) int {
+	if machine.Spec.FailureDomain == nil {
+		return 0
+	}
+
+	return counts[*machine.Spec.FailureDomain]
+}
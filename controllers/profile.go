@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const reconcileProfileKey = "profile.txt"
+
+// reconcileProfile records the duration of each reconcile phase.
+type reconcileProfile struct {
+	start  time.Time
+	phases []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+	err      error
+}
+
+// newReconcileProfile starts profiling the reconcile if it's requested by the annotation, otherwise it returns nil.
+func newReconcileProfile(tcp *controlplanev1.TalosControlPlane) *reconcileProfile {
+	if _, ok := tcp.Annotations[controlplanev1.ProfileReconcileAnnotation]; !ok {
+		return nil
+	}
+
+	return &reconcileProfile{start: time.Now()}
+}
+
+// record adds the phase timing, it's a no-op if the profiling is disabled.
+func (p *reconcileProfile) record(phase interface{}, start time.Time, err error) {
+	if p == nil {
+		return
+	}
+
+	p.phases = append(p.phases, phaseTiming{
+		name:     phaseName(phase),
+		duration: time.Since(start),
+		err:      err,
+	})
+}
+
+// slowest returns the phase which took the longest.
+func (p *reconcileProfile) slowest() phaseTiming {
+	var slowest phaseTiming
+
+	for _, phase := range p.phases {
+		if phase.duration > slowest.duration {
+			slowest = phase
+		}
+	}
+
+	return slowest
+}
+
+func (p *reconcileProfile) String() string {
+	var sb strings.Builder
+
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "PHASE\tDURATION\tERROR\n")
+
+	for _, phase := range p.phases {
+		errMsg := ""
+		if phase.err != nil {
+			errMsg = phase.err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", phase.name, phase.duration.Round(time.Millisecond), errMsg)
+	}
+
+	fmt.Fprintf(w, "total\t%s\t\n", time.Since(p.start).Round(time.Millisecond))
+
+	w.Flush() //nolint:errcheck
+
+	return sb.String()
+}
+
+// phaseName returns the name of the reconcile phase method, e.g. "reconcileEtcdMembers".
+func phaseName(phase interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(phase).Pointer()).Name()
+
+	name = strings.TrimSuffix(name, "-fm")
+
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return name
+}
+
+// writeReconcileProfile stores the phase timings of the profiled reconcile into the "<name>-reconcile-profile" ConfigMap
+// and emits an event with the summary.
+//
+// The annotation is removed afterwards, so only a single reconcile is profiled per request.
+func (r *TalosControlPlaneReconciler) writeReconcileProfile(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, profile *reconcileProfile) error {
+	if profile == nil {
+		return nil
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tcp.Name + "-reconcile-profile",
+			Namespace: tcp.Namespace,
+		},
+	}
+
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Labels = map[string]string{
+			clusterv1.ClusterLabelName:            cluster.Name,
+			controlplanev1.TalosControlPlaneLabel: tcp.Name,
+		}
+
+		configMap.Data = map[string]string{
+			reconcileProfileKey: profile.String(),
+		}
+
+		return controllerutil.SetOwnerReference(tcp, configMap, r.Scheme)
+	}); err != nil {
+		return errors.Wrap(err, "Failed to write reconcile profile")
+	}
+
+	total := time.Since(profile.start).Round(time.Millisecond)
+	slowest := profile.slowest()
+
+	r.Log.Info("profiled reconcile", "configMap", configMap.Name, "total", total, "slowest", slowest.name)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "ReconcileProfiled", "Reconcile took %s, slowest phase %s took %s, see ConfigMap %s",
+			total, slowest.name, slowest.duration.Round(time.Millisecond), configMap.Name)
+	}
+
+	// the TalosControlPlane is patched at the end of the reconcile loop
+	delete(tcp.Annotations, controlplanev1.ProfileReconcileAnnotation)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// talosRPCLimiter limits the number of concurrent Talos API calls per cluster,
+// so that health checks don't overwhelm apid on resource constrained control plane nodes.
+type talosRPCLimiter struct {
+	mu        sync.Mutex
+	semaphore map[client.ObjectKey]chan struct{}
+}
+
+func (l *talosRPCLimiter) get(cluster client.ObjectKey, limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.semaphore == nil {
+		l.semaphore = map[client.ObjectKey]chan struct{}{}
+	}
+
+	sem, ok := l.semaphore[cluster]
+	if !ok {
+		sem = make(chan struct{}, limit)
+
+		l.semaphore[cluster] = sem
+	}
+
+	return sem
+}
+
+// dialOptions returns the gRPC options which limit concurrent calls of the Talos client to the cluster.
+//
+// Streaming calls only hold the slot until the stream is established.
+// No limit is applied if limit is not positive.
+func (l *talosRPCLimiter) dialOptions(cluster client.ObjectKey, limit int) []grpc.DialOption {
+	if limit <= 0 {
+		return nil
+	}
+
+	sem := l.get(cluster, limit)
+
+	acquire := func(ctx context.Context) error {
+		select {
+		case sem <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	release := func() {
+		<-sem
+	}
+
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if err := acquire(ctx); err != nil {
+				return err
+			}
+
+			defer release()
+
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			if err := acquire(ctx); err != nil {
+				return nil, err
+			}
+
+			defer release()
+
+			return streamer(ctx, desc, cc, method, opts...)
+		}),
+	}
+}
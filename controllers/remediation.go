@@ -0,0 +1,363 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// remediationData tracks the remediation of the control plane machine in the RemediationInProgressAnnotation
+// and RemediationForAnnotation annotations.
+type remediationData struct {
+	// Machine is the name of the remediated machine.
+	Machine string `json:"machine"`
+	// Timestamp is the time the remediated machine was deleted.
+	Timestamp metav1.Time `json:"timestamp"`
+	// RetryCount is the number of the remediations of the replacement machines in a row.
+	RetryCount int32 `json:"retryCount"`
+}
+
+func parseRemediationData(value string) (*remediationData, error) {
+	var data remediationData
+
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse remediation data %q: %w", value, err)
+	}
+
+	return &data, nil
+}
+
+func (d *remediationData) marshal() (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// remediationRetry applies the remediation strategy to the replacement of the previously remediated machine.
+//
+// It returns the retry count of the remediation, or the reason the remediation is blocked by MaxRetry,
+// or the time to wait for the RetryPeriodSeconds to pass.
+func remediationRetry(tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) (retryCount int32, blocked string, wait time.Duration, err error) {
+	value, ok := machine.Annotations[controlplanev1.RemediationForAnnotation]
+	if !ok {
+		return 0, "", 0, nil
+	}
+
+	prev, err := parseRemediationData(value)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	var (
+		strategy   = tcp.Spec.RemediationStrategy
+		minHealthy = defaultRemediationMinHealthyPeriod
+		retry      time.Duration
+	)
+
+	if strategy != nil && strategy.MinHealthyPeriodSeconds != nil {
+		minHealthy = time.Duration(*strategy.MinHealthyPeriodSeconds) * time.Second
+	}
+
+	if strategy != nil && strategy.RetryPeriodSeconds != nil {
+		retry = time.Duration(*strategy.RetryPeriodSeconds) * time.Second
+	}
+
+	failedAt := time.Now()
+	if condition := conditions.Get(machine, clusterv1.MachineOwnerRemediatedCondition); condition != nil {
+		failedAt = condition.LastTransitionTime.Time
+	}
+
+	// the replacement was healthy long enough, so the failure is not related to the previous remediation
+	if prev.Timestamp.Add(minHealthy).Before(failedAt) {
+		return 0, "", 0, nil
+	}
+
+	if strategy != nil && strategy.MaxRetry != nil && prev.RetryCount >= *strategy.MaxRetry {
+		return 0, fmt.Sprintf("machine %q was already remediated %d time(s) in a row, the limit is %d", prev.Machine, prev.RetryCount+1, *strategy.MaxRetry), 0, nil
+	}
+
+	if wait = time.Until(prev.Timestamp.Add(retry)); wait > 0 {
+		return 0, "", wait, nil
+	}
+
+	return prev.RetryCount + 1, "", 0, nil
+}
+
+// needsRemediation checks whether the machine was marked unhealthy by the MachineHealthCheck or
+// manually with the remediate-machine annotation.
+func needsRemediation(machine *clusterv1.Machine) bool {
+	if _, ok := machine.Annotations[controlplanev1.RemediateMachineAnnotation]; ok {
+		return true
+	}
+
+	return conditions.IsFalse(machine, clusterv1.MachineOwnerRemediatedCondition)
+}
+
+// reconcileRemediation replaces the unhealthy control plane machines, one machine at a time.
+//
+// The etcd member of the machine is removed first, then the machine is deleted and the scale up creates the replacement.
+// Remediation is skipped if it would make etcd lose quorum, while the control plane is resized,
+// or while another machine is being deleted.
+func (r *TalosControlPlaneReconciler) reconcileRemediation(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	var (
+		unhealthy *clusterv1.Machine
+		failed    int
+		active    int
+	)
+
+	for i := range machines {
+		machine := &machines[i]
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		active++
+
+		if !needsRemediation(machine) {
+			continue
+		}
+
+		failed++
+
+		if unhealthy == nil || machine.CreationTimestamp.Before(&unhealthy.CreationTimestamp) {
+			unhealthy = machine
+		}
+	}
+
+	if tcp.Spec.RemediationTemplate != nil {
+		if err := r.cleanupExternalRemediations(ctx, tcp, machines); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if unhealthy == nil {
+		// the replacement machine is not going to be created if the control plane was scaled down meanwhile
+		if active == len(machines) && active == int(*tcp.Spec.Replicas) {
+			delete(tcp.Annotations, controlplanev1.RemediationInProgressAnnotation)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	var reason string
+
+	switch {
+	case active != len(machines):
+		reason = "waiting for the deleted control plane machines to go away"
+	case active != int(*tcp.Spec.Replicas):
+		reason = fmt.Sprintf("waiting for the control plane to have %d machines", *tcp.Spec.Replicas)
+	case active-failed < active/2+1:
+		reason = fmt.Sprintf("removing the etcd member would break etcd quorum, %d of %d machines are unhealthy", failed, active)
+	default:
+		if operation, ok := etcdMaintenanceInProgress(tcp); ok {
+			reason = fmt.Sprintf("waiting for etcd %s to complete", operation)
+		}
+	}
+
+	if reason != "" {
+		r.Log.Info("postponing remediation", "machine", unhealthy.Name, "reason", reason)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, r.markRemediation(ctx, unhealthy, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityWarning, reason)
+	}
+
+	if tcp.Spec.RemediationTemplate != nil {
+		return ctrl.Result{}, r.requestExternalRemediation(ctx, cluster, tcp, unhealthy)
+	}
+
+	retryCount, blocked, wait, err := remediationRetry(tcp, unhealthy)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if blocked != "" {
+		r.Log.Info("refusing to remediate machine", "machine", unhealthy.Name, "reason", blocked)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "RemediationBlocked", "Machine %q is not remediated: %s", unhealthy.Name, blocked)
+		}
+
+		// changing the remediation strategy re-triggers reconcile
+		return ctrl.Result{}, r.markRemediation(ctx, unhealthy, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityError, blocked)
+	}
+
+	if wait > 0 {
+		r.Log.Info("waiting for the remediation retry period", "machine", unhealthy.Name, "wait", wait)
+
+		return ctrl.Result{RequeueAfter: wait}, r.markRemediation(ctx, unhealthy, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityWarning,
+			fmt.Sprintf("waiting for the retry period to pass at %s", time.Now().Add(wait).UTC().Format(time.RFC3339)))
+	}
+
+	inProgress, err := (&remediationData{
+		Machine:    unhealthy.Name,
+		Timestamp:  metav1.Now(),
+		RetryCount: retryCount,
+	}).marshal()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.markRemediation(ctx, unhealthy, clusterv1.RemediationInProgressReason, clusterv1.ConditionSeverityWarning, "Removing the etcd member and deleting the machine"); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.Log.Info("remediating unhealthy control plane machine", "machine", unhealthy.Name, "retry", retryCount)
+
+	if err := r.removeEtcdMemberForMachine(ctx, tcp, util.ObjectKey(cluster), machines, *unhealthy); err != nil {
+		r.audit(tcp, cluster.Name, auditRemediation, unhealthy.Name, err, "Failed to remove the etcd member of the unhealthy machine")
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	err = r.Client.Delete(ctx, unhealthy.DeepCopy())
+
+	r.audit(tcp, cluster.Name, auditRemediation, unhealthy.Name, err, fmt.Sprintf("Deleting unhealthy control plane machine (retry %d)", retryCount))
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// the annotation is moved to the replacement machine once it's created
+	if tcp.Annotations == nil {
+		tcp.Annotations = map[string]string{}
+	}
+
+	tcp.Annotations[controlplanev1.RemediationInProgressAnnotation] = inProgress
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "MachineRemediated", "Deleted unhealthy control plane machine %q", unhealthy.Name)
+	}
+
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// markRemediation updates the OwnerRemediated condition of the machine with the remediation progress.
+func (r *TalosControlPlaneReconciler) markRemediation(ctx context.Context, machine *clusterv1.Machine, reason string, severity clusterv1.ConditionSeverity, message string) error {
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	conditions.MarkFalse(machine, clusterv1.MachineOwnerRemediatedCondition, reason, severity, message)
+
+	return patchHelper.Patch(ctx, machine, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{
+		clusterv1.MachineOwnerRemediatedCondition,
+	}})
+}
+
+// externalRemediationRef returns the reference to the external remediation request of the machine.
+func externalRemediationRef(tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: tcp.Spec.RemediationTemplate.APIVersion,
+		Kind:       strings.TrimSuffix(tcp.Spec.RemediationTemplate.Kind, clusterv1.TemplateSuffix),
+		Name:       machine.Name,
+		Namespace:  machine.Namespace,
+	}
+}
+
+// requestExternalRemediation creates the external remediation request for the machine from the remediation template,
+// the provider-specific controller remediates the machine.
+func (r *TalosControlPlaneReconciler) requestExternalRemediation(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	ref := externalRemediationRef(tcp, machine)
+
+	_, err := external.Get(ctx, r.Client, ref, machine.Namespace)
+	if err == nil {
+		// remediation is in progress
+		return nil
+	}
+
+	if !apierrors.IsNotFound(errors.Cause(err)) {
+		return err
+	}
+
+	template, err := external.Get(ctx, r.Client, tcp.Spec.RemediationTemplate, tcp.Namespace)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get remediation template")
+	}
+
+	request, err := external.GenerateTemplate(&external.GenerateTemplateInput{
+		Template:    template,
+		TemplateRef: tcp.Spec.RemediationTemplate,
+		Namespace:   machine.Namespace,
+		ClusterName: cluster.Name,
+		OwnerRef: &metav1.OwnerReference{
+			APIVersion: clusterv1.GroupVersion.String(),
+			Kind:       "Machine",
+			Name:       machine.Name,
+			UID:        machine.UID,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	request.SetName(machine.Name)
+
+	err = r.Client.Create(ctx, request)
+
+	r.audit(tcp, cluster.Name, auditRemediation, machine.Name, err, fmt.Sprintf("Requested external remediation %s %q", ref.Kind, ref.Name))
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create %s %q", ref.Kind, ref.Name)
+	}
+
+	r.Log.Info("requested external remediation", "machine", machine.Name, "kind", ref.Kind)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "ExternalRemediationRequested", "Created %s %q to remediate unhealthy machine", ref.Kind, ref.Name)
+	}
+
+	return r.markRemediation(ctx, machine, clusterv1.RemediationInProgressReason, clusterv1.ConditionSeverityWarning,
+		fmt.Sprintf("External remediation %s %q requested", ref.Kind, ref.Name))
+}
+
+// cleanupExternalRemediations deletes the external remediation requests of the machines which are healthy again.
+func (r *TalosControlPlaneReconciler) cleanupExternalRemediations(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) error {
+	for i := range machines {
+		machine := &machines[i]
+
+		if needsRemediation(machine) {
+			continue
+		}
+
+		ref := externalRemediationRef(tcp, machine)
+
+		if _, err := external.Get(ctx, r.Client, ref, machine.Namespace); err != nil {
+			if apierrors.IsNotFound(errors.Cause(err)) {
+				continue
+			}
+
+			return err
+		}
+
+		r.Log.Info("machine is healthy, deleting external remediation request", "machine", machine.Name, "kind", ref.Kind)
+
+		if err := external.Delete(ctx, r.Client, ref); err != nil && !apierrors.IsNotFound(errors.Cause(err)) {
+			return err
+		}
+	}
+
+	return nil
+}
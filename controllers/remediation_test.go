@@ -0,0 +1,326 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func mustRemediationData(t *testing.T, machine string, deleted time.Time, retryCount int32) string {
+	value, err := (&remediationData{
+		Machine:    machine,
+		Timestamp:  metav1.NewTime(deleted),
+		RetryCount: retryCount,
+	}).marshal()
+	require.NoError(t, err)
+
+	return value
+}
+
+func TestRemediationData(t *testing.T) {
+	deleted := time.Now().Truncate(time.Second)
+
+	data, err := parseRemediationData(mustRemediationData(t, "cp-1", deleted, 2))
+	require.NoError(t, err)
+
+	assert.Equal(t, "cp-1", data.Machine)
+	assert.True(t, deleted.Equal(data.Timestamp.Time))
+	assert.EqualValues(t, 2, data.RetryCount)
+
+	_, err = parseRemediationData("cp-1")
+	assert.Error(t, err)
+}
+
+func TestRemediationRetry(t *testing.T) {
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name       string
+		strategy   *controlplanev1.RemediationStrategy
+		previous   string
+		retryCount int32
+		blocked    bool
+		wait       time.Duration
+		err        bool
+	}{
+		{
+			name: "first remediation",
+		},
+		{
+			name:     "replacement was healthy long enough",
+			previous: mustRemediationData(t, "cp-1", now.Add(-2*time.Hour), 3),
+		},
+		{
+			name:     "replacement was healthy longer than the strategy period",
+			strategy: &controlplanev1.RemediationStrategy{MinHealthyPeriodSeconds: pointer.Int32Ptr(300)},
+			previous: mustRemediationData(t, "cp-1", now.Add(-10*time.Minute), 3),
+		},
+		{
+			name:       "replacement failed",
+			previous:   mustRemediationData(t, "cp-1", now.Add(-10*time.Minute), 1),
+			retryCount: 2,
+		},
+		{
+			name:     "retry limit reached",
+			strategy: &controlplanev1.RemediationStrategy{MaxRetry: pointer.Int32Ptr(1)},
+			previous: mustRemediationData(t, "cp-1", now.Add(-10*time.Minute), 1),
+			blocked:  true,
+		},
+		{
+			name:     "retry period",
+			strategy: &controlplanev1.RemediationStrategy{RetryPeriodSeconds: pointer.Int32Ptr(1800)},
+			previous: mustRemediationData(t, "cp-1", now.Add(-10*time.Minute), 0),
+			wait:     20 * time.Minute,
+		},
+		{
+			name:     "invalid annotation",
+			previous: "cp-1",
+			err:      true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := &controlplanev1.TalosControlPlane{
+				Spec: controlplanev1.TalosControlPlaneSpec{RemediationStrategy: tt.strategy},
+			}
+
+			machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-2"}}
+
+			if tt.previous != "" {
+				machine.Annotations = map[string]string{controlplanev1.RemediationForAnnotation: tt.previous}
+			}
+
+			retryCount, blocked, wait, err := remediationRetry(tcp, machine)
+			if tt.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.retryCount, retryCount)
+			assert.Equal(t, tt.blocked, blocked != "")
+			assert.InDelta(t, tt.wait, wait, float64(time.Minute))
+		})
+	}
+}
+
+func TestNeedsRemediation(t *testing.T) {
+	machine := &clusterv1.Machine{}
+	assert.False(t, needsRemediation(machine))
+
+	conditions.MarkTrue(machine, clusterv1.MachineOwnerRemediatedCondition)
+	assert.False(t, needsRemediation(machine))
+
+	conditions.MarkFalse(machine, clusterv1.MachineOwnerRemediatedCondition, clusterv1.WaitingForRemediationReason, clusterv1.ConditionSeverityWarning, "")
+	assert.True(t, needsRemediation(machine))
+
+	machine = &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{controlplanev1.RemediateMachineAnnotation: ""}},
+	}
+	assert.True(t, needsRemediation(machine))
+}
+
+func TestExternalRemediationRef(t *testing.T) {
+	tcp := &controlplanev1.TalosControlPlane{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-cp"},
+		Spec: controlplanev1.TalosControlPlaneSpec{
+			RemediationTemplate: &corev1.ObjectReference{
+				APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+				Kind:       "Metal3RemediationTemplate",
+				Name:       "remediation",
+			},
+		},
+	}
+
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "machines", Name: "cp-1"}}
+
+	assert.Equal(t, &corev1.ObjectReference{
+		APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+		Kind:       "Metal3Remediation",
+		Namespace:  "machines",
+		Name:       "cp-1",
+	}, externalRemediationRef(tcp, machine))
+}
+
+var _ = Describe("Remediation", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		recorder  *record.FakeRecorder
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+	)
+
+	unhealthy := map[string]string{controlplanev1.RemediateMachineAnnotation: ""}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+		recorder = record.NewFakeRecorder(8)
+
+		r = &TalosControlPlaneReconciler{
+			Client:   k8sClient,
+			Log:      logr.Discard(),
+			Scheme:   scheme.Scheme,
+			Recorder: recorder,
+		}
+
+		cluster = &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"}}
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp", Annotations: map[string]string{}},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				// the nodes are not reachable: the machines have no addresses
+				AddressSources: []controlplanev1.AddressSourceName{controlplanev1.AnnotationAddressSource},
+			},
+		}
+	})
+
+	newMachines := func(annotations ...map[string]string) []clusterv1.Machine {
+		machines := make([]clusterv1.Machine, 0, len(annotations))
+
+		for i, machineAnnotations := range annotations {
+			machine := newTestMachine(ctx, namespace, fmt.Sprintf("cp-%d", i+1), machineAnnotations)
+
+			// the older machines are remediated first
+			machine.CreationTimestamp = metav1.NewTime(time.Now().Add(time.Duration(i) * time.Minute))
+
+			machines = append(machines, *machine)
+		}
+
+		return machines
+	}
+
+	remediated := func(name string) *clusterv1.Condition {
+		var machine clusterv1.Machine
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &machine)).To(Succeed())
+
+		return conditions.Get(&machine, clusterv1.MachineOwnerRemediatedCondition)
+	}
+
+	It("finishes the remediation once the replacement machine is created", func() {
+		tcp.Annotations[controlplanev1.RemediationInProgressAnnotation] = "{}"
+
+		machines := newMachines(nil, nil, nil)
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.RemediationInProgressAnnotation))
+	})
+
+	It("waits for the control plane to be scaled up", func() {
+		tcp.Annotations[controlplanev1.RemediationInProgressAnnotation] = "{}"
+
+		machines := newMachines(unhealthy, nil)
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(tcp.Annotations).To(HaveKey(controlplanev1.RemediationInProgressAnnotation))
+
+		condition := remediated("cp-1")
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Reason).To(Equal(clusterv1.RemediationFailedReason))
+		Expect(condition.Message).To(ContainSubstring("to have 3 machines"))
+	})
+
+	It("doesn't break etcd quorum", func() {
+		machines := newMachines(nil, unhealthy, unhealthy)
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		condition := remediated("cp-2")
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Message).To(ContainSubstring("would break etcd quorum"))
+
+		Expect(remediated("cp-1")).To(BeNil())
+		Expect(remediated("cp-3")).To(BeNil())
+	})
+
+	It("waits for the etcd maintenance to complete", func() {
+		tcp.Annotations[controlplanev1.EtcdMaintenanceAnnotation] = "defragmentation"
+
+		machines := newMachines(nil, nil, unhealthy)
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(remediated("cp-3").Message).To(Equal("waiting for etcd defragmentation to complete"))
+	})
+
+	It("stops remediating the replacements once the retry limit is reached", func() {
+		tcp.Spec.RemediationStrategy = &controlplanev1.RemediationStrategy{MaxRetry: pointer.Int32Ptr(1)}
+
+		previous, err := (&remediationData{Machine: "cp-0", Timestamp: metav1.Now(), RetryCount: 1}).marshal()
+		Expect(err).NotTo(HaveOccurred())
+
+		machines := newMachines(nil, nil, map[string]string{
+			controlplanev1.RemediateMachineAnnotation: "",
+			controlplanev1.RemediationForAnnotation:   previous,
+		})
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		condition := remediated("cp-3")
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Severity).To(Equal(clusterv1.ConditionSeverityError))
+		Expect(recorder.Events).To(Receive(ContainSubstring("RemediationBlocked")))
+	})
+
+	It("deletes the machine only once its etcd member is removed", func() {
+		machines := newMachines(nil, unhealthy, nil)
+
+		// the machines have joined etcd
+		for i := range machines {
+			machines[i].Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: machines[i].Name}
+		}
+
+		result, err := r.reconcileRemediation(ctx, cluster, tcp, machines)
+		Expect(err).To(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: 20 * time.Second}))
+
+		Expect(remediated("cp-2").Reason).To(Equal(clusterv1.RemediationInProgressReason))
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.RemediationInProgressAnnotation))
+
+		var machine clusterv1.Machine
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "cp-2"}, &machine)).To(Succeed())
+		Expect(machine.DeletionTimestamp).To(BeNil())
+	})
+})
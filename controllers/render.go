@@ -0,0 +1,364 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/talos/pkg/machinery/config"
+	"github.com/talos-systems/talos/pkg/machinery/config/configloader"
+	"github.com/talos-systems/talos/pkg/machinery/config/configpatcher"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/generate"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/machine"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	yamlv3 "gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+const (
+	renderedConfigKey        = "talosconfig.yaml"
+	renderedMachineConfigKey = "machineconfig.yaml"
+)
+
+// redactedValue replaces the secrets in the rendered machine configuration.
+const redactedValue = "******"
+
+// redactedConfigPaths are the secrets of the machine configuration which are not written to the rendered config.
+var redactedConfigPaths = [][]string{
+	{"machine", "token"},
+	{"machine", "ca", "key"},
+	{"cluster", "secret"},
+	{"cluster", "token"},
+	{"cluster", "aescbcEncryptionSecret"},
+	{"cluster", "ca", "key"},
+	{"cluster", "aggregatorCA", "key"},
+	{"cluster", "serviceAccount", "key"},
+	{"cluster", "etcd", "ca", "key"},
+}
+
+// reconcileRenderedConfig writes the TalosConfig spec and the machine configuration which would be used
+// for a new control plane machine into a ConfigMap when it's requested by the annotation.
+//
+// The rendered spec contains all config patches generated by the control plane provider, the machine
+// configuration is generated from it the same way the bootstrap provider does.
+func (r *TalosControlPlaneReconciler) reconcileRenderedConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	if _, ok := tcp.Annotations[controlplanev1.RenderConfigAnnotation]; !ok {
+		return ctrl.Result{}, nil
+	}
+
+	spec, err := renderConfigSpec(tcp, &tcp.Spec.ControlPlaneConfig.ControlPlaneConfig)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to render bootstrap configuration")
+	}
+
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	machineConfig, err := r.renderMachineConfig(ctx, cluster, tcp, spec)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to render machine configuration")
+	}
+
+	if err = validateMachineConfig(machineConfig); err != nil {
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "InvalidRenderedConfig", "Rendered machine configuration is invalid: %s", err)
+		}
+
+		// the config stays the same until the TalosControlPlane is changed, the annotation is kept to render it again
+		return ctrl.Result{}, tcpclient.Terminal(errors.Wrap(err, "rendered machine configuration is invalid"))
+	}
+
+	machineConfig, err = redactMachineConfig(machineConfig)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tcp.Name + "-rendered-config",
+			Namespace: tcp.Namespace,
+		},
+	}
+
+	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Labels = map[string]string{
+			clusterv1.ClusterLabelName:            cluster.Name,
+			controlplanev1.TalosControlPlaneLabel: tcp.Name,
+		}
+
+		configMap.Data = map[string]string{
+			renderedConfigKey:        string(data),
+			renderedMachineConfigKey: string(machineConfig),
+		}
+
+		return controllerutil.SetOwnerReference(tcp, configMap, r.Scheme)
+	}); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to write rendered bootstrap configuration")
+	}
+
+	r.Log.Info("rendered bootstrap configuration", "configMap", configMap.Name)
+
+	// the TalosControlPlane is patched at the end of the reconcile loop
+	delete(tcp.Annotations, controlplanev1.RenderConfigAnnotation)
+
+	return ctrl.Result{}, nil
+}
+
+// renderMachineConfig generates the machine configuration from the TalosConfig spec and applies the config patches,
+// the secrets are not redacted yet.
+//
+// The hostname is not set even if it's sourced from the machine name, as the name of a new machine is not known in advance.
+func (r *TalosControlPlaneReconciler) renderMachineConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, spec *cabptv1.TalosConfigSpec) ([]byte, error) {
+	data := []byte(spec.Data)
+
+	if spec.GenerateType != "none" {
+		var err error
+
+		data, err = r.generateMachineConfig(ctx, cluster, tcp, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(spec.ConfigPatches) > 0 {
+		marshalledPatches, err := json.Marshal(spec.ConfigPatches)
+		if err != nil {
+			return nil, err
+		}
+
+		patch, err := jsonpatch.DecodePatch(marshalledPatches)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode config patches")
+		}
+
+		data, err = configpatcher.JSON6902(data, patch)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to apply config patches")
+		}
+	}
+
+	return data, nil
+}
+
+// renderRuntimeMode is the runtime mode the rendered machine configuration is validated for,
+// the install section is not required as the machines might boot from the disk images.
+type renderRuntimeMode struct{}
+
+// String implements config.RuntimeMode.
+func (renderRuntimeMode) String() string {
+	return "render"
+}
+
+// RequiresInstall implements config.RuntimeMode.
+func (renderRuntimeMode) RequiresInstall() bool {
+	return false
+}
+
+// validateMachineConfig checks the machine configuration the same way Talos does before applying it.
+func validateMachineConfig(data []byte) error {
+	provider, err := configloader.NewFromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = provider.Validate(renderRuntimeMode{})
+
+	return err
+}
+
+// generateMachineConfig generates the machine configuration from the cluster secrets bundle, a new bundle is generated
+// if the bootstrap provider didn't generate it yet.
+func (r *TalosControlPlaneReconciler) generateMachineConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, spec *cabptv1.TalosConfigSpec) ([]byte, error) {
+	machineType, err := machine.ParseType(spec.GenerateType)
+	if err != nil {
+		return nil, err
+	}
+
+	if cluster.Spec.ControlPlaneEndpoint.Host == "" {
+		return nil, errors.New("control plane endpoint is not set yet")
+	}
+
+	clusterDNS := constants.DefaultDNSDomain
+	if cluster.Spec.ClusterNetwork != nil && cluster.Spec.ClusterNetwork.ServiceDomain != "" {
+		clusterDNS = cluster.Spec.ClusterNetwork.ServiceDomain
+	}
+
+	versionContract, err := talosVersionContract(spec.TalosVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	genOptions := []generate.GenOption{generate.WithDNSDomain(clusterDNS), generate.WithVersionContract(versionContract)}
+
+	bundle, _, err := r.secretsBundle(ctx, cluster)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		bundle, err = generate.NewSecretsBundle(generate.NewClock(), genOptions...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	input, err := generate.NewInput(
+		cluster.Name,
+		"https://"+cluster.Spec.ControlPlaneEndpoint.Host+":"+strconv.Itoa(int(cluster.Spec.ControlPlaneEndpoint.Port)),
+		strings.TrimPrefix(tcp.Spec.Version, "v"),
+		bundle,
+		genOptions...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := generate.Config(machineType, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if cluster.Spec.ClusterNetwork != nil && cluster.Spec.ClusterNetwork.Pods != nil {
+		cfg.ClusterConfig.ClusterNetwork.PodSubnet = cluster.Spec.ClusterNetwork.Pods.CIDRBlocks
+	}
+
+	if cluster.Spec.ClusterNetwork != nil && cluster.Spec.ClusterNetwork.Services != nil {
+		cfg.ClusterConfig.ClusterNetwork.ServiceSubnet = cluster.Spec.ClusterNetwork.Services.CIDRBlocks
+	}
+
+	data, err := cfg.String()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(data), nil
+}
+
+// talosVersionContract returns the version contract the machine configuration is generated with for the Talos version.
+func talosVersionContract(talosVersion string) (*config.VersionContract, error) {
+	if talosVersion == "" {
+		return config.TalosVersionCurrent, nil
+	}
+
+	versionContract, err := config.ParseContractFromVersion(talosVersion)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid talos-version")
+	}
+
+	return versionContract, nil
+}
+
+// maxGeneratedConfigs bounds the number of the machine configurations cached by generatedConfig.
+const maxGeneratedConfigs = 32
+
+// generatedConfigs caches the machine configurations generated by generatedConfig by the machine type
+// and the version contract, as the configuration layout depends only on them.
+var generatedConfigs = struct {
+	sync.Mutex
+
+	configs map[string][]byte
+}{configs: map[string][]byte{}}
+
+// generatedConfig returns the machine configuration generated for the generate type and the Talos version
+// with placeholder cluster secrets and endpoint.
+//
+// Only the layout of the configuration is the same as the one generated by the bootstrap provider,
+// so the configuration is cached and never applied to the machines.
+func generatedConfig(generateType, talosVersion string) ([]byte, error) {
+	// the bootstrap provider falls back to the worker configuration as well
+	machineType, err := machine.ParseType(generateType)
+	if err != nil {
+		machineType = machine.TypeWorker
+	}
+
+	versionContract, err := talosVersionContract(talosVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s/%d.%d", machineType, versionContract.Major, versionContract.Minor)
+
+	generatedConfigs.Lock()
+	data, ok := generatedConfigs.configs[key]
+	generatedConfigs.Unlock()
+
+	if ok {
+		return data, nil
+	}
+
+	genOptions := []generate.GenOption{generate.WithVersionContract(versionContract)}
+
+	bundle, err := generate.NewSecretsBundle(generate.NewClock(), genOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := generate.NewInput("cluster", "https://127.0.0.1:6443", constants.DefaultKubernetesVersion, bundle, genOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := generate.Config(machineType, input)
+	if err != nil {
+		return nil, err
+	}
+
+	generated, err := cfg.String()
+	if err != nil {
+		return nil, err
+	}
+
+	data = []byte(generated)
+
+	generatedConfigs.Lock()
+	if len(generatedConfigs.configs) < maxGeneratedConfigs {
+		generatedConfigs.configs[key] = data
+	}
+	generatedConfigs.Unlock()
+
+	return data, nil
+}
+
+// redactMachineConfig replaces the secrets in the machine configuration.
+func redactMachineConfig(data []byte) ([]byte, error) {
+	var cfg map[string]interface{}
+
+	if err := yamlv3.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse machine configuration")
+	}
+
+	for _, path := range redactedConfigPaths {
+		section := cfg
+
+		for _, key := range path[:len(path)-1] {
+			section, _ = section[key].(map[string]interface{}) //nolint:errcheck
+		}
+
+		if value, ok := section[path[len(path)-1]]; ok && value != "" {
+			section[path[len(path)-1]] = redactedValue
+		}
+	}
+
+	return yamlv3.Marshal(cfg)
+}
@@ -0,0 +1,189 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
+)
+
+// invalidMachineConfig is parsed by Talos, but it fails the validation.
+const invalidMachineConfig = `version: v1alpha1
+machine:
+  type: controlplane
+`
+
+func TestValidateMachineConfig(t *testing.T) {
+	generated, err := generatedConfig("controlplane", "")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name string
+		data string
+		err  bool
+	}{
+		{
+			name: "generated",
+			data: string(generated),
+		},
+		{
+			name: "no cluster section",
+			data: invalidMachineConfig,
+			err:  true,
+		},
+		{
+			name: "unknown version",
+			data: "version: v2alpha1\n",
+			err:  true,
+		},
+		{
+			name: "not yaml",
+			data: "machine: [",
+			err:  true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMachineConfig([]byte(tt.data))
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGeneratedConfigCache(t *testing.T) {
+	// the configs with the same layout are cached once
+	for _, talosVersion := range []string{"v0.14", "v0.14.0", "v0.14.1"} {
+		_, err := generatedConfig("controlplane", talosVersion)
+		require.NoError(t, err)
+
+		_, err = generatedConfig("unknown", talosVersion)
+		require.NoError(t, err)
+	}
+
+	generatedConfigs.Lock()
+	defer generatedConfigs.Unlock()
+
+	assert.Contains(t, generatedConfigs.configs, "controlplane/0.14")
+	assert.Contains(t, generatedConfigs.configs, "worker/0.14")
+	assert.LessOrEqual(t, len(generatedConfigs.configs), maxGeneratedConfigs)
+
+	for key := range generatedConfigs.configs {
+		assert.NotContains(t, key, "unknown")
+		assert.NotContains(t, key, "0.14.1")
+	}
+}
+
+func TestReconcileRenderedConfig(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, clusterv1.AddToScheme(scheme))
+	require.NoError(t, controlplanev1.AddToScheme(scheme))
+
+	cluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: clusterv1.ClusterSpec{
+			ControlPlaneEndpoint: clusterv1.APIEndpoint{Host: "10.5.0.1", Port: 6443},
+		},
+	}
+
+	configMapKey := client.ObjectKey{Namespace: "default", Name: "test-cp-rendered-config"}
+
+	for _, tt := range []struct {
+		name   string
+		config cabptv1.TalosConfigSpec
+		valid  bool
+	}{
+		{
+			name:   "generated",
+			config: cabptv1.TalosConfigSpec{GenerateType: "controlplane"},
+			valid:  true,
+		},
+		{
+			name:   "invalid",
+			config: cabptv1.TalosConfigSpec{GenerateType: "none", Data: invalidMachineConfig},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(1)
+
+			r := &TalosControlPlaneReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).Build(),
+				Scheme:   scheme,
+				Log:      logr.Discard(),
+				Recorder: recorder,
+			}
+
+			tcp := &controlplanev1.TalosControlPlane{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "test-cp",
+					UID:         "tcp-uid",
+					Annotations: map[string]string{controlplanev1.RenderConfigAnnotation: ""},
+				},
+				Spec: controlplanev1.TalosControlPlaneSpec{
+					Version:            "v1.22.2",
+					ControlPlaneConfig: controlplanev1.ControlPlaneConfig{ControlPlaneConfig: tt.config},
+				},
+			}
+
+			_, err := r.reconcileRenderedConfig(ctx, cluster, tcp, nil)
+
+			var configMap corev1.ConfigMap
+
+			getErr := r.Client.Get(ctx, configMapKey, &configMap)
+
+			if !tt.valid {
+				require.Error(t, err)
+				assert.True(t, tcpclient.IsTerminal(err))
+
+				// the invalid configuration is not written, and it's rendered again once the TalosControlPlane is fixed
+				assert.True(t, apierrors.IsNotFound(getErr))
+				assert.Contains(t, tcp.Annotations, controlplanev1.RenderConfigAnnotation)
+
+				require.Len(t, recorder.Events, 1)
+				assert.Contains(t, <-recorder.Events, "InvalidRenderedConfig")
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, getErr)
+
+			assert.NotContains(t, tcp.Annotations, controlplanev1.RenderConfigAnnotation)
+			assert.Empty(t, recorder.Events)
+
+			machineConfig := configMap.Data[renderedMachineConfigKey]
+
+			assert.Contains(t, machineConfig, "https://10.5.0.1:6443")
+			assert.Contains(t, machineConfig, redactedValue)
+		})
+	}
+}
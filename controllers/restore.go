@@ -0,0 +1,517 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	talosconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/generate"
+	machinetype "github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/machine"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/storage/names"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const (
+	// etcdBackupVerificationTimeout is the default timeout of a single etcd backup verification.
+	etcdBackupVerificationTimeout = 30 * time.Minute
+
+	// etcdBackupVerificationPollInterval is the interval the progress of the verification is checked at.
+	etcdBackupVerificationPollInterval = 30 * time.Second
+
+	// etcdBackupVerificationEndpoint is the Kubernetes API endpoint of the verification machine,
+	// it is only used by the machine itself.
+	etcdBackupVerificationEndpoint = "https://127.0.0.1:6443"
+)
+
+// errEtcdBackupNotRestorable is the verification failure caused by the backup itself.
+type errEtcdBackupNotRestorable struct {
+	reason string
+}
+
+func (e *errEtcdBackupNotRestorable) Error() string {
+	return e.reason
+}
+
+// reconcileEtcdBackupVerification restores the last uploaded etcd backup on a temporary single-node machine
+// on the configured interval, and reports whether the backup is restorable with the EtcdBackupRestorable condition.
+//
+// The machine is cloned from the verification infrastructure template and boots with a standalone Talos configuration
+// generated for the verification, so it never joins the cluster. Once Talos API is up, the backup is uploaded
+// to the machine and etcd is bootstrapped from it. The backup is restorable if etcd becomes healthy.
+// The machine is deleted once the verification completes or times out.
+func (r *TalosControlPlaneReconciler) reconcileEtcdBackupVerification(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	backup := tcp.Spec.EtcdBackup
+	if backup == nil || backup.Verification == nil {
+		if tcp.Status.EtcdBackup != nil && tcp.Status.EtcdBackup.Verification != nil {
+			if err := r.cleanupEtcdBackupVerification(ctx, cluster, tcp); err != nil {
+				return ctrl.Result{}, err
+			}
+
+			tcp.Status.EtcdBackup.Verification = nil
+		}
+
+		conditions.Delete(tcp, controlplanev1.EtcdBackupRestorableCondition)
+
+		return ctrl.Result{}, nil
+	}
+
+	if !tcp.Status.Bootstrapped || tcp.Status.EtcdBackup == nil {
+		return ctrl.Result{}, nil
+	}
+
+	if tcp.Status.EtcdBackup.Verification == nil {
+		tcp.Status.EtcdBackup.Verification = &controlplanev1.EtcdBackupVerificationStatus{}
+	}
+
+	verification := tcp.Status.EtcdBackup.Verification
+
+	if verification.LastCompletionTime == nil {
+		conditions.MarkFalse(tcp, controlplanev1.EtcdBackupRestorableCondition, controlplanev1.EtcdBackupNotVerifiedReason,
+			clusterv1.ConditionSeverityInfo, "no etcd backup has been verified yet")
+	}
+
+	if verification.Machine != "" {
+		return r.checkEtcdBackupVerification(ctx, cluster, tcp)
+	}
+
+	object := tcp.Status.EtcdBackup.LastObject
+	if object == "" || object == verification.LastObject {
+		// the status update of the next backup triggers the reconcile
+		return ctrl.Result{}, nil
+	}
+
+	if verification.LastCompletionTime != nil {
+		if next := verification.LastCompletionTime.Add(backup.Verification.Interval.Duration); time.Now().Before(next) {
+			return ctrl.Result{RequeueAfter: time.Until(next)}, nil
+		}
+	}
+
+	if r.dryRun(tcp, "verifying etcd backup %q on a temporary machine", object) {
+		return ctrl.Result{RequeueAfter: backup.Verification.Interval.Duration}, nil
+	}
+
+	return r.startEtcdBackupVerification(ctx, cluster, tcp, object)
+}
+
+// startEtcdBackupVerification creates the temporary machine with the bootstrap data secret holding the generated
+// machine configuration and the talosconfig to access the machine.
+func (r *TalosControlPlaneReconciler) startEtcdBackupVerification(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, object string) (ctrl.Result, error) {
+	// leftovers of the interrupted verifications are not reused
+	if err := r.cleanupEtcdBackupVerification(ctx, cluster, tcp); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	name := names.SimpleNameGenerator.GenerateName(etcdBackupVerificationName(cluster.Name) + "-")
+
+	machineConfig, talosconfigData, err := etcdBackupVerificationConfig(name, tcp.Spec.Version)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to generate etcd backup verification machine config")
+	}
+
+	labels := map[string]string{
+		clusterv1.ClusterLabelName:                 cluster.Name,
+		controlplanev1.EtcdBackupVerificationLabel: tcp.Name,
+		controlplanev1.TalosControlPlaneLabel:      tcp.Name,
+	}
+
+	owner := metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane"))
+
+	if err = r.Client.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       tcp.Namespace,
+			Name:            name,
+			Labels:          labels,
+			OwnerReferences: []metav1.OwnerReference{*owner},
+		},
+		Data: map[string][]byte{
+			"value":              machineConfig,
+			talosconfigSecretKey: talosconfigData,
+		},
+	}); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to create etcd backup verification secret")
+	}
+
+	infraRef, err := external.CloneTemplate(ctx, &external.CloneTemplateInput{
+		Client:      r.Client,
+		TemplateRef: &tcp.Spec.EtcdBackup.Verification.InfrastructureTemplate,
+		Namespace:   tcp.Namespace,
+		OwnerRef: &metav1.OwnerReference{
+			APIVersion: controlplanev1.GroupVersion.String(),
+			Kind:       "TalosControlPlane",
+			Name:       tcp.Name,
+			UID:        tcp.UID,
+		},
+		ClusterName: cluster.Name,
+		Labels:      labels,
+	})
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to clone etcd backup verification infrastructure template")
+	}
+
+	version := tcp.Spec.Version
+
+	if err = r.Client.Create(ctx, &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       tcp.Namespace,
+			Name:            name,
+			Labels:          labels,
+			OwnerReferences: []metav1.OwnerReference{*owner},
+		},
+		Spec: clusterv1.MachineSpec{
+			ClusterName:       cluster.Name,
+			Version:           &version,
+			InfrastructureRef: *infraRef,
+			Bootstrap: clusterv1.Bootstrap{
+				DataSecretName: &name,
+			},
+		},
+	}); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "Failed to create etcd backup verification machine")
+	}
+
+	now := metav1.Now()
+
+	verification := tcp.Status.EtcdBackup.Verification
+	verification.Machine = name
+	verification.Object = object
+	verification.StartTime = &now
+	verification.Restored = false
+
+	r.Log.Info("started etcd backup verification", "machine", name, "object", object)
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "EtcdBackupVerificationStarted", "Verifying etcd backup %s on machine %q", object, name)
+	}
+
+	return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+}
+
+// checkEtcdBackupVerification advances the verification in progress: the backup is restored once the machine
+// is reachable, and the verification completes once etcd is healthy.
+//
+// Errors are retried until the timeout, as the machine might be still booting.
+func (r *TalosControlPlaneReconciler) checkEtcdBackupVerification(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane) (ctrl.Result, error) {
+	verification := tcp.Status.EtcdBackup.Verification
+
+	timeout := etcdBackupVerificationTimeout
+	if tcp.Spec.EtcdBackup.Verification.Timeout != nil {
+		timeout = tcp.Spec.EtcdBackup.Verification.Timeout.Duration
+	}
+
+	if verification.StartTime != nil && time.Since(verification.StartTime.Time) > timeout {
+		if verification.Restored {
+			return r.completeEtcdBackupVerification(ctx, cluster, tcp,
+				&errEtcdBackupNotRestorable{reason: fmt.Sprintf("etcd didn't become healthy with the restored backup within %s", timeout)})
+		}
+
+		return r.completeEtcdBackupVerification(ctx, cluster, tcp, fmt.Errorf("machine %q didn't accept the backup within %s", verification.Machine, timeout))
+	}
+
+	// the machine was created recently, so it's read bypassing the cache
+	var machine clusterv1.Machine
+
+	if err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: verification.Machine}, &machine); err != nil {
+		if apierrors.IsNotFound(err) {
+			return r.completeEtcdBackupVerification(ctx, cluster, tcp, fmt.Errorf("machine %q was deleted", verification.Machine))
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	discovered, err := r.discoverAddresses(ctx, tcp, []clusterv1.Machine{machine})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(discovered[machine.Name]) == 0 {
+		r.Log.Info("waiting for etcd backup verification machine addresses", "machine", machine.Name)
+
+		return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+	}
+
+	c, err := r.etcdBackupVerificationClient(ctx, tcp, machine.Name, discovered[machine.Name])
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	if !verification.Restored {
+		// the backup is only downloaded once Talos API is up
+		if _, err = c.Version(ctx); err != nil {
+			r.Log.Info("waiting for etcd backup verification machine to boot", "machine", machine.Name, "error", err)
+
+			return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+		}
+
+		if err = r.restoreEtcdBackup(ctx, c, tcp, verification.Object); err != nil {
+			var notRestorable *errEtcdBackupNotRestorable
+
+			if errors.As(err, &notRestorable) {
+				return r.completeEtcdBackupVerification(ctx, cluster, tcp, err)
+			}
+
+			r.Log.Info("failed to restore etcd backup on verification machine", "machine", machine.Name, "error", err)
+
+			return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+		}
+
+		r.Log.Info("restored etcd backup on verification machine", "machine", machine.Name, "object", verification.Object)
+
+		verification.Restored = true
+
+		return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+	}
+
+	if err = restoredEtcdHealthcheck(ctx, c); err != nil {
+		r.Log.Info("waiting for etcd to start from the restored backup", "machine", machine.Name, "error", err)
+
+		return ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}, nil
+	}
+
+	return r.completeEtcdBackupVerification(ctx, cluster, tcp, nil)
+}
+
+// restoreEtcdBackup downloads the backup, uploads it to the verification machine and bootstraps etcd from it.
+func (r *TalosControlPlaneReconciler) restoreEtcdBackup(ctx context.Context, c *talosclient.Client, tcp *controlplanev1.TalosControlPlane, object string) error {
+	storage, err := r.etcdBackupStorage(ctx, tcp)
+	if err != nil {
+		return err
+	}
+
+	data, err := storage.GetObject(ctx, tcp.Spec.EtcdBackup.S3.Bucket, object)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to download etcd backup %s/%s", tcp.Spec.EtcdBackup.S3.Bucket, object)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return &errEtcdBackupNotRestorable{reason: fmt.Sprintf("backup is not gzip-compressed: %s", err)}
+	}
+
+	snapshot, err := io.ReadAll(gz)
+	if err != nil {
+		return &errEtcdBackupNotRestorable{reason: fmt.Sprintf("failed to decompress backup: %s", err)}
+	}
+
+	if _, err = c.EtcdRecover(ctx, bytes.NewReader(snapshot)); err != nil {
+		return errors.Wrap(err, "Failed to upload etcd backup")
+	}
+
+	if err = c.Bootstrap(ctx, &machineapi.BootstrapRequest{RecoverEtcd: true}); err != nil {
+		// etcd was bootstrapped by the previous attempt
+		if status.Code(err) != codes.AlreadyExists {
+			return errors.Wrap(err, "Failed to bootstrap etcd from the backup")
+		}
+	}
+
+	return nil
+}
+
+// restoredEtcdHealthcheck checks that etcd is healthy and runs as a single member cluster.
+func restoredEtcdHealthcheck(ctx context.Context, c *talosclient.Client) error {
+	svcs, err := c.ServiceInfo(ctx, "etcd")
+	if err != nil {
+		return err
+	}
+
+	if len(svcs) == 0 || !svcs[0].Service.GetHealth().GetHealthy() {
+		return fmt.Errorf("etcd service is not healthy")
+	}
+
+	resp, err := c.EtcdMemberList(ctx, &machineapi.EtcdMemberListRequest{})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range resp.Messages {
+		if len(message.Members) != 1 {
+			return fmt.Errorf("expected a single etcd member, got %d", len(message.Members))
+		}
+	}
+
+	return nil
+}
+
+// completeEtcdBackupVerification deletes the verification machine and records the result.
+func (r *TalosControlPlaneReconciler) completeEtcdBackupVerification(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, verifyErr error) (ctrl.Result, error) {
+	if err := r.cleanupEtcdBackupVerification(ctx, cluster, tcp); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	verification := tcp.Status.EtcdBackup.Verification
+	object := verification.Object
+	now := metav1.Now()
+
+	verification.Machine = ""
+	verification.Object = ""
+	verification.StartTime = nil
+	verification.Restored = false
+	verification.LastCompletionTime = &now
+
+	var notRestorable *errEtcdBackupNotRestorable
+
+	switch {
+	case verifyErr == nil:
+		verification.LastObject = object
+		verification.LastError = ""
+
+		r.Log.Info("etcd backup is restorable", "object", object)
+
+		conditions.MarkTrue(tcp, controlplanev1.EtcdBackupRestorableCondition)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "EtcdBackupVerified", "Restored etcd backup %s on a temporary machine", object)
+		}
+	case errors.As(verifyErr, &notRestorable):
+		verification.LastObject = object
+		verification.LastError = verifyErr.Error()
+
+		r.Log.Info("etcd backup is not restorable", "object", object, "error", verifyErr)
+
+		conditions.MarkFalse(tcp, controlplanev1.EtcdBackupRestorableCondition, controlplanev1.EtcdBackupNotRestorableReason,
+			clusterv1.ConditionSeverityError, "etcd backup %s is not restorable: %s", object, verifyErr)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdBackupNotRestorable", "Etcd backup %s is not restorable: %s", object, verifyErr)
+		}
+	default:
+		// the backup itself is retried after the interval
+		verification.LastError = verifyErr.Error()
+
+		r.Log.Info("etcd backup verification failed", "object", object, "error", verifyErr)
+
+		conditions.MarkFalse(tcp, controlplanev1.EtcdBackupRestorableCondition, controlplanev1.EtcdBackupVerificationFailedReason,
+			clusterv1.ConditionSeverityWarning, "failed to verify etcd backup %s: %s", object, verifyErr)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdBackupVerificationFailed", "Failed to verify etcd backup %s: %s", object, verifyErr)
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: tcp.Spec.EtcdBackup.Verification.Interval.Duration}, nil
+}
+
+// cleanupEtcdBackupVerification deletes the verification machines of the TalosControlPlane and their secrets.
+func (r *TalosControlPlaneReconciler) cleanupEtcdBackupVerification(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane) error {
+	selector := client.MatchingLabels{
+		clusterv1.ClusterLabelName:                 cluster.Name,
+		controlplanev1.EtcdBackupVerificationLabel: tcp.Name,
+	}
+
+	var machines clusterv1.MachineList
+
+	if err := r.Client.List(ctx, &machines, client.InNamespace(tcp.Namespace), selector); err != nil {
+		return err
+	}
+
+	for i := range machines.Items {
+		if !machines.Items[i].ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		r.Log.Info("deleting etcd backup verification machine", "machine", machines.Items[i].Name)
+
+		if err := r.Client.Delete(ctx, &machines.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	var secrets corev1.SecretList
+
+	if err := r.Client.List(ctx, &secrets, client.InNamespace(tcp.Namespace), selector); err != nil {
+		return err
+	}
+
+	for i := range secrets.Items {
+		if err := r.Client.Delete(ctx, &secrets.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// etcdBackupVerificationName is the prefix of the verification machine names.
+func etcdBackupVerificationName(clusterName string) string {
+	return clusterName + "-etcd-backup-verification"
+}
+
+// etcdBackupVerificationClient returns the Talos client of the verification machine using the generated talosconfig.
+func (r *TalosControlPlaneReconciler) etcdBackupVerificationClient(ctx context.Context, tcp *controlplanev1.TalosControlPlane, name string, addresses []string) (*talosclient.Client, error) {
+	var s corev1.Secret
+
+	if err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: tcp.Namespace, Name: name}, &s); err != nil {
+		return nil, errors.Wrap(err, "Failed to get etcd backup verification secret")
+	}
+
+	t, err := talosconfig.FromBytes(s.Data[talosconfigSecretKey])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse etcd backup verification talosconfig")
+	}
+
+	return talosclient.New(ctx, talosclient.WithEndpoints(addresses...), talosclient.WithConfig(t))
+}
+
+// etcdBackupVerificationConfig generates the machine configuration of a standalone single-node Talos cluster
+// with its own secrets, and the talosconfig to access it.
+//
+// CNI is disabled, so that the workloads of the restored cluster don't start on the machine.
+func etcdBackupVerificationConfig(clusterName, version string) (machineConfig, talosconfigData []byte, err error) {
+	secrets, err := generate.NewSecretsBundle(generate.NewClock())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	input, err := generate.NewInput(clusterName, etcdBackupVerificationEndpoint, strings.TrimPrefix(version, "v"), secrets,
+		generate.WithClusterCNIConfig(&v1alpha1.CNIConfig{CNIName: constants.NoneCNI}),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := generate.Config(machinetype.TypeControlPlane, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if machineConfig, err = cfg.Bytes(); err != nil {
+		return nil, nil, err
+	}
+
+	t, err := generate.Talosconfig(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if talosconfigData, err = t.Bytes(); err != nil {
+		return nil, nil, err
+	}
+
+	return machineConfig, talosconfigData, nil
+}
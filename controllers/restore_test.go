@@ -0,0 +1,283 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestEtcdBackupVerificationConfig(t *testing.T) {
+	name := etcdBackupVerificationName("test")
+	assert.Equal(t, "test-etcd-backup-verification", name)
+
+	machineConfig, talosconfigData, err := etcdBackupVerificationConfig(name, "v1.22.2")
+	require.NoError(t, err)
+
+	require.NoError(t, validateMachineConfig(machineConfig))
+
+	var config struct {
+		Machine struct {
+			Type string `yaml:"type"`
+		} `yaml:"machine"`
+		Cluster struct {
+			Network struct {
+				CNI struct {
+					Name string `yaml:"name"`
+				} `yaml:"cni"`
+			} `yaml:"network"`
+		} `yaml:"cluster"`
+	}
+
+	require.NoError(t, yaml.Unmarshal(machineConfig, &config))
+
+	assert.Equal(t, "controlplane", config.Machine.Type)
+	// the restored etcd is checked without any workloads
+	assert.Equal(t, "none", config.Cluster.Network.CNI.Name)
+
+	var talosconfig struct {
+		Context  string                 `yaml:"context"`
+		Contexts map[string]interface{} `yaml:"contexts"`
+	}
+
+	require.NoError(t, yaml.Unmarshal(talosconfigData, &talosconfig))
+
+	assert.Equal(t, name, talosconfig.Context)
+	assert.Contains(t, talosconfig.Contexts, name)
+}
+
+var _ = Describe("Etcd backup verification", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		recorder  *record.FakeRecorder
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+	)
+
+	const interval = time.Hour
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+		recorder = record.NewFakeRecorder(8)
+
+		r = &TalosControlPlaneReconciler{
+			Client:    k8sClient,
+			APIReader: k8sClient,
+			Log:       logr.Discard(),
+			Scheme:    scheme.Scheme,
+			Recorder:  recorder,
+		}
+
+		cluster = &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"}}
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp"},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				Version: "v1.22.2",
+				// the verification machines never get any addresses
+				AddressSources: []controlplanev1.AddressSourceName{controlplanev1.AnnotationAddressSource},
+				EtcdBackup: &controlplanev1.EtcdBackup{
+					Verification: &controlplanev1.EtcdBackupVerification{
+						Interval: metav1.Duration{Duration: interval},
+					},
+				},
+			},
+			Status: controlplanev1.TalosControlPlaneStatus{
+				Bootstrapped: true,
+				EtcdBackup: &controlplanev1.EtcdBackupStatus{
+					LastObject: "backup-2",
+				},
+			},
+		}
+	})
+
+	// newVerificationMachine creates the verification machine of the backup and its secret.
+	newVerificationMachine := func(name string) {
+		verificationLabels := map[string]string{
+			clusterv1.ClusterLabelName:                 "test",
+			controlplanev1.EtcdBackupVerificationLabel: "test-cp",
+		}
+
+		machine := newTestMachine(ctx, namespace, name, nil)
+		machine.Labels = verificationLabels
+		Expect(k8sClient.Update(ctx, machine)).To(Succeed())
+
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: verificationLabels},
+		})).To(Succeed())
+
+		now := metav1.Now()
+
+		tcp.Status.EtcdBackup.Verification = &controlplanev1.EtcdBackupVerificationStatus{
+			Machine:   name,
+			Object:    "backup-2",
+			StartTime: &now,
+		}
+	}
+
+	expectCleanedUp := func() {
+		var machines clusterv1.MachineList
+
+		Expect(k8sClient.List(ctx, &machines, client.InNamespace(namespace))).To(Succeed())
+		Expect(machines.Items).To(BeEmpty())
+
+		var secrets corev1.SecretList
+
+		Expect(k8sClient.List(ctx, &secrets, client.InNamespace(namespace),
+			client.HasLabels{controlplanev1.EtcdBackupVerificationLabel})).To(Succeed())
+		Expect(secrets.Items).To(BeEmpty())
+	}
+
+	It("reports the backup as not verified before the first verification", func() {
+		tcp.Status.EtcdBackup.LastObject = ""
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(conditions.GetReason(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(Equal(controlplanev1.EtcdBackupNotVerifiedReason))
+	})
+
+	It("verifies each backup once", func() {
+		now := metav1.Now()
+
+		tcp.Status.EtcdBackup.Verification = &controlplanev1.EtcdBackupVerificationStatus{
+			LastCompletionTime: &now,
+			LastObject:         "backup-2",
+		}
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+
+	It("waits for the interval before verifying the next backup", func() {
+		completed := metav1.NewTime(time.Now().Add(-interval / 2))
+
+		tcp.Status.EtcdBackup.Verification = &controlplanev1.EtcdBackupVerificationStatus{
+			LastCompletionTime: &completed,
+			LastObject:         "backup-1",
+		}
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically("~", interval/2, time.Minute))
+	})
+
+	It("skips the verification in the dry run", func() {
+		r.DryRun = true
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: interval}))
+
+		Expect(tcp.Status.EtcdBackup.Verification.Machine).To(BeEmpty())
+		Expect(recorder.Events).To(Receive(ContainSubstring("DryRun")))
+	})
+
+	It("waits for the addresses of the verification machine", func() {
+		newVerificationMachine("test-etcd-backup-verification-1")
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: etcdBackupVerificationPollInterval}))
+
+		Expect(tcp.Status.EtcdBackup.Verification.Machine).To(Equal("test-etcd-backup-verification-1"))
+	})
+
+	It("retries the backup once the verification machine is deleted", func() {
+		tcp.Status.EtcdBackup.Verification = &controlplanev1.EtcdBackupVerificationStatus{
+			Machine:    "test-etcd-backup-verification-1",
+			Object:     "backup-2",
+			LastObject: "backup-1",
+		}
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: interval}))
+
+		verification := tcp.Status.EtcdBackup.Verification
+		Expect(verification.Machine).To(BeEmpty())
+		Expect(verification.LastCompletionTime).NotTo(BeNil())
+		Expect(verification.LastObject).To(Equal("backup-1"))
+		Expect(verification.LastError).To(ContainSubstring("was deleted"))
+
+		Expect(conditions.GetReason(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(Equal(controlplanev1.EtcdBackupVerificationFailedReason))
+		Expect(recorder.Events).To(Receive(ContainSubstring("EtcdBackupVerificationFailed")))
+	})
+
+	It("reports the backup as not restorable when etcd doesn't become healthy in time", func() {
+		newVerificationMachine("test-etcd-backup-verification-1")
+
+		started := metav1.NewTime(time.Now().Add(-time.Hour))
+		tcp.Spec.EtcdBackup.Verification.Timeout = &metav1.Duration{Duration: 10 * time.Minute}
+		tcp.Status.EtcdBackup.Verification.StartTime = &started
+		tcp.Status.EtcdBackup.Verification.Restored = true
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: interval}))
+
+		Expect(tcp.Status.EtcdBackup.Verification.LastObject).To(Equal("backup-2"))
+		Expect(conditions.IsFalse(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(BeTrue())
+		Expect(conditions.GetReason(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(Equal(controlplanev1.EtcdBackupNotRestorableReason))
+		Expect(recorder.Events).To(Receive(ContainSubstring("EtcdBackupNotRestorable")))
+
+		expectCleanedUp()
+	})
+
+	It("reports the backup as restorable", func() {
+		newVerificationMachine("test-etcd-backup-verification-1")
+
+		result, err := r.completeEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: interval}))
+
+		verification := tcp.Status.EtcdBackup.Verification
+		Expect(verification.LastObject).To(Equal("backup-2"))
+		Expect(verification.LastError).To(BeEmpty())
+		Expect(conditions.IsTrue(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(BeTrue())
+		Expect(recorder.Events).To(Receive(ContainSubstring("EtcdBackupVerified")))
+
+		expectCleanedUp()
+	})
+
+	It("cleans up once the verification is disabled", func() {
+		newVerificationMachine("test-etcd-backup-verification-1")
+		conditions.MarkTrue(tcp, controlplanev1.EtcdBackupRestorableCondition)
+
+		tcp.Spec.EtcdBackup.Verification = nil
+
+		result, err := r.reconcileEtcdBackupVerification(ctx, cluster, tcp, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(tcp.Status.EtcdBackup.Verification).To(BeNil())
+		Expect(conditions.Has(tcp, controlplanev1.EtcdBackupRestorableCondition)).To(BeFalse())
+
+		expectCleanedUp()
+	})
+})
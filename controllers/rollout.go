@@ -0,0 +1,365 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// configHashes are the short hashes of the rendered control plane machine configuration.
+type configHashes struct {
+	// full covers the whole machine configuration, the machines without the StaticPodConfigHashAnnotation
+	// were created before the static pod configuration was tracked separately and are compared by it.
+	full string
+	// machine covers the machine configuration except for the static pod configuration.
+	machine string
+	// staticPods covers the static pod configuration, which is applied without replacing the machines.
+	staticPods string
+}
+
+// configHash returns a short hash of the rendered control plane machine configuration.
+//
+// Manifests, install and etcd configuration are left out, as changes are applied without replacing the machines.
+func configHash(tcp *controlplanev1.TalosControlPlane) (string, error) {
+	hashes, err := machineConfigHashes(tcp)
+
+	return hashes.full, err
+}
+
+// machineConfigHashes returns the hashes of the rendered control plane machine configuration,
+// the static pod configuration patches are hashed separately.
+func machineConfigHashes(tcp *controlplanev1.TalosControlPlane) (configHashes, error) {
+	tcp = tcp.DeepCopy()
+	tcp.Spec.ControlPlaneConfig.ExtraManifests = nil
+	tcp.Spec.ControlPlaneConfig.InlineManifests = nil
+	tcp.Spec.Install = nil
+	tcp.Spec.Etcd = nil
+
+	spec, err := renderConfigSpec(tcp, &tcp.Spec.ControlPlaneConfig.ControlPlaneConfig)
+	if err != nil {
+		return configHashes{}, err
+	}
+
+	var hashes configHashes
+
+	if hashes.full, err = shortHash(spec); err != nil {
+		return configHashes{}, err
+	}
+
+	machinePatches, staticPodPatches := splitStaticPodPatches(spec.ConfigPatches)
+
+	spec.ConfigPatches = machinePatches
+
+	if hashes.machine, err = shortHash(spec); err != nil {
+		return configHashes{}, err
+	}
+
+	if hashes.staticPods, err = shortHash(staticPodPatches); err != nil {
+		return configHashes{}, err
+	}
+
+	return hashes, nil
+}
+
+// shortHash returns a short hash of the JSON representation of the value.
+func shortHash(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])[:10], nil
+}
+
+// machineChanges describes the differences between the machine and the TalosControlPlane spec.
+//
+// Machines created before the config hash was recorded are not compared by the machine configuration.
+// The static pod configuration is applied in place, so it's not compared for the machines which track it separately.
+func (r *TalosControlPlaneReconciler) machineChanges(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine, hashes configHashes) ([]string, error) {
+	changes := []string{}
+
+	if machine.Spec.Version != nil && *machine.Spec.Version != tcp.Spec.Version {
+		changes = append(changes, fmt.Sprintf("version %s -> %s", *machine.Spec.Version, tcp.Spec.Version))
+	}
+
+	infraMachine, err := external.Get(ctx, r.Client, &machine.Spec.InfrastructureRef, machine.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if clonedFrom, ok := infraMachine.GetAnnotations()[clusterv1.TemplateClonedFromNameAnnotation]; ok && clonedFrom != tcp.Spec.InfrastructureTemplate.Name {
+		changes = append(changes, fmt.Sprintf("infrastructure template %s -> %s", clonedFrom, tcp.Spec.InfrastructureTemplate.Name))
+	}
+
+	hash := hashes.full
+	if _, ok := machine.Annotations[controlplanev1.StaticPodConfigHashAnnotation]; ok {
+		hash = hashes.machine
+	}
+
+	if machineHash, ok := machine.Annotations[controlplanev1.ConfigHashAnnotation]; ok && machineHash != hash {
+		changes = append(changes, fmt.Sprintf("config hash %s -> %s", machineHash, hash))
+	}
+
+	if rolloutAfter := tcp.Spec.RolloutAfter; rolloutAfter != nil && rolloutAfter.Time.Before(time.Now()) && machine.CreationTimestamp.Before(rolloutAfter) {
+		changes = append(changes, fmt.Sprintf("rolloutAfter %s", rolloutAfter.Format(time.RFC3339)))
+	}
+
+	if expiry, ok := certificatesExpiring(tcp, machine); ok {
+		changes = append(changes, fmt.Sprintf("certificates expire at %s", expiry.Format(time.RFC3339)))
+	}
+
+	return changes, nil
+}
+
+// reconcileRolloutStatus detects the machines which don't match the TalosControlPlane spec anymore
+// and publishes a short summary of the changes, so that operators know why machines get replaced.
+func (r *TalosControlPlaneReconciler) reconcileRolloutStatus(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	hashes, err := machineConfigHashes(tcp)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var outdated, updated int32
+
+	reasons := map[string]struct{}{}
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		changes, err := r.machineChanges(ctx, tcp, &machine, hashes)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if len(changes) == 0 {
+			updated++
+
+			continue
+		}
+
+		outdated++
+
+		for _, change := range changes {
+			reasons[change] = struct{}{}
+		}
+	}
+
+	tcp.Status.UpdatedReplicas = updated
+
+	var res ctrl.Result
+
+	// reconcile once the forced rollout is due
+	if rolloutAfter := tcp.Spec.RolloutAfter; rolloutAfter != nil && time.Now().Before(rolloutAfter.Time) {
+		res.RequeueAfter = time.Until(rolloutAfter.Time)
+	}
+
+	if outdated == 0 {
+		if rollout := tcp.Status.Rollout; rollout != nil && rollout.StartTime != nil {
+			duration := time.Since(rollout.StartTime.Time)
+
+			r.Log.Info("control plane rollout finished", "duration", duration)
+
+			clusterRolloutDuration.WithLabelValues(tcp.Namespace, cluster.Name).Set(duration.Seconds())
+		}
+
+		tcp.Status.Rollout = nil
+
+		return res, nil
+	}
+
+	summary := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		summary = append(summary, reason)
+	}
+
+	sort.Strings(summary)
+
+	reason := strings.Join(summary, ", ")
+
+	startTime := metav1.Now()
+	if tcp.Status.Rollout != nil && tcp.Status.Rollout.StartTime != nil {
+		startTime = *tcp.Status.Rollout.StartTime
+	}
+
+	if tcp.Status.Rollout == nil || tcp.Status.Rollout.Reason != reason {
+		r.Log.Info("control plane machines are outdated", "reason", reason, "outdated", outdated)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "RolloutRequired", "%d machine(s) are outdated: %s", outdated, reason)
+		}
+	}
+
+	tcp.Status.Rollout = &controlplanev1.RolloutStatus{
+		Reason:           reason,
+		OutdatedReplicas: outdated,
+		StartTime:        &startTime,
+	}
+
+	return res, nil
+}
+
+// scaleUpVersion returns the version of the machines created on scale up.
+//
+// By default (UpgradeFirst), the new machines get the desired version. With ScaleFirst ordering, machines
+// added while the version change is pending get the version of the existing machines, so that the version
+// and replicas changes are not interleaved.
+func scaleUpVersion(tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) string {
+	// with OnDelete, new machines usually replace the machines deleted to apply the changes
+	if tcp.Spec.ChangeOrdering != controlplanev1.ScaleFirst || rolloutStrategyType(tcp) == controlplanev1.OnDeleteStrategyType {
+		return tcp.Spec.Version
+	}
+
+	version := ""
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Spec.Version == nil {
+			continue
+		}
+
+		if version != "" && *machine.Spec.Version != version {
+			// machines already run different versions, nothing to keep
+			return tcp.Spec.Version
+		}
+
+		version = *machine.Spec.Version
+	}
+
+	if version == "" {
+		return tcp.Spec.Version
+	}
+
+	return version
+}
+
+// rolloutStrategyType returns the rollout strategy type, defaulting to RollingUpdate.
+func rolloutStrategyType(tcp *controlplanev1.TalosControlPlane) controlplanev1.RolloutStrategyType {
+	if tcp.Spec.RolloutStrategy == nil || tcp.Spec.RolloutStrategy.Type == "" {
+		return controlplanev1.RollingUpdateStrategyType
+	}
+
+	return tcp.Spec.RolloutStrategy.Type
+}
+
+// maxSurge returns the number of machines which can be created above the desired replicas during the rollout.
+func maxSurge(tcp *controlplanev1.TalosControlPlane) int {
+	if tcp.Spec.RolloutStrategy == nil || tcp.Spec.RolloutStrategy.RollingUpdate == nil || tcp.Spec.RolloutStrategy.RollingUpdate.MaxSurge == nil {
+		return 1
+	}
+
+	return tcp.Spec.RolloutStrategy.RollingUpdate.MaxSurge.IntValue()
+}
+
+// outdatedMachines returns the machines which should be replaced by the rollout.
+//
+// Machines excluded from scale down are never replaced.
+func (r *TalosControlPlaneReconciler) outdatedMachines(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) ([]clusterv1.Machine, error) {
+	hashes, err := machineConfigHashes(tcp)
+	if err != nil {
+		return nil, err
+	}
+
+	var outdated []clusterv1.Machine
+
+	for _, machine := range machines {
+		machine := machine
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if _, ok := machine.Annotations[controlplanev1.ScaleDownDisabledAnnotation]; ok {
+			continue
+		}
+
+		changes, err := r.machineChanges(ctx, tcp, &machine, hashes)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(changes) > 0 {
+			outdated = append(outdated, machine)
+		}
+	}
+
+	return outdated, nil
+}
+
+// rolloutControlPlane replaces a single outdated machine.
+//
+// With surge, the new machine is created first and the outdated machine is removed by scaling down afterwards.
+// Without surge, the outdated machine is removed first and the replacement is created by scaling up.
+func (r *TalosControlPlaneReconciler) rolloutControlPlane(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, controlPlane *ControlPlane, machines, outdated []clusterv1.Machine) (ctrl.Result, error) {
+	conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.RollingUpdateReason, clusterv1.ConditionSeverityWarning,
+		"Rolling out %d outdated machine(s)", len(outdated))
+
+	if err := r.ensureNodesBooted(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for all nodes to finish boot sequence", "error", err)
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	if !conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) {
+		r.Log.Info("waiting for etcd to become healthy before rolling out")
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	if err := r.leadersCheck(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for the controller manager and scheduler leaders before rolling out", "error", err)
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// single machine control plane can't be scaled down to zero
+	if maxSurge(tcp) > 0 || len(machines) == 1 {
+		r.Log.Info("creating control plane machine to replace outdated machines", "outdated", len(outdated))
+
+		return r.bootControlPlane(ctx, cluster, tcp, controlPlane, tcp.Spec.Version, false)
+	}
+
+	r.Log.Info("deleting outdated control plane machine before creating its replacement", "outdated", len(outdated))
+
+	res, err := r.scaleDownControlPlane(ctx, tcp, util.ObjectKey(cluster), tcp.Name, machines, outdated)
+	if err != nil && (res.Requeue || res.RequeueAfter > 0) {
+		r.Log.Info("failed to delete outdated control plane machine", "error", err)
+
+		return res, nil
+	}
+
+	return res, err
+}
+
+func containsMachine(machines []clusterv1.Machine, name string) bool {
+	for _, machine := range machines {
+		if machine.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
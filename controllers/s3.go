@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Timeout is the timeout to upload or download a single object.
+const s3Timeout = 5 * time.Minute
+
+// s3Client uploads and downloads objects to S3-compatible storage, requests are signed with AWS Signature Version 4.
+//
+// Objects are addressed path-style, which is supported by AWS S3, MinIO and the GCS XML API.
+type s3Client struct {
+	endpoint        *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+func newS3Client(endpoint, region, accessKeyID, secretAccessKey string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported endpoint scheme %q", u.Scheme)
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Client{
+		endpoint:        u,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+	}, nil
+}
+
+// PutObject uploads the object to the bucket.
+func (c *s3Client) PutObject(ctx context.Context, bucket, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+
+	path := strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(bucket) + "/" + s3Escape(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint.Scheme+"://"+c.endpoint.Host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	c.sign(req, path, data, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck
+
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// GetObject downloads the object from the bucket.
+func (c *s3Client) GetObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+
+	path := strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(bucket) + "/" + s3Escape(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint.Scheme+"://"+c.endpoint.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.sign(req, path, nil, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck
+
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (c *s3Client) sign(req *http.Request, path string, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// s3Escape escapes the object key as required by the signature: everything except unreserved characters
+// and the path separators is percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //nolint:errcheck
+
+	return h.Sum(nil)
+}
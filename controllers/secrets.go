@@ -0,0 +1,281 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api/util/certs"
+	"sigs.k8s.io/cluster-api/util/kubeconfig"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// SecretsBackend loads and stores the secret material generated by the controller (CA rotation material, published talosconfig).
+//
+// The default backend uses Kubernetes Secrets, other implementations might keep the material
+// in an external secrets manager (e.g. Vault).
+// Secrets generated by the bootstrap provider (e.g. the cluster CA), consumed by other Cluster API controllers
+// (e.g. kubeconfig) or referenced by the users are always Kubernetes Secrets.
+type SecretsBackend interface {
+	// Get returns the secret data.
+	//
+	// Errors for missing secrets should satisfy apierrors.IsNotFound.
+	Get(ctx context.Context, key client.ObjectKey) (map[string][]byte, error)
+
+	// Put creates or updates the secret data.
+	Put(ctx context.Context, key client.ObjectKey, data map[string][]byte, owner metav1.OwnerReference) error
+}
+
+// KubernetesSecretsBackend keeps the secret material in Kubernetes Secrets.
+type KubernetesSecretsBackend struct {
+	Client client.Client
+}
+
+// Get implements SecretsBackend.
+func (b *KubernetesSecretsBackend) Get(ctx context.Context, key client.ObjectKey) (map[string][]byte, error) {
+	var s corev1.Secret
+
+	if err := b.Client.Get(ctx, key, &s); err != nil {
+		return nil, err
+	}
+
+	return s.Data, nil
+}
+
+// Put implements SecretsBackend.
+func (b *KubernetesSecretsBackend) Put(ctx context.Context, key client.ObjectKey, data map[string][]byte, owner metav1.OwnerReference) error {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+		},
+	}
+
+	_, err := controllerutil.CreateOrUpdate(ctx, b.Client, s, func() error {
+		s.Data = data
+		s.OwnerReferences = mergeOwnerReference(s.OwnerReferences, owner)
+
+		if owner.Kind == "TalosControlPlane" {
+			if s.Labels == nil {
+				s.Labels = map[string]string{}
+			}
+
+			s.Labels[controlplanev1.TalosControlPlaneLabel] = owner.Name
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// VaultSecretsBackend keeps the secret material in the HashiCorp Vault KV version 2 secrets engine.
+//
+// Secrets are stored at <Mount>/data/<namespace>/<name>, the values are base64 encoded.
+// Secrets are not garbage collected with the owner, they have to be removed from Vault when the cluster is deleted.
+// The secrets are addressed by the cluster only, references to the secrets in other paths or stores
+// (like the External Secrets Operator ones) are not supported.
+type VaultSecretsBackend struct {
+	// Address of the Vault server, e.g. https://vault:8200.
+	Address string
+	// Mount is the path of the KV version 2 secrets engine.
+	Mount string
+	// Token authenticates the requests, it's not renewed.
+	Token string
+	// TokenFile is read on every request to authenticate it, the token is kept up to date by another process
+	// (e.g. Vault Agent auto-auth). It takes precedence over Token.
+	TokenFile string
+	// DryRun skips writing the secrets.
+	DryRun bool
+
+	Client *http.Client
+}
+
+type vaultSecret struct {
+	Data map[string]string `json:"data"`
+}
+
+func (b *VaultSecretsBackend) url(key client.ObjectKey) string {
+	return fmt.Sprintf("%s/v1/%s/data/%s/%s", strings.TrimSuffix(b.Address, "/"), strings.Trim(b.Mount, "/"), key.Namespace, key.Name)
+}
+
+func (b *VaultSecretsBackend) do(ctx context.Context, method string, key client.ObjectKey, body interface{}) (*http.Response, error) {
+	var data []byte
+
+	if body != nil {
+		var err error
+
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.url(key), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	token := b.Token
+
+	if b.TokenFile != "" {
+		contents, err := os.ReadFile(b.TokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read vault token")
+		}
+
+		token = strings.TrimSpace(string(contents))
+	}
+
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	c := b.Client
+	if c == nil {
+		c = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return c.Do(req)
+}
+
+// Get implements SecretsBackend.
+func (b *VaultSecretsBackend) Get(ctx context.Context, key client.ObjectKey) (map[string][]byte, error) {
+	resp, err := b.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("vault responded with %s reading secret %s", resp.Status, key)
+	}
+
+	var payload struct {
+		Data vaultSecret `json:"data"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode secret %s", key)
+	}
+
+	data := make(map[string][]byte, len(payload.Data.Data))
+
+	for k, v := range payload.Data.Data {
+		if data[k], err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode key %q of secret %s", k, key)
+		}
+	}
+
+	return data, nil
+}
+
+// Put implements SecretsBackend.
+func (b *VaultSecretsBackend) Put(ctx context.Context, key client.ObjectKey, data map[string][]byte, owner metav1.OwnerReference) error {
+	if b.DryRun {
+		return nil
+	}
+
+	secret := vaultSecret{Data: make(map[string]string, len(data))}
+
+	for k, v := range data {
+		secret.Data[k] = base64.StdEncoding.EncodeToString(v)
+	}
+
+	resp, err := b.do(ctx, http.MethodPost, key, secret)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("vault responded with %s writing secret %s", resp.Status, key)
+	}
+
+	return nil
+}
+
+// mergeOwnerReference adds the owner reference unless it's already present.
+func mergeOwnerReference(refs []metav1.OwnerReference, owner metav1.OwnerReference) []metav1.OwnerReference {
+	for _, ref := range refs {
+		if ref.UID == owner.UID {
+			return refs
+		}
+	}
+
+	return append(refs, owner)
+}
+
+// secretsBackend returns the configured secrets backend, defaulting to Kubernetes Secrets.
+func (r *TalosControlPlaneReconciler) secretsBackend() SecretsBackend {
+	if r.SecretsBackend != nil {
+		return r.SecretsBackend
+	}
+
+	return r.kubernetesSecrets()
+}
+
+// kubernetesSecrets returns the backend for the secrets which are always Kubernetes Secrets.
+func (r *TalosControlPlaneReconciler) kubernetesSecrets() SecretsBackend {
+	return &KubernetesSecretsBackend{Client: r.Client}
+}
+
+// generateKubeconfig builds the admin kubeconfig of the cluster signed by the cluster CA generated by the bootstrap provider.
+func (r *TalosControlPlaneReconciler) generateKubeconfig(ctx context.Context, clusterName client.ObjectKey, endpoint string) ([]byte, error) {
+	ca, err := r.kubernetesSecrets().Get(ctx, client.ObjectKey{Namespace: clusterName.Namespace, Name: secret.Name(clusterName.Name, secret.ClusterCA)})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, kubeconfig.ErrDependentCertificateNotFound
+		}
+
+		return nil, err
+	}
+
+	cert, err := certs.DecodeCertPEM(ca[secret.TLSCrtDataName])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode CA certificate")
+	} else if cert == nil {
+		return nil, errors.New("CA certificate not found")
+	}
+
+	key, err := certs.DecodePrivateKeyPEM(ca[secret.TLSKeyDataName])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode CA private key")
+	} else if key == nil {
+		return nil, errors.New("CA private key not found")
+	}
+
+	cfg, err := kubeconfig.New(clusterName.Name, endpoint, cert, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate a kubeconfig")
+	}
+
+	// trust the whole CA bundle, it has both the old and the new CA while the CA is rotated
+	for _, cluster := range cfg.Clusters {
+		cluster.CertificateAuthorityData = ca[secret.TLSCrtDataName]
+	}
+
+	return clientcmd.Write(*cfg)
+}
@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/talos/pkg/machinery/config"
+	"github.com/talos-systems/talos/pkg/machinery/config/types/v1alpha1/generate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeVault implements the subset of the Vault KV version 2 HTTP API used by VaultSecretsBackend.
+type fakeVault struct {
+	mu       sync.Mutex
+	token    string
+	secrets  map[string]map[string]string
+	requests int
+}
+
+func newFakeVault(t *testing.T, token string) (*fakeVault, *httptest.Server) {
+	v := &fakeVault{
+		token:   token,
+		secrets: map[string]map[string]string{},
+	}
+
+	server := httptest.NewServer(v)
+	t.Cleanup(server.Close)
+
+	return v, server
+}
+
+func (v *fakeVault) setToken(token string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.token = token
+}
+
+func (v *fakeVault) stored(path string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, ok := v.secrets[path]
+
+	return ok
+}
+
+func (v *fakeVault) requestCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.requests
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.requests++
+
+	if req.Header.Get("X-Vault-Token") != v.token {
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v1/secret/data/")
+
+	switch req.Method {
+	case http.MethodGet:
+		data, ok := v.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"data": map[string]interface{}{"data": data},
+		})
+	case http.MethodPost:
+		var body vaultSecret
+
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		v.secrets[path] = body.Data
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestVaultSecretsBackend(t *testing.T) {
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: "default", Name: "test-ca-rotation"}
+	data := map[string][]byte{"os.crt": []byte("certificate"), "os.key": []byte("key")}
+
+	t.Run("round trip", func(t *testing.T) {
+		vault, server := newFakeVault(t, "token")
+
+		backend := &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "token"}
+
+		require.NoError(t, backend.Put(ctx, key, data, metav1.OwnerReference{}))
+		assert.True(t, vault.stored("default/test-ca-rotation"))
+
+		loaded, err := backend.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, data, loaded)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, server := newFakeVault(t, "token")
+
+		backend := &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "token"}
+
+		_, err := backend.Get(ctx, key)
+		assert.True(t, apierrors.IsNotFound(err), "unexpected error %v", err)
+	})
+
+	t.Run("token file", func(t *testing.T) {
+		vault, server := newFakeVault(t, "first")
+
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("first\n"), 0o600))
+
+		backend := &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "ignored", TokenFile: tokenFile}
+
+		require.NoError(t, backend.Put(ctx, key, data, metav1.OwnerReference{}))
+
+		// the token is renewed by another process
+		vault.setToken("second")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("second\n"), 0o600))
+
+		loaded, err := backend.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, data, loaded)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		vault, server := newFakeVault(t, "token")
+
+		backend := &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "token", DryRun: true}
+
+		require.NoError(t, backend.Put(ctx, key, data, metav1.OwnerReference{}))
+		assert.Zero(t, vault.requestCount())
+	})
+}
+
+// TestGenerateKubeconfigWithVault checks the cluster CA generated by the bootstrap provider is read
+// from the Kubernetes Secret even if the secrets backend is Vault.
+func TestGenerateKubeconfigWithVault(t *testing.T) {
+	ctx := context.Background()
+
+	ca, err := generate.NewKubernetesCA(time.Now(), config.TalosVersionCurrent)
+	require.NoError(t, err)
+
+	vault, server := newFakeVault(t, "token")
+
+	r := &TalosControlPlaneReconciler{
+		Client: fake.NewClientBuilder().WithObjects(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      secret.Name("test", secret.ClusterCA),
+			},
+			Data: map[string][]byte{
+				secret.TLSCrtDataName: ca.CrtPEM,
+				secret.TLSKeyDataName: ca.KeyPEM,
+			},
+		}).Build(),
+		SecretsBackend: &VaultSecretsBackend{Address: server.URL, Mount: "secret", Token: "token"},
+	}
+
+	data, err := r.generateKubeconfig(ctx, client.ObjectKey{Namespace: "default", Name: "test"}, "https://10.5.0.2:6443")
+	require.NoError(t, err)
+
+	cfg, err := clientcmd.Load(data)
+	require.NoError(t, err)
+	require.Contains(t, cfg.Clusters, "test")
+	assert.Equal(t, ca.CrtPEM, cfg.Clusters["test"].CertificateAuthorityData)
+
+	assert.Zero(t, vault.requestCount())
+}
@@ -0,0 +1,186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+const (
+	// etcdSnapshotKey is the key of the gzip-compressed etcd snapshot chunk in the snapshot secrets.
+	etcdSnapshotKey = "snapshot.db.gz"
+
+	// etcdSnapshotChunksKey is the key of the number of the snapshot chunk secrets.
+	etcdSnapshotChunksKey = "chunks"
+
+	// etcdSnapshotReasonKey is the key of the membership change which triggered the snapshot.
+	etcdSnapshotReasonKey = "reason"
+
+	// etcdSnapshotTimestampKey is the key of the time (RFC 3339) the snapshot was taken at.
+	etcdSnapshotTimestampKey = "timestamp"
+
+	// etcdSnapshotChunkSize is the size of the snapshot chunk stored in a single secret,
+	// secrets are limited to 1 MiB.
+	etcdSnapshotChunkSize = 512 * 1024
+)
+
+// etcdSnapshotSecretName returns the name of the secret holding the metadata of the latest etcd snapshot of the cluster.
+func etcdSnapshotSecretName(clusterName string) string {
+	return clusterName + "-etcd-snapshot"
+}
+
+// etcdSnapshotChunkSecretName returns the name of the secret holding the chunk of the latest etcd snapshot of the cluster.
+func etcdSnapshotChunkSecretName(clusterName string, chunk int) string {
+	return fmt.Sprintf("%s-etcd-snapshot-%d", clusterName, chunk)
+}
+
+// snapshotEtcd takes the etcd snapshot via the Talos API, so that there is a recovery point before the etcd membership changes.
+//
+// The snapshot is uploaded to the etcd backup storage if it's configured, otherwise it's stored in Kubernetes Secrets
+// split into "<cluster>-etcd-snapshot-<n>" chunks described by the "<cluster>-etcd-snapshot" secret, only the latest snapshot is kept.
+// The caller should not proceed with the membership change if the snapshot can't be taken,
+// failures to store it are reported with a warning event only.
+func (r *TalosControlPlaneReconciler) snapshotEtcd(ctx context.Context, c *talosclient.Client, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, reason string) error {
+	if r.DisableEtcdSnapshots {
+		return nil
+	}
+
+	r.Log.Info("taking etcd snapshot", "reason", reason)
+
+	snapshot, err := readEtcdSnapshot(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	var location string
+
+	if tcp.Spec.EtcdBackup != nil {
+		location, err = r.uploadEtcdSnapshot(ctx, tcp, cluster, snapshot, now)
+	} else {
+		location, err = r.storeEtcdSnapshot(ctx, tcp, cluster, snapshot, reason, now)
+	}
+
+	if err != nil {
+		r.Log.Error(err, "failed to store etcd snapshot", "reason", reason)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdSnapshotFailed", "Failed to store etcd snapshot %s: %s", reason, err)
+		}
+
+		return nil
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "EtcdSnapshotTaken", "Stored etcd snapshot (%d bytes compressed) %s in %s", len(snapshot), reason, location)
+	}
+
+	return nil
+}
+
+// uploadEtcdSnapshot uploads the snapshot to the etcd backup storage, it returns the object location.
+func (r *TalosControlPlaneReconciler) uploadEtcdSnapshot(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, snapshot []byte, now time.Time) (string, error) {
+	s3 := tcp.Spec.EtcdBackup.S3
+
+	uploader, err := r.etcdBackupStorage(ctx, tcp)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s%s/%s/snapshots/etcd-%s.db.gz", s3.Prefix, cluster.Namespace, cluster.Name, now.Format("20060102T150405Z"))
+
+	if err = uploader.PutObject(ctx, s3.Bucket, key, snapshot); err != nil {
+		return "", errors.Wrapf(err, "Failed to upload etcd snapshot to %s/%s", s3.Bucket, key)
+	}
+
+	return s3.Bucket + "/" + key, nil
+}
+
+// storeEtcdSnapshot stores the snapshot chunks with the secrets backend, it returns the name of the metadata secret.
+//
+// The metadata secret is written last, so that it only references the complete set of chunks.
+func (r *TalosControlPlaneReconciler) storeEtcdSnapshot(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, snapshot []byte, reason string, now time.Time) (string, error) {
+	owner := metav1.OwnerReference{
+		APIVersion: controlplanev1.GroupVersion.String(),
+		Kind:       "TalosControlPlane",
+		Name:       tcp.Name,
+		UID:        tcp.UID,
+	}
+
+	chunks := 0
+
+	for offset := 0; offset < len(snapshot); offset += etcdSnapshotChunkSize {
+		end := offset + etcdSnapshotChunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+
+		if err := r.kubernetesSecrets().Put(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: etcdSnapshotChunkSecretName(cluster.Name, chunks)}, map[string][]byte{
+			etcdSnapshotKey: snapshot[offset:end],
+		}, owner); err != nil {
+			return "", errors.Wrapf(err, "Failed to store etcd snapshot chunk %d", chunks)
+		}
+
+		chunks++
+	}
+
+	name := etcdSnapshotSecretName(cluster.Name)
+
+	if err := r.kubernetesSecrets().Put(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: name}, map[string][]byte{
+		etcdSnapshotChunksKey:    []byte(strconv.Itoa(chunks)),
+		etcdSnapshotReasonKey:    []byte(reason),
+		etcdSnapshotTimestampKey: []byte(now.Format(time.RFC3339)),
+	}, owner); err != nil {
+		return "", errors.Wrap(err, "Failed to store etcd snapshot")
+	}
+
+	return "secret " + name, nil
+}
+
+// readEtcdSnapshot takes the etcd snapshot via the Talos API and returns it gzip-compressed.
+func readEtcdSnapshot(ctx context.Context, c *talosclient.Client) ([]byte, error) {
+	reader, errCh, err := c.EtcdSnapshot(ctx, &machineapi.EtcdSnapshotRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to take etcd snapshot")
+	}
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+
+	_, err = io.Copy(gz, reader)
+
+	reader.Close() //nolint:errcheck
+
+	if err == nil {
+		err = <-errCh
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read etcd snapshot")
+	}
+
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
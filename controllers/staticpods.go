@@ -0,0 +1,627 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	machineapi "github.com/talos-systems/talos/pkg/machinery/api/machine"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	"github.com/talos-systems/talos/pkg/machinery/constants"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	sigsyaml "sigs.k8s.io/yaml"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// staticPodConfigOperation is the etcd maintenance operation set while the static pod configuration is applied in place.
+const staticPodConfigOperation = "static-pod-config"
+
+// staticPodRestartGracePeriod is how long Talos and the kubelet get to pick up the applied configuration
+// before the kubelet is restarted.
+const staticPodRestartGracePeriod = 2 * time.Minute
+
+// staticPodComponents are the machine configuration sections rendered by Talos into the static pods.
+var staticPodComponents = []struct {
+	section string
+	pod     string
+}{
+	{section: "apiServer", pod: "kube-apiserver"},
+	{section: "controllerManager", pod: "kube-controller-manager"},
+	{section: "scheduler", pod: "kube-scheduler"},
+}
+
+// isStaticPodPatch checks whether the config patch only changes the static pod configuration.
+func isStaticPodPatch(patch cabptv1.ConfigPatches) bool {
+	for _, component := range staticPodComponents {
+		prefix := "/cluster/" + component.section
+
+		if patch.Path == prefix || strings.HasPrefix(patch.Path, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitStaticPodPatches splits the config patches into the ones changing the static pod configuration
+// and the rest of the machine configuration.
+func splitStaticPodPatches(patches []cabptv1.ConfigPatches) (machine, staticPods []cabptv1.ConfigPatches) {
+	machine = []cabptv1.ConfigPatches{}
+	staticPods = []cabptv1.ConfigPatches{}
+
+	for _, patch := range patches {
+		if isStaticPodPatch(patch) {
+			staticPods = append(staticPods, patch)
+		} else {
+			machine = append(machine, patch)
+		}
+	}
+
+	return machine, staticPods
+}
+
+// reconcileStaticPodConfig applies the changed static pod configuration (API server, controller manager
+// and scheduler settings) to the control plane machines without replacing or rebooting them.
+//
+// The patched machine configuration is applied immediately, Talos renders the static pod manifests
+// and the kubelet restarts the pods. The static pods are verified to run the rendered manifests,
+// if they are stale after the grace period, the kubelet is restarted on the node.
+// Machines are updated one at a time: the next machine is picked only after the static pods
+// of the previous one are ready, all nodes finished booting and etcd is healthy.
+//
+// Settings removed from the spec are left in the node configuration until the machine is replaced.
+func (r *TalosControlPlaneReconciler) reconcileStaticPodConfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	operation, maintenance := etcdMaintenanceInProgress(tcp)
+
+	if maintenance && operation == staticPodConfigOperation {
+		pending, err := r.pendingStaticPodConfigs(ctx, cluster, tcp, machines)
+		if err != nil {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, err
+		}
+
+		if pending {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+
+		finishEtcdMaintenance(tcp, staticPodConfigOperation)
+	} else if maintenance {
+		return ctrl.Result{}, nil
+	}
+
+	// machine replacement takes care of the static pod configuration as well
+	if !tcp.Status.Bootstrapped || tcp.Status.Rollout != nil {
+		return ctrl.Result{}, nil
+	}
+
+	hashes, err := machineConfigHashes(tcp)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var outdated *clusterv1.Machine
+
+	for i := range machines {
+		machine := &machines[i]
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		hash, ok := machine.Annotations[controlplanev1.StaticPodConfigHashAnnotation]
+		if !ok {
+			// machines created before the static pod configuration was tracked separately
+			// start tracking it once they match the whole machine configuration
+			if machine.Annotations[controlplanev1.ConfigHashAnnotation] == hashes.full {
+				if err = r.trackStaticPodConfig(ctx, machine, hashes); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+
+			continue
+		}
+
+		if hash == hashes.staticPods {
+			continue
+		}
+
+		if outdated == nil || machine.CreationTimestamp.Before(&outdated.CreationTimestamp) {
+			outdated = machine
+		}
+	}
+
+	if outdated == nil {
+		return ctrl.Result{}, nil
+	}
+
+	if !pendingChangeApproved(tcp, staticPodConfigChange(hashes, 0)) {
+		r.Log.Info("postponing static pod configuration until the change is approved", "machine", outdated.Name)
+
+		return ctrl.Result{}, nil
+	}
+
+	if len(machines) != int(*tcp.Spec.Replicas) {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || machine.Status.NodeRef == nil {
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+		}
+	}
+
+	if err = r.ensureNodesBooted(ctx, tcp, cluster, machines); err != nil {
+		r.Log.Info("waiting for all nodes to finish boot sequence before applying static pod configuration", "error", err)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if !conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) || !conditions.IsTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition) {
+		r.Log.Info("waiting for etcd and control plane components to become healthy before applying static pod configuration")
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	r.Log.Info("applying static pod configuration in place", "machine", outdated.Name)
+
+	if err = r.applyStaticPodConfig(ctx, tcp, outdated); err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
+	patchHelper, err := patch.NewHelper(outdated, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	outdated.Annotations[controlplanev1.StaticPodConfigHashAnnotation] = hashes.staticPods
+	outdated.Annotations[controlplanev1.StaticPodConfigAppliedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	startEtcdMaintenance(tcp, staticPodConfigOperation)
+
+	if err = patchHelper.Patch(ctx, outdated); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "StaticPodConfig", "Applying static pod configuration to machine %q in place", outdated.Name)
+	}
+
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+// staticPodConfigChange builds the pending in-place change of the static pod configuration.
+func staticPodConfigChange(hashes configHashes, machines int32) controlplanev1.PendingChange {
+	return pendingChange(controlplanev1.InPlaceChangeStrategy, hashes.staticPods, "static pod configuration", machines)
+}
+
+// trackStaticPodConfig records the static pod configuration hash on the machine matching the whole machine configuration.
+func (r *TalosControlPlaneReconciler) trackStaticPodConfig(ctx context.Context, machine *clusterv1.Machine, hashes configHashes) error {
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	machine.Annotations[controlplanev1.ConfigHashAnnotation] = hashes.machine
+	machine.Annotations[controlplanev1.StaticPodConfigHashAnnotation] = hashes.staticPods
+
+	return patchHelper.Patch(ctx, machine)
+}
+
+// pendingStaticPodConfigs checks whether the static pods of the updated machines run the applied configuration.
+func (r *TalosControlPlaneReconciler) pendingStaticPodConfigs(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (bool, error) {
+	pending := false
+
+	for i := range machines {
+		machine := &machines[i]
+
+		value, ok := machine.Annotations[controlplanev1.StaticPodConfigAppliedAtAnnotation]
+		if !ok {
+			continue
+		}
+
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		appliedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false, fmt.Errorf("machine %q has invalid %s annotation: %w", machine.Name, controlplanev1.StaticPodConfigAppliedAtAnnotation, err)
+		}
+
+		upToDate, restarted, err := r.verifyStaticPods(ctx, cluster, tcp, machine, appliedAt)
+		if err != nil {
+			r.Log.Info("waiting for static pods to pick up the configuration", "machine", machine.Name, "error", err)
+
+			pending = true
+
+			continue
+		}
+
+		if !upToDate && !restarted {
+			pending = true
+
+			continue
+		}
+
+		patchHelper, err := patch.NewHelper(machine, r.Client)
+		if err != nil {
+			return false, err
+		}
+
+		if restarted {
+			// give the restarted kubelet another grace period
+			machine.Annotations[controlplanev1.StaticPodConfigAppliedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+			pending = true
+		} else {
+			delete(machine.Annotations, controlplanev1.StaticPodConfigAppliedAtAnnotation)
+
+			r.Log.Info("static pods run the applied configuration", "machine", machine.Name)
+		}
+
+		if err = patchHelper.Patch(ctx, machine); err != nil {
+			return false, err
+		}
+	}
+
+	return pending, nil
+}
+
+// verifyStaticPods checks that Talos rendered the static pod manifests from the applied configuration
+// and the mirror pods run the rendered manifests and are ready.
+//
+// The kubelet is restarted if the static pods are stale after the grace period, restarted is reported then.
+func (r *TalosControlPlaneReconciler) verifyStaticPods(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine, appliedAt time.Time) (upToDate, restarted bool, err error) {
+	if machine.Status.NodeRef == nil {
+		return false, false, fmt.Errorf("machine %q has no node", machine.Name)
+	}
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return false, false, err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	clientset, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
+	if err != nil {
+		return false, false, err
+	}
+
+	defer clientset.Close() //nolint:errcheck
+
+	data, err := readNodeFile(ctx, c, "/system/state/config.yaml")
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read machine configuration: %w", err)
+	}
+
+	var config map[string]interface{}
+
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return false, false, fmt.Errorf("failed to parse machine configuration: %w", err)
+	}
+
+	stale := false
+
+	for _, component := range staticPodComponents {
+		rendered, err := readStaticPodManifest(ctx, c, component.pod)
+		if err != nil {
+			return false, false, err
+		}
+
+		if !staticPodHasArgs(rendered, component.pod, componentExtraArgs(config, component.section)) {
+			r.Log.Info("waiting for Talos to render the static pod", "machine", machine.Name, "pod", component.pod)
+
+			return false, false, nil
+		}
+
+		pod, err := clientset.CoreV1().Pods(metav1.NamespaceSystem).Get(ctx, component.pod+"-"+machine.Status.NodeRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, false, err
+		}
+
+		if pod.Annotations[constants.AnnotationStaticPodConfigVersion] != rendered.Annotations[constants.AnnotationStaticPodConfigVersion] {
+			stale = true
+
+			continue
+		}
+
+		if !podReady(pod) {
+			r.Log.Info("waiting for the static pod to become ready", "machine", machine.Name, "pod", pod.Name)
+
+			return false, false, nil
+		}
+	}
+
+	if !stale {
+		return true, false, nil
+	}
+
+	if time.Since(appliedAt) < staticPodRestartGracePeriod {
+		return false, false, nil
+	}
+
+	r.Log.Info("static pods are stale, restarting kubelet", "machine", machine.Name)
+
+	if !r.dryRun(tcp, "restarting kubelet on machine %q", machine.Name) {
+		if _, err = c.ServiceRestart(ctx, "kubelet"); err != nil {
+			return false, false, fmt.Errorf("failed to restart kubelet: %w", err)
+		}
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "StaticPodsStale", "Restarted kubelet on machine %q to pick up the static pod configuration", machine.Name)
+	}
+
+	return false, true, nil
+}
+
+// readStaticPodManifest reads the static pod manifest rendered by Talos on the node.
+func readStaticPodManifest(ctx context.Context, c *talosclient.Client, name string) (*corev1.Pod, error) {
+	data, err := readNodeFile(ctx, c, path.Join(constants.ManifestsDirectory, constants.TalosManifestPrefix+name+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s manifest: %w", name, err)
+	}
+
+	var pod corev1.Pod
+
+	if err = sigsyaml.Unmarshal(data, &pod); err != nil {
+		return nil, fmt.Errorf("failed to parse %s manifest: %w", name, err)
+	}
+
+	return &pod, nil
+}
+
+// componentExtraArgs returns the extra arguments of the control plane component from the machine configuration.
+func componentExtraArgs(config map[string]interface{}, section string) map[string]string {
+	cluster, _ := config["cluster"].(map[string]interface{})        //nolint:errcheck
+	component, _ := cluster[section].(map[string]interface{})       //nolint:errcheck
+	extraArgs, _ := component["extraArgs"].(map[string]interface{}) //nolint:errcheck
+
+	args := make(map[string]string, len(extraArgs))
+
+	for name, value := range extraArgs {
+		args[name] = fmt.Sprint(value)
+	}
+
+	return args
+}
+
+// staticPodHasArgs checks whether the container of the static pod is started with the arguments.
+func staticPodHasArgs(pod *corev1.Pod, container string, args map[string]string) bool {
+	for _, c := range pod.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+
+		present := map[string]struct{}{}
+
+		for _, arg := range append(append([]string{}, c.Command...), c.Args...) {
+			present[arg] = struct{}{}
+		}
+
+		for name, value := range args {
+			if _, ok := present[fmt.Sprintf("--%s=%s", name, value)]; !ok {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// applyStaticPodConfig applies the static pod configuration patches to the machine configuration on the node
+// without rebooting it.
+func (r *TalosControlPlaneReconciler) applyStaticPodConfig(ctx context.Context, tcp *controlplanev1.TalosControlPlane, machine *clusterv1.Machine) error {
+	if r.dryRun(tcp, "applying static pod configuration to machine %q", machine.Name) {
+		return nil
+	}
+
+	spec, err := renderConfigSpec(tcp, &tcp.Spec.ControlPlaneConfig.ControlPlaneConfig)
+	if err != nil {
+		return err
+	}
+
+	_, patches := splitStaticPodPatches(spec.ConfigPatches)
+
+	c, err := r.talosconfigForMachines(ctx, tcp, *machine)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close() //nolint:errcheck
+
+	current, err := readNodeFile(ctx, c, "/system/state/config.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read machine configuration: %w", err)
+	}
+
+	data, err := patchNodeConfig(current, patches)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.ApplyConfiguration(ctx, &machineapi.ApplyConfigurationRequest{
+		Data:      data,
+		Immediate: true,
+	}); err != nil {
+		return fmt.Errorf("failed to apply machine configuration: %w", err)
+	}
+
+	return nil
+}
+
+// patchNodeConfig applies the config patches to the machine configuration read from the node.
+//
+// Patches appending to a list are skipped if the list already contains the value,
+// so that the patches can be applied to the configuration they were applied to before.
+func patchNodeConfig(data []byte, patches []cabptv1.ConfigPatches) ([]byte, error) {
+	var config interface{}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse machine configuration: %w", err)
+	}
+
+	for _, p := range patches {
+		patched, err := applyConfigPatch(config, p)
+		if err != nil {
+			return nil, err
+		}
+
+		config = patched
+	}
+
+	return yaml.Marshal(config)
+}
+
+// applyConfigPatch applies the config patch to the parsed machine configuration, creating missing sections.
+func applyConfigPatch(config interface{}, p cabptv1.ConfigPatches) (interface{}, error) {
+	var value interface{}
+
+	if p.Op != "remove" {
+		if err := json.Unmarshal(p.Value.Raw, &value); err != nil {
+			return config, fmt.Errorf("failed to parse value of the %s patch %q: %w", p.Op, p.Path, err)
+		}
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(p.Path, "/"), "/")
+
+	for i := range tokens {
+		tokens[i] = decodePathToken(tokens[i])
+	}
+
+	patched, err := patchConfigNode(config, tokens, p.Op, value)
+	if err != nil {
+		return config, fmt.Errorf("failed to apply the %s patch %q: %w", p.Op, p.Path, err)
+	}
+
+	return patched, nil
+}
+
+// decodePathToken unescapes the JSON pointer token.
+func decodePathToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+}
+
+// patchConfigNode applies the patch operation at the path tokens relative to the node, returning the updated node.
+func patchConfigNode(node interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	switch op {
+	case "add", "replace", "remove":
+	default:
+		return nil, fmt.Errorf("unsupported operation %q", op)
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	token := tokens[0]
+
+	if node == nil {
+		if token == "-" {
+			node = []interface{}{}
+		} else {
+			node = map[string]interface{}{}
+		}
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+
+		if len(tokens) == 1 && op == "remove" {
+			delete(n, token)
+
+			return n, nil
+		}
+
+		if !ok && op == "remove" {
+			return n, nil
+		}
+
+		child, err := patchConfigNode(child, tokens[1:], op, value)
+		if err != nil {
+			return nil, err
+		}
+
+		n[token] = child
+
+		return n, nil
+	case []interface{}:
+		if token == "-" {
+			if len(tokens) != 1 || op != "add" {
+				return nil, fmt.Errorf("%q is only supported when adding to the list", token)
+			}
+
+			for _, item := range n {
+				if reflect.DeepEqual(item, value) {
+					return n, nil
+				}
+			}
+
+			return append(n, value), nil
+		}
+
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index > len(n) || (index == len(n) && (len(tokens) != 1 || op != "add")) {
+			return nil, fmt.Errorf("invalid list index %q", token)
+		}
+
+		if len(tokens) == 1 {
+			switch op {
+			case "remove":
+				return append(n[:index], n[index+1:]...), nil
+			case "add":
+				if index < len(n) && reflect.DeepEqual(n[index], value) {
+					return n, nil
+				}
+
+				return append(n[:index], append([]interface{}{value}, n[index:]...)...), nil
+			default:
+				n[index] = value
+
+				return n, nil
+			}
+		}
+
+		child, err := patchConfigNode(n[index], tokens[1:], op, value)
+		if err != nil {
+			return nil, err
+		}
+
+		n[index] = child
+
+		return n, nil
+	default:
+		return nil, fmt.Errorf("can't patch %q of a scalar value", token)
+	}
+}
@@ -0,0 +1,338 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestSplitStaticPodPatches(t *testing.T) {
+	patches := []cabptv1.ConfigPatches{
+		mustConfigPatch(t, "add", "/cluster/apiServer/extraArgs/feature-gates", "EphemeralContainers=true"),
+		mustConfigPatch(t, "add", "/machine/kubelet/extraArgs/rotate-server-certificates", "true"),
+		mustConfigPatch(t, "replace", "/cluster/scheduler", map[string]interface{}{"extraArgs": map[string]interface{}{"v": "2"}}),
+		mustConfigPatch(t, "add", "/cluster/apiServerExtra", map[string]interface{}{}),
+		mustConfigPatch(t, "add", "/cluster/controllerManager/extraArgs/bind-address", "0.0.0.0"),
+	}
+
+	machine, staticPods := splitStaticPodPatches(patches)
+
+	assert.Equal(t, []cabptv1.ConfigPatches{patches[1], patches[3]}, machine)
+	assert.Equal(t, []cabptv1.ConfigPatches{patches[0], patches[2], patches[4]}, staticPods)
+}
+
+func TestPatchNodeConfig(t *testing.T) {
+	const current = `machine:
+  type: controlplane
+cluster:
+  apiServer:
+    certSANs:
+      - 10.5.0.1
+    extraArgs:
+      v: "2"
+`
+
+	for _, tt := range []struct {
+		name     string
+		patches  []cabptv1.ConfigPatches
+		expected string
+		err      bool
+	}{
+		{
+			name: "missing sections",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "add", "/cluster/scheduler/extraArgs/bind-address", "0.0.0.0"),
+			},
+			expected: `machine:
+  type: controlplane
+cluster:
+  apiServer:
+    certSANs:
+      - 10.5.0.1
+    extraArgs:
+      v: "2"
+  scheduler:
+    extraArgs:
+      bind-address: 0.0.0.0
+`,
+		},
+		{
+			name: "applied before",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "add", "/cluster/apiServer/certSANs/-", "10.5.0.1"),
+				mustConfigPatch(t, "add", "/cluster/apiServer/extraArgs/v", "2"),
+			},
+			expected: current,
+		},
+		{
+			name: "appended",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "add", "/cluster/apiServer/certSANs/-", "10.5.0.2"),
+				mustConfigPatch(t, "add", "/cluster/apiServer/certSANs/0", "cp.example.com"),
+			},
+			expected: `machine:
+  type: controlplane
+cluster:
+  apiServer:
+    certSANs:
+      - cp.example.com
+      - 10.5.0.1
+      - 10.5.0.2
+    extraArgs:
+      v: "2"
+`,
+		},
+		{
+			name: "removed",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "remove", "/cluster/apiServer/extraArgs/v", nil),
+				mustConfigPatch(t, "remove", "/cluster/scheduler/extraArgs/v", nil),
+			},
+			expected: `machine:
+  type: controlplane
+cluster:
+  apiServer:
+    certSANs:
+      - 10.5.0.1
+    extraArgs: {}
+`,
+		},
+		{
+			name: "invalid list index",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "add", "/cluster/apiServer/certSANs/5", "10.5.0.2"),
+			},
+			err: true,
+		},
+		{
+			name: "scalar",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "add", "/machine/type/name", "controlplane"),
+			},
+			err: true,
+		},
+		{
+			name: "unsupported operation",
+			patches: []cabptv1.ConfigPatches{
+				mustConfigPatch(t, "move", "/cluster/apiServer/extraArgs/v", "2"),
+			},
+			err: true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := patchNodeConfig([]byte(current), tt.patches)
+			if tt.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			var actual, expected interface{}
+
+			require.NoError(t, yaml.Unmarshal(data, &actual))
+			require.NoError(t, yaml.Unmarshal([]byte(tt.expected), &expected))
+
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestStaticPodHasArgs(t *testing.T) {
+	var config map[string]interface{}
+
+	require.NoError(t, yaml.Unmarshal([]byte(`cluster:
+  apiServer:
+    extraArgs:
+      feature-gates: EphemeralContainers=true
+      v: 2
+`), &config))
+
+	args := componentExtraArgs(config, "apiServer")
+
+	assert.Equal(t, map[string]string{"feature-gates": "EphemeralContainers=true", "v": "2"}, args)
+	assert.Empty(t, componentExtraArgs(config, "scheduler"))
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "kube-apiserver",
+					Command: []string{"/go-runner", "/usr/local/bin/kube-apiserver"},
+					Args:    []string{"--feature-gates=EphemeralContainers=true", "--v=2"},
+				},
+			},
+		},
+	}
+
+	assert.True(t, staticPodHasArgs(pod, "kube-apiserver", args))
+	assert.True(t, staticPodHasArgs(pod, "kube-apiserver", nil))
+	assert.False(t, staticPodHasArgs(pod, "kube-apiserver", map[string]string{"v": "4"}))
+	assert.False(t, staticPodHasArgs(pod, "kube-scheduler", nil))
+}
+
+var _ = Describe("Static pod configuration", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		tcp       *controlplanev1.TalosControlPlane
+		hashes    configHashes
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+
+		r = &TalosControlPlaneReconciler{
+			Client: k8sClient,
+			Log:    logr.Discard(),
+			Scheme: scheme.Scheme,
+		}
+
+		featureGates, err := configPatch("add", "/cluster/apiServer/extraArgs/feature-gates", "EphemeralContainers=true")
+		Expect(err).NotTo(HaveOccurred())
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp", Annotations: map[string]string{}},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(3),
+				Version:  "v1.22.2",
+				ControlPlaneConfig: controlplanev1.ControlPlaneConfig{
+					ControlPlaneConfig: cabptv1.TalosConfigSpec{
+						GenerateType:  "controlplane",
+						ConfigPatches: []cabptv1.ConfigPatches{featureGates},
+					},
+				},
+			},
+			Status: controlplanev1.TalosControlPlaneStatus{Bootstrapped: true},
+		}
+
+		hashes, err = machineConfigHashes(tcp)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	machines := func() []clusterv1.Machine {
+		var list clusterv1.MachineList
+
+		Expect(k8sClient.List(ctx, &list, client.InNamespace(namespace))).To(Succeed())
+
+		return list.Items
+	}
+
+	It("starts tracking the machines matching the whole machine configuration", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{controlplanev1.ConfigHashAnnotation: hashes.full})
+		newTestMachine(ctx, namespace, "cp-2", map[string]string{controlplanev1.ConfigHashAnnotation: "outdated"})
+
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		for _, machine := range machines() {
+			switch machine.Name {
+			case "cp-1":
+				Expect(machine.Annotations).To(HaveKeyWithValue(controlplanev1.ConfigHashAnnotation, hashes.machine))
+				Expect(machine.Annotations).To(HaveKeyWithValue(controlplanev1.StaticPodConfigHashAnnotation, hashes.staticPods))
+			case "cp-2":
+				// replaced by the rollout
+				Expect(machine.Annotations).NotTo(HaveKey(controlplanev1.StaticPodConfigHashAnnotation))
+			}
+		}
+	})
+
+	It("waits for all replicas before applying the configuration", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{
+			controlplanev1.ConfigHashAnnotation:          hashes.machine,
+			controlplanev1.StaticPodConfigHashAnnotation: "outdated",
+		})
+
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(20 * time.Second))
+
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.EtcdMaintenanceAnnotation))
+		Expect(machines()[0].Annotations).To(HaveKeyWithValue(controlplanev1.StaticPodConfigHashAnnotation, "outdated"))
+	})
+
+	It("leaves the machines to the rollout", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{
+			controlplanev1.ConfigHashAnnotation:          hashes.machine,
+			controlplanev1.StaticPodConfigHashAnnotation: "outdated",
+		})
+
+		tcp.Status.Rollout = &controlplanev1.RolloutStatus{}
+
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+
+	It("waits for another etcd maintenance operation", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{controlplanev1.ConfigHashAnnotation: hashes.full})
+
+		startEtcdMaintenance(tcp, installUpgradeOperation)
+
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(tcp.Annotations).To(HaveKeyWithValue(controlplanev1.EtcdMaintenanceAnnotation, installUpgradeOperation))
+		Expect(machines()[0].Annotations).NotTo(HaveKey(controlplanev1.StaticPodConfigHashAnnotation))
+	})
+
+	It("keeps the maintenance until the static pods of the updated machine are verified", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{
+			controlplanev1.StaticPodConfigHashAnnotation:      hashes.staticPods,
+			controlplanev1.StaticPodConfigAppliedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+		})
+
+		startEtcdMaintenance(tcp, staticPodConfigOperation)
+
+		// the machine has no node yet, so the static pods can't be verified
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(30 * time.Second))
+
+		Expect(tcp.Annotations).To(HaveKeyWithValue(controlplanev1.EtcdMaintenanceAnnotation, staticPodConfigOperation))
+		Expect(machines()[0].Annotations).To(HaveKey(controlplanev1.StaticPodConfigAppliedAtAnnotation))
+	})
+
+	It("finishes the maintenance once the machines are verified", func() {
+		newTestMachine(ctx, namespace, "cp-1", map[string]string{
+			controlplanev1.ConfigHashAnnotation:          hashes.machine,
+			controlplanev1.StaticPodConfigHashAnnotation: hashes.staticPods,
+		})
+
+		startEtcdMaintenance(tcp, staticPodConfigOperation)
+
+		result, err := r.reconcileStaticPodConfig(ctx, nil, tcp, machines())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(tcp.Annotations).NotTo(HaveKey(controlplanev1.EtcdMaintenanceAnnotation))
+	})
+})
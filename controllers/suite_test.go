@@ -5,13 +5,21 @@
 package controllers
 
 import (
+	"context"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -42,7 +50,13 @@ var _ = BeforeSuite(func(done Done) {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths: []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths: []string{
+			filepath.Join("..", "config", "crd", "bases"),
+			moduleCRDs("sigs.k8s.io/cluster-api"),
+			moduleCRDs("sigs.k8s.io/cluster-api", "controlplane", "kubeadm"),
+			moduleCRDs("github.com/talos-systems/cluster-api-bootstrap-provider-talos"),
+		},
+		ErrorIfCRDPathMissing: true,
 	}
 
 	var err error
@@ -53,6 +67,12 @@ var _ = BeforeSuite(func(done Done) {
 	err = controlplanev1alpha3.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = clusterv1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = cabptv1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	// +kubebuilder:scaffold:scheme
 
 	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
@@ -67,3 +87,47 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).ToNot(HaveOccurred())
 })
+
+// moduleCRDs returns the CRD directory of the Go module the provider depends on, optionally of the provider in its subdirectory.
+func moduleCRDs(module string, subdir ...string) string {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", module).Output()
+	Expect(err).NotTo(HaveOccurred())
+
+	return filepath.Join(append(append([]string{strings.TrimSpace(string(out))}, subdir...), "config", "crd", "bases")...)
+}
+
+// newTestNamespace creates the namespace for the objects of a single spec.
+func newTestNamespace(ctx context.Context) string {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+	Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+
+	return namespace.Name
+}
+
+// newTestMachine creates the control plane Machine of the cluster "test".
+func newTestMachine(ctx context.Context, namespace, name string, annotations map[string]string) *clusterv1.Machine {
+	machine := &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: annotations,
+			Labels: map[string]string{
+				clusterv1.ClusterLabelName:             "test",
+				clusterv1.MachineControlPlaneLabelName: "",
+			},
+		},
+		Spec: clusterv1.MachineSpec{
+			ClusterName: "test",
+			Bootstrap:   clusterv1.Bootstrap{DataSecretName: pointer.StringPtr(name + "-bootstrap")},
+			InfrastructureRef: corev1.ObjectReference{
+				APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+				Kind:       "GenericMachine",
+				Name:       name,
+			},
+		},
+	}
+
+	Expect(k8sClient.Create(ctx, machine)).To(Succeed())
+
+	return machine
+}
@@ -0,0 +1,288 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"sort"
+
+	talosconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// clusterTalosconfigSecretName is the name of the talosconfig secret of the cluster written by the bootstrap provider.
+func clusterTalosconfigSecretName(cluster *clusterv1.Cluster) string {
+	return cluster.Name + "-talosconfig"
+}
+
+// cappedTalosconfigSecretName is the name of the talosconfig secret with the capped endpoint list published by the controller.
+func cappedTalosconfigSecretName(cluster *clusterv1.Cluster) string {
+	return cluster.Name + "-capped-talosconfig"
+}
+
+// reconcileClusterTalosconfig publishes the "<cluster>-capped-talosconfig" secret with the talosconfig used by the controller
+// and the addresses of the current control plane machines as the endpoints, capped with MaxTalosconfigEndpoints.
+//
+// The "<cluster>-talosconfig" secret is left to the bootstrap provider, which rewrites it with all the endpoints when
+// the TalosConfigs are reconciled. The published secret is only updated if the endpoints or the credentials differ,
+// so that the client certificate is not replaced on every reconcile.
+func (r *TalosControlPlaneReconciler) reconcileClusterTalosconfig(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (ctrl.Result, error) {
+	// the bootstrap provider secret has all the endpoints already
+	if r.MaxTalosconfigEndpoints <= 0 {
+		return ctrl.Result{}, nil
+	}
+
+	active := []clusterv1.Machine{}
+
+	for _, machine := range machines {
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			active = append(active, machine)
+		}
+	}
+
+	discovered, err := r.discoverAddresses(ctx, tcp, active)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(active) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	current := &active[0]
+
+	endpoints := talosconfigEndpoints(active, discovered, r.MaxTalosconfigEndpoints)
+	if len(endpoints) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	sort.Strings(endpoints)
+
+	t, err := r.machineTalosconfig(ctx, tcp, current)
+	if err != nil {
+		r.Log.Info("talosconfig is not available yet", "machine", current.Name, "error", err)
+
+		return ctrl.Result{}, nil
+	}
+
+	configContext, ok := t.Contexts[t.Context]
+	if !ok {
+		return ctrl.Result{}, fmt.Errorf("talosconfig context %q not found", t.Context)
+	}
+
+	desired := &talosconfig.Context{
+		Endpoints: endpoints,
+		CA:        configContext.CA,
+		Crt:       configContext.Crt,
+		Key:       configContext.Key,
+	}
+
+	key := client.ObjectKey{Namespace: cluster.Namespace, Name: cappedTalosconfigSecretName(cluster)}
+
+	published, err := r.kubernetesSecrets().Get(ctx, key)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	if err == nil && !clusterTalosconfigOutdated(published[talosconfigSecretKey], desired) {
+		return ctrl.Result{}, nil
+	}
+
+	data, err := (&talosconfig.Config{
+		Context: cluster.Name,
+		Contexts: map[string]*talosconfig.Context{
+			cluster.Name: desired,
+		},
+	}).Bytes()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if r.dryRun(tcp, "publishing talosconfig secret %q with endpoints %v", key.Name, endpoints) {
+		return ctrl.Result{}, nil
+	}
+
+	r.Log.Info("publishing cluster talosconfig", "secret", key.Name, "endpoints", endpoints)
+
+	return ctrl.Result{}, r.kubernetesSecrets().Put(ctx, key, map[string][]byte{talosconfigSecretKey: data},
+		*metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")))
+}
+
+// talosconfigEndpoints returns the endpoints of the cluster talosconfig, at most limit of them unless limit is zero.
+//
+// Talos client fans out to the endpoints, so for very large control planes the list is capped:
+// the first address of each machine goes first, the machines are ordered by endpointMachinesOrder.
+// Addresses shared by the machines (e.g. a VIP) are listed once.
+func talosconfigEndpoints(machines []clusterv1.Machine, discovered map[string][]string, limit int) []string {
+	endpoints := []string{}
+	seen := map[string]struct{}{}
+
+	add := func(address string) {
+		if _, ok := seen[address]; ok {
+			return
+		}
+
+		seen[address] = struct{}{}
+		endpoints = append(endpoints, address)
+	}
+
+	if limit <= 0 {
+		for _, machine := range machines {
+			for _, address := range discovered[machine.Name] {
+				add(address)
+			}
+		}
+
+		return endpoints
+	}
+
+	ordered := endpointMachinesOrder(machines)
+
+	for i := 0; len(endpoints) < limit; i++ {
+		remaining := false
+
+		for _, machine := range ordered {
+			addresses := discovered[machine.Name]
+
+			if i < len(addresses) && len(endpoints) < limit {
+				add(addresses[i])
+				remaining = true
+			}
+		}
+
+		if !remaining {
+			break
+		}
+	}
+
+	return endpoints
+}
+
+// endpointMachinesOrder orders the machines by the priority of their addresses in the talosconfig:
+// healthy machines go first, and the machines are picked from the failure domains in turn,
+// so that a capped endpoint list is not lost together with a single failure domain.
+func endpointMachinesOrder(machines []clusterv1.Machine) []clusterv1.Machine {
+	var healthy, unhealthy []clusterv1.Machine
+
+	for _, machine := range machines {
+		if endpointMachineHealthy(&machine) {
+			healthy = append(healthy, machine)
+		} else {
+			unhealthy = append(unhealthy, machine)
+		}
+	}
+
+	return append(spreadAcrossFailureDomains(healthy), spreadAcrossFailureDomains(unhealthy)...)
+}
+
+// endpointMachineHealthy checks whether the machine has a healthy node and is not going to be remediated.
+func endpointMachineHealthy(machine *clusterv1.Machine) bool {
+	return machine.Status.NodeRef != nil &&
+		!conditions.IsFalse(machine, clusterv1.MachineNodeHealthyCondition) &&
+		!conditions.IsFalse(machine, clusterv1.MachineOwnerRemediatedCondition)
+}
+
+// spreadAcrossFailureDomains interleaves the machines of the failure domains sorted by the name,
+// the machines within a failure domain are sorted by the name as well.
+func spreadAcrossFailureDomains(machines []clusterv1.Machine) []clusterv1.Machine {
+	byDomain := map[string][]clusterv1.Machine{}
+	domains := []string{}
+
+	for _, machine := range machines {
+		domain := ""
+		if machine.Spec.FailureDomain != nil {
+			domain = *machine.Spec.FailureDomain
+		}
+
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+
+		byDomain[domain] = append(byDomain[domain], machine)
+	}
+
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		domainMachines := byDomain[domain]
+
+		sort.Slice(domainMachines, func(i, j int) bool { return domainMachines[i].Name < domainMachines[j].Name })
+	}
+
+	result := make([]clusterv1.Machine, 0, len(machines))
+
+	for i := 0; len(result) < len(machines); i++ {
+		for _, domain := range domains {
+			if i < len(byDomain[domain]) {
+				result = append(result, byDomain[domain][i])
+			}
+		}
+	}
+
+	return result
+}
+
+// clusterTalosconfigOutdated checks whether the published talosconfig has other endpoints, trusts another CA,
+// or has a client certificate which is not issued by the CA.
+func clusterTalosconfigOutdated(data []byte, desired *talosconfig.Context) bool {
+	t, err := talosconfig.FromBytes(data)
+	if err != nil {
+		return true
+	}
+
+	published, ok := t.Contexts[t.Context]
+	if !ok {
+		return true
+	}
+
+	endpoints := append([]string(nil), published.Endpoints...)
+	sort.Strings(endpoints)
+
+	if !reflect.DeepEqual(endpoints, desired.Endpoints) || published.CA != desired.CA {
+		return true
+	}
+
+	// client certificates issued by the bootstrap provider from the same CA are as good as the controller ones
+	roots, err := talosconfigCA(t)
+	if err != nil {
+		return true
+	}
+
+	return !clientCertificateTrusted(published.Crt, roots)
+}
+
+// clientCertificateTrusted checks whether the base64-encoded PEM client certificate is valid and issued by one of the roots.
+func clientCertificateTrusted(crt string, roots *x509.CertPool) bool {
+	data, err := base64.StdEncoding.DecodeString(crt)
+	if err != nil {
+		return false
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	return err == nil
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+func endpointMachine(name, failureDomain string, healthy bool) clusterv1.Machine {
+	machine := clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+
+	if failureDomain != "" {
+		machine.Spec.FailureDomain = pointer.StringPtr(failureDomain)
+	}
+
+	if healthy {
+		machine.Status.NodeRef = &corev1.ObjectReference{Name: name}
+	}
+
+	return machine
+}
+
+func TestTalosconfigEndpoints(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		machines   []clusterv1.Machine
+		discovered map[string][]string
+		limit      int
+		expected   []string
+	}{
+		{
+			name: "unlimited keeps all addresses in the machine order",
+			machines: []clusterv1.Machine{
+				endpointMachine("b", "", true),
+				endpointMachine("a", "", false),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.2", "10.5.0.3"},
+				"b": {"10.5.0.4"},
+			},
+			expected: []string{"10.5.0.4", "10.5.0.2", "10.5.0.3"},
+		},
+		{
+			name: "limit above the number of addresses",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "", true),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.2"},
+			},
+			limit:    5,
+			expected: []string{"10.5.0.2"},
+		},
+		{
+			name: "first address of each machine goes first",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "", true),
+				endpointMachine("b", "", true),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.2", "fd00::2"},
+				"b": {"10.5.0.3", "fd00::3"},
+			},
+			limit:    3,
+			expected: []string{"10.5.0.2", "10.5.0.3", "fd00::2"},
+		},
+		{
+			name: "healthy machines go first",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "", false),
+				endpointMachine("b", "", true),
+				endpointMachine("c", "", false),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.2"},
+				"b": {"10.5.0.3"},
+				"c": {"10.5.0.4"},
+			},
+			limit:    2,
+			expected: []string{"10.5.0.3", "10.5.0.2"},
+		},
+		{
+			name: "machines are spread across failure domains",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "fd1", true),
+				endpointMachine("b", "fd1", true),
+				endpointMachine("c", "fd2", true),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.2"},
+				"b": {"10.5.0.3"},
+				"c": {"10.5.0.4"},
+			},
+			limit:    2,
+			expected: []string{"10.5.0.2", "10.5.0.4"},
+		},
+		{
+			name: "shared addresses are listed once",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "", true),
+				endpointMachine("b", "", true),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.10", "10.5.0.2"},
+				"b": {"10.5.0.10", "10.5.0.3"},
+			},
+			limit:    3,
+			expected: []string{"10.5.0.10", "10.5.0.2", "10.5.0.3"},
+		},
+		{
+			name: "shared addresses are listed once without the limit",
+			machines: []clusterv1.Machine{
+				endpointMachine("a", "", true),
+				endpointMachine("b", "", true),
+			},
+			discovered: map[string][]string{
+				"a": {"10.5.0.10", "10.5.0.2"},
+				"b": {"10.5.0.10", "10.5.0.3"},
+			},
+			expected: []string{"10.5.0.10", "10.5.0.2", "10.5.0.3"},
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, talosconfigEndpoints(tt.machines, tt.discovered, tt.limit))
+		})
+	}
+}
@@ -8,13 +8,10 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math/rand"
 	"reflect"
 	"sort"
-	"strings"
 	"time"
 
-	"github.com/coreos/go-semver/semver"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
@@ -28,9 +25,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/selection"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apiserver/pkg/storage/names"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/controllers/external"
@@ -45,9 +44,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/internal/capicompat"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/pkg/tcpclient"
 )
 
 const requeueDuration = 30 * time.Second
@@ -66,22 +68,103 @@ type TalosControlPlaneReconciler struct {
 	APIReader client.Reader
 	Log       logr.Logger
 	Scheme    *runtime.Scheme
+
+	// CoreAPIVersion is the served core Cluster API version of Machines and Clusters to watch,
+	// Client is expected to convert them to the v1beta1 types used by the controller.
+	CoreAPIVersion schema.GroupVersion
+
+	// SupportedVersions limits Kubernetes versions of the new control plane machines.
+	SupportedVersions VersionRange
+
+	// SecretsBackend keeps the secret material generated by the controller, defaults to Kubernetes Secrets.
+	SecretsBackend SecretsBackend
+
+	// AddressSources registers additional sources of the Talos API endpoints by the name
+	// to be used in the TalosControlPlane AddressSources, they take precedence over the built-in sources.
+	AddressSources map[string]AddressSource
+
+	// DisablePerMachineMetrics drops the metrics labeled with the machine, keeping only per-cluster metrics
+	// to limit the number of series in large fleets.
+	DisablePerMachineMetrics bool
+
+	// DegradedFailureThreshold is the number of consecutive reconcile failures after which
+	// the TalosControlPlane is reported as degraded, defaults to defaultDegradedFailureThreshold.
+	DegradedFailureThreshold int32
+
+	// DisableWorkloadNodeLookups disables the NodeStatus address source, for management clusters
+	// which can't reach the workload cluster Kubernetes API.
+	DisableWorkloadNodeLookups bool
+
+	// MaxConcurrentTalosCalls limits the number of concurrent Talos API calls per cluster, unlimited if zero.
+	MaxConcurrentTalosCalls int
+
+	// MaxTalosconfigEndpoints limits the number of endpoints in the published cluster talosconfig, it's not published if zero.
+	MaxTalosconfigEndpoints int
+
+	// SkipEndpointDNSCheck disables checking the control plane endpoint DNS name resolves before the bootstrap,
+	// for management clusters which can't resolve the workload cluster names.
+	SkipEndpointDNSCheck bool
+
+	// DisableEtcdSnapshots disables taking the etcd snapshot before removing etcd members.
+	DisableEtcdSnapshots bool
+
+	// EnableKCPMigration enables the experimental migration from the KubeadmControlPlane requested with MigrateFromKCPAnnotation.
+	EnableKCPMigration bool
+
+	// InsecureMaintenanceApply allows applying the machine config to the nodes in maintenance mode
+	// without verifying their certificate when MaintenanceCertificateFingerprintAnnotation is not set.
+	InsecureMaintenanceApply bool
+
+	// DryRun makes the controller only log and record the intended actions: Talos API actions are skipped,
+	// workload cluster API requests are sent as dry-run. Client is expected to be a dry-run client as well.
+	DryRun bool
+
+	// Recorder records events for the TalosControlPlane, events are not recorded if nil.
+	Recorder record.EventRecorder
+
+	// AuditSink receives the records of the scale, rollout, remediation and bootstrap operations,
+	// records are not emitted if nil.
+	AuditSink AuditSink
+
+	workloadConnections workloadConnections
+	talosRPCLimiter     talosRPCLimiter
+	provisioning        provisioningTracker
+	clockOffsetNodes    nodeSeriesTracker
+	audits              auditTracker
+	learners            learnerTracker
+	warmup              warmupGate
 }
 
 func (r *TalosControlPlaneReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	// the warm up needs the leader election, so it's started along with the controller
+	r.warmup.arm()
+
+	if err := mgr.Add(manager.RunnableFunc(r.warmCaches)); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&controlplanev1.TalosControlPlane{}).
-		Owns(&clusterv1.Machine{}).
+		Owns(capicompat.Object(r.CoreAPIVersion, &clusterv1.Machine{})).
 		Watches(
-			&source.Kind{Type: &clusterv1.Cluster{}},
+			&source.Kind{Type: capicompat.Object(r.CoreAPIVersion, &clusterv1.Cluster{})},
 			handler.EnqueueRequestsFromMapFunc(r.ClusterToTalosControlPlane),
 		).
+		Watches(
+			&source.Kind{Type: capicompat.Object(r.CoreAPIVersion, &clusterv1.Machine{})},
+			handler.EnqueueRequestsFromMapFunc(r.AdoptedMachineToTalosControlPlane),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.KubeconfigSecretToTalosControlPlane),
+		).
 		WithOptions(options).
 		Complete(r)
 }
 
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;patch
-// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;patch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=configmaps,namespace=kube-system,verbs=get;list;watch;create
 // +kubebuilder:rbac:groups=rbac,resources=roles,namespace=kube-system,verbs=get;list;watch;create
 // +kubebuilder:rbac:groups=rbac,resources=rolebindings,namespace=kube-system,verbs=get;list;watch;create
@@ -92,6 +175,10 @@ func (r *TalosControlPlaneReconciler) SetupWithManager(mgr ctrl.Manager, options
 func (r *TalosControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, reterr error) {
 	logger := r.Log.WithValues("namespace", req.Namespace, "talosControlPlane", req.Name)
 
+	if err := r.warmup.wait(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Fetch the TalosControlPlane instance.
 	tcp := &controlplanev1.TalosControlPlane{}
 	if err := r.APIReader.Get(ctx, req.NamespacedName, tcp); err != nil {
@@ -163,10 +250,15 @@ func (r *TalosControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Re
 			reterr = kerrors.NewAggregate([]error{reterr, err})
 		}
 
-		// Always attempt to Patch the TalosControlPlane object and status after each reconciliation.
-		if err := patchTalosControlPlane(ctx, patchHelper, tcp, patch.WithStatusObservedGeneration{}); err != nil {
-			logger.Error(err, "failed to patch TalosControlPlane")
-			reterr = kerrors.NewAggregate([]error{reterr, err})
+		r.updateFailureBudget(tcp, reterr)
+		r.updateOperationTimeouts(tcp)
+
+		// terminal errors keep failing until the inputs are changed, so the exponential backoff is skipped,
+		// the failure is still counted above and reported by the OperatorDegraded condition
+		if reterr != nil && tcpclient.IsTerminal(reterr) {
+			logger.Error(reterr, "reconcile failed with a terminal error", "requeueAfter", terminalErrorRequeueAfter)
+
+			res, reterr = ctrl.Result{RequeueAfter: terminalErrorRequeueAfter}, nil
 		}
 
 		// TODO: remove this as soon as we have a proper remote cluster cache in place.
@@ -178,6 +270,14 @@ func (r *TalosControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Re
 			}
 		}
 
+		setReconcileHint(tcp, res, reterr)
+
+		// Always attempt to Patch the TalosControlPlane object and status after each reconciliation.
+		if err := patchTalosControlPlane(ctx, patchHelper, tcp, patch.WithStatusObservedGeneration{}); err != nil {
+			logger.Error(err, "failed to patch TalosControlPlane")
+			reterr = kerrors.NewAggregate([]error{reterr, err})
+		}
+
 		r.Log.Info("successfully updated control plane status")
 	}()
 
@@ -204,7 +304,11 @@ func (r *TalosControlPlaneReconciler) reconcile(ctx context.Context, cluster *cl
 		return ctrl.Result{}, nil
 	}
 
-	// TODO: handle proper adoption of Machines
+	// adopting and ejecting machines changes the set of the control plane machines, so it's done first
+	if result, err := r.reconcileMachineHandover(ctx, cluster, tcp); err != nil || result.Requeue {
+		return result, err
+	}
+
 	ownedMachines, err := r.getControlPlaneMachinesForCluster(ctx, util.ObjectKey(cluster), tcp.Name)
 	if err != nil {
 		logger.Error(err, "failed to retrieve control plane machines for cluster")
@@ -219,26 +323,87 @@ func (r *TalosControlPlaneReconciler) reconcile(ctx context.Context, cluster *cl
 
 	conditions.SetAggregate(tcp, controlplanev1.MachinesReadyCondition, conditionGetters, conditions.AddSourceRef(), conditions.WithStepCounterIf(false))
 
-	var (
-		errs        error
-		result      ctrl.Result
-		phaseResult ctrl.Result
-	)
+	profile := newReconcileProfile(tcp)
+
+	result, errs := runReconcilePhases(ctx, cluster, tcp, ownedMachines, r.reconcilePhases(), profile)
+
+	if err = r.writeReconcileProfile(ctx, cluster, tcp, profile); err != nil {
+		errs = kerrors.NewAggregate([]error{errs, err})
+	}
+
+	return result, errs
+}
 
-	// run all similar reconcile steps in the loop and pick the lowest RetryAfter, aggregate errors and check the requeue flags.
-	for _, phase := range []func(context.Context, *clusterv1.Cluster, *controlplanev1.TalosControlPlane, []clusterv1.Machine) (ctrl.Result, error){
+// reconcilePhase is a step of the reconcile of the control plane machines.
+type reconcilePhase func(context.Context, *clusterv1.Cluster, *controlplanev1.TalosControlPlane, []clusterv1.Machine) (ctrl.Result, error)
+
+// reconcilePhases returns the reconcile phases in the order they run.
+//
+// The phases changing the set of the control plane machines (remediation and scaling) go last.
+func (r *TalosControlPlaneReconciler) reconcilePhases() []reconcilePhase {
+	return []reconcilePhase{
+		r.reconcileKubeadmMigration,
+		r.reconcileOwnerReferences,
+		r.reconcileSecretsAvailability,
+		r.reconcileBootstrapData,
+		r.reconcileOrphanedObjects,
+		r.reconcileMachineFinalizers,
+		r.reconcileMachineMetadata,
+		r.reconcileTalosIdentity,
 		r.reconcileEtcdMembers,
+		r.reconcileMembershipAudit,
 		r.reconcileNodeHealth,
+		r.reconcileMachineContacts,
+		r.reconcileMachineBootstrapConfigs,
+		r.reconcileMaintenanceMode,
+		r.reconcileTimeSync,
+		r.reconcileImages,
+		r.reconcileKubeletServingCertificates,
+		r.reconcileAPIServerCertificate,
+		r.reconcileCertificatesExpiry,
+		r.reconcileRolloutStatus,
+		r.reconcileChangeStrategy,
 		r.reconcileConditions,
 		r.reconcileKubeconfig,
+		r.reconcileClusterTalosconfig,
+		r.reconcileManifests,
+		r.reconcileInstallConfig,
+		r.reconcileEtcdConfig,
+		r.reconcileStaticPodConfig,
+		r.reconcileCARotation,
+		r.reconcileEtcdBackupVerification,
+		r.reconcileEtcdBackup,
+		r.reconcileRenderedConfig,
+		r.reconcileRemediation,
 		r.reconcileMachines,
-	} {
-		phaseResult, err = phase(ctx, cluster, tcp, ownedMachines)
+	}
+}
+
+// runReconcilePhases runs the similar reconcile steps in order, picks the lowest RequeueAfter and aggregates the errors.
+//
+// A phase requesting the requeue has changed the set of the control plane machines, so the rest of the phases is skipped
+// instead of acting on the outdated set, the next reconcile starts over.
+func runReconcilePhases(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine, phases []reconcilePhase, profile *reconcileProfile) (ctrl.Result, error) {
+	var (
+		errs   error
+		result ctrl.Result
+	)
+
+	for _, phase := range phases {
+		start := time.Now()
+
+		phaseResult, err := phase(ctx, cluster, tcp, machines)
 		if err != nil {
 			errs = kerrors.NewAggregate([]error{errs, err})
 		}
 
+		profile.record(phase, start, err)
+
 		result = util.LowestNonZeroResult(result, phaseResult)
+
+		if phaseResult.Requeue {
+			break
+		}
 	}
 
 	return result, errs
@@ -247,6 +412,12 @@ func (r *TalosControlPlaneReconciler) reconcile(ctx context.Context, cluster *cl
 // ClusterToTalosControlPlane is a handler.ToRequestsFunc to be used to enqueue requests for reconciliation
 // for TalosControlPlane based on updates to a Cluster.
 func (r *TalosControlPlaneReconciler) ClusterToTalosControlPlane(o client.Object) []ctrl.Request {
+	o, err := capicompat.ToHub(o)
+	if err != nil {
+		r.Log.Error(err, "failed to convert Cluster")
+		return nil
+	}
+
 	c, ok := o.(*clusterv1.Cluster)
 	if !ok {
 		r.Log.Error(nil, fmt.Sprintf("expected a Cluster but got a %T", o))
@@ -272,11 +443,37 @@ func (r *TalosControlPlaneReconciler) reconcileDelete(ctx context.Context, clust
 
 	// If no control plane machines remain, remove the finalizer
 	if len(ownedMachines) == 0 {
+		if err := r.cleanupGeneratedObjects(ctx, tcp); err != nil {
+			r.Log.Error(err, "failed to clean up generated objects")
+
+			return ctrl.Result{}, err
+		}
+
 		controllerutil.RemoveFinalizer(tcp, controlplanev1.TalosControlPlaneFinalizer)
 		return ctrl.Result{}, r.Client.Update(ctx, tcp)
 	}
 
+	// The etcd data is lost once the machines are deleted, so the backups are checked before that.
+	if !machinesDeleting(ownedMachines) {
+		hold, err := r.holdDeletionForEtcdBackup(ctx, cluster, tcp, ownedMachines)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if hold {
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+	}
+
 	for _, ownedMachine := range ownedMachines {
+		// The whole control plane is going away, so there is no etcd cluster left to clean up.
+		if controllerutil.ContainsFinalizer(&ownedMachine, controlplanev1.MachineEtcdFinalizer) {
+			if err := r.updateMachineFinalizer(ctx, &ownedMachine, false); err != nil {
+				r.Log.Error(err, "failed to remove etcd finalizer from owned machine")
+				return ctrl.Result{}, err
+			}
+		}
+
 		// Already deleting this machine
 		if !ownedMachine.ObjectMeta.DeletionTimestamp.IsZero() {
 			continue
@@ -293,6 +490,17 @@ func (r *TalosControlPlaneReconciler) reconcileDelete(ctx context.Context, clust
 	return ctrl.Result{RequeueAfter: requeueDuration}, nil
 }
 
+// machinesDeleting reports whether any of the machines is being deleted.
+func machinesDeleting(machines []clusterv1.Machine) bool {
+	for _, machine := range machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			return true
+		}
+	}
+
+	return false
+}
+
 // newControlPlane returns an instantiated ControlPlane.
 func newControlPlane(cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) *ControlPlane {
 	return &ControlPlane{
@@ -302,25 +510,44 @@ func newControlPlane(cluster *clusterv1.Cluster, tcp *controlplanev1.TalosContro
 	}
 }
 
-func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, cpName string, machines []clusterv1.Machine) (ctrl.Result, error) {
+// scaleDownControlPlane deletes the oldest control plane machine of the most populated failure domain.
+//
+// If outdated machines are passed, the machine is picked out of them, so that the rollout doesn't remove up to date machines.
+func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster client.ObjectKey, cpName string, machines, outdated []clusterv1.Machine) (ctrl.Result, error) {
+	operation := auditScaleDown
+	if len(outdated) > 0 {
+		operation = auditRollout
+	}
+
 	if len(machines) == 0 {
 		return ctrl.Result{}, fmt.Errorf("no machines found")
 	}
 
 	r.Log.Info("Found control plane machines", "machines", len(machines))
 
-	kubeclient, err := r.kubeconfigForCluster(ctx, cluster)
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, cluster)
 	if err != nil {
 		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
 	}
 
 	defer kubeclient.Close() //nolint:errcheck
 
-	deleteMachine := machines[0]
+	var oldest *clusterv1.Machine
+
+	perFailureDomain := machinesPerFailureDomain(machines)
+
 	for _, machine := range machines {
+		machine := machine
+
 		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
 			r.Log.Info("machine is in process of deletion", "machine", machine.Name)
 
+			if preDrainHookPending(tcp, &machine) {
+				r.Log.Info("waiting for pre-drain hook to be acknowledged", "machine", machine.Name)
+
+				return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+			}
+
 			node, err := kubeclient.CoreV1().Nodes().Get(ctx, machine.Status.NodeRef.Name, metav1.GetOptions{})
 			if err != nil {
 				// It's possible for the node to already be deleted in the workload cluster, so we just
@@ -333,7 +560,7 @@ func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context,
 
 			r.Log.Info("Deleting node", "machine", machine.Name, "node", node.Name)
 
-			err = kubeclient.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{})
+			err = kubeclient.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{DryRun: r.dryRunAll()})
 			if err != nil {
 				return ctrl.Result{RequeueAfter: 20 * time.Second}, err
 			}
@@ -348,17 +575,57 @@ func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context,
 			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 		}
 
-		if machine.CreationTimestamp.Before(&deleteMachine.CreationTimestamp) {
-			deleteMachine = machine
+		if _, ok := machine.Annotations[controlplanev1.ScaleDownDisabledAnnotation]; ok {
+			r.Log.Info("machine is excluded from scale down", "machine", machine.Name)
+
+			continue
+		}
+
+		if len(outdated) > 0 && !containsMachine(outdated, machine.Name) {
+			continue
+		}
+
+		if scaleDownPreferred(&machine, oldest, perFailureDomain) {
+			oldest = &machine
 		}
 	}
 
+	if oldest == nil {
+		r.Log.Info("all machines are excluded from scale down")
+
+		conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.ScaleDownBlockedReason, clusterv1.ConditionSeverityWarning,
+			"All machines have the %s annotation", controlplanev1.ScaleDownDisabledAnnotation)
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	deleteMachine := *oldest
+
 	if deleteMachine.Status.NodeRef == nil {
 		return ctrl.Result{RequeueAfter: 20 * time.Second}, fmt.Errorf("%q machine does not have a nodeRef", deleteMachine.Name)
 	}
 
 	node := deleteMachine.Status.NodeRef
 
+	if tcp.Spec.PreDrainHook != nil {
+		// etcd member is removed by the machine finalizer once the hook is acknowledged
+		if err = r.setPreDrainHook(ctx, tcp, &deleteMachine); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		r.Log.Info("deleting machine, waiting for pre-drain hook", "machine", deleteMachine.Name, "node", node.Name)
+
+		err = r.Client.Delete(ctx, &deleteMachine)
+
+		r.audit(tcp, cluster.Name, operation, deleteMachine.Name, err, "Deleting control plane machine after the pre-drain hook is acknowledged")
+
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
 	c, err := r.talosconfigForMachines(ctx, tcp, deleteMachine)
 	if err != nil {
 		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
@@ -366,35 +633,34 @@ func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context,
 
 	defer c.Close() //nolint:errcheck
 
+	if err = r.snapshotEtcd(ctx, c, tcp, cluster, fmt.Sprintf("before removing the etcd member of machine %q", deleteMachine.Name)); err != nil {
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
+	}
+
 	err = r.gracefulEtcdLeave(ctx, c, cluster, deleteMachine)
 	if err != nil {
+		r.audit(tcp, cluster.Name, operation, deleteMachine.Name, err, "Failed to remove the etcd member of the control plane machine")
+
 		return ctrl.Result{}, err
 	}
 
 	r.Log.Info("deleting machine", "machine", deleteMachine.Name, "node", node.Name)
 
 	err = r.Client.Delete(ctx, &deleteMachine)
-	if err != nil {
-		return ctrl.Result{}, err
-	}
 
-	// TODO: drop version check and shutdown when Talos < 0.12.2 reaches end of life
-	version, err := c.Version(ctx)
+	r.audit(tcp, cluster.Name, operation, deleteMachine.Name, err, "Deleting control plane machine")
+
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	fromVersion, _ := semver.NewVersion("0.12.2") //nolint:errcheck
-
-	nodeVersion, err := semver.NewVersion(
-		strings.TrimLeft(version.Messages[0].Version.Tag, "v"),
-	)
-
+	// TODO: drop version check and shutdown when Talos < 0.12.2 reaches end of life
+	caps, err := detectTalosCapabilities(ctx, c)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if nodeVersion.LessThan(*fromVersion) {
+	if !caps.etcdStopsOnLeave() && !r.dryRun(tcp, "shutting down node %q", node.Name) {
 		// NB: We shutdown the node here so that a loadbalancer will drop the backend.
 		// The Kubernetes API server is configured to talk to etcd on localhost, but
 		// at this point etcd has been stopped.
@@ -408,7 +674,7 @@ func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context,
 
 	r.Log.Info("deleting node", "machine", deleteMachine.Name, "node", node.Name)
 
-	err = kubeclient.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{})
+	err = kubeclient.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{DryRun: r.dryRunAll()})
 	if err != nil {
 		return ctrl.Result{RequeueAfter: 20 * time.Second}, err
 	}
@@ -418,38 +684,39 @@ func (r *TalosControlPlaneReconciler) scaleDownControlPlane(ctx context.Context,
 }
 
 func (r *TalosControlPlaneReconciler) getControlPlaneMachinesForCluster(ctx context.Context, cluster client.ObjectKey, cpName string) ([]clusterv1.Machine, error) {
-	selector := map[string]string{
-		clusterv1.ClusterLabelName:             cluster.Name,
-		clusterv1.MachineControlPlaneLabelName: "",
-	}
-
 	machineList := clusterv1.MachineList{}
 	if err := r.Client.List(
 		ctx,
 		&machineList,
 		client.InNamespace(cluster.Namespace),
-		client.MatchingLabels(selector),
+		client.MatchingLabels(tcpclient.MachineLabels(cluster.Name)),
 	); err != nil {
 		return nil, err
 	}
 
-	return machineList.Items, nil
-}
+	// the machines of the KubeadmControlPlane the cluster is migrated from are retired by the migration
+	machines := make([]clusterv1.Machine, 0, len(machineList.Items))
 
-// getFailureDomain will return a slice of failure domains from the cluster status.
-func (r *TalosControlPlaneReconciler) getFailureDomain(ctx context.Context, cluster *clusterv1.Cluster) []string {
-	if cluster.Status.FailureDomains == nil {
-		return nil
+	for _, machine := range machineList.Items {
+		if _, ok := kubeadmControlPlaneOf(&machine); !ok {
+			machines = append(machines, machine)
+		}
 	}
 
-	retList := []string{}
-	for key := range cluster.Status.FailureDomains {
-		retList = append(retList, key)
-	}
-	return retList
+	return machines, nil
 }
 
-func (r *TalosControlPlaneReconciler) bootControlPlane(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, controlPlane *ControlPlane, first bool) (ctrl.Result, error) {
+func (r *TalosControlPlaneReconciler) bootControlPlane(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, controlPlane *ControlPlane, version string, first bool) (ctrl.Result, error) {
+	if err := r.SupportedVersions.Validate(version); err != nil {
+		conditions.MarkFalse(tcp, controlplanev1.MachinesCreatedCondition, controlplanev1.UnsupportedVersionReason,
+			clusterv1.ConditionSeverityError, err.Error())
+
+		r.Log.Info("refusing to create control plane machine", "error", err)
+
+		// changing the version re-triggers reconcile
+		return ctrl.Result{}, nil
+	}
+
 	// Since the cloned resource should eventually have a controller ref for the Machine, we create an
 	// OwnerReference here without the Controller field set
 	infraCloneOwner := &metav1.OwnerReference{
@@ -459,21 +726,62 @@ func (r *TalosControlPlaneReconciler) bootControlPlane(ctx context.Context, clus
 		UID:        tcp.UID,
 	}
 
-	// Clone the infrastructure template
-	infraRef, err := external.CloneTemplate(ctx, &external.CloneTemplateInput{
-		Client:      r.Client,
-		TemplateRef: &tcp.Spec.InfrastructureTemplate,
-		Namespace:   tcp.Namespace,
-		OwnerRef:    infraCloneOwner,
-		ClusterName: cluster.Name,
-	})
+	failureDomain := scaleUpFailureDomain(cluster, controlPlane.Machines)
+
+	machineLabels, machineAnnotations := machineMetadata(tcp, failureDomain)
+
+	hashes, err := machineConfigHashes(tcp)
 	if err != nil {
-		conditions.MarkFalse(tcp, controlplanev1.MachinesCreatedCondition, controlplanev1.InfrastructureTemplateCloningFailedReason,
-			clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+
+	// Adopt the infrastructure machine left over by an interrupted scale up
+	infraRef, err := r.adoptableInfrastructureMachine(ctx, cluster, tcp, controlPlane.Machines)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if infraRef != nil {
+		r.Log.Info("adopting orphaned infrastructure machine", "kind", infraRef.Kind, "name", infraRef.Name)
+
+		if r.Recorder != nil {
+			r.Recorder.Eventf(tcp, corev1.EventTypeNormal, "OrphanAdopted", "Adopted %s %q left over by an interrupted scale up", infraRef.Kind, infraRef.Name)
+		}
+	} else {
+		// Clone the infrastructure template
+		infraRef, err = external.CloneTemplate(ctx, &external.CloneTemplateInput{
+			Client:      r.Client,
+			TemplateRef: &tcp.Spec.InfrastructureTemplate,
+			Namespace:   tcp.Namespace,
+			OwnerRef:    infraCloneOwner,
+			ClusterName: cluster.Name,
+			Labels:      machineLabels,
+			Annotations: machineAnnotations,
+		})
+		if err != nil {
+			conditions.MarkFalse(tcp, controlplanev1.MachinesCreatedCondition, controlplanev1.InfrastructureTemplateCloningFailedReason,
+				clusterv1.ConditionSeverityError, err.Error())
+
+			return ctrl.Result{}, err
+		}
+	}
 
+	machineAnnotations[controlplanev1.ConfigHashAnnotation] = hashes.machine
+	machineAnnotations[controlplanev1.StaticPodConfigHashAnnotation] = hashes.staticPods
+
+	if machineAnnotations[controlplanev1.InstallHashAnnotation], err = installHash(tcp.Spec.Install); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if machineAnnotations[controlplanev1.EtcdConfigHashAnnotation], err = etcdConfigHash(tcp.Spec.Etcd); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	remediation, remediating := tcp.Annotations[controlplanev1.RemediationInProgressAnnotation]
+	if remediating {
+		machineAnnotations[controlplanev1.RemediationForAnnotation] = remediation
+	}
+
 	bootstrapConfig := &tcp.Spec.ControlPlaneConfig.ControlPlaneConfig
 	if !reflect.ValueOf(tcp.Spec.ControlPlaneConfig.InitConfig).IsZero() && first {
 		bootstrapConfig = &tcp.Spec.ControlPlaneConfig.InitConfig
@@ -488,40 +796,60 @@ func (r *TalosControlPlaneReconciler) bootControlPlane(ctx context.Context, clus
 		return ctrl.Result{}, err
 	}
 
+	machineLabels[clusterv1.ClusterLabelName] = cluster.ClusterName
+	machineLabels[clusterv1.MachineControlPlaneLabelName] = ""
+
 	machine := &clusterv1.Machine{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      names.SimpleNameGenerator.GenerateName(tcp.Name + "-"),
-			Namespace: tcp.Namespace,
-			Labels: map[string]string{
-				clusterv1.ClusterLabelName:             cluster.ClusterName,
-				clusterv1.MachineControlPlaneLabelName: "",
-			},
+			Name:        names.SimpleNameGenerator.GenerateName(tcp.Name + "-"),
+			Namespace:   tcp.Namespace,
+			Labels:      machineLabels,
+			Annotations: machineAnnotations,
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")),
 			},
+			Finalizers: []string{
+				controlplanev1.MachineEtcdFinalizer,
+			},
 		},
 		Spec: clusterv1.MachineSpec{
 			ClusterName:       cluster.Name,
-			Version:           &tcp.Spec.Version,
+			Version:           &version,
 			InfrastructureRef: *infraRef,
 			Bootstrap: clusterv1.Bootstrap{
 				ConfigRef: bootstrapRef,
 			},
+			FailureDomain:    failureDomain,
+			NodeDrainTimeout: tcp.Spec.MachineTemplate.NodeDrainTimeout,
 		},
 	}
 
-	failureDomains := r.getFailureDomain(ctx, cluster)
-	if len(failureDomains) > 0 {
-		machine.Spec.FailureDomain = &failureDomains[rand.Intn(len(failureDomains))]
+	operation := auditScaleUp
+
+	switch {
+	case first:
+		operation = auditInitialize
+	case remediating:
+		operation = auditRemediation
+	case conditions.GetReason(tcp, controlplanev1.ResizedCondition) == controlplanev1.RollingUpdateReason:
+		operation = auditRollout
 	}
 
 	if err := r.Client.Create(ctx, machine); err != nil {
 		conditions.MarkFalse(tcp, controlplanev1.MachinesCreatedCondition, controlplanev1.MachineGenerationFailedReason,
 			clusterv1.ConditionSeverityError, err.Error())
 
+		r.audit(tcp, cluster.Name, operation, machine.Name, err, "Failed to create control plane machine")
+
 		return ctrl.Result{}, errors.Wrap(err, "Failed to create machine")
 	}
 
+	r.audit(tcp, cluster.Name, operation, machine.Name, nil, fmt.Sprintf("Created control plane machine with Kubernetes version %s", version))
+
+	if remediating {
+		delete(tcp.Annotations, controlplanev1.RemediationInProgressAnnotation)
+	}
+
 	return ctrl.Result{Requeue: true}, nil
 }
 
@@ -580,6 +908,16 @@ func (r *TalosControlPlaneReconciler) bootstrapCluster(ctx context.Context, tcp
 
 	sort.Strings(addresses)
 
+	if !r.SkipEndpointDNSCheck {
+		if err := verifyEndpointResolves(ctx, cluster.Spec.ControlPlaneEndpoint.Host); err != nil {
+			return err
+		}
+	}
+
+	if r.dryRun(tcp, "bootstrapping etcd on node %q", addresses[0]) {
+		return nil
+	}
+
 	if err := c.Bootstrap(talosclient.WithNodes(ctx, addresses[0]), &machineapi.BootstrapRequest{}); err != nil {
 		if status.Code(err) != codes.AlreadyExists {
 			return err
@@ -598,6 +936,11 @@ func (r *TalosControlPlaneReconciler) generateTalosConfig(ctx context.Context, t
 		BlockOwnerDeletion: pointer.BoolPtr(true),
 	}
 
+	spec, err := renderConfigSpec(tcp, spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render bootstrap configuration")
+	}
+
 	bootstrapConfig := &cabptv1.TalosConfig{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            names.SimpleNameGenerator.GenerateName(tcp.Name + "-"),
@@ -624,10 +967,7 @@ func (r *TalosControlPlaneReconciler) generateTalosConfig(ctx context.Context, t
 
 func (r *TalosControlPlaneReconciler) updateStatus(ctx context.Context, tcp *controlplanev1.TalosControlPlane, cluster *clusterv1.Cluster) error {
 	clusterSelector := &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			clusterv1.ClusterLabelName:             cluster.Name,
-			clusterv1.MachineControlPlaneLabelName: "",
-		},
+		MatchLabels: tcpclient.MachineLabels(cluster.Name),
 	}
 
 	selector, err := metav1.LabelSelectorAsSelector(clusterSelector)
@@ -646,18 +986,23 @@ func (r *TalosControlPlaneReconciler) updateStatus(ctx context.Context, tcp *con
 
 	replicas := int32(len(ownedMachines))
 
+	tcp.Status.Version = lowestVersion(ownedMachines)
+
+	wasInitialized, wasReady := tcp.Status.Initialized, tcp.Status.Ready
+
 	// set basic data that does not require interacting with the workload cluster
 	tcp.Status.Ready = false
 	tcp.Status.Replicas = replicas
 	tcp.Status.ReadyReplicas = 0
 	tcp.Status.UnavailableReplicas = replicas
+	tcp.Status.DisruptionAllowed = 0
 
 	// Return early if the deletion timestamp is set, we don't want to try to connect to the workload cluster.
 	if !tcp.DeletionTimestamp.IsZero() {
 		return nil
 	}
 
-	kubeclient, err := r.kubeconfigForCluster(ctx, util.ObjectKey(cluster))
+	kubeclient, err := r.kubeconfigForCluster(ctx, tcp, util.ObjectKey(cluster))
 	if err != nil {
 		r.Log.Info("failed to get kubeconfig for the cluster", "error", err)
 
@@ -679,9 +1024,13 @@ func (r *TalosControlPlaneReconciler) updateStatus(ctx context.Context, tcp *con
 	if err != nil {
 		r.Log.Info("failed to list controlplane nodes", "error", err)
 
+		markWorkloadAPIUnreachable(tcp, err)
+
 		return nil
 	}
 
+	conditions.MarkTrue(tcp, controlplanev1.WorkloadAPIReachableCondition)
+
 	for _, node := range nodes.Items {
 		if util.IsNodeReady(&node) {
 			tcp.Status.ReadyReplicas++
@@ -699,11 +1048,61 @@ func (r *TalosControlPlaneReconciler) updateStatus(ctx context.Context, tcp *con
 		tcp.Status.Ready = true
 	}
 
+	r.provisioning.observe(tcp, cluster.Name, wasInitialized, wasReady)
+
+	healthy := conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) &&
+		conditions.IsTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition)
+
+	tcp.Status.DisruptionAllowed = disruptionAllowed(replicas, tcp.Status.ReadyReplicas, healthy)
+
 	r.Log.Info("ready replicas", "count", tcp.Status.ReadyReplicas)
 
 	return nil
 }
 
+// markWorkloadAPIUnreachable reports the workload cluster Kubernetes API failure, telling the broken
+// control plane endpoint apart from the control plane being down using the health checks done via the Talos API.
+func markWorkloadAPIUnreachable(tcp *controlplanev1.TalosControlPlane, err error) {
+	if certificateUntrusted(err) {
+		source := "the kubeconfig CA"
+		if ref := tcp.Spec.ControlPlaneConfig.APIServerCASecretRef; ref != nil {
+			source = fmt.Sprintf("the CA from secret %q", ref.Name)
+		}
+
+		conditions.MarkFalse(tcp, controlplanev1.WorkloadAPIReachableCondition, controlplanev1.APIServerCertificateUntrustedReason,
+			clusterv1.ConditionSeverityError, "API server certificate is not trusted by %s: %s", source, err)
+
+		return
+	}
+
+	if conditions.IsTrue(tcp, controlplanev1.EtcdClusterHealthyCondition) &&
+		conditions.IsTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition) {
+		conditions.MarkFalse(tcp, controlplanev1.WorkloadAPIReachableCondition, controlplanev1.ControlPlaneEndpointUnreachableReason,
+			clusterv1.ConditionSeverityWarning, "etcd and control plane components are healthy, but the API is unreachable: %s", err)
+
+		return
+	}
+
+	conditions.MarkFalse(tcp, controlplanev1.WorkloadAPIReachableCondition, controlplanev1.ControlPlaneDownReason,
+		clusterv1.ConditionSeverityError, "control plane is unhealthy and the API is unreachable: %s", err)
+}
+
+// disruptionAllowed returns the number of ready control plane machines which can go away
+// while the rest of them still keeps etcd quorum.
+func disruptionAllowed(replicas, readyReplicas int32, healthy bool) int32 {
+	if !healthy || replicas == 0 {
+		return 0
+	}
+
+	quorum := replicas/2 + 1
+
+	if readyReplicas <= quorum {
+		return 0
+	}
+
+	return readyReplicas - quorum
+}
+
 func (r *TalosControlPlaneReconciler) reconcileExternalReference(ctx context.Context, ref corev1.ObjectReference, cluster *clusterv1.Cluster) error {
 	obj, err := external.Get(ctx, r.Client, &ref, cluster.Namespace)
 	if err != nil {
@@ -732,27 +1131,35 @@ func (r *TalosControlPlaneReconciler) reconcileKubeconfig(ctx context.Context, c
 	}
 
 	clusterName := util.ObjectKey(cluster)
-	_, err := secret.GetFromNamespacedName(ctx, r.Client, clusterName, secret.Kubeconfig)
+	kubeconfigSecret, err := secret.GetFromNamespacedName(ctx, r.Client, clusterName, secret.Kubeconfig)
 	switch {
 	case apierrors.IsNotFound(err):
-		createErr := kubeconfig.CreateSecretWithOwner(
-			ctx,
-			r.Client,
-			clusterName,
-			endpoint.String(),
-			*metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")),
-		)
-		if createErr != nil {
-			if errors.Is(createErr, kubeconfig.ErrDependentCertificateNotFound) {
+		data, generateErr := r.generateKubeconfig(ctx, clusterName, endpoint.String())
+		if generateErr != nil {
+			if errors.Is(generateErr, kubeconfig.ErrDependentCertificateNotFound) {
 				r.Log.Info("could not find secret", "secret", secret.ClusterCA, "cluster", clusterName.Name, "namespace", clusterName.Namespace)
 
 				return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
 			}
 
+			return ctrl.Result{}, generateErr
+		}
+
+		kubeconfigSecret := kubeconfig.GenerateSecretWithOwner(
+			clusterName,
+			data,
+			*metav1.NewControllerRef(tcp, controlplanev1.GroupVersion.WithKind("TalosControlPlane")),
+		)
+		kubeconfigSecret.Labels[controlplanev1.TalosControlPlaneLabel] = tcp.Name
+
+		createErr := r.Client.Create(ctx, kubeconfigSecret)
+		if createErr != nil {
 			return ctrl.Result{}, createErr
 		}
 	case err != nil:
 		return ctrl.Result{RequeueAfter: 20 * time.Second}, errors.Wrapf(err, "failed to retrieve kubeconfig Secret for Cluster %q in namespace %q", clusterName.Name, clusterName.Namespace)
+	default:
+		return r.renewKubeconfig(ctx, cluster, tcp, machines, kubeconfigSecret)
 	}
 
 	return ctrl.Result{}, nil
@@ -760,13 +1167,44 @@ func (r *TalosControlPlaneReconciler) reconcileKubeconfig(ctx context.Context, c
 
 func (r *TalosControlPlaneReconciler) reconcileEtcdMembers(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (result ctrl.Result, err error) {
 	var errs error
-	// Audit the etcd member list to remove any nodes that no longer exist
-	if err := r.auditEtcd(ctx, tcp, util.ObjectKey(cluster), tcp.Name); err != nil {
-		errs = kerrors.NewAggregate([]error{errs, err})
+	// Audit the etcd member list to remove any nodes that no longer exist,
+	// the members of the kubeadm machines are kept until they are retired by the migration
+	if !kubeadmMigrationInProgress(tcp) {
+		if err := r.auditEtcd(ctx, tcp, util.ObjectKey(cluster), tcp.Name); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	// the condition type used to be named "EtcdClusterHealthyCondition"
+	conditions.Delete(tcp, legacyEtcdClusterHealthyCondition)
+
+	var learner *errEtcdLearner
+
+	problems, err := r.etcdHealthcheck(ctx, tcp, cluster, machines)
+	learning := errors.As(err, &learner)
+
+	if problems != nil {
+		if updateErr := r.updateEtcdMemberConditions(ctx, machines, problems, learner); updateErr != nil {
+			errs = kerrors.NewAggregate([]error{errs, updateErr})
+		}
 	}
 
-	if err := r.etcdHealthcheck(ctx, tcp, cluster, machines); err != nil {
-		conditions.MarkFalse(tcp, controlplanev1.EtcdClusterHealthyCondition, controlplanev1.EtcdClusterUnhealthyReason,
+	if learning {
+		if learner.stuck() {
+			if r.Recorder != nil && conditions.GetReason(tcp, controlplanev1.EtcdClusterHealthyCondition) != controlplanev1.EtcdLearnerNotPromotedReason {
+				r.Recorder.Eventf(tcp, corev1.EventTypeWarning, "EtcdLearnerNotPromoted", "%s", learner.Error())
+			}
+
+			conditions.MarkFalse(tcp, controlplanev1.EtcdClusterHealthyCondition, controlplanev1.EtcdLearnerNotPromotedReason,
+				clusterv1.ConditionSeverityError, learner.Error())
+		} else {
+			conditions.MarkFalse(tcp, controlplanev1.EtcdClusterHealthyCondition, controlplanev1.EtcdLearnerPromotingReason,
+				clusterv1.ConditionSeverityInfo, learner.Error())
+		}
+
+		result.RequeueAfter = 10 * time.Second
+	} else if err != nil {
+		conditions.MarkFalse(tcp, controlplanev1.EtcdClusterHealthyCondition, errorReason(err, controlplanev1.EtcdClusterUnhealthyReason),
 			clusterv1.ConditionSeverityWarning, err.Error())
 		errs = kerrors.NewAggregate([]error{errs, err})
 	} else {
@@ -777,25 +1215,153 @@ func (r *TalosControlPlaneReconciler) reconcileEtcdMembers(ctx context.Context,
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, errs
 	}
 
+	return result, nil
+}
+
+// reconcileMachineFinalizers makes sure the control plane machines have the etcd finalizer and releases it from
+// the deleted machines only after their etcd member is gone, no matter who has deleted the machine.
+func (r *TalosControlPlaneReconciler) reconcileMachineFinalizers(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (result ctrl.Result, err error) {
+	var (
+		errs    error
+		waiting bool
+	)
+
+	for _, machine := range machines {
+		machine := machine
+
+		hasFinalizer := controllerutil.ContainsFinalizer(&machine, controlplanev1.MachineEtcdFinalizer)
+
+		if machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			if !hasFinalizer {
+				if err := r.updateMachineFinalizer(ctx, &machine, true); err != nil {
+					errs = kerrors.NewAggregate([]error{errs, err})
+				}
+			}
+
+			continue
+		}
+
+		if !hasFinalizer {
+			continue
+		}
+
+		pending, err := r.reconcilePreDrainHook(ctx, tcp, &machine)
+		if err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		if pending {
+			r.Log.Info("waiting for pre-drain hook before removing etcd member", "machine", machine.Name)
+
+			waiting = true
+
+			continue
+		}
+
+		if err := r.removeEtcdMemberForMachine(ctx, tcp, util.ObjectKey(cluster), machines, machine); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+
+			continue
+		}
+
+		r.Log.Info("etcd member removed, releasing machine", "machine", machine.Name)
+
+		if err := r.updateMachineFinalizer(ctx, &machine, false); err != nil {
+			errs = kerrors.NewAggregate([]error{errs, err})
+		}
+	}
+
+	if errs != nil || waiting {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, errs
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// updateMachineFinalizer adds or removes the etcd finalizer on the machine.
+func (r *TalosControlPlaneReconciler) updateMachineFinalizer(ctx context.Context, machine *clusterv1.Machine, present bool) error {
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	if present {
+		controllerutil.AddFinalizer(machine, controlplanev1.MachineEtcdFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(machine, controlplanev1.MachineEtcdFinalizer)
+	}
+
+	return patchHelper.Patch(ctx, machine)
+}
+
 func (r *TalosControlPlaneReconciler) reconcileNodeHealth(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (result ctrl.Result, err error) {
 	if err := r.nodesHealthcheck(ctx, tcp, cluster, machines); err != nil {
 		reason := controlplanev1.ControlPlaneComponentsInspectionFailedReason
 
-		if errors.Is(err, &errServiceUnhealthy{}) {
+		var (
+			notReady  *errMachineNotReady
+			unhealthy *errServiceUnhealthy
+		)
+
+		switch {
+		case errors.As(err, &unhealthy):
 			reason = controlplanev1.ControlPlaneComponentsUnhealthyReason
+		case errors.As(err, &notReady):
+			reason = controlplanev1.MachineNotReadyReason
+		default:
+			reason = errorReason(err, reason)
 		}
 
 		conditions.MarkFalse(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition, reason,
 			clusterv1.ConditionSeverityWarning, err.Error())
 
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, err
-	} else {
-		conditions.MarkTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition)
 	}
 
+	if err := r.resourcePressureCheck(ctx, tcp, machines); err != nil {
+		var pressure *errResourcePressure
+
+		if errors.As(err, &pressure) {
+			conditions.MarkFalse(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition, pressure.reason,
+				clusterv1.ConditionSeverityWarning, err.Error())
+
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+
+		conditions.MarkFalse(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition, errorReason(err, controlplanev1.ControlPlaneComponentsInspectionFailedReason),
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, err
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.ControlPlaneComponentsHealthyCondition)
+
+	return ctrl.Result{}, nil
+}
+
+func (r *TalosControlPlaneReconciler) reconcileTimeSync(ctx context.Context, cluster *clusterv1.Cluster, tcp *controlplanev1.TalosControlPlane, machines []clusterv1.Machine) (result ctrl.Result, err error) {
+	if err := r.timeSyncHealthcheck(ctx, tcp, cluster, machines); err != nil {
+		var drift *errClockDrift
+
+		if errors.As(err, &drift) {
+			conditions.MarkFalse(tcp, controlplanev1.ClockSynchronizedCondition, controlplanev1.ClockDriftedReason,
+				clusterv1.ConditionSeverityWarning, err.Error())
+
+			return ctrl.Result{}, nil
+		}
+
+		r.Log.Info("failed to inspect control plane node clocks", "error", err)
+
+		conditions.MarkFalse(tcp, controlplanev1.ClockSynchronizedCondition, errorReason(err, controlplanev1.ClockInspectionFailedReason),
+			clusterv1.ConditionSeverityWarning, err.Error())
+
+		return ctrl.Result{}, nil
+	}
+
+	conditions.MarkTrue(tcp, controlplanev1.ClockSynchronizedCondition)
+
 	return ctrl.Result{}, nil
 }
 
@@ -820,23 +1386,70 @@ func (r *TalosControlPlaneReconciler) reconcileMachines(ctx context.Context, clu
 
 	controlPlane := newControlPlane(cluster, tcp, machines)
 
+	tcp.Status.PendingVersion = ""
+
+	if kubeadmMigrationBlocksMachines(tcp) {
+		logger.Info("postponing machine creation until the migration from KubeadmControlPlane starts")
+
+		return ctrl.Result{}, nil
+	}
+
+	var outdated []clusterv1.Machine
+
+	if tcp.Status.Rollout != nil && numMachines >= desiredReplicas {
+		if outdated, err = r.outdatedMachines(ctx, tcp, machines); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	rollingUpdate := len(outdated) > 0 && rolloutStrategyType(tcp) == controlplanev1.RollingUpdateStrategyType
+
+	if operation, ok := etcdMaintenanceInProgress(tcp); ok && numMachines > 0 && (numMachines != desiredReplicas || rollingUpdate) {
+		logger.Info("postponing scaling until etcd maintenance completes", "operation", operation)
+
+		conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.EtcdMaintenanceReason, clusterv1.ConditionSeverityInfo,
+			"Waiting for etcd %s to complete", operation)
+
+		return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+	}
+
+	if rollingUpdate && tcp.Status.Bootstrapped && numMachines == desiredReplicas && !changeApproved(tcp, controlplanev1.ReplacementChangeStrategy) {
+		logger.Info("postponing rollout until the change is approved", "outdated", len(outdated))
+
+		conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.ChangeApprovalRequiredReason, clusterv1.ConditionSeverityInfo,
+			"Waiting for approval to replace %d outdated machine(s)", len(outdated))
+
+		return ctrl.Result{}, nil
+	}
+
 	switch {
 	// We are creating the first replica
 	case numMachines < desiredReplicas && numMachines == 0:
 		// Create new Machine w/ init
 		logger.Info("initializing control plane", "Desired", desiredReplicas, "Existing", numMachines)
 
-		return r.bootControlPlane(ctx, cluster, tcp, controlPlane, true)
+		return r.bootControlPlane(ctx, cluster, tcp, controlPlane, tcp.Spec.Version, true)
 	// We are scaling up
 	case numMachines < desiredReplicas && numMachines > 0:
-		conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.ScalingUpReason, clusterv1.ConditionSeverityWarning,
-			"Scaling up control plane to %d replicas (actual %d)",
-			desiredReplicas, numMachines)
+		version := scaleUpVersion(tcp, machines)
+
+		if conditions.GetReason(tcp, controlplanev1.ResizedCondition) == controlplanev1.RollingUpdateReason {
+			// replacing the outdated machine deleted by the rollout without surge
+			version = tcp.Spec.Version
+		} else {
+			conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.ScalingUpReason, clusterv1.ConditionSeverityWarning,
+				"Scaling up control plane to %d replicas (actual %d)",
+				desiredReplicas, numMachines)
+		}
+
+		if version != tcp.Spec.Version {
+			tcp.Status.PendingVersion = tcp.Spec.Version
+		}
 
 		// Create a new Machine w/ join
-		logger.Info("scaling up control plane", "Desired", desiredReplicas, "Existing", numMachines)
+		logger.Info("scaling up control plane", "Desired", desiredReplicas, "Existing", numMachines, "Version", version)
 
-		return r.bootControlPlane(ctx, cluster, tcp, controlPlane, false)
+		return r.bootControlPlane(ctx, cluster, tcp, controlPlane, version, false)
 	// We are scaling down
 	case numMachines > desiredReplicas:
 		conditions.MarkFalse(tcp, controlplanev1.ResizedCondition, controlplanev1.ScalingDownReason, clusterv1.ConditionSeverityWarning,
@@ -865,7 +1478,7 @@ func (r *TalosControlPlaneReconciler) reconcileMachines(ctx context.Context, clu
 
 		logger.Info("scaling down control plane", "Desired", desiredReplicas, "Existing", numMachines)
 
-		res, err = r.scaleDownControlPlane(ctx, tcp, util.ObjectKey(cluster), controlPlane.TCP.Name, machines)
+		res, err = r.scaleDownControlPlane(ctx, tcp, util.ObjectKey(cluster), controlPlane.TCP.Name, machines, outdated)
 		if err != nil {
 			if res.Requeue || res.RequeueAfter > 0 {
 				logger.Info("failed to scale down control plane", "error", err)
@@ -875,6 +1488,11 @@ func (r *TalosControlPlaneReconciler) reconcileMachines(ctx context.Context, clu
 		}
 
 		return res, err
+	// We are replacing the outdated machines, with OnDelete they are replaced only once deleted manually
+	case rollingUpdate && tcp.Status.Bootstrapped:
+		logger.Info("rolling out control plane", "Desired", desiredReplicas, "Outdated", len(outdated))
+
+		return r.rolloutControlPlane(ctx, cluster, tcp, controlPlane, machines, outdated)
 	default:
 		if !reflect.ValueOf(tcp.Spec.ControlPlaneConfig.InitConfig).IsZero() {
 			tcp.Status.Bootstrapped = true
@@ -883,7 +1501,13 @@ func (r *TalosControlPlaneReconciler) reconcileMachines(ctx context.Context, clu
 
 		if !tcp.Status.Bootstrapped {
 			if err := r.bootstrapCluster(ctx, tcp, cluster, machines); err != nil {
-				conditions.MarkFalse(tcp, controlplanev1.MachinesBootstrapped, controlplanev1.WaitingForTalosBootReason, clusterv1.ConditionSeverityInfo, err.Error())
+				var notResolved *errEndpointNotResolved
+
+				if errors.As(err, &notResolved) {
+					conditions.MarkFalse(tcp, controlplanev1.MachinesBootstrapped, controlplanev1.EndpointNotResolvedReason, clusterv1.ConditionSeverityWarning, err.Error())
+				} else {
+					conditions.MarkFalse(tcp, controlplanev1.MachinesBootstrapped, controlplanev1.WaitingForTalosBootReason, clusterv1.ConditionSeverityInfo, err.Error())
+				}
 
 				logger.Info("bootstrap failed, retrying in 20 seconds", "error", err)
 
@@ -893,6 +1517,8 @@ func (r *TalosControlPlaneReconciler) reconcileMachines(ctx context.Context, clu
 			conditions.MarkTrue(tcp, controlplanev1.MachinesBootstrapped)
 
 			tcp.Status.Bootstrapped = true
+
+			r.audit(tcp, cluster.Name, auditBootstrap, "", nil, "Bootstrapped the cluster")
 		}
 
 		if conditions.Has(tcp, controlplanev1.MachinesReadyCondition) {
@@ -935,3 +1561,75 @@ func patchTalosControlPlane(ctx context.Context, patchHelper *patch.Helper, tcp
 		opts...,
 	)
 }
+
+// updateFailureBudget tracks consecutive reconcile failures and reports the TalosControlPlane as degraded
+// once they reach the threshold.
+func (r *TalosControlPlaneReconciler) updateFailureBudget(tcp *controlplanev1.TalosControlPlane, reconcileErr error) {
+	if reconcileErr == nil {
+		tcp.Status.ConsecutiveFailures = 0
+
+		conditions.Delete(tcp, controlplanev1.OperatorDegradedCondition)
+
+		return
+	}
+
+	tcp.Status.ConsecutiveFailures++
+
+	threshold := r.DegradedFailureThreshold
+	if threshold <= 0 {
+		threshold = defaultDegradedFailureThreshold
+	}
+
+	if tcp.Status.ConsecutiveFailures < threshold {
+		return
+	}
+
+	conditions.Set(tcp, &clusterv1.Condition{
+		Type:     controlplanev1.OperatorDegradedCondition,
+		Status:   corev1.ConditionTrue,
+		Severity: clusterv1.ConditionSeverityError,
+		Reason:   controlplanev1.ReconcileFailingReason,
+		Message:  fmt.Sprintf("%d consecutive reconciles failed, last error: %s", tcp.Status.ConsecutiveFailures, reconcileErr),
+	})
+}
+
+// setReconcileHint publishes when the controller is going to check the TalosControlPlane again and why,
+// so that external tools waiting for the control plane can poll accordingly.
+//
+// The hint is cleared once there is nothing to wait for.
+func setReconcileHint(tcp *controlplanev1.TalosControlPlane, res ctrl.Result, reconcileErr error) {
+	if reconcileErr == nil && !res.Requeue && res.RequeueAfter <= 0 {
+		tcp.Status.NextReconcileHint = nil
+
+		return
+	}
+
+	hint := &controlplanev1.ReconcileHint{}
+
+	for _, conditionType := range []clusterv1.ConditionType{
+		controlplanev1.MachinesCreatedCondition,
+		controlplanev1.ResizedCondition,
+		controlplanev1.MachinesBootstrapped,
+		controlplanev1.AvailableCondition,
+		controlplanev1.MachinesReadyCondition,
+	} {
+		if conditions.IsFalse(tcp, conditionType) {
+			hint.Reason = conditions.GetReason(tcp, conditionType)
+
+			break
+		}
+	}
+
+	if reconcileErr == nil && res.RequeueAfter > 0 {
+		// keep the planned time while it's still ahead, as every status update triggers another reconcile
+		if previous := tcp.Status.NextReconcileHint; previous != nil && previous.Reason == hint.Reason &&
+			previous.After != nil && previous.After.After(time.Now()) {
+			hint.After = previous.After
+		} else {
+			after := metav1.NewTime(time.Now().Add(res.RequeueAfter).Truncate(time.Second))
+			hint.After = &after
+		}
+	}
+
+	tcp.Status.NextReconcileHint = hint
+}
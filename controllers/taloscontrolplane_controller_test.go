@@ -0,0 +1,281 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	cabptv1 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+func TestDisruptionAllowed(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		replicas      int32
+		readyReplicas int32
+		healthy       bool
+		expected      int32
+	}{
+		{
+			name: "no machines",
+		},
+		{
+			name:          "single machine",
+			replicas:      1,
+			readyReplicas: 1,
+			healthy:       true,
+		},
+		{
+			name:          "two machines",
+			replicas:      2,
+			readyReplicas: 2,
+			healthy:       true,
+		},
+		{
+			name:          "three ready machines",
+			replicas:      3,
+			readyReplicas: 3,
+			healthy:       true,
+			expected:      1,
+		},
+		{
+			name:          "three machines with one not ready",
+			replicas:      3,
+			readyReplicas: 2,
+			healthy:       true,
+		},
+		{
+			name:          "five ready machines",
+			replicas:      5,
+			readyReplicas: 5,
+			healthy:       true,
+			expected:      2,
+		},
+		{
+			name:          "five machines with one not ready",
+			replicas:      5,
+			readyReplicas: 4,
+			healthy:       true,
+			expected:      1,
+		},
+		{
+			name:          "four ready machines",
+			replicas:      4,
+			readyReplicas: 4,
+			healthy:       true,
+			expected:      1,
+		},
+		{
+			name:          "unhealthy",
+			replicas:      3,
+			readyReplicas: 3,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, disruptionAllowed(tt.replicas, tt.readyReplicas, tt.healthy))
+		})
+	}
+}
+
+func TestRunReconcilePhases(t *testing.T) {
+	type step struct {
+		name   string
+		result ctrl.Result
+		err    error
+	}
+
+	for _, tt := range []struct {
+		name     string
+		steps    []step
+		ran      []string
+		expected ctrl.Result
+		err      bool
+	}{
+		{
+			name: "lowest requeue",
+			steps: []step{
+				{name: "first", result: ctrl.Result{RequeueAfter: 30 * time.Second}},
+				{name: "second", result: ctrl.Result{RequeueAfter: 10 * time.Second}},
+				{name: "third"},
+			},
+			ran:      []string{"first", "second", "third"},
+			expected: ctrl.Result{RequeueAfter: 10 * time.Second},
+		},
+		{
+			name: "errors don't stop the phases",
+			steps: []step{
+				{name: "first", err: errors.New("first failed")},
+				{name: "second", result: ctrl.Result{RequeueAfter: 10 * time.Second}},
+				{name: "third", err: errors.New("third failed")},
+			},
+			ran:      []string{"first", "second", "third"},
+			expected: ctrl.Result{RequeueAfter: 10 * time.Second},
+			err:      true,
+		},
+		{
+			name: "requeue skips the rest",
+			steps: []step{
+				{name: "first", result: ctrl.Result{RequeueAfter: 10 * time.Second}},
+				{name: "second", result: ctrl.Result{Requeue: true}},
+				{name: "third"},
+			},
+			ran:      []string{"first", "second"},
+			expected: ctrl.Result{Requeue: true},
+		},
+		{
+			name: "failed requeue",
+			steps: []step{
+				{name: "first", result: ctrl.Result{Requeue: true}, err: errors.New("first failed")},
+				{name: "second"},
+			},
+			ran:      []string{"first"},
+			expected: ctrl.Result{Requeue: true},
+			err:      true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+
+			phases := make([]reconcilePhase, 0, len(tt.steps))
+
+			for _, s := range tt.steps {
+				s := s
+
+				phases = append(phases, func(context.Context, *clusterv1.Cluster, *controlplanev1.TalosControlPlane, []clusterv1.Machine) (ctrl.Result, error) {
+					ran = append(ran, s.name)
+
+					return s.result, s.err
+				})
+			}
+
+			result, err := runReconcilePhases(context.Background(), &clusterv1.Cluster{}, &controlplanev1.TalosControlPlane{}, nil, phases, nil)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tt.ran, ran)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestReconcilePhases(t *testing.T) {
+	r := &TalosControlPlaneReconciler{}
+
+	names := map[string]struct{}{}
+
+	var order []string
+
+	for _, phase := range r.reconcilePhases() {
+		name := phaseName(phase)
+
+		assert.NotContains(t, names, name, "phase %s runs twice", name)
+
+		names[name] = struct{}{}
+		order = append(order, name)
+	}
+
+	// the migration decides whether the machines are created at all
+	assert.Equal(t, "reconcileKubeadmMigration", order[0])
+
+	// the phases requeueing after changing the set of the machines go last
+	assert.Equal(t, []string{"reconcileRemediation", "reconcileMachines"}, order[len(order)-2:])
+}
+
+var _ = Describe("Reconcile", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		r         *TalosControlPlaneReconciler
+		recorder  *record.FakeRecorder
+		cluster   *clusterv1.Cluster
+		tcp       *controlplanev1.TalosControlPlane
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newTestNamespace(ctx)
+		recorder = record.NewFakeRecorder(8)
+
+		r = &TalosControlPlaneReconciler{
+			Client:   k8sClient,
+			Log:      logr.Discard(),
+			Scheme:   scheme.Scheme,
+			Recorder: recorder,
+		}
+
+		// any object served by the test environment stands in for the infrastructure template
+		template := &cabptv1.TalosConfigTemplate{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-template"},
+			Spec: cabptv1.TalosConfigTemplateSpec{
+				Template: cabptv1.TalosConfigTemplateResource{Spec: cabptv1.TalosConfigSpec{GenerateType: "controlplane"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, template)).To(Succeed())
+
+		cluster = &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test"},
+			Spec: clusterv1.ClusterSpec{
+				ControlPlaneEndpoint: clusterv1.APIEndpoint{Host: "10.5.0.1", Port: 6443},
+			},
+		}
+		Expect(k8sClient.Create(ctx, cluster)).To(Succeed())
+
+		tcp = &controlplanev1.TalosControlPlane{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "test-cp", UID: "test-cp-uid"},
+			Spec: controlplanev1.TalosControlPlaneSpec{
+				Replicas: pointer.Int32Ptr(1),
+				Version:  "v1.22.2",
+				InfrastructureTemplate: corev1.ObjectReference{
+					APIVersion: cabptv1.GroupVersion.String(),
+					Kind:       "TalosConfigTemplate",
+					Namespace:  namespace,
+					Name:       "test-template",
+				},
+			},
+		}
+	})
+
+	It("skips the phases once the machine handover requeues", func() {
+		machine := newTestMachine(ctx, namespace, "cp-1", map[string]string{controlplanev1.AdoptMachineAnnotation: "test-cp"})
+		machine.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "cluster.x-k8s.io/v1beta1", Kind: "MachineSet", Name: "workers", UID: "workers-uid", Controller: pointer.BoolPtr(true)},
+		}
+		Expect(k8sClient.Update(ctx, machine)).To(Succeed())
+
+		result, err := r.reconcile(ctx, cluster, tcp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{Requeue: true}))
+
+		Expect(recorder.Events).To(Receive(ContainSubstring("AdoptionRefused")))
+
+		// none of the phases ran against the outdated set of the machines
+		Expect(conditions.Has(tcp, controlplanev1.MachinesReadyCondition)).To(BeFalse())
+		Expect(recorder.Events).To(BeEmpty())
+	})
+})
@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// blockingConditions are checked in order to find the step a timed out operation is blocked on.
+var blockingConditions = []clusterv1.ConditionType{
+	controlplanev1.MachinesCreatedCondition,
+	controlplanev1.ResizedCondition,
+	controlplanev1.MachinesBootstrapped,
+	controlplanev1.AvailableCondition,
+	controlplanev1.MachinesReadyCondition,
+	controlplanev1.EtcdClusterHealthyCondition,
+	controlplanev1.ControlPlaneComponentsHealthyCondition,
+}
+
+// updateOperationTimeouts tracks the start of the scale up and reports the control plane changes
+// which take longer than the configured timeouts.
+//
+// It runs after the status is updated, so that the replicas are up to date.
+func (r *TalosControlPlaneReconciler) updateOperationTimeouts(tcp *controlplanev1.TalosControlPlane) {
+	now := time.Now()
+
+	if tcp.Spec.Replicas != nil && tcp.Status.Replicas < *tcp.Spec.Replicas && tcp.ObjectMeta.DeletionTimestamp.IsZero() {
+		if tcp.Status.ScaleUpStartTime == nil {
+			startTime := metav1.NewTime(now)
+			tcp.Status.ScaleUpStartTime = &startTime
+		}
+	} else {
+		tcp.Status.ScaleUpStartTime = nil
+	}
+
+	timeouts := tcp.Spec.OperationTimeouts
+
+	if timeouts == nil || !tcp.ObjectMeta.DeletionTimestamp.IsZero() {
+		conditions.Delete(tcp, controlplanev1.OperationTimedOutCondition)
+
+		return
+	}
+
+	var reason, operation string
+
+	switch {
+	case timedOut(timeouts.Rollout, rolloutStartTime(tcp), now):
+		reason, operation = controlplanev1.RolloutTimedOutReason, fmt.Sprintf("rollout (%s) didn't complete within %s", tcp.Status.Rollout.Reason, timeouts.Rollout.Duration)
+	case timedOut(timeouts.ScaleUp, tcp.Status.ScaleUpStartTime, now):
+		reason, operation = controlplanev1.ScaleUpTimedOutReason, fmt.Sprintf("scale up to %d replicas didn't complete within %s", *tcp.Spec.Replicas, timeouts.ScaleUp.Duration)
+	default:
+		conditions.Delete(tcp, controlplanev1.OperationTimedOutCondition)
+
+		return
+	}
+
+	message := fmt.Sprintf("%s, blocked on %s", operation, blockedStep(tcp))
+
+	if r.Recorder != nil && conditions.GetReason(tcp, controlplanev1.OperationTimedOutCondition) != reason {
+		r.Recorder.Eventf(tcp, corev1.EventTypeWarning, reason, "%s", message)
+	}
+
+	conditions.Set(tcp, &clusterv1.Condition{
+		Type:     controlplanev1.OperationTimedOutCondition,
+		Status:   corev1.ConditionTrue,
+		Severity: clusterv1.ConditionSeverityError,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+func rolloutStartTime(tcp *controlplanev1.TalosControlPlane) *metav1.Time {
+	if tcp.Status.Rollout == nil {
+		return nil
+	}
+
+	return tcp.Status.Rollout.StartTime
+}
+
+func timedOut(timeout *metav1.Duration, startTime *metav1.Time, now time.Time) bool {
+	return timeout != nil && startTime != nil && now.Sub(startTime.Time) > timeout.Duration
+}
+
+// blockedStep describes the first condition which is not satisfied.
+func blockedStep(tcp *controlplanev1.TalosControlPlane) string {
+	for _, conditionType := range blockingConditions {
+		condition := conditions.Get(tcp, conditionType)
+		if condition == nil || condition.Status == corev1.ConditionTrue {
+			continue
+		}
+
+		if condition.Message == "" {
+			return fmt.Sprintf("%s (%s)", condition.Type, condition.Reason)
+		}
+
+		return fmt.Sprintf("%s (%s): %s", condition.Type, condition.Reason, condition.Message)
+	}
+
+	return "an unknown step"
+}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// VersionRange is the range of Kubernetes versions supported by the provider build.
+//
+// Nil bounds are not checked.
+type VersionRange struct {
+	Min *semver.Version
+	Max *semver.Version
+}
+
+// ParseVersionRange parses the range bounds, empty strings leave the bound unset.
+func ParseVersionRange(min, max string) (VersionRange, error) {
+	var (
+		vr  VersionRange
+		err error
+	)
+
+	if min != "" {
+		if vr.Min, err = parseKubernetesVersion(min); err != nil {
+			return vr, fmt.Errorf("invalid minimum Kubernetes version: %w", err)
+		}
+	}
+
+	if max != "" {
+		if vr.Max, err = parseKubernetesVersion(max); err != nil {
+			return vr, fmt.Errorf("invalid maximum Kubernetes version: %w", err)
+		}
+	}
+
+	if vr.Min != nil && vr.Max != nil && vr.Max.LessThan(*vr.Min) {
+		return vr, fmt.Errorf("maximum Kubernetes version %s is lower than minimum %s", vr.Max, vr.Min)
+	}
+
+	return vr, nil
+}
+
+// Validate checks that the version is within the range.
+func (vr VersionRange) Validate(version string) error {
+	v, err := parseKubernetesVersion(version)
+	if err != nil {
+		return err
+	}
+
+	if vr.Min != nil && v.LessThan(*vr.Min) {
+		return fmt.Errorf("Kubernetes version %s is not supported by this provider, minimum supported version is v%s", version, vr.Min)
+	}
+
+	if vr.Max != nil && vr.Max.LessThan(*v) {
+		return fmt.Errorf("Kubernetes version %s is not supported by this provider, maximum supported version is v%s", version, vr.Max)
+	}
+
+	return nil
+}
+
+func parseKubernetesVersion(version string) (*semver.Version, error) {
+	return semver.NewVersion(strings.TrimPrefix(version, "v"))
+}
+
+// lowestVersion returns the lowest Kubernetes version of the machines, or an empty string if none of the versions is valid.
+func lowestVersion(machines []clusterv1.Machine) string {
+	var (
+		lowest        *semver.Version
+		lowestVersion string
+	)
+
+	for _, machine := range machines {
+		if machine.Spec.Version == nil {
+			continue
+		}
+
+		v, err := parseKubernetesVersion(*machine.Spec.Version)
+		if err != nil {
+			continue
+		}
+
+		if lowest == nil || v.LessThan(*lowest) {
+			lowest, lowestVersion = v, *machine.Spec.Version
+		}
+	}
+
+	return lowestVersion
+}
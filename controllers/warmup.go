@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// warmupGate holds the reconciles back until the in-memory state of the controller is restored.
+//
+// The gate is open unless it's armed, so the reconciler works without the warm up as well (e.g. in tests).
+type warmupGate struct {
+	done chan struct{}
+}
+
+func (g *warmupGate) arm() {
+	g.done = make(chan struct{})
+}
+
+func (g *warmupGate) open() {
+	close(g.done)
+}
+
+// wait blocks until the gate is open or the context is canceled.
+func (g *warmupGate) wait(ctx context.Context) error {
+	if g.done == nil {
+		return nil
+	}
+
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// warmCaches restores the per-cluster state of the controller from the persisted TalosControlPlane status.
+//
+// It runs once the manager becomes the leader, before the queued reconciles are processed.
+// Without it, the new leader treats every control plane as never seen before: all the membership audits
+// are due at once right after the failover, and the control planes which became ready meanwhile are
+// reported as provisioned again.
+// The warm up is best effort, failing to restore the state only costs the extra work.
+func (r *TalosControlPlaneReconciler) warmCaches(ctx context.Context) error {
+	defer r.warmup.open()
+
+	start := time.Now()
+
+	var tcps controlplanev1.TalosControlPlaneList
+
+	if err := r.APIReader.List(ctx, &tcps); err != nil {
+		r.Log.Error(err, "failed to list control planes to warm up caches")
+
+		return nil
+	}
+
+	audited := []*controlplanev1.TalosControlPlane{}
+
+	for i := range tcps.Items {
+		tcp := &tcps.Items[i]
+
+		if !tcp.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if tcp.Status.Ready {
+			r.provisioning.seed(tcp.UID)
+		}
+
+		if tcp.Status.Ready && conditions.IsTrue(tcp, controlplanev1.MembershipConsistentCondition) {
+			audited = append(audited, tcp)
+		}
+
+		if clusterName, ok := tcp.Labels[clusterv1.ClusterLabelName]; ok && r.MaxConcurrentTalosCalls > 0 {
+			r.talosRPCLimiter.get(client.ObjectKey{Namespace: tcp.Namespace, Name: clusterName}, r.MaxConcurrentTalosCalls)
+		}
+	}
+
+	// the previous leader audited these control planes recently, the next audits are spread over the interval
+	// instead of running all of them on the first reconcile
+	for i, tcp := range audited {
+		offset := membershipAuditInterval * time.Duration(i) / time.Duration(len(audited))
+
+		r.audits.seed(tcp.UID, start.Add(-offset))
+	}
+
+	r.Log.Info("warmed up caches", "controlPlanes", len(tcps.Items), "audited", len(audited), "duration", time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/util/connrotation"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadConnections tracks the connections of the workload cluster clients per kubeconfig secret version.
+//
+// When the kubeconfig secret is rotated, connections opened with the previous credentials are closed,
+// so that in-flight operations fail fast and get retried with the fresh credentials.
+type workloadConnections struct {
+	mu       sync.Mutex
+	clusters map[client.ObjectKey]*clusterConnections
+}
+
+type clusterConnections struct {
+	resourceVersion string
+	dialers         map[*connrotation.Dialer]struct{}
+}
+
+// register tracks the dialer of the client created from the given kubeconfig secret version.
+//
+// It returns the function to stop tracking the dialer once the client is closed.
+func (w *workloadConnections) register(cluster client.ObjectKey, resourceVersion string, dialer *connrotation.Dialer) func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.clusters == nil {
+		w.clusters = map[client.ObjectKey]*clusterConnections{}
+	}
+
+	conns, ok := w.clusters[cluster]
+	if !ok {
+		conns = &clusterConnections{
+			resourceVersion: resourceVersion,
+			dialers:         map[*connrotation.Dialer]struct{}{},
+		}
+
+		w.clusters[cluster] = conns
+	}
+
+	if conns.resourceVersion != resourceVersion {
+		w.invalidateLocked(cluster)
+
+		conns.resourceVersion = resourceVersion
+	}
+
+	conns.dialers[dialer] = struct{}{}
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		delete(conns.dialers, dialer)
+
+		if len(conns.dialers) == 0 && w.clusters[cluster] == conns {
+			delete(w.clusters, cluster)
+		}
+	}
+}
+
+// invalidate closes connections of all clients created from the kubeconfig secret version other than the given one.
+func (w *workloadConnections) invalidate(cluster client.ObjectKey, resourceVersion string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	conns, ok := w.clusters[cluster]
+	if !ok || conns.resourceVersion == resourceVersion {
+		return
+	}
+
+	w.invalidateLocked(cluster)
+
+	conns.resourceVersion = resourceVersion
+}
+
+func (w *workloadConnections) invalidateLocked(cluster client.ObjectKey) {
+	conns := w.clusters[cluster]
+
+	for dialer := range conns.dialers {
+		dialer.CloseAll()
+	}
+
+	conns.dialers = map[*connrotation.Dialer]struct{}{}
+}
+
+// SecretCacheSelector selects the Secrets labeled with the cluster name (e.g. kubeconfig) watched by the controller,
+// the manager cache is expected to be restricted to them, as caching all Secrets of the management cluster is expensive.
+func SecretCacheSelector() (labels.Selector, error) {
+	requirement, err := labels.NewRequirement(clusterv1.ClusterLabelName, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return labels.NewSelector().Add(*requirement), nil
+}
+
+// KubeconfigSecretToTalosControlPlane is a handler.ToRequestsFunc which enqueues the TalosControlPlane
+// of the cluster when its kubeconfig secret changes.
+//
+// Connections of the workload cluster clients using the previous credentials are closed right away.
+func (r *TalosControlPlaneReconciler) KubeconfigSecretToTalosControlPlane(o client.Object) []ctrl.Request {
+	s, ok := o.(*corev1.Secret)
+	if !ok {
+		return nil
+	}
+
+	clusterName, ok := s.Labels[clusterv1.ClusterLabelName]
+	if !ok || s.Name != secret.Name(clusterName, secret.Kubeconfig) {
+		return nil
+	}
+
+	key := client.ObjectKey{Namespace: s.Namespace, Name: clusterName}
+
+	r.workloadConnections.invalidate(key, s.ResourceVersion)
+
+	var cluster clusterv1.Cluster
+
+	if err := r.Client.Get(context.Background(), key, &cluster); err != nil {
+		return nil
+	}
+
+	return r.ClusterToTalosControlPlane(&cluster)
+}
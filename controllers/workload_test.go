@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/kubeconfig"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newKubeconfigTestReconciler returns the reconciler knowing the Cluster of the TalosControlPlane test-cp.
+func newKubeconfigTestReconciler(namespace, name string) (*TalosControlPlaneReconciler, error) {
+	clusterScheme := runtime.NewScheme()
+
+	if err := clusterv1.AddToScheme(clusterScheme); err != nil {
+		return nil, err
+	}
+
+	cluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: clusterv1.ClusterSpec{
+			ControlPlaneRef: &corev1.ObjectReference{Kind: "TalosControlPlane", Namespace: namespace, Name: "test-cp"},
+		},
+	}
+
+	return &TalosControlPlaneReconciler{
+		Client: fake.NewClientBuilder().WithScheme(clusterScheme).WithObjects(cluster).Build(),
+		Log:    logr.Discard(),
+	}, nil
+}
+
+func TestKubeconfigSecretToTalosControlPlane(t *testing.T) {
+	r, err := newKubeconfigTestReconciler("default", "test")
+	require.NoError(t, err)
+
+	selector, err := SecretCacheSelector()
+	require.NoError(t, err)
+
+	clusterKey := client.ObjectKey{Namespace: "default", Name: "test"}
+	expected := []ctrl.Request{{NamespacedName: client.ObjectKey{Namespace: "default", Name: "test-cp"}}}
+
+	for _, tt := range []struct {
+		name     string
+		secret   *corev1.Secret
+		cached   bool
+		expected []ctrl.Request
+	}{
+		{
+			name:     "kubeconfig",
+			secret:   kubeconfig.GenerateSecretWithOwner(clusterKey, []byte("kubeconfig"), metav1.OwnerReference{}),
+			cached:   true,
+			expected: expected,
+		},
+		{
+			name: "cluster CA",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      secret.Name("test", secret.ClusterCA),
+					Labels:    map[string]string{clusterv1.ClusterLabelName: "test"},
+				},
+			},
+			cached: true,
+		},
+		{
+			name: "kubeconfig without the cluster label",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: secret.Name("test", secret.Kubeconfig)},
+			},
+		},
+		{
+			name: "kubeconfig of another cluster",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      secret.Name("other", secret.Kubeconfig),
+					Labels:    map[string]string{clusterv1.ClusterLabelName: "other"},
+				},
+			},
+			cached: true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.cached, selector.Matches(labels.Set(tt.secret.Labels)))
+			assert.Equal(t, tt.expected, r.KubeconfigSecretToTalosControlPlane(tt.secret))
+		})
+	}
+}
+
+var _ = Describe("Secret cache", func() {
+	It("delivers the kubeconfig rotation to the TalosControlPlane", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		r, err := newKubeconfigTestReconciler("default", "rotated")
+		Expect(err).NotTo(HaveOccurred())
+
+		selector, err := SecretCacheSelector()
+		Expect(err).NotTo(HaveOccurred())
+
+		// same restriction as the manager cache
+		secretCache, err := cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Secret{}: {Label: selector},
+			},
+		})(cfg, cache.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+
+		informer, err := secretCache.GetInformer(ctx, &corev1.Secret{})
+		Expect(err).NotTo(HaveOccurred())
+
+		requests := make(chan ctrl.Request, 16)
+
+		informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(_, obj interface{}) {
+				for _, req := range r.KubeconfigSecretToTalosControlPlane(obj.(client.Object)) {
+					requests <- req
+				}
+			},
+		})
+
+		go func() {
+			defer GinkgoRecover()
+
+			Expect(secretCache.Start(ctx)).To(Succeed())
+		}()
+
+		Expect(secretCache.WaitForCacheSync(ctx)).To(BeTrue())
+
+		kubeconfigSecret := kubeconfig.GenerateSecretWithOwner(client.ObjectKey{Namespace: "default", Name: "rotated"}, []byte("old"), metav1.OwnerReference{
+			APIVersion: clusterv1.GroupVersion.String(),
+			Kind:       "Cluster",
+			Name:       "rotated",
+			UID:        "rotated-uid",
+		})
+		Expect(k8sClient.Create(ctx, kubeconfigSecret)).To(Succeed())
+
+		unlabeled := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unlabeled"}}
+		Expect(k8sClient.Create(ctx, unlabeled)).To(Succeed())
+
+		Eventually(func() error {
+			return secretCache.Get(ctx, client.ObjectKeyFromObject(kubeconfigSecret), &corev1.Secret{})
+		}).Should(Succeed())
+
+		kubeconfigSecret.Data[secret.KubeconfigDataName] = []byte("new")
+		Expect(k8sClient.Update(ctx, kubeconfigSecret)).To(Succeed())
+
+		Eventually(requests).Should(Receive(Equal(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "test-cp"}})))
+
+		// the rest of the Secrets is not cached
+		err = secretCache.Get(ctx, client.ObjectKeyFromObject(unlabeled), &corev1.Secret{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,412 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package capicompat allows running the provider against management clusters which don't serve
+// the core Cluster API version the provider is built against, e.g. mid-way through a Cluster API upgrade.
+//
+// The controllers always work with the v1beta1 (hub) Machines and Clusters, the client returned by NewClient
+// converts them to the served version using the Cluster API conversion functions.
+// Supporting a new core API version means adding its types to the spokes once Cluster API ships them.
+package capicompat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/util/retry"
+	clusterv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
+	clusterv1alpha4 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// hubs are the constructors of the hub types converted by the compatibility layer.
+var hubs = []func() conversion.Hub{
+	func() conversion.Hub { return &clusterv1.Machine{} },
+	func() conversion.Hub { return &clusterv1.MachineList{} },
+	func() conversion.Hub { return &clusterv1.Cluster{} },
+	func() conversion.Hub { return &clusterv1.ClusterList{} },
+}
+
+// spokes are the served versions supported by the compatibility layer, preferred versions first.
+//
+// The objects are returned in the order of the hubs.
+var spokes = []struct {
+	version     schema.GroupVersion
+	addToScheme func(*runtime.Scheme) error
+	objects     func() []conversion.Convertible
+}{
+	{
+		version:     clusterv1alpha4.GroupVersion,
+		addToScheme: clusterv1alpha4.AddToScheme,
+		objects: func() []conversion.Convertible {
+			return []conversion.Convertible{
+				&clusterv1alpha4.Machine{},
+				&clusterv1alpha4.MachineList{},
+				&clusterv1alpha4.Cluster{},
+				&clusterv1alpha4.ClusterList{},
+			}
+		},
+	},
+	{
+		version:     clusterv1alpha3.GroupVersion,
+		addToScheme: clusterv1alpha3.AddToScheme,
+		objects: func() []conversion.Convertible {
+			return []conversion.Convertible{
+				&clusterv1alpha3.Machine{},
+				&clusterv1alpha3.MachineList{},
+				&clusterv1alpha3.Cluster{},
+				&clusterv1alpha3.ClusterList{},
+			}
+		},
+	},
+}
+
+// AddToScheme registers all core Cluster API versions supported by the compatibility layer.
+func AddToScheme(scheme *runtime.Scheme) error {
+	if err := clusterv1.AddToScheme(scheme); err != nil {
+		return err
+	}
+
+	for _, s := range spokes {
+		if err := s.addToScheme(scheme); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ServedVersion returns the core Cluster API version to be used for Machines and Clusters:
+// the hub version if it is served, otherwise the most recent served version supported by the compatibility layer.
+func ServedVersion(dc discovery.DiscoveryInterface) (schema.GroupVersion, error) {
+	versions := []schema.GroupVersion{clusterv1.GroupVersion}
+
+	for _, s := range spokes {
+		versions = append(versions, s.version)
+	}
+
+	for _, version := range versions {
+		served, err := IsServed(dc, version)
+		if err != nil {
+			return schema.GroupVersion{}, err
+		}
+
+		if served {
+			return version, nil
+		}
+	}
+
+	return schema.GroupVersion{}, fmt.Errorf("none of the supported core Cluster API versions %v serve Machines and Clusters", versions)
+}
+
+// IsServed checks whether Machines and Clusters are served in the core Cluster API version.
+func IsServed(dc discovery.DiscoveryInterface, version schema.GroupVersion) (bool, error) {
+	resources, err := dc.ServerResourcesForGroupVersion(version.String())
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	found := map[string]bool{}
+
+	for _, resource := range resources.APIResources {
+		found[resource.Name] = true
+	}
+
+	return found["machines"] && found["clusters"], nil
+}
+
+// Object returns the object of the served version to be watched in place of the hub object.
+func Object(version schema.GroupVersion, hub client.Object) client.Object {
+	if spoke := spokeFor(version, hub); spoke != nil {
+		return spoke.(client.Object)
+	}
+
+	return hub
+}
+
+// ToHub converts the object of any supported core Cluster API version to the hub version.
+//
+// Hub objects and unsupported objects are returned unchanged.
+func ToHub(obj client.Object) (client.Object, error) {
+	for _, s := range spokes {
+		for i, spoke := range s.objects() {
+			if reflect.TypeOf(spoke) != reflect.TypeOf(obj) {
+				continue
+			}
+
+			hub := hubs[i]()
+
+			if err := obj.(conversion.Convertible).ConvertTo(hub); err != nil {
+				return nil, err
+			}
+
+			return hub.(client.Object), nil
+		}
+	}
+
+	return obj, nil
+}
+
+// NewClient returns the client converting the hub Machines and Clusters to the served version.
+//
+// The client is returned unchanged if the hub version is served.
+func NewClient(c client.Client, version schema.GroupVersion) client.Client {
+	if version == clusterv1.GroupVersion {
+		return c
+	}
+
+	return &convertingClient{
+		Client:  c,
+		reader:  &convertingReader{Reader: c, version: version},
+		version: version,
+	}
+}
+
+// NewReader returns the reader converting the hub Machines and Clusters to the served version,
+// e.g. for the API reader of the manager.
+//
+// The reader is returned unchanged if the hub version is served.
+func NewReader(r client.Reader, version schema.GroupVersion) client.Reader {
+	if version == clusterv1.GroupVersion {
+		return r
+	}
+
+	return &convertingReader{
+		Reader:  r,
+		version: version,
+	}
+}
+
+func spokeFor(version schema.GroupVersion, hub runtime.Object) conversion.Convertible {
+	for _, s := range spokes {
+		if s.version != version {
+			continue
+		}
+
+		for i, newHub := range hubs {
+			if reflect.TypeOf(newHub()) == reflect.TypeOf(hub) {
+				return s.objects()[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+type convertingReader struct {
+	client.Reader
+
+	version schema.GroupVersion
+}
+
+func (r *convertingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	spoke := spokeFor(r.version, obj)
+	if spoke == nil {
+		return r.Reader.Get(ctx, key, obj)
+	}
+
+	if err := r.Reader.Get(ctx, key, spoke.(client.Object)); err != nil {
+		return err
+	}
+
+	return spoke.ConvertTo(obj.(conversion.Hub))
+}
+
+func (r *convertingReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	spoke := spokeFor(r.version, list)
+	if spoke == nil {
+		return r.Reader.List(ctx, list, opts...)
+	}
+
+	if err := r.Reader.List(ctx, spoke.(client.ObjectList), opts...); err != nil {
+		return err
+	}
+
+	return spoke.ConvertTo(list.(conversion.Hub))
+}
+
+type convertingClient struct {
+	client.Client
+
+	reader  *convertingReader
+	version schema.GroupVersion
+}
+
+func (c *convertingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.reader.Get(ctx, key, obj)
+}
+
+func (c *convertingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.reader.List(ctx, list, opts...)
+}
+
+func (c *convertingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.write(obj, func(spoke client.Object) error {
+		return c.Client.Create(ctx, spoke, opts...)
+	})
+}
+
+func (c *convertingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.write(obj, func(spoke client.Object) error {
+		return c.Client.Update(ctx, spoke, opts...)
+	})
+}
+
+// Patch applies the patch computed for the hub object to the served version object.
+func (c *convertingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if spokeFor(c.version, obj) == nil {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	return c.patch(ctx, obj, patch, func(spoke client.Object) error {
+		return c.Client.Update(ctx, spoke, patchUpdateOptions(opts)...)
+	})
+}
+
+func (c *convertingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.write(obj, func(spoke client.Object) error {
+		return c.Client.Delete(ctx, spoke, opts...)
+	})
+}
+
+func (c *convertingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return c.write(obj, func(spoke client.Object) error {
+		return c.Client.DeleteAllOf(ctx, spoke, opts...)
+	})
+}
+
+func (c *convertingClient) Status() client.StatusWriter {
+	return &convertingStatusWriter{
+		client: c,
+	}
+}
+
+// write converts the hub object to the served version, and updates the hub object with the response.
+func (c *convertingClient) write(obj client.Object, f func(spoke client.Object) error) error {
+	spoke := spokeFor(c.version, obj)
+	if spoke == nil {
+		return f(obj)
+	}
+
+	if err := spoke.ConvertFrom(obj.(conversion.Hub)); err != nil {
+		return err
+	}
+
+	if err := f(spoke.(client.Object)); err != nil {
+		return err
+	}
+
+	return spoke.ConvertTo(obj.(conversion.Hub))
+}
+
+type convertingStatusWriter struct {
+	client *convertingClient
+}
+
+func (w *convertingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.client.write(obj, func(spoke client.Object) error {
+		return w.client.Client.Status().Update(ctx, spoke, opts...)
+	})
+}
+
+func (w *convertingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if spokeFor(w.client.version, obj) == nil {
+		return w.client.Client.Status().Patch(ctx, obj, patch, opts...)
+	}
+
+	return w.client.patch(ctx, obj, patch, func(spoke client.Object) error {
+		return w.client.Client.Status().Update(ctx, spoke, patchUpdateOptions(opts)...)
+	})
+}
+
+// patch applies the patch computed for the hub object to the current object, and writes the result with update.
+//
+// The patch can't be sent to the served version as is, as the JSON representation of the versions differs,
+// so it's applied to the current object converted to the hub version. The resource version of the current object
+// is kept, so concurrent writes are detected and the patch is applied again.
+func (c *convertingClient) patch(ctx context.Context, obj client.Object, patch client.Patch, update func(spoke client.Object) error) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(client.Object)
+
+		if err := c.reader.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+			return err
+		}
+
+		original, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		var patched []byte
+
+		switch patch.Type() { //nolint:exhaustive
+		case types.MergePatchType:
+			patched, err = jsonpatch.MergePatch(original, data)
+		case types.JSONPatchType:
+			var p jsonpatch.Patch
+
+			p, err = jsonpatch.DecodePatch(data)
+			if err == nil {
+				patched, err = p.Apply(original)
+			}
+		default:
+			err = fmt.Errorf("patch type %q is not supported for core Cluster API version %s", patch.Type(), c.version)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		result := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(client.Object)
+
+		if err = json.Unmarshal(patched, result); err != nil {
+			return err
+		}
+
+		if err = c.write(result, update); err != nil {
+			return err
+		}
+
+		reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(result).Elem())
+
+		return nil
+	})
+}
+
+// patchUpdateOptions returns the update options matching the patch options.
+func patchUpdateOptions(opts []client.PatchOption) []client.UpdateOption {
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+
+	updateOpts := []client.UpdateOption{}
+
+	if len(patchOpts.DryRun) > 0 {
+		updateOpts = append(updateOpts, client.DryRunAll)
+	}
+
+	if patchOpts.FieldManager != "" {
+		updateOpts = append(updateOpts, client.FieldOwner(patchOpts.FieldManager))
+	}
+
+	return updateOpts
+}
@@ -0,0 +1,284 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capicompat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/utils/pointer"
+	clusterv1alpha3 "sigs.k8s.io/cluster-api/api/v1alpha3"
+	clusterv1alpha4 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeDiscovery serves the resources by the group version.
+type fakeDiscovery struct {
+	discovery.DiscoveryInterface
+
+	resources map[schema.GroupVersion][]string
+	err       error
+}
+
+func (d *fakeDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	gv, err := schema.ParseGroupVersion(groupVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	names, ok := d.resources[gv]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: gv.Group}, gv.Version)
+	}
+
+	list := &metav1.APIResourceList{GroupVersion: groupVersion}
+
+	for _, name := range names {
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: name})
+	}
+
+	return list, nil
+}
+
+func TestServedVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		discovery *fakeDiscovery
+		expected  schema.GroupVersion
+		err       bool
+	}{
+		{
+			name: "hub",
+			discovery: &fakeDiscovery{resources: map[schema.GroupVersion][]string{
+				clusterv1.GroupVersion:       {"machines", "clusters"},
+				clusterv1alpha4.GroupVersion: {"machines", "clusters"},
+			}},
+			expected: clusterv1.GroupVersion,
+		},
+		{
+			name: "hub without clusters",
+			discovery: &fakeDiscovery{resources: map[schema.GroupVersion][]string{
+				clusterv1.GroupVersion:       {"machines"},
+				clusterv1alpha4.GroupVersion: {"machines", "clusters"},
+			}},
+			expected: clusterv1alpha4.GroupVersion,
+		},
+		{
+			name: "oldest supported",
+			discovery: &fakeDiscovery{resources: map[schema.GroupVersion][]string{
+				clusterv1alpha3.GroupVersion: {"machines", "clusters", "machinesets"},
+			}},
+			expected: clusterv1alpha3.GroupVersion,
+		},
+		{
+			name:      "not served",
+			discovery: &fakeDiscovery{},
+			err:       true,
+		},
+		{
+			name:      "discovery failure",
+			discovery: &fakeDiscovery{err: errors.New("connection refused")},
+			err:       true,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := ServedVersion(tt.discovery)
+			if tt.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func TestObject(t *testing.T) {
+	assert.IsType(t, &clusterv1alpha4.Machine{}, Object(clusterv1alpha4.GroupVersion, &clusterv1.Machine{}))
+	assert.IsType(t, &clusterv1alpha3.Cluster{}, Object(clusterv1alpha3.GroupVersion, &clusterv1.Cluster{}))
+
+	machine := &clusterv1.Machine{}
+	assert.Same(t, machine, Object(clusterv1.GroupVersion, machine))
+
+	secret := &corev1.Secret{}
+	assert.Same(t, secret, Object(clusterv1alpha4.GroupVersion, secret))
+}
+
+func TestToHub(t *testing.T) {
+	spoke := &clusterv1alpha4.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-1"},
+		Spec: clusterv1alpha4.MachineSpec{
+			ClusterName: "test",
+			Version:     pointer.StringPtr("v1.22.2"),
+		},
+	}
+
+	hub, err := ToHub(spoke)
+	require.NoError(t, err)
+
+	require.IsType(t, &clusterv1.Machine{}, hub)
+	assert.Equal(t, "cp-1", hub.GetName())
+	assert.Equal(t, "test", hub.(*clusterv1.Machine).Spec.ClusterName)
+	assert.Equal(t, "v1.22.2", *hub.(*clusterv1.Machine).Spec.Version)
+
+	machine := &clusterv1.Machine{}
+
+	hub, err = ToHub(machine)
+	require.NoError(t, err)
+	assert.Same(t, machine, hub)
+
+	secret := &corev1.Secret{}
+
+	hub, err = ToHub(secret)
+	require.NoError(t, err)
+	assert.Same(t, secret, hub)
+}
+
+func newSpokeClient(t *testing.T, objects ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+func TestNewClient(t *testing.T) {
+	ctx := context.Background()
+
+	c := newSpokeClient(t, &clusterv1alpha4.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-1", Labels: map[string]string{clusterv1.ClusterLabelName: "test"}},
+		Spec:       clusterv1alpha4.MachineSpec{ClusterName: "test"},
+	})
+
+	assert.Same(t, c, NewClient(c, clusterv1.GroupVersion))
+
+	converting := NewClient(c, clusterv1alpha4.GroupVersion)
+
+	var machine clusterv1.Machine
+
+	require.NoError(t, converting.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cp-1"}, &machine))
+	assert.Equal(t, "test", machine.Spec.ClusterName)
+
+	var machines clusterv1.MachineList
+
+	require.NoError(t, converting.List(ctx, &machines, client.MatchingLabels{clusterv1.ClusterLabelName: "test"}))
+	require.Len(t, machines.Items, 1)
+	assert.Equal(t, "cp-1", machines.Items[0].Name)
+
+	created := &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-2"},
+		Spec:       clusterv1.MachineSpec{ClusterName: "test"},
+	}
+
+	require.NoError(t, converting.Create(ctx, created))
+	assert.NotEmpty(t, created.ResourceVersion, "the hub object is updated with the response")
+
+	// the served version is written
+	var spoke clusterv1alpha4.Machine
+
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cp-2"}, &spoke))
+	assert.Equal(t, "test", spoke.Spec.ClusterName)
+
+	patch := client.MergeFrom(machine.DeepCopy())
+	machine.Labels[clusterv1.MachineControlPlaneLabelName] = ""
+
+	require.NoError(t, converting.Patch(ctx, &machine, patch))
+	assert.Contains(t, machine.Labels, clusterv1.MachineControlPlaneLabelName)
+
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cp-1"}, &spoke))
+	assert.Contains(t, spoke.Labels, clusterv1.MachineControlPlaneLabelName)
+
+	patch = client.MergeFrom(machine.DeepCopy())
+	machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "cp-1"}
+
+	require.NoError(t, converting.Status().Patch(ctx, &machine, patch))
+
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cp-1"}, &spoke))
+	require.NotNil(t, spoke.Status.NodeRef)
+	assert.Equal(t, "cp-1", spoke.Status.NodeRef.Name)
+
+	assert.Error(t, converting.Patch(ctx, &machine, client.RawPatch(types.StrategicMergePatchType, []byte("{}"))))
+
+	require.NoError(t, converting.Delete(ctx, created))
+
+	err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cp-2"}, &spoke)
+	assert.True(t, apierrors.IsNotFound(err), "unexpected error %v", err)
+
+	// the rest of the objects is passed as is
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "secret"}}
+
+	require.NoError(t, converting.Create(ctx, secret))
+	require.NoError(t, converting.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{}))
+}
+
+func TestNewReader(t *testing.T) {
+	ctx := context.Background()
+
+	c := newSpokeClient(t, &clusterv1alpha3.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: clusterv1alpha3.ClusterSpec{
+			ControlPlaneEndpoint: clusterv1alpha3.APIEndpoint{Host: "10.5.0.1", Port: 6443},
+		},
+	})
+
+	assert.Same(t, c, NewReader(c, clusterv1.GroupVersion))
+
+	var cluster clusterv1.Cluster
+
+	require.NoError(t, NewReader(c, clusterv1alpha3.GroupVersion).Get(ctx, client.ObjectKey{Namespace: "default", Name: "test"}, &cluster))
+	assert.Equal(t, "10.5.0.1", cluster.Spec.ControlPlaneEndpoint.Host)
+}
+
+func TestPatchUpdateOptions(t *testing.T) {
+	assert.Empty(t, patchUpdateOptions(nil))
+
+	opts := &client.UpdateOptions{}
+	opts.ApplyOptions(patchUpdateOptions([]client.PatchOption{client.DryRunAll, client.FieldOwner("manager"), client.ForceOwnership}))
+
+	assert.Equal(t, []string{metav1.DryRunAll}, opts.DryRun)
+	assert.Equal(t, "manager", opts.FieldManager)
+}
+
+func TestMonitor(t *testing.T) {
+	served := &fakeDiscovery{resources: map[schema.GroupVersion][]string{
+		clusterv1.GroupVersion:       {"machines", "clusters"},
+		clusterv1alpha4.GroupVersion: {"machines", "clusters"},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	monitor := &Monitor{Discovery: served, Version: clusterv1alpha4.GroupVersion, Interval: 10 * time.Millisecond, Log: logr.Discard()}
+	assert.NoError(t, monitor.Start(ctx))
+
+	removed := &fakeDiscovery{resources: map[schema.GroupVersion][]string{
+		clusterv1.GroupVersion: {"machines", "clusters"},
+	}}
+
+	monitor = &Monitor{Discovery: removed, Version: clusterv1alpha4.GroupVersion, Interval: 10 * time.Millisecond, Log: logr.Discard()}
+	assert.Error(t, monitor.Start(context.Background()))
+}
@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capicompat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+)
+
+// Monitor watches the core Cluster API versions served while the manager runs.
+//
+// The watches are established for the version picked on startup, so the manager is stopped
+// once that version is no longer served (the old version is removed at the end of a Cluster API upgrade),
+// and the provider is restarted with the served version.
+type Monitor struct {
+	Discovery discovery.DiscoveryInterface
+	Version   schema.GroupVersion
+	Interval  time.Duration
+	Log       logr.Logger
+}
+
+// Start implements manager.Runnable.
+func (m *Monitor) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	hubReported := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		served, err := IsServed(m.Discovery, m.Version)
+		if err != nil {
+			m.Log.Info("failed to check served core Cluster API versions", "error", err)
+
+			continue
+		}
+
+		if !served {
+			return fmt.Errorf("core Cluster API version %s is no longer served", m.Version)
+		}
+
+		if m.Version == clusterv1.GroupVersion || hubReported {
+			continue
+		}
+
+		if served, err = IsServed(m.Discovery, clusterv1.GroupVersion); err == nil && served {
+			m.Log.Info("core Cluster API version is served now, restart the provider to stop converting", "version", clusterv1.GroupVersion.String())
+
+			hubReported = true
+		}
+	}
+}
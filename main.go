@@ -24,12 +24,18 @@ import (
 
 	bootstrapv1alpha3 "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
 	controlplanev1alpha3 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	controlplanev1beta1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1beta1"
 	"github.com/talos-systems/cluster-api-control-plane-provider-talos/controllers"
+	"github.com/talos-systems/cluster-api-control-plane-provider-talos/internal/capicompat"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	// +kubebuilder:scaffold:imports
@@ -42,9 +48,10 @@ var (
 
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
-	_ = clusterv1.AddToScheme(scheme)
+	_ = capicompat.AddToScheme(scheme)
 	_ = bootstrapv1alpha3.AddToScheme(scheme)
 	_ = controlplanev1alpha3.AddToScheme(scheme)
+	_ = controlplanev1beta1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -54,41 +61,196 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var webhookPort int
+	var minKubernetesVersion, maxKubernetesVersion string
+	var fleetStatusAddr string
+	var disablePerMachineMetrics bool
+	var degradedFailureThreshold int
+	var disableWorkloadNodeLookups bool
+	var maxConcurrentTalosCalls int
+	var maxTalosconfigEndpoints int
+	var skipEndpointDNSCheck bool
+	var disableEtcdSnapshots bool
+	var dryRun bool
+	var auditSinkURL string
+	var enableKCPMigration bool
+	var insecureMaintenanceApply bool
+	var secretsBackend string
+	var vaultAddress, vaultMount, vaultTokenFile string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&webhookPort, "webhook-port", 9443, "Webhook Server port, disabled by default. When enabled, the manager will only work as webhook server, no reconcilers are installed.")
+	flag.StringVar(&minKubernetesVersion, "min-kubernetes-version", "", "Minimum Kubernetes version (inclusive) of the control plane machines created by the provider, not checked if empty.")
+	flag.StringVar(&maxKubernetesVersion, "max-kubernetes-version", "", "Maximum Kubernetes version (inclusive) of the control plane machines created by the provider, not checked if empty.")
+	flag.StringVar(&fleetStatusAddr, "fleet-status-bind-addr", "", "The address the fleet status endpoint binds to, disabled if empty.")
+	flag.BoolVar(&disablePerMachineMetrics, "disable-per-machine-metrics", false, "Disable metrics labeled per control plane machine, only per-cluster metrics are reported.")
+	flag.IntVar(&degradedFailureThreshold, "degraded-failure-threshold", 5, "Number of consecutive reconcile failures after which the control plane is reported as degraded.")
+	flag.BoolVar(&disableWorkloadNodeLookups, "disable-workload-node-lookups", false, "Discover Talos API endpoints only from Machine and infrastructure machine addresses, never from the workload cluster nodes.")
+	flag.IntVar(&maxConcurrentTalosCalls, "max-concurrent-talos-calls", 0, "Maximum number of concurrent Talos API calls per cluster, unlimited if zero.")
+	flag.IntVar(&maxTalosconfigEndpoints, "max-talosconfig-endpoints", 0, "Maximum number of endpoints in the <cluster>-capped-talosconfig secret, the secret is not published if zero.")
+	flag.BoolVar(&skipEndpointDNSCheck, "skip-endpoint-dns-check", false, "Skip checking the control plane endpoint DNS name resolves before bootstrapping the cluster.")
+	flag.BoolVar(&disableEtcdSnapshots, "disable-etcd-snapshots", false, "Disable taking the etcd snapshot before removing etcd members on scale down and remediation.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only log and record the intended actions without changing the management and workload clusters.")
+	flag.StringVar(&auditSinkURL, "audit-sink-url", "", "The URL to post the JSON records of the scale, rollout, remediation and bootstrap operations to, disabled if empty.")
+	flag.BoolVar(&enableKCPMigration, "enable-kcp-migration", false, "Enable the experimental migration of the control planes from KubeadmControlPlane requested with the migrate-from-kcp annotation.")
+	flag.BoolVar(&insecureMaintenanceApply, "insecure-maintenance-apply", false, "Allow applying the machine config with the cluster secrets to the nodes in maintenance mode without verifying their certificate fingerprint.")
+	flag.StringVar(&secretsBackend, "secrets-backend", "kubernetes", "Backend keeping the CA rotation material and the published talosconfig: kubernetes or vault.")
+	flag.StringVar(&vaultAddress, "vault-address", "", "The address of the Vault server used by the vault secrets backend.")
+	flag.StringVar(&vaultTokenFile, "vault-token-file", "", "The file the Vault token is read from on every request, e.g. the Vault Agent token sink. "+
+		"If not set, the token is read from VAULT_TOKEN once and it's not renewed.")
+	flag.StringVar(&vaultMount, "vault-mount", "secret", "The path of the KV version 2 secrets engine used by the vault secrets backend.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	supportedVersions, err := controllers.ParseVersionRange(minKubernetesVersion, maxKubernetesVersion)
+	if err != nil {
+		setupLog.Error(err, "invalid supported Kubernetes versions")
+		os.Exit(1)
+	}
+
+	secretSelector, err := controllers.SecretCacheSelector()
+	if err != nil {
+		setupLog.Error(err, "invalid Secret cache selector")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               webhookPort,
 		LeaderElection:     enableLeaderElection,
 		LeaderElectionID:   "controller-leader-election-cacppt",
+		// only the watched cluster Secrets are cached, the rest is read from the API server
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Secret{}: {Label: secretSelector},
+			},
+		}),
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	dc, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+
+	coreAPIVersion, err := capicompat.ServedVersion(dc)
+	if err != nil {
+		setupLog.Error(err, "unable to find served core Cluster API version")
+		os.Exit(1)
+	}
+
+	if coreAPIVersion != clusterv1.GroupVersion {
+		setupLog.Info("core Cluster API version is not served, converting Machines and Clusters", "version", clusterv1.GroupVersion.String(), "served", coreAPIVersion.String())
+	}
+
+	c := capicompat.NewClient(mgr.GetClient(), coreAPIVersion)
+
+	if dryRun {
+		setupLog.Info("running in dry-run mode, changes are not persisted")
+
+		c = client.NewDryRunClient(c)
+	}
+
+	var backend controllers.SecretsBackend
+
+	switch secretsBackend {
+	case "kubernetes":
+		backend = &controllers.KubernetesSecretsBackend{Client: c}
+	case "vault":
+		if vaultAddress == "" {
+			setupLog.Error(nil, "vault secrets backend requires --vault-address")
+			os.Exit(1)
+		}
+
+		backend = &controllers.VaultSecretsBackend{
+			Address:   vaultAddress,
+			Mount:     vaultMount,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			TokenFile: vaultTokenFile,
+			DryRun:    dryRun,
+		}
+	default:
+		setupLog.Error(nil, "unsupported secrets backend", "backend", secretsBackend)
+		os.Exit(1)
+	}
+
+	var auditSink controllers.AuditSink
+
+	if auditSinkURL != "" {
+		sink := &controllers.HTTPAuditSink{
+			URL: auditSinkURL,
+			Log: ctrl.Log.WithName("audit-sink"),
+		}
+
+		if err = mgr.Add(sink); err != nil {
+			setupLog.Error(err, "unable to add audit sink")
+			os.Exit(1)
+		}
+
+		auditSink = sink
+	}
+
 	if err = (&controllers.TalosControlPlaneReconciler{
-		Client:    mgr.GetClient(),
-		APIReader: mgr.GetAPIReader(),
+		Client:    c,
+		APIReader: capicompat.NewReader(mgr.GetAPIReader(), coreAPIVersion),
 		Log:       ctrl.Log.WithName("controllers").WithName("TalosControlPlane"),
 		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("taloscontrolplane-controller"),
+
+		CoreAPIVersion:             coreAPIVersion,
+		SupportedVersions:          supportedVersions,
+		DisablePerMachineMetrics:   disablePerMachineMetrics,
+		DegradedFailureThreshold:   int32(degradedFailureThreshold),
+		DisableWorkloadNodeLookups: disableWorkloadNodeLookups,
+		MaxConcurrentTalosCalls:    maxConcurrentTalosCalls,
+		MaxTalosconfigEndpoints:    maxTalosconfigEndpoints,
+		SkipEndpointDNSCheck:       skipEndpointDNSCheck,
+		DisableEtcdSnapshots:       disableEtcdSnapshots,
+		DryRun:                     dryRun,
+		AuditSink:                  auditSink,
+		SecretsBackend:             backend,
+		EnableKCPMigration:         enableKCPMigration,
+		InsecureMaintenanceApply:   insecureMaintenanceApply,
 	}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: 10}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "TalosControlPlane")
 		os.Exit(1)
 	}
+	if err = mgr.Add(&capicompat.Monitor{
+		Discovery: dc,
+		Version:   coreAPIVersion,
+		Interval:  time.Minute,
+		Log:       ctrl.Log.WithName("capicompat"),
+	}); err != nil {
+		setupLog.Error(err, "unable to add core Cluster API version monitor")
+		os.Exit(1)
+	}
 	if err = (&controlplanev1alpha3.TalosControlPlane{}).SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "TalosConfigTemplate")
 		os.Exit(1)
 	}
+	if err = (&controlplanev1beta1.TalosControlPlaneTemplate{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "TalosControlPlaneTemplate")
+		os.Exit(1)
+	}
+	if fleetStatusAddr != "" {
+		if err = mgr.Add(&controllers.FleetStatusServer{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("fleet-status"),
+			Addr:   fleetStatusAddr,
+		}); err != nil {
+			setupLog.Error(err, "unable to add fleet status server")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
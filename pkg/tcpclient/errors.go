@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tcpclient
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ClassifiedError is implemented by the errors which know whether the failed operation is worth retrying.
+type ClassifiedError interface {
+	error
+
+	// IsRetriable reports whether the operation might succeed if retried as is (e.g. the API is not reachable yet).
+	IsRetriable() bool
+	// IsTerminal reports whether the operation fails until the inputs are changed (e.g. a malformed secret).
+	IsTerminal() bool
+}
+
+// Error wraps the error of an operation with the retry decision.
+type Error struct {
+	Err       error
+	Retriable bool
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsRetriable implements ClassifiedError.
+func (e *Error) IsRetriable() bool {
+	return e.Retriable
+}
+
+// IsTerminal implements ClassifiedError.
+func (e *Error) IsTerminal() bool {
+	return !e.Retriable
+}
+
+// Retriable marks the error as retriable, nil is returned as is.
+func Retriable(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Err: err, Retriable: true}
+}
+
+// Terminal marks the error as terminal, nil is returned as is.
+func Terminal(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Err: err}
+}
+
+// IsRetriable checks whether the failed operation might succeed if retried.
+//
+// The decision of the ClassifiedError in the chain is used, otherwise the common transient
+// Kubernetes API, gRPC and network failures are reported as retriable.
+func IsRetriable(err error) bool {
+	var classified ClassifiedError
+
+	if errors.As(err, &classified) {
+		return classified.IsRetriable()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		apierrors.IsConflict(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsInternalError(err):
+		return true
+	}
+
+	switch grpcCode(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsTerminal checks whether the failed operation keeps failing until its inputs are changed.
+//
+// The decision of the ClassifiedError in the chain is used, otherwise the Kubernetes API and gRPC errors
+// rejecting the request itself (invalid, unauthorized, forbidden, unimplemented) are reported as terminal.
+// Errors which are neither retriable nor terminal are unknown, the callers should keep their default behavior.
+func IsTerminal(err error) bool {
+	var classified ClassifiedError
+
+	if errors.As(err, &classified) {
+		return classified.IsTerminal()
+	}
+
+	switch {
+	case apierrors.IsInvalid(err),
+		apierrors.IsBadRequest(err),
+		apierrors.IsUnauthorized(err),
+		apierrors.IsForbidden(err):
+		return true
+	}
+
+	switch grpcCode(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+// grpcCode returns the code of the gRPC status in the error chain, codes.OK if there is none.
+func grpcCode(err error) codes.Code {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if s, ok := status.FromError(err); ok {
+			return s.Code()
+		}
+	}
+
+	return codes.OK
+}
@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tcpclient provides helpers for Go tooling working with the TalosControlPlane API.
+//
+// The label and owner matching is shared with the controller, so the tooling sees the same control plane
+// machines as the controller does. IsRetriable and IsTerminal classify the errors of the helpers
+// the same way the controller does when deciding whether to retry.
+package tcpclient
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+)
+
+// Client reads the TalosControlPlanes and their control plane Machines.
+type Client struct {
+	client.Reader
+}
+
+// New creates the Client, the reader should have the Cluster API and the TalosControlPlane types registered.
+func New(reader client.Reader) *Client {
+	return &Client{Reader: reader}
+}
+
+// Get returns the TalosControlPlane.
+func (c *Client) Get(ctx context.Context, key client.ObjectKey) (*controlplanev1.TalosControlPlane, error) {
+	var tcp controlplanev1.TalosControlPlane
+
+	if err := c.Reader.Get(ctx, key, &tcp); err != nil {
+		return nil, err
+	}
+
+	return &tcp, nil
+}
+
+// List returns the TalosControlPlanes matching the options.
+func (c *Client) List(ctx context.Context, opts ...client.ListOption) ([]controlplanev1.TalosControlPlane, error) {
+	var list controlplanev1.TalosControlPlaneList
+
+	if err := c.Reader.List(ctx, &list, opts...); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// ForCluster returns the TalosControlPlane referenced by the Cluster.
+func (c *Client) ForCluster(ctx context.Context, cluster *clusterv1.Cluster) (*controlplanev1.TalosControlPlane, error) {
+	ref := cluster.Spec.ControlPlaneRef
+	if ref == nil || ref.Kind != "TalosControlPlane" {
+		return nil, Terminal(fmt.Errorf("cluster %q control plane is not a TalosControlPlane", cluster.Name))
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+
+	return c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name})
+}
+
+// Machines returns the control plane Machines of the TalosControlPlane, filtered by the filters.
+func (c *Client) Machines(ctx context.Context, tcp *controlplanev1.TalosControlPlane, filters ...MachineFilter) ([]clusterv1.Machine, error) {
+	var list clusterv1.MachineList
+
+	if err := c.Reader.List(ctx, &list, client.InNamespace(tcp.Namespace), client.MatchingLabels(MachineLabels(ClusterName(tcp)))); err != nil {
+		return nil, err
+	}
+
+	return FilterMachines(list.Items, filters...), nil
+}
+
+// ClusterName returns the name of the Cluster the TalosControlPlane belongs to.
+func ClusterName(tcp *controlplanev1.TalosControlPlane) string {
+	return tcp.Labels[clusterv1.ClusterLabelName]
+}
+
+// MachineLabels returns the labels of the control plane Machines of the cluster.
+func MachineLabels(clusterName string) map[string]string {
+	return map[string]string{
+		clusterv1.ClusterLabelName:             clusterName,
+		clusterv1.MachineControlPlaneLabelName: "",
+	}
+}
+
+// IsOwnerRef checks whether the owner reference points to the TalosControlPlane.
+//
+// References are matched by the name and the API group, so that references left by a TalosControlPlane
+// with the same name but a different UID (e.g. before a management cluster restore) match as well.
+func IsOwnerRef(ref metav1.OwnerReference, tcp *controlplanev1.TalosControlPlane) bool {
+	if ref.Kind != "TalosControlPlane" || ref.Name != tcp.Name {
+		return false
+	}
+
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+
+	return err == nil && gv.Group == controlplanev1.GroupVersion.Group
+}
+
+// IsOwnedBy checks whether the object is owned by the TalosControlPlane.
+func IsOwnedBy(obj metav1.Object, tcp *controlplanev1.TalosControlPlane) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if IsOwnerRef(ref, tcp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MachineFilter selects the Machines.
+type MachineFilter func(machine *clusterv1.Machine) bool
+
+// FilterMachines returns the Machines matching all of the filters.
+func FilterMachines(machines []clusterv1.Machine, filters ...MachineFilter) []clusterv1.Machine {
+	result := []clusterv1.Machine{}
+
+outer:
+	for i := range machines {
+		for _, filter := range filters {
+			if !filter(&machines[i]) {
+				continue outer
+			}
+		}
+
+		result = append(result, machines[i])
+	}
+
+	return result
+}
+
+// OwnedBy selects the Machines owned by the TalosControlPlane.
+func OwnedBy(tcp *controlplanev1.TalosControlPlane) MachineFilter {
+	return func(machine *clusterv1.Machine) bool {
+		return IsOwnedBy(machine, tcp)
+	}
+}
+
+// Active selects the Machines which are not being deleted.
+func Active(machine *clusterv1.Machine) bool {
+	return machine.DeletionTimestamp.IsZero()
+}
+
+// WithNodeRef selects the Machines which have joined the workload cluster.
+func WithNodeRef(machine *clusterv1.Machine) bool {
+	return machine.Status.NodeRef != nil
+}
+
+// InFailureDomain selects the Machines placed into the failure domain.
+func InFailureDomain(failureDomain string) MachineFilter {
+	return func(machine *clusterv1.Machine) bool {
+		return machine.Spec.FailureDomain != nil && *machine.Spec.FailureDomain == failureDomain
+	}
+}
+
+// Condition returns the condition of the TalosControlPlane, nil if it's not set.
+func Condition(tcp *controlplanev1.TalosControlPlane, conditionType clusterv1.ConditionType) *clusterv1.Condition {
+	return conditions.Get(tcp, conditionType)
+}
+
+// IsConditionTrue checks whether the condition of the TalosControlPlane is set and true.
+func IsConditionTrue(tcp *controlplanev1.TalosControlPlane, conditionType clusterv1.ConditionType) bool {
+	return conditions.IsTrue(tcp, conditionType)
+}
+
+// IsUpToDate checks whether the controller observed the latest spec and all of the machines match it.
+func IsUpToDate(tcp *controlplanev1.TalosControlPlane) bool {
+	return tcp.Status.ObservedGeneration == tcp.Generation && tcp.Status.Rollout == nil && len(tcp.Status.PendingChanges) == 0
+}
+
+// Rollout returns the summary of the outdated machines, nil if there are none.
+func Rollout(tcp *controlplanev1.TalosControlPlane) *controlplanev1.RolloutStatus {
+	return tcp.Status.Rollout
+}
+
+// PendingChanges returns the spec changes not applied yet with the given strategy, all changes if no strategy is given.
+func PendingChanges(tcp *controlplanev1.TalosControlPlane, strategies ...controlplanev1.ChangeStrategy) []controlplanev1.PendingChange {
+	if len(strategies) == 0 {
+		return tcp.Status.PendingChanges
+	}
+
+	result := []controlplanev1.PendingChange{}
+
+	for _, change := range tcp.Status.PendingChanges {
+		for _, strategy := range strategies {
+			if change.Strategy == strategy {
+				result = append(result, change)
+
+				break
+			}
+		}
+	}
+
+	return result
+}